@@ -0,0 +1,59 @@
+// gatecrypt manages the keys personal data in a Gate database is encrypted with, as set under Database.Encryption.
+//
+//	gatecrypt genkey
+//	gatecrypt [-config file] reencrypt
+//
+// genkey prints a new random key, in base64. reencrypt rewrites every user with the primary key and the index key,
+// after either changes; with no primary key, it decrypts them.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/jakenichols2719/gate/pkg/credentials"
+	"github.com/jakenichols2719/gate/pkg/server"
+)
+
+const usage = `usage: gatecrypt genkey
+       gatecrypt [-config file] reencrypt
+`
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	configFile := flag.String("config", "./dat/config/config.yml", "Gate configuration file")
+	flag.Parse()
+	switch {
+	case flag.NArg() == 1 && flag.Arg(0) == "genkey":
+		key := make([]byte, credentials.EncryptionKeySize)
+		if _, err := rand.Read(key); err != nil {
+			fail(err)
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(key))
+	case flag.NArg() == 1 && flag.Arg(0) == "reencrypt":
+		cfg := server.NewConfig()
+		if err := cfg.ReadDBConfig(*configFile); err != nil {
+			fail(err)
+		}
+		count, err := credentials.ReencryptUsers(cfg.DB.Options())
+		if err != nil {
+			fail(fmt.Errorf("%v (%d users rewritten first)", err, count))
+		}
+		fmt.Printf("Rewrote %d users\n", count)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// Print an error and exit.
+//
+// Input:
+//   - err error: Error to print.
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "gatecrypt: %v\n", err)
+	os.Exit(1)
+}
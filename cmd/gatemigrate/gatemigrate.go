@@ -0,0 +1,68 @@
+// gatemigrate migrates the schema of a Gate database, for servers run with Database.ManualMigrations.
+//
+//	gatemigrate [-config file] status
+//	gatemigrate [-config file] up [version]
+//	gatemigrate [-config file] down version
+//
+// up migrates to the latest version unless one is given. down loses the data in the columns and tables it removes.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/jakenichols2719/gate/pkg/credentials"
+	"github.com/jakenichols2719/gate/pkg/server"
+)
+
+const usage = `usage: gatemigrate [-config file] status
+       gatemigrate [-config file] up [version]
+       gatemigrate [-config file] down version
+`
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	configFile := flag.String("config", "./dat/config/config.yml", "Gate configuration file")
+	flag.Parse()
+	cfg := server.NewConfig()
+	if err := cfg.ReadDBConfig(*configFile); err != nil {
+		fail(err)
+	}
+	opts := cfg.DB.Options()
+	version, err := credentials.SchemaVersion(opts)
+	if err != nil {
+		fail(err)
+	}
+	target := credentials.LatestSchemaVersion()
+	switch {
+	case flag.NArg() == 1 && flag.Arg(0) == "status":
+		fmt.Printf("Schema version %d; latest is %d\n", version, target)
+		return
+	case flag.NArg() == 1 && flag.Arg(0) == "up":
+	case flag.NArg() == 2 && (flag.Arg(0) == "up" || flag.Arg(0) == "down"):
+		if target, err = strconv.Atoi(flag.Arg(1)); err != nil {
+			fail(err)
+		}
+		if (flag.Arg(0) == "up" && target < version) || (flag.Arg(0) == "down" && target > version) {
+			fail(fmt.Errorf("can't migrate %s from version %d to %d", flag.Arg(0), version, target))
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := credentials.MigrateDB(opts, target); err != nil {
+		fail(err)
+	}
+	fmt.Printf("Migrated from schema version %d to %d\n", version, target)
+}
+
+// Print an error and exit.
+//
+// Input:
+//   - err error: Error to print.
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "gatemigrate: %v\n", err)
+	os.Exit(1)
+}
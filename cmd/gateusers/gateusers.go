@@ -0,0 +1,146 @@
+// gateusers imports and exports the users of a Gate database, keeping their password hashes.
+//
+//	gateusers [-config file] export [-format json|csv] [-out file]
+//	gateusers [-config file] import [-format json|csv] [-dry-run] [-on-conflict skip|update|fail] file
+//
+// The format defaults to the extension of the file, or json. import prints a JSON report of what was imported.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jakenichols2719/gate/pkg/credentials"
+	"github.com/jakenichols2719/gate/pkg/server"
+)
+
+const usage = `usage: gateusers [-config file] export [-format json|csv] [-out file]
+       gateusers [-config file] import [-format json|csv] [-dry-run] [-on-conflict skip|update|fail] file
+`
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	configFile := flag.String("config", "./dat/config/config.yml", "Gate configuration file")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cfg := server.NewConfig()
+	if err := cfg.ReadDBConfig(*configFile); err != nil {
+		fail(err)
+	}
+	store, err := credentials.OpenDB(cfg.DB.Options())
+	if err != nil {
+		fail(err)
+	}
+	users := credentials.NewService(store)
+	switch flag.Arg(0) {
+	case "export":
+		err = export(users, flag.Args()[1:])
+	case "import":
+		err = importUsers(users, flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+// Print an error and exit.
+//
+// Input:
+//   - err error: Error to print.
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "gateusers: %v\n", err)
+	os.Exit(1)
+}
+
+// Get the record format for a file: format if set, otherwise the file's extension, otherwise json.
+//
+// Input:
+//   - format string: Format given on the command line.
+//   - fn string: File name; "" for standard input or output.
+// Output:
+//   - string: credentials.FormatJSON or credentials.FormatCSV.
+func recordFormat(format, fn string) string {
+	if format != "" {
+		return format
+	}
+	if strings.EqualFold(filepath.Ext(fn), ".csv") {
+		return credentials.FormatCSV
+	}
+	return credentials.FormatJSON
+}
+
+// Run the export command.
+//
+// Input:
+//   - users *credentials.Service: Service to export from.
+//   - args []string: Arguments after "export".
+// Output:
+//   - error: Any error that occurs while exporting.
+func export(users *credentials.Service, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "", "json or csv")
+	out := flags.String("out", "", "File to write; standard output if not set")
+	flags.Parse(args)
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		// Exports contain password hashes, so only the owner may read them.
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	count, err := users.ExportUsers(w, recordFormat(*format, *out))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d users\n", count)
+	return nil
+}
+
+// Run the import command.
+//
+// Input:
+//   - users *credentials.Service: Service to import into.
+//   - args []string: Arguments after "import".
+// Output:
+//   - error: Any error that occurs while importing, including: credentials.ErrImportRejected.
+func importUsers(users *credentials.Service, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "", "json or csv")
+	dryRun := flags.Bool("dry-run", false, "Check and report without importing")
+	onConflict := flags.String("on-conflict", credentials.ConflictSkip, "skip, update or fail")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	records, err := credentials.DecodeUserRecords(f, recordFormat(*format, flags.Arg(0)))
+	if err != nil {
+		return err
+	}
+	report, importErr := users.ImportUsers(records, credentials.ImportOptions{DryRun: *dryRun, OnConflict: *onConflict})
+	encoded, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(encoded))
+	return importErr
+}
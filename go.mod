@@ -4,7 +4,11 @@ go 1.13
 
 require (
 	github.com/pkg/errors v0.9.1
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	golang.org/x/text v0.3.7
 	gopkg.in/yaml.v3 v3.0.1
+	gorm.io/driver/mysql v1.3.5
+	gorm.io/driver/postgres v1.3.8
 	gorm.io/driver/sqlite v1.3.6
 	gorm.io/gorm v1.23.8
 )
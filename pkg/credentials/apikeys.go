@@ -0,0 +1,485 @@
+package credentials
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidAPIKey is returned by ResolveAPIKey for keys that don't belong to any application, or that have been
+// revoked or have expired.
+var ErrInvalidAPIKey = errors.New("Invalid API key")
+
+// ErrAPIKeyNotFound is returned when no API key has a given prefix.
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// legacyAPIUser is the pseudo-user that held the single API key of databases from before applications existed.
+// It is recognized by its username together with the apikey permission it was registered with.
+const legacyAPIUser = "api"
+
+// legacyAPIKeyName is the default name of the legacy pseudo-user's key once adopted; see AdoptLegacyAPIKey.
+const legacyAPIKeyName = "legacy"
+
+// apiKeyPrefixStart starts the prefix of every API key.
+const apiKeyPrefixStart = "gk_"
+
+// apiKeyUsedInterval is how often the last use of an API key is recorded, so that busy keys don't write to the store
+// on every request.
+const apiKeyUsedInterval = time.Minute
+
+// API key states, as given by APIKey.Status.
+const (
+	// APIKeyActive keys are accepted.
+	APIKeyActive = "active"
+	// APIKeyExpired keys have passed their expiry time.
+	APIKeyExpired = "expired"
+	// APIKeyRevoked keys have been revoked, whether or not they have also expired.
+	APIKeyRevoked = "revoked"
+)
+
+// An apiKeyEntry is an API key belonging to an application. Only a hash of the key is stored.
+// Scopes are stored as JSON. Zero times mean never: the key doesn't expire, hasn't been used, or isn't revoked.
+type apiKeyEntry struct {
+	ID    uint `gorm:"autoIncrement,primaryKey"`
+	AppID uint `gorm:"index"`
+	// Prefix identifies the key without revealing it. Keys are "<prefix>.<secret>"; keys from before prefixes existed
+	// were given one that isn't part of the key.
+	Prefix     string `gorm:"size:191;uniqueIndex"`
+	Name       string
+	Scopes     string
+	KeyHash    string `gorm:"size:191;uniqueIndex"`
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastUsedAt time.Time
+	RevokedAt  time.Time
+}
+
+// APIKeyOptions describe a new API key.
+type APIKeyOptions struct {
+	// Name describes what the key is for, e.g. "web frontend".
+	Name string
+	// Scopes limits the endpoints the key can call, by name, e.g. "login"; see APIKey.Allows. Empty allows all.
+	Scopes []string
+	// ExpiresAt is when the key stops working. The zero time never expires.
+	ExpiresAt time.Time
+}
+
+// An APIKey contains *public* information about an API key. The key itself is never stored.
+type APIKey struct {
+	Prefix      string    `json:"prefix"`
+	Application string    `json:"application"`
+	Name        string    `json:"name"`
+	Scopes      []string  `json:"scopes"`
+	Status      string    `json:"status"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires"`
+	LastUsed    time.Time `json:"lastUsed"`
+	Revoked     time.Time `json:"revoked"`
+}
+
+// Check whether an API key may call an endpoint.
+//
+// Calling:
+//   - k APIKey: Key to check.
+// Input:
+//   - scope string: Name of the endpoint, e.g. "login".
+// Output:
+//   - bool: Is scope one of the key's scopes, or does the key have none (or "*"), allowing every endpoint?
+func (k APIKey) Allows(scope string) bool {
+	if len(k.Scopes) == 0 {
+		return true
+	}
+	for _, allowed := range k.Scopes {
+		if allowed == scope || allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the state of the calling apiKeyEntry.
+//
+// Calling:
+//   - k apiKeyEntry: Entry to check.
+// Input:
+//   - now time.Time: Current time.
+// Output:
+//   - string: One of the APIKey states.
+func (k apiKeyEntry) status(now time.Time) string {
+	switch {
+	case !k.RevokedAt.IsZero():
+		return APIKeyRevoked
+	case !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt):
+		return APIKeyExpired
+	}
+	return APIKeyActive
+}
+
+// Convert the calling apiKeyEntry to an APIKey.
+//
+// Calling:
+//   - k apiKeyEntry: Entry to convert.
+// Input:
+//   - app string: Name of the application the key belongs to.
+// Output:
+//   - APIKey: Public API key.
+func (k apiKeyEntry) toAPIKey(app string) APIKey {
+	key := APIKey{
+		Prefix:      k.Prefix,
+		Application: app,
+		Name:        k.Name,
+		Status:      k.status(time.Now()),
+		Created:     k.CreatedAt,
+		Expires:     k.ExpiresAt,
+		LastUsed:    k.LastUsedAt,
+		Revoked:     k.RevokedAt,
+	}
+	json.Unmarshal([]byte(k.Scopes), &key.Scopes)
+	return key
+}
+
+// Check whether the calling userEntry is the pseudo-user that held the API key of databases from before
+// applications existed.
+//
+// Calling:
+//   - u userEntry: Entry to check.
+// Output:
+//   - bool: Is u the legacy API pseudo-user?
+func (u userEntry) isLegacyAPIUser() bool {
+	return u.Username == legacyAPIUser && decodePermissions(u.Permissions)["apikey"]
+}
+
+// Hash an API key for storage. API keys are random, so a fast hash is enough, and lets keys be looked up by hash.
+//
+// Input:
+//   - key string: API key.
+// Output:
+//   - string: Hex SHA-256 digest of key.
+func hashAPIKey(key string) string {
+	digest := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(digest[:])
+}
+
+// Make a random API key prefix.
+//
+// Output:
+//   - string: New prefix, e.g. gk_3f9a0c1d2e.
+//   - error: Returned if no random bytes could be read.
+func newAPIKeyPrefix() (string, error) {
+	raw := make([]byte, 5)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return apiKeyPrefixStart + hex.EncodeToString(raw), nil
+}
+
+// Make the entry for an API key.
+//
+// Input:
+//   - app applicationEntry: Application the key belongs to.
+//   - opts APIKeyOptions: Name, scopes and expiry of the key.
+//   - prefix, key string: Prefix and key.
+//   - now time.Time: Current time.
+// Output:
+//   - apiKeyEntry: Entry to store.
+//   - error: Returned if opts.ExpiresAt is in the past.
+func newAPIKeyEntry(app applicationEntry, opts APIKeyOptions, prefix, key string, now time.Time) (apiKeyEntry, error) {
+	if !opts.ExpiresAt.IsZero() && !opts.ExpiresAt.After(now) {
+		return apiKeyEntry{}, errors.New("API key expiry is in the past")
+	}
+	scopes := make([]string, 0, len(opts.Scopes))
+	for _, scope := range opts.Scopes {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	encoded, _ := json.Marshal(scopes)
+	return apiKeyEntry{
+		AppID:     app.ID,
+		Prefix:    prefix,
+		Name:      opts.Name,
+		Scopes:    string(encoded),
+		KeyHash:   hashAPIKey(key),
+		CreatedAt: now,
+		ExpiresAt: opts.ExpiresAt,
+	}, nil
+}
+
+// Make a new API key and its entry, and add the entry to the store.
+//
+// Calling:
+//   - s *Service: Service whose store the key is added to.
+// Input:
+//   - app applicationEntry: Application the key belongs to.
+//   - opts APIKeyOptions: Name, scopes and expiry of the key.
+// Output:
+//   - string: The API key.
+//   - apiKeyEntry: The stored entry.
+//   - error: Any error that occurs, including: invalid options, failure to add to the store.
+func (s *Service) addAPIKey(app applicationEntry, opts APIKeyOptions) (string, apiKeyEntry, error) {
+	prefix, err := newAPIKeyPrefix()
+	if err != nil {
+		return "", apiKeyEntry{}, err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", apiKeyEntry{}, err
+	}
+	key := prefix + "." + stringEncode(secret)
+	entry, err := newAPIKeyEntry(app, opts, prefix, key, time.Now())
+	if err != nil {
+		return "", apiKeyEntry{}, err
+	}
+	if err := s.store.addAPIKey(&entry); err != nil {
+		return "", apiKeyEntry{}, err
+	}
+	return key, entry, nil
+}
+
+// Create a new API key for an application. Applications may have any number of keys.
+//
+// Input:
+//   - name string: Application the key belongs to.
+//   - opts APIKeyOptions: Name, scopes and expiry of the key.
+// Output:
+//   - string: The API key. Only its hash is stored, so it can't be recovered later.
+//   - APIKey: The key's public information, including the prefix that identifies it.
+//   - error: Any error that occurs, including: ErrApplicationNotFound, an expiry in the past, failure to add to the
+//   store.
+func (s *Service) CreateAPIKey(name string, opts APIKeyOptions) (string, APIKey, error) {
+	app, err := s.findApplication(name)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	key, entry, err := s.addAPIKey(app, opts)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	return key, entry.toAPIKey(app.Name), nil
+}
+
+// Get every API key of an application, including revoked and expired ones, in the order they were created.
+//
+// Input:
+//   - name string: Application whose keys to list.
+// Output:
+//   - []APIKey: The keys.
+//   - error: Any error that occurs, including: ErrApplicationNotFound, failure to read the store.
+func (s *Service) ListAPIKeys(name string) ([]APIKey, error) {
+	app, err := s.findApplication(name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := s.store.listAPIKeys(app.ID)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]APIKey, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.toAPIKey(app.Name)
+	}
+	return keys, nil
+}
+
+// Find an API key and its application by prefix, failing if the key doesn't exist.
+//
+// Calling:
+//   - s *Service: Service whose store is searched.
+// Input:
+//   - prefix string: Prefix of the key.
+// Output:
+//   - apiKeyEntry: The key.
+//   - applicationEntry: The application it belongs to.
+//   - error: ErrAPIKeyNotFound, or any error from the store.
+func (s *Service) findAPIKey(prefix string) (apiKeyEntry, applicationEntry, error) {
+	entry, err := s.store.findAPIKeyByPrefix(prefix)
+	if err != nil {
+		return entry, applicationEntry{}, err
+	}
+	if entry.ID == 0 {
+		return entry, applicationEntry{}, errors.Wrap(ErrAPIKeyNotFound, prefix)
+	}
+	app, err := s.store.findApplicationByID(entry.AppID)
+	return entry, app, err
+}
+
+// Replace an API key with a new one for the same application, with the same name and scopes. A key that expires
+// is replaced by one that lasts as long, from now. The old key keeps working for a grace period, so that it can be
+// replaced wherever it is used, and is then revoked.
+//
+// Input:
+//   - prefix string: Prefix of the key to replace.
+//   - grace time.Duration: How long the old key keeps working. 0 or less revokes it at once. A key that expires
+//   sooner still expires when it would have.
+// Output:
+//   - string: The new API key. Only its hash is stored, so it can't be recovered later.
+//   - APIKey: The new key's public information.
+//   - error: Any error that occurs, including: ErrAPIKeyNotFound, the old key is revoked, failure to update the store.
+func (s *Service) RotateAPIKey(prefix string, grace time.Duration) (string, APIKey, error) {
+	old, app, err := s.findAPIKey(prefix)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	now := time.Now()
+	if old.status(now) == APIKeyRevoked {
+		return "", APIKey{}, errors.Errorf("API key %s is revoked", prefix)
+	}
+	opts := APIKeyOptions{Name: old.Name}
+	json.Unmarshal([]byte(old.Scopes), &opts.Scopes)
+	if !old.ExpiresAt.IsZero() && !old.CreatedAt.IsZero() {
+		opts.ExpiresAt = now.Add(old.ExpiresAt.Sub(old.CreatedAt))
+	}
+	key, entry, err := s.addAPIKey(app, opts)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	if grace <= 0 {
+		old.RevokedAt = now
+	} else if end := now.Add(grace); old.ExpiresAt.IsZero() || end.Before(old.ExpiresAt) {
+		old.ExpiresAt = end
+	}
+	if err := s.store.updateAPIKey(&old); err != nil {
+		return "", APIKey{}, err
+	}
+	return key, entry.toAPIKey(app.Name), nil
+}
+
+// Revoke an API key, so that it is no longer accepted. Revoked keys are kept, so they still show in ListAPIKeys.
+// Revoking a revoked key does nothing.
+//
+// Input:
+//   - prefix string: Prefix of the key to revoke.
+// Output:
+//   - error: Any error that occurs, including: ErrAPIKeyNotFound, failure to update the store.
+func (s *Service) RevokeAPIKey(prefix string) error {
+	entry, _, err := s.findAPIKey(prefix)
+	if err != nil || !entry.RevokedAt.IsZero() {
+		return err
+	}
+	entry.RevokedAt = time.Now()
+	return s.store.updateAPIKey(&entry)
+}
+
+// Check an API key, and get it with the application it belongs to. The key's last use is recorded, at most once
+// every apiKeyUsedInterval.
+//
+// Input:
+//   - key string: API key, as sent in the x-api-key header.
+// Output:
+//   - APIKey: The key's public information, for checking its scopes; see APIKey.Allows.
+//   - Application: The application the key belongs to.
+//   - error: ErrInvalidAPIKey if the key doesn't belong to an application, is revoked or has expired, or any error
+//   from the store.
+func (s *Service) AuthenticateAPIKey(key string) (APIKey, Application, error) {
+	entry, err := s.store.findAPIKeyByHash(hashAPIKey(key))
+	if err != nil {
+		return APIKey{}, Application{}, err
+	}
+	if entry.ID == 0 {
+		return APIKey{}, Application{}, ErrInvalidAPIKey
+	}
+	now := time.Now()
+	if status := entry.status(now); status != APIKeyActive {
+		s.Log("API key %s rejected: %s", entry.Prefix, status)
+		return APIKey{}, Application{}, errors.Wrapf(ErrInvalidAPIKey, "key is %s", status)
+	}
+	app, err := s.store.findApplicationByID(entry.AppID)
+	if err != nil || app.ID == 0 {
+		return APIKey{}, Application{}, errors.Wrap(ErrInvalidAPIKey, "key belongs to a missing application")
+	}
+	if now.Sub(entry.LastUsedAt) >= apiKeyUsedInterval {
+		if err := s.store.touchAPIKey(entry.ID, now); err != nil {
+			s.Log("Couldn't record use of API key %s: %v", entry.Prefix, err)
+		} else {
+			entry.LastUsedAt = now
+		}
+	}
+	return entry.toAPIKey(app.Name), app.toApplication(), nil
+}
+
+// Get the application an API key belongs to. See AuthenticateAPIKey, which also gets the key.
+//
+// Input:
+//   - key string: API key, as sent in the x-api-key header.
+// Output:
+//   - Application: The application.
+//   - error: ErrInvalidAPIKey if the key doesn't belong to an application, is revoked or has expired, or any error
+//   from the store.
+func (s *Service) ResolveAPIKey(key string) (Application, error) {
+	_, app, err := s.AuthenticateAPIKey(key)
+	return app, err
+}
+
+// Check whether the store still has the legacy API pseudo-user, whose key is refused until AdoptLegacyAPIKey is
+// called with it.
+//
+// Output:
+//   - bool: Does the pseudo-user exist?
+//   - error: Any error from the store.
+func (s *Service) HasLegacyAPIKey() (bool, error) {
+	user, err := s.findUserEntryByUsername(legacyAPIUser)
+	return user.isLegacyAPIUser(), err
+}
+
+// Adopt the key of the legacy API pseudo-user as an ordinary API key, and delete the pseudo-user.
+// That key is only stored as a slow password hash, which can't be converted without the key itself, and checking
+// every unknown key against it would put a slow hash back on every request; so it is refused until the operator
+// adopts it with this, which checks it once.
+//
+// Input:
+//   - key string: The legacy API key.
+//   - name string: Application to adopt the key into; "" for the first application.
+//   - opts APIKeyOptions: Name, scopes and expiry of the adopted key. The name defaults to "legacy".
+// Output:
+//   - APIKey: The adopted key's public information.
+//   - error: Any error that occurs, including: ErrInvalidAPIKey if there is no pseudo-user or key isn't its key,
+//   ErrApplicationNotFound, an expiry in the past, failure to update the store.
+func (s *Service) AdoptLegacyAPIKey(key, name string, opts APIKeyOptions) (APIKey, error) {
+	user, err := s.findUserEntryByUsername(legacyAPIUser)
+	if err != nil {
+		return APIKey{}, err
+	}
+	if !user.isLegacyAPIUser() {
+		return APIKey{}, errors.Wrap(ErrInvalidAPIKey, "no legacy API key to adopt")
+	}
+	if match, err := checkHash([]byte(key), user.PasswordHash, s.Pepper); err != nil || !match {
+		return APIKey{}, errors.Wrap(ErrInvalidAPIKey, "key isn't the legacy API key")
+	}
+	var app applicationEntry
+	if name != "" {
+		app, err = s.findApplication(name)
+	} else {
+		var apps []applicationEntry
+		if apps, err = s.store.listApplications(); err == nil && len(apps) == 0 {
+			err = errors.Wrap(ErrApplicationNotFound, "no applications exist")
+		} else if err == nil {
+			app = apps[0]
+		}
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+	if opts.Name == "" {
+		opts.Name = legacyAPIKeyName
+	}
+	prefix, err := newAPIKeyPrefix()
+	if err != nil {
+		return APIKey{}, err
+	}
+	entry, err := newAPIKeyEntry(app, opts, prefix, key, time.Now())
+	if err != nil {
+		return APIKey{}, err
+	}
+	if err := s.store.addAPIKey(&entry); err != nil {
+		return APIKey{}, err
+	}
+	if err := s.store.deleteUser(&user); err != nil {
+		return APIKey{}, err
+	}
+	return entry.toAPIKey(app.Name), nil
+}
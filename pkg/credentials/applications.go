@@ -0,0 +1,320 @@
+package credentials
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// ErrApplicationNotFound is returned when a named application doesn't exist.
+var ErrApplicationNotFound = errors.New("Application not found")
+
+// ErrNotMember is returned by CheckMember for registered users that aren't members of an application.
+var ErrNotMember = errors.New("User is not a member of the application")
+
+// An applicationEntry is a product that users log in to, stored in its own table.
+// Settings are stored as JSON, in the format of ApplicationSettings.
+type applicationEntry struct {
+	ID       uint   `gorm:"autoIncrement,primaryKey"`
+	Name     string `gorm:"size:191;uniqueIndex"`
+	Audience string
+	Settings string
+}
+
+// A membershipEntry lets a user log in to an application.
+type membershipEntry struct {
+	ID     uint `gorm:"autoIncrement,primaryKey"`
+	AppID  uint `gorm:"index"`
+	UserID uint `gorm:"index"`
+}
+
+// ApplicationSettings are per-application overrides of server settings. Zero values use the server's settings.
+type ApplicationSettings struct {
+	// TokenValidTime is how long gate keys issued for the application last, in minutes.
+	TokenValidTime int `json:"tokenValidTime"`
+	// RequireVerifiedEmail is when users of the application must have verified their email: "none", "login" or "token".
+	RequireVerifiedEmail string `json:"requireVerifiedEmail"`
+	// ProfileClaims names the profile fields and attributes that gate keys for the application carry; see ProfileClaims.
+	ProfileClaims []string `json:"profileClaims"`
+}
+
+// An Application contains *public* information about an application.
+type Application struct {
+	Name string `json:"name"`
+	// Audience is the aud claim of gate keys issued for the application. App servers should refuse keys for any other.
+	Audience string              `json:"audience"`
+	Settings ApplicationSettings `json:"settings"`
+}
+
+// Convert the calling applicationEntry to an Application.
+//
+// Calling:
+//   - a applicationEntry: Entry to convert.
+// Output:
+//   - Application: Public application.
+func (a applicationEntry) toApplication() Application {
+	app := Application{Name: a.Name, Audience: a.Audience}
+	json.Unmarshal([]byte(a.Settings), &app.Settings)
+	return app
+}
+
+// Find an application by name, failing if it doesn't exist.
+//
+// Calling:
+//   - s *Service: Service whose store is searched.
+// Input:
+//   - name string: Application name.
+// Output:
+//   - applicationEntry: The application.
+//   - error: ErrApplicationNotFound, or any error from the store.
+func (s *Service) findApplication(name string) (applicationEntry, error) {
+	app, err := s.store.findApplicationByName(name)
+	if err != nil {
+		return app, err
+	}
+	if app.ID == 0 {
+		return app, errors.Wrap(ErrApplicationNotFound, name)
+	}
+	return app, nil
+}
+
+// Create an application.
+// The first application created adopts every existing user, so that databases from before applications existed keep
+// working; later applications start with no members.
+//
+// Input:
+//   - name string: Application name. Must be unique.
+//   - audience string: aud claim for the application's gate keys. "" uses name.
+//   - settings ApplicationSettings: Settings for the application.
+// Output:
+//   - error: Any error that occurs, including: name already in use, failure to add to the store.
+func (s *Service) CreateApplication(name, audience string, settings ApplicationSettings) error {
+	if name == "" {
+		return errors.New("Application name is empty")
+	}
+	if audience == "" {
+		audience = name
+	}
+	existing, err := s.store.listApplications()
+	if err != nil {
+		return err
+	}
+	for _, app := range existing {
+		if app.Name == name {
+			return errors.Errorf("Application %s already exists", name)
+		}
+	}
+	encoded, _ := json.Marshal(settings)
+	app := applicationEntry{Name: name, Audience: audience, Settings: string(encoded)}
+	if err := s.store.addApplication(&app); err != nil {
+		return err
+	}
+	if len(existing) == 0 {
+		return s.store.addAllMemberships(app.ID)
+	}
+	return nil
+}
+
+// Get an application by name.
+//
+// Input:
+//   - name string: Application to find.
+// Output:
+//   - Application: The application.
+//   - error: Any error that occurs, including: ErrApplicationNotFound, failure to read the store.
+func (s *Service) FindApplication(name string) (Application, error) {
+	app, err := s.findApplication(name)
+	if err != nil {
+		return Application{}, err
+	}
+	return app.toApplication(), nil
+}
+
+// Get every application, in the order they were created.
+//
+// Output:
+//   - []Application: The applications.
+//   - error: Any error from the store.
+func (s *Service) ListApplications() ([]Application, error) {
+	entries, err := s.store.listApplications()
+	if err != nil {
+		return nil, err
+	}
+	apps := make([]Application, len(entries))
+	for i, entry := range entries {
+		apps[i] = entry.toApplication()
+	}
+	return apps, nil
+}
+
+// Change the settings of an application.
+//
+// Input:
+//   - name string: Application to alter.
+//   - settings ApplicationSettings: New settings. Replaces every existing setting.
+// Output:
+//   - error: Any error that occurs, including: ErrApplicationNotFound, failure to update the store.
+func (s *Service) ChangeApplicationSettings(name string, settings ApplicationSettings) error {
+	app, err := s.findApplication(name)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	app.Settings = string(encoded)
+	return s.store.updateApplication(&app)
+}
+
+// Find the membership of a user in an application.
+//
+// Calling:
+//   - s *Service: Service whose store is searched.
+// Input:
+//   - appID, userID uint: IDs of the application and user.
+// Output:
+//   - membershipEntry: Membership of the user in the application; it may not be stored.
+//   - bool: Is the user already a member?
+//   - error: Any error from the store.
+func (s *Service) membership(appID, userID uint) (membershipEntry, bool, error) {
+	membership := membershipEntry{AppID: appID, UserID: userID}
+	memberships, err := s.store.findMemberships(userID)
+	if err != nil {
+		return membership, false, err
+	}
+	for _, m := range memberships {
+		if m.AppID == appID {
+			return m, true, nil
+		}
+	}
+	return membership, false, nil
+}
+
+// Find an application and a user by name, for changing memberships.
+//
+// Calling:
+//   - s *Service: Service whose store is searched.
+// Input:
+//   - name string: Application name.
+//   - user string: Username or email of the user.
+// Output:
+//   - membershipEntry: Membership of the user in the application; it may not be stored.
+//   - bool: Is the user already a member?
+//   - error: Any error that occurs, including: ErrApplicationNotFound, ErrUserNotFound, failure to read the store.
+func (s *Service) findMembership(name, user string) (membershipEntry, bool, error) {
+	app, err := s.findApplication(name)
+	if err != nil {
+		return membershipEntry{}, false, err
+	}
+	entry, err := s.findUserEntryByName(user)
+	if err != nil {
+		return membershipEntry{}, false, err
+	}
+	if entry.ID == 0 {
+		return membershipEntry{}, false, errors.Wrap(ErrUserNotFound, user)
+	}
+	return s.membership(app.ID, entry.ID)
+}
+
+// Let a user log in to an application. Adding an existing member does nothing.
+//
+// Input:
+//   - name string: Application name.
+//   - user string: Username or email of the user.
+// Output:
+//   - error: Any error that occurs, including: ErrApplicationNotFound, ErrUserNotFound, failure to update the store.
+func (s *Service) AddMember(name, user string) error {
+	membership, member, err := s.findMembership(name, user)
+	if err != nil || member {
+		return err
+	}
+	return s.store.addMembership(&membership)
+}
+
+// Register a new user as a member of an application. If the membership can't be added, the new user is removed again,
+// so that no account is left behind that can't log in to the application it registered for.
+//
+// Input:
+//   - name string: Application name.
+//   - email, username, password string: The new user, as for RegisterUser.
+//   - permissions map[string]bool: Permissions of the new user, as for RegisterUser.
+// Output:
+//   - error: Any error that occurs, including: ErrApplicationNotFound, any error from RegisterUser, failure to add the
+//   membership.
+func (s *Service) RegisterMember(name, email, username, password string, permissions map[string]bool) error {
+	if _, err := s.findApplication(name); err != nil {
+		return err
+	}
+	if err := s.RegisterUser(email, username, password, permissions); err != nil {
+		return err
+	}
+	if err := s.AddMember(name, username); err != nil {
+		if purgeErr := s.PurgeUser(username); purgeErr != nil {
+			s.Log("Couldn't remove %s after failing to add them to %s: %v", username, name, purgeErr)
+		}
+		return errors.Wrapf(err, "Couldn't add %s to %s", username, name)
+	}
+	return nil
+}
+
+// Stop a user logging in to an application. Removing a user that isn't a member does nothing.
+//
+// Input:
+//   - name string: Application name.
+//   - user string: Username or email of the user.
+// Output:
+//   - error: Any error that occurs, including: ErrApplicationNotFound, ErrUserNotFound, failure to update the store.
+func (s *Service) RemoveMember(name, user string) error {
+	membership, member, err := s.findMembership(name, user)
+	if err != nil || !member {
+		return err
+	}
+	return s.store.deleteMembership(&membership)
+}
+
+// Check whether a user may log in to an application.
+//
+// Input:
+//   - name string: Application name.
+//   - user string: Username or email of the user.
+// Output:
+//   - bool: Is the user a member of the application? Users that don't exist are not.
+//   - error: Any error that occurs, including: ErrApplicationNotFound, failure to read the store.
+func (s *Service) IsMember(name, user string) (bool, error) {
+	app, err := s.findApplication(name)
+	if err != nil {
+		return false, err
+	}
+	entry, err := s.findUserEntryByName(user)
+	if err != nil || entry.ID == 0 {
+		return false, err
+	}
+	_, member, err := s.membership(app.ID, entry.ID)
+	return member, err
+}
+
+// Check that a user may use an application, for callers that hold a gate key or code rather than a password.
+// Users that don't exist pass, since keys and codes may be issued to email addresses that never registered.
+//
+// Input:
+//   - name string: Application name.
+//   - user string: Username or email of the user.
+// Output:
+//   - error: ErrNotMember if the user is registered but isn't a member, any error from the store, or nil.
+func (s *Service) CheckMember(name, user string) error {
+	app, err := s.findApplication(name)
+	if err != nil {
+		return err
+	}
+	entry, err := s.findUserEntryByName(user)
+	if err != nil || entry.ID == 0 {
+		return err
+	}
+	if _, member, err := s.membership(app.ID, entry.ID); err != nil {
+		return err
+	} else if !member {
+		return errors.Wrapf(ErrNotMember, "%s isn't a member of %s", user, name)
+	}
+	return nil
+}
@@ -1,15 +1,39 @@
 // Package credentials handles the authentication of users using username-password pairs.
-// Each user is stored as a userEntry in a local database. The database columns are defined
-// by the userEntry struct, so they appear as seen below:
-//   +----+-------+----------+---------------+------+---------------+-------------+
-//   | ID | Email | Username | Password Hash | Salt | Hash Function | Permissions |
-//   +----+-------+----------+---------------+------+---------------+-------------+
+// Each user is stored as a userEntry in a Store; OpenDB provides a store backed by a local database,
+// and NewMemoryStore provides one that lives in memory. The database columns follow the userEntry struct, and are
+// created and changed by the versioned migrations in migrations.go (see MigrateDB), so they appear as seen below:
+//   +----+-------+----------+---------------+-------------+------------+-----------------+--------------+--------------+--------+------------+----------------+-------------------+--------------------+----------------+-------------------+----------------------+--------------+--------+------------+------------+
+//   | ID | Email | Username | Password Hash | Permissions | Created At | Failed Attempts | Last Failure | Locked Until | Status | Deleted At | Email Verified | Email Verified At | Tokens Valid After | Previous Email | Email Revert Hash | Email Revert Expires | Display Name | Locale | Avatar URL | Attributes |
+//   +----+-------+----------+---------------+-------------+------------+-----------------+--------------+--------------+--------+------------+----------------+-------------------+--------------------+----------------+-------------------+----------------------+--------------+--------+------------+------------+
+// Password hashes are self-describing, recording their hash function, parameters and salt alongside the digest
+// (e.g. $argon2id$v=19$m=65536,t=3,p=2$salt$digest). Entries from before this format also have Salt and Hash Function
+// columns; these are converted when the entry is next read. Previous password hashes are kept in a separate
+// password history table, so that recently used passwords can be refused. Hashes made with a Pepper are prefixed with
+// its version, as in $pepper$v=1$argon2id$...
+// Emails and usernames are also stored in canonical form, case-folded and NFKC-normalized respectively, in uniquely
+// indexed Email Key and Username Key columns; lookups use these, and registrations that race can't both succeed.
+// With DBOptions.Encryption, Email, Previous Email, Display Name and Attributes are encrypted, and Email Key holds a
+// blind index of the email instead; see FieldEncryption.
+// Credential operations are methods on a Service, which is created from a Store with NewService.
 // Two main authentication functions are provided in RegisterUser() and ValidateUserCred(),
 // with supporting functions ChangeUserPassword() and ChangeUserPermissions() to alter the
-// data of already-existing users in the database.
+// data of already-existing users in the store. DisableUser, EnableUser, DeleteUser, RestoreUser and PurgeUser manage
+// the lifecycle of an account, ChangeUserEmail changes a user's email, and ChangeUserProfile changes the profile:
+// display name, locale, avatar URL, and arbitrary JSON attributes for applications to use. ListUsers lists users a page
+// at a time, filtered and sorted. ExportUsers and ImportUsers move users between stores, or in from other systems,
+// keeping their password hashes.
+//
+// Permissions can be granted to users directly, or through roles. Roles are stored in their own tables, and may include
+// other roles; GrantRole binds a role to a user. The permissions of a User returned by credentials are always the
+// effective set, merging the user's own permissions with those of every role they have.
+//
+// A single store can serve several applications. Each application has its own API keys, token audience and settings,
+// and users log in to an application only if they are a member of it; AuthenticateAPIKey finds the application a
+// request is for, and the scopes of its key. Users themselves are shared, so one account can be a member of several
+// applications.
 //
 // credentials exports the User type, which contains the same data as userEntry with private data
-// (password hash, salt, hash func, internal ID) removed. ValidateUserCred() returns one, so that
+// (password hash, internal ID) removed. ValidateUserCred() returns one, so that
 // when the authentication API is called, it returns back information about the user in a format
 // that can easily pass back to the application servers or converted into a token without exposing
 // important data.
@@ -17,17 +41,19 @@ package credentials
 
 import (
 	"encoding/json"
-	"fmt"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
-	"gorm.io/driver/sqlite"
-	"gorm.io/gorm"
-	"gorm.io/gorm/logger"
 )
 
-/* From config.go: DBConfig
-Path string
-*/
+// ErrInvalidCredentials is returned for every credential failure, whether the user doesn't exist or the password is wrong,
+// so that callers can't tell which usernames are registered. The specific reason is passed to Service.Log.
+var ErrInvalidCredentials = errors.New("Invalid credentials")
+
+// ErrUserNotFound is returned when a user that an operation needs doesn't exist. Logins never return it; they return
+// ErrInvalidCredentials instead.
+var ErrUserNotFound = errors.New("User not found")
 
 // A User contains *public* information about a user.
 // authcred functions that return user info MUST return this.
@@ -35,6 +61,18 @@ type User struct {
 	Email       string          `json:"email"`
 	Username    string          `json:"username"`
 	Permissions map[string]bool `json:"permissions"`
+	Status      string          `json:"status"`
+	// EmailVerified is set once the user proves they own Email; see Service.VerifyEmail.
+	EmailVerified bool `json:"emailVerified"`
+	// Roles lists the roles granted directly to the user. Permissions already includes their permissions.
+	Roles []string `json:"roles"`
+	// Profile; see ChangeUserProfile.
+	DisplayName string                 `json:"displayName"`
+	Locale      string                 `json:"locale"`
+	AvatarURL   string                 `json:"avatarUrl"`
+	Attributes  map[string]interface{} `json:"attributes"`
+	// Created is when the user registered; zero for users registered before this was recorded.
+	Created time.Time `json:"created"`
 }
 
 // Empty() checks if the calling User is the empty User.
@@ -55,9 +93,37 @@ type userEntry struct {
 	Email        string `gorm:"email"`
 	Username     string `gorm:"username"`
 	PasswordHash string `gorm:"password"`
-	Salt         string `gorm:"salt"`
-	HashFunc     string `gorm:"hashfunc"`
 	Permissions  string `gorm:"permissions"`
+	// Canonical forms of Email and Username, which lookups use and which are unique; see emailKey and usernameKey.
+	EmailKey    string `gorm:"size:191;uniqueIndex"`
+	UsernameKey string `gorm:"size:191;uniqueIndex"`
+	// CreatedAt is when the user registered.
+	CreatedAt time.Time `gorm:"index"`
+	// Failed login tracking; see LockoutPolicy.
+	FailedAttempts int
+	LastFailure    time.Time
+	LockedUntil    time.Time
+	// Account lifecycle; see DisableUser and DeleteUser. Deleted entries record when they were deleted.
+	Status    string `gorm:"default:active"`
+	DeletedAt time.Time
+	// Email verification; see VerifyEmail.
+	EmailVerified   bool
+	EmailVerifiedAt time.Time
+	// Tokens issued before this time are revoked; see CheckTokenIssued.
+	TokensValidAfter time.Time
+	// The email before the last change, and a hash of the code that reverts it; see ChangeUserEmail.
+	PreviousEmail      string
+	EmailRevertHash    string
+	EmailRevertExpires time.Time
+	// Profile; see ChangeUserProfile. Attributes are stored as JSON.
+	DisplayName string
+	Locale      string
+	AvatarURL   string
+	Attributes  string
+	// Legacy hash columns. These are only set on entries hashed before PasswordHash was self-describing,
+	// and are cleared once the entry is converted; see upgradeLegacyHash.
+	LegacySalt     string `gorm:"column:salt"`
+	LegacyHashFunc string `gorm:"column:hash_func"`
 }
 
 // Empty() checks if the calling userEntry is the empty userEntry.
@@ -67,7 +133,7 @@ type userEntry struct {
 // Output:
 //   - bool: Is u the empty userEntry?
 func (u userEntry) Empty() bool {
-	return u.ID == 0 && u.Email == "" && u.Username == "" && u.PasswordHash == "" && u.Salt == "" && u.HashFunc == "" && u.Permissions == ""
+	return u.ID == 0 && u.Email == "" && u.Username == "" && u.PasswordHash == "" && u.Permissions == "" && u.FailedAttempts == 0 && u.Status == "" && u.LegacySalt == "" && u.LegacyHashFunc == ""
 }
 
 // toUser converts the calling userEntry into a User.
@@ -78,49 +144,202 @@ func (u userEntry) Empty() bool {
 //   - User: the resulting public User struct.
 func (u userEntry) toUser() User {
 	outUser := User{
-		Email:       u.Email,
-		Username:    u.Username,
-		Permissions: make(map[string]bool),
+		Email:         u.Email,
+		Username:      u.Username,
+		Permissions:   decodePermissions(u.Permissions),
+		EmailVerified: u.EmailVerified,
+		DisplayName:   u.DisplayName,
+		Locale:        u.Locale,
+		AvatarURL:     u.AvatarURL,
+		Attributes:    decodeAttributes(u.Attributes),
+		Created:       u.CreatedAt,
+	}
+	if !u.Empty() {
+		outUser.Status = u.status()
 	}
-	json.Unmarshal([]byte(u.Permissions), &outUser.Permissions)
 	return outUser
 }
 
-// Open the database.
-// This MUST be called before any authcred operations take place, and if the path is changed,
-// a different DB will be opened; this is configured under DB.Path in config.yml, and should probably not
-// change unless you have a testing database to use.
-// Only one database can be open at a time.
+// Convert the calling userEntry's legacy hash columns into a self-describing PasswordHash.
+//
+// Calling:
+//   - u *userEntry: Entry to convert, in place.
+// Output:
+//   - bool: Was the entry changed?
+//   - error: Returned if the legacy columns can't be converted; u is unchanged.
+func (u *userEntry) upgradeLegacyHash() (bool, error) {
+	if u.LegacyHashFunc == "" {
+		return false, nil
+	}
+	encoded, err := legacyToEncoded(u.PasswordHash, u.LegacySalt, u.LegacyHashFunc)
+	if err != nil {
+		return false, err
+	}
+	u.PasswordHash = encoded
+	u.LegacySalt = ""
+	u.LegacyHashFunc = ""
+	return true, nil
+}
+
+// A Service performs credential operations against a single Store.
+// Services are independent of each other, so several can run side by side with different stores.
+type Service struct {
+	// Hashing is the policy used for new password hashes. Hashes made under a different policy are upgraded
+	// the next time their user logs in.
+	Hashing HashPolicy
+	// Pepper is the secret mixed into password hashes. Hashes made with a different pepper version are upgraded
+	// the next time their user logs in. The zero Pepper mixes in nothing.
+	Pepper Pepper
+	// Lockout controls how failed logins lock an account.
+	Lockout LockoutPolicy
+	// Passwords restricts the passwords accepted for new users and password changes. The zero value accepts any password.
+	Passwords PasswordPolicy
+	// PasswordHistory is how many previous passwords ChangeUserPassword remembers and refuses to reuse, in addition
+	// to the current one. 0 disables the check.
+	PasswordHistory int
+	// RestoreWindow is how long a deleted user can be restored before it is purged. Defaults to DefaultRestoreWindow.
+	RestoreWindow time.Duration
+	// EmailRevertWindow is how long the previous email can revert an email change. Defaults to DefaultEmailRevertWindow.
+	EmailRevertWindow time.Duration
+	// Log receives detailed reasons for credential failures, which are never returned to callers.
+	// Defaults to discarding them.
+	Log func(format string, args ...interface{})
+	// PRIVATE
+	store Store
+	// dummyHash is hashed against when a user isn't found, so unknown users take as long to reject as known ones.
+	// It's regenerated whenever Hashing or the pepper version changes.
+	dummyMu     sync.Mutex
+	dummyHash   string
+	dummyPolicy HashPolicy
+	dummyPepper int
+}
+
+// Create a new Service using a Store.
 //
 // Input:
-//   - path string: Path to the database file
+//   - store Store: Store to read and write users through. See OpenDB and NewMemoryStore.
+// Output:
+//   - *Service: A new credentials service, using DefaultHashPolicy for password hashes and DefaultLockoutPolicy
+//   for failed logins.
+func NewService(store Store) *Service {
+	return &Service{
+		Hashing:           DefaultHashPolicy(),
+		Lockout:           DefaultLockoutPolicy(),
+		RestoreWindow:     DefaultRestoreWindow,
+		EmailRevertWindow: DefaultEmailRevertWindow,
+		Log:               func(format string, args ...interface{}) {},
+		store:             store,
+	}
+}
+
+// Get a password hash made under the current hash policy, for checking passwords of users that don't exist.
+//
+// Calling:
+//   - s *Service: Service whose Hashing policy is used.
+// Output:
+//   - string: Encoded hash of a random password.
+//   - error: Any error that occurs while hashing.
+func (s *Service) getDummyHash() (string, error) {
+	s.dummyMu.Lock()
+	defer s.dummyMu.Unlock()
+	if s.dummyHash == "" || s.dummyPolicy != s.Hashing || s.dummyPepper != s.Pepper.Version {
+		pwd, err := genSalt()
+		if err != nil {
+			return "", err
+		}
+		dummyHash, err := s.hashPassword(stringEncode(pwd))
+		if err != nil {
+			return "", err
+		}
+		s.dummyHash, s.dummyPolicy, s.dummyPepper = dummyHash, s.Hashing, s.Pepper.Version
+	}
+	return s.dummyHash, nil
+}
+
+// Hash a password with a new salt under the calling Service's hash policy and pepper.
+//
+// Calling:
+//   - s *Service: Service whose Hashing policy and Pepper are used.
+// Input:
+//   - password string: Password to hash.
 // Output:
-//   - error: Output if the open fails, or if the userEntry struct changes in a way that prevents migrating the DB.
-//   This most commonly occurs if the path does not exist; gorm can create a new file, but not directories.
-func OpenDB(path string) error {
-	var err error
-	db, err = gorm.Open(sqlite.Open(path), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+//   - string: Encoded password hash.
+//   - error: Any error that occurs, including: unsupported hash function, ErrPepperUnavailable, failure to hash.
+func (s *Service) hashPassword(password string) (string, error) {
+	hashFunc, params, err := s.Hashing.hashFunc()
 	if err != nil {
-		return err
+		return "", err
 	}
-	err = db.AutoMigrate(&userEntry{})
+	return slowHash([]byte(password), hashFunc, params, s.Pepper)
+}
+
+// Find a userEntry in the store by its email, converting legacy hash columns if needed.
+// Deleted entries whose restore window has passed are purged, and not returned.
+//
+// Calling:
+//   - s *Service: Service whose store is searched.
+// Input:
+//   - email string: Email to find.
+// Output:
+//   - userEntry: The resulting userEntry, or the empty userEntry if not found.
+//   - error: Any error from the store, or from converting the entry.
+func (s *Service) findUserEntryByEmail(email string) (userEntry, error) {
+	entry, err := s.store.findUserEntryByEmail(email)
 	if err != nil {
-		return err
+		return entry, err
+	}
+	if err := s.upgradeLegacyEntry(&entry); err != nil {
+		return entry, err
+	}
+	return s.purgeIfExpired(entry)
+}
+
+// Find a userEntry in the store by its username, converting legacy hash columns if needed.
+// Deleted entries whose restore window has passed are purged, and not returned.
+//
+// Calling:
+//   - s *Service: Service whose store is searched.
+// Input:
+//   - username string: Username to find.
+// Output:
+//   - userEntry: The resulting userEntry, or the empty userEntry if not found.
+//   - error: Any error from the store, or from converting the entry.
+func (s *Service) findUserEntryByUsername(username string) (userEntry, error) {
+	entry, err := s.store.findUserEntryByUsername(username)
+	if err != nil {
+		return entry, err
 	}
+	if err := s.upgradeLegacyEntry(&entry); err != nil {
+		return entry, err
+	}
+	return s.purgeIfExpired(entry)
+}
 
-	return nil
+// Convert a userEntry's legacy hash columns and save the result to the store.
+//
+// Calling:
+//   - s *Service: Service whose store holds the entry.
+// Input:
+//   - entry *userEntry: Entry to convert. Entries without legacy columns are left alone.
+// Output:
+//   - error: Any error from converting or saving the entry.
+func (s *Service) upgradeLegacyEntry(entry *userEntry) error {
+	changed, err := entry.upgradeLegacyHash()
+	if err != nil || !changed {
+		return err
+	}
+	return s.store.updateUser(entry)
 }
 
-// Get the current number of entries in the database.
+// Get the current number of entries in the store. This counts rather than reads them, so it's cheap on large stores.
 // It's not likely that this has significant use outside of noticing if the user is initializing a new database; to preserve
 // security in this case, the user should be asked to create the first account as an admin account before opening to a network.
 //
 // Output:
-//   - int: Number of entries in the current database
-func Entries() int {
-	entries := make([]userEntry, 0)
-	db.Find(&entries)
-	return len(entries)
+//   - int: Number of entries in the current store
+//   - error: Returned if the store can't be counted, such as when the database is closed.
+func (s *Service) Entries() (int, error) {
+	return s.store.countUsers()
 }
 
 // Exported version of findUserEntryByEmail; returns public User instead of userEntry.
@@ -129,12 +348,16 @@ func Entries() int {
 //   - email string: Email to find
 // Output:
 //   - User: User data, or empty user if not found.
-func FindUserByEmail(email string) (User, error) {
-	uentry, err := findUserEntryByEmail(email)
+//   - error: ErrUserNotFound if no user has the email, or any error from the store.
+func (s *Service) FindUserByEmail(email string) (User, error) {
+	uentry, err := s.findUserEntryByEmail(email)
 	if err != nil {
 		return User{}, err
 	}
-	return uentry.toUser(), nil
+	if uentry.Email == "" {
+		return User{}, errors.Wrap(ErrUserNotFound, email)
+	}
+	return s.publicUser(uentry)
 }
 
 // Exported version of findUserEntryByUsername; returns public User instead of userEntry.
@@ -143,38 +366,48 @@ func FindUserByEmail(email string) (User, error) {
 //   - username string: Username to find
 // Output:
 //   - User: User data, or empty user if not found.
-func FindUserByUsername(username string) (User, error) {
-	uentry, err := findUserEntryByUsername(username)
+//   - error: ErrUserNotFound if no user has the username, or any error from the store.
+func (s *Service) FindUserByUsername(username string) (User, error) {
+	uentry, err := s.findUserEntryByUsername(username)
 	if err != nil {
 		return User{}, err
 	}
-	return uentry.toUser(), nil
+	if uentry.Username == "" {
+		return User{}, errors.Wrap(ErrUserNotFound, username)
+	}
+	return s.publicUser(uentry)
 }
 
 // Register a user with the given credentials and permissions.
 //
 // Input:
-//   - email, username string: User email/username pair. Both of these values MUST be unique.
-//   - password string: User password. To avoid conflicts with integration, auth imposes no password restrictions; it is
-//   expected that the application manage restrictions such as password length.
+//   - email, username string: User email/username pair. Both of these values MUST be unique in canonical form: emails
+//   are case-folded, and usernames NFKC-normalized.
+//   - password string: User password. Must satisfy s.Passwords; by default, auth imposes no password restrictions.
 //   - permissions map[string]bool: User permissions. auth only takes advantage of the admin permission; all others are
 //   application-defined.
 // Output:
-//   - error: Any errors that occur during the registration of a user, including: non-unique email/username, failure to generate
-//   password salt, failure to hash password. If an error is returned, no change is made to the database.
-func RegisterUser(email, username string, password string, permissions map[string]bool) error {
-	if user, _ := findUserEntryByEmail(email); user.Email != "" {
-		return errors.New("Email is already in use.")
+//   - error: Any errors that occur during the registration of a user, including: a *DuplicateError (matching
+//   ErrDuplicateEmail or ErrDuplicateUsername) if either is taken, even by a concurrent registration, a
+//   *PasswordPolicyError if the password is rejected, failure to hash password or add to the store. If an error is
+//   returned, no change is made to the database.
+func (s *Service) RegisterUser(email, username string, password string, permissions map[string]bool) error {
+	// The store refuses duplicates too, but checking first avoids hashing a password that can't be used.
+	if user, err := s.findUserEntryByEmail(email); err != nil {
+		return err
+	} else if user.Email != "" {
+		return &DuplicateError{Field: FieldEmail}
 	}
-	if user, _ := findUserEntryByUsername(username); user.Username != "" {
-		return errors.New("Username is already in use.")
+	if user, err := s.findUserEntryByUsername(username); err != nil {
+		return err
+	} else if user.Username != "" {
+		return &DuplicateError{Field: FieldUsername}
 	}
-	perm, _ := json.Marshal(permissions)
-	salt, err := genSalt()
-	if err != nil {
+	if err := s.Passwords.Check(password, email, username); err != nil {
 		return err
 	}
-	pwdHash, err := slowHash([]byte(password), salt, "sha512")
+	perm, _ := json.Marshal(permissions)
+	pwdHash, err := s.hashPassword(password)
 	if err != nil {
 		return err
 	}
@@ -182,51 +415,110 @@ func RegisterUser(email, username string, password string, permissions map[strin
 		Email:        email,
 		Username:     username,
 		PasswordHash: pwdHash,
-		Salt:         stringEncode(salt),
-		HashFunc:     "sha512",
 		Permissions:  string(perm),
+		CreatedAt:    time.Now(),
 	}
-	addUser(entry)
-	return nil
+	return s.store.addUser(entry)
 }
 
 // Validate a user with username and password credentials.
+// If the stored password hash was made under a different hash policy, it is replaced with one made under the current
+// policy once the credentials are validated.
+// Unknown usernames are checked against a dummy hash, and hashes are compared in constant time, so that the time
+// taken doesn't reveal whether a username exists. Every credential failure returns ErrInvalidCredentials; the
+// specific reason is passed to s.Log.
+// Failed attempts are counted against the user, and lock the account according to s.Lockout. A locked account
+// fails with a *LockedError, without checking the password. Deleted users and the legacy API pseudo-user are treated
+// as unknown, and disabled users fail with ErrUserDisabled once their password is checked.
 //
 // Input:
 //   - username, password string: User credentials. The username will be used to find the userEntry, and then the password
-//   will be hashed with that userEntry salt and hash function and compared to the userEntry password.
+//   will be hashed with the salt, hash function and parameters recorded in that userEntry password hash and compared to it.
 // Output:
 //   - bool: Is user valid?
 //   - User: Public user credentials.
-//   - error: Any errors that occur during user validation, including: failure to find user, failure to hash password, failure to validate
-//   user.
-func ValidateUserCred(username, password string) (bool, User, error) {
-	// Find user. Fail out if non-eistent
-	user, err := findUserEntryByUsername(username)
+//   - error: ErrInvalidCredentials if the credentials are wrong, a *LockedError (matching ErrLocked) if the account is
+//   locked, ErrUserDisabled if the account is disabled, or any other error that occurs during user validation, such as failure to read the store.
+func (s *Service) ValidateUserCred(username, password string) (bool, User, error) {
+	// Find user. If non-existent, check against the dummy hash anyway before failing out.
+	user, err := s.findUserEntryByUsername(username)
 	if err != nil {
 		return false, User{}, err
 	}
-	if user.Username == "" {
-		return false, User{}, fmt.Errorf("User %s not found", username)
+	// The legacy API pseudo-user holds an API key, not a password, so nobody can log in as it.
+	found := user.Username != "" && user.status() != StatusDeleted && !user.isLegacyAPIUser()
+	if found {
+		if err := user.lockedError(time.Now()); err != nil {
+			s.Log("Credential validation failed: user %s is locked", username)
+			return false, User{}, err
+		}
+	}
+	pwdHash := user.PasswordHash
+	if !found {
+		if pwdHash, err = s.getDummyHash(); err != nil {
+			return false, User{}, err
+		}
 	}
 	// Check hashed password against input password.
-	salt, _ := stringDecode(user.Salt)
-	pwdHash, err := slowHash([]byte(password), salt, user.HashFunc)
+	match, err := checkHash([]byte(password), pwdHash, s.Pepper)
 	if err != nil {
-		return false, User{}, err
+		s.Log("Couldn't check password hash for user %s: %v", username, err)
+		return false, User{}, ErrInvalidCredentials
 	}
-	valid := username == user.Username && pwdHash == user.PasswordHash
-	if valid {
-		outUser := User{
-			Email:       user.Email,
-			Username:    user.Username,
-			Permissions: make(map[string]bool),
+	if !found {
+		s.Log("Credential validation failed: user %s not found", username)
+		return false, User{}, ErrInvalidCredentials
+	}
+	if !match {
+		s.Log("Credential validation failed: wrong password for user %s", username)
+		if err := s.recordLoginFailure(&user); err != nil {
+			return false, User{}, err
 		}
-		json.Unmarshal([]byte(user.Permissions), &outUser.Permissions)
-		return true, outUser, nil
-	} else {
-		return false, User{}, fmt.Errorf("User validation failed")
+		return false, User{}, ErrInvalidCredentials
+	}
+	// Only reveal that an account is disabled to someone who knows its password.
+	if user.status() == StatusDisabled {
+		s.Log("Credential validation failed: user %s is disabled", username)
+		return false, User{}, ErrUserDisabled
 	}
+	if err := s.recordLoginSuccess(&user); err != nil {
+		return false, User{}, err
+	}
+	// Upgrade the stored hash if the hash policy or pepper version has changed since it was made.
+	if err := s.rehashIfNeeded(&user, password); err != nil {
+		return false, User{}, err
+	}
+	public, err := s.publicUser(user)
+	if err != nil {
+		return false, User{}, err
+	}
+	return true, public, nil
+}
+
+// Rehash a validated password if the stored hash was made under a different hash policy or pepper version.
+//
+// Calling:
+//   - s *Service: Service whose Hashing policy and Pepper are current.
+// Input:
+//   - user *userEntry: Entry whose password was just validated. Updated in place and in the store if rehashed.
+//   - password string: The validated password.
+// Output:
+//   - error: Any error that occurs while hashing or updating the entry.
+func (s *Service) rehashIfNeeded(user *userEntry, password string) error {
+	outdated, err := s.Hashing.outdated(user.PasswordHash)
+	if err != nil {
+		return err
+	}
+	version, _, err := splitPepper(user.PasswordHash)
+	if err != nil || (!outdated && version == s.Pepper.Version) {
+		return err
+	}
+	pwdHash, err := s.hashPassword(password)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = pwdHash
+	return s.store.updateUser(user)
 }
 
 // Validate a user's current credentials, then change their password if they could be validated.
@@ -235,37 +527,105 @@ func ValidateUserCred(username, password string) (bool, User, error) {
 //   - username, password string: User credentials. See ValidateUserCred.
 //   - newPassword string: New password to set IF the above credentials can be validated.
 // Output:
-//   - error: Any error that occurs when changing user password, including: failure to validate,
-//   user doesn't exist, failure to hash password
-func ChangeUserPassword(username, password string, newPassword string) error {
-	valid, _, err := ValidateUserCred(username, password)
+//   - error: Any error that occurs when changing user password, including: ErrInvalidCredentials if the user doesn't exist
+//   or the password is wrong, a *PasswordPolicyError if the new password is rejected or was used recently (see
+//   PasswordHistory), failure to hash password. Tokens issued to the user before the change are revoked.
+func (s *Service) ChangeUserPassword(username, password string, newPassword string) error {
+	valid, _, err := s.ValidateUserCred(username, password)
 	if !valid {
 		if err != nil {
 			return err
 		} else {
-			return fmt.Errorf("User validation failed")
+			return ErrInvalidCredentials
 		}
 	}
 	// If the user didn't exist, validation would have failed
-	user, err := findUserEntryByUsername(username)
+	user, err := s.findUserEntryByUsername(username)
 	if err != nil {
 		return err
 	}
-	salt, err := genSalt()
-	if err != nil {
+	return s.setPassword(&user, newPassword)
+}
+
+// Check a new password against the password policy and history, then set it.
+// Tokens issued to the user before the change are revoked; see CheckTokenIssued.
+//
+// Calling:
+//   - s *Service: Service whose policies and store are used.
+// Input:
+//   - user *userEntry: Entry to change. Updated in place and in the store.
+//   - newPassword string: Password to set.
+// Output:
+//   - error: A *PasswordPolicyError if the password is rejected or was used recently, or any error from hashing or
+//   the store.
+func (s *Service) setPassword(user *userEntry, newPassword string) error {
+	if err := s.Passwords.Check(newPassword, user.Email, user.Username); err != nil {
+		return err
+	}
+	if err := s.checkPasswordHistory(*user, newPassword); err != nil {
 		return err
 	}
-	pwdHash, err := slowHash([]byte(newPassword), salt, user.HashFunc)
+	pwdHash, err := s.hashPassword(newPassword)
 	if err != nil {
 		return err
 	}
+	if err := s.recordPasswordHistory(*user); err != nil {
+		return err
+	}
 	user.PasswordHash = pwdHash
-	user.Salt = stringEncode(salt)
-	updateUser(&user)
-	return nil
+	user.TokensValidAfter = time.Now()
+	return s.store.updateUser(user)
+}
+
+// Set a new password for the user with an email, without their old password.
+// This is the second step of a forgotten password reset; the caller is responsible for proving ownership of the
+// email first, e.g. with a gatecode sent to it. A successful reset also unlocks the account.
+//
+// Input:
+//   - email string: Email of the user.
+//   - newPassword string: Password to set.
+// Output:
+//   - error: Any error that occurs, including: ErrInvalidCredentials if no active user has the email, a
+//   *PasswordPolicyError if the password is rejected or was used recently, failure to hash password or update the store
+func (s *Service) ResetUserPassword(email, newPassword string) error {
+	user, err := s.findUserEntryByEmail(email)
+	if err != nil {
+		return err
+	}
+	if user.Email == "" || user.status() != StatusActive {
+		s.Log("Password reset failed: no active user with email %s", email)
+		return ErrInvalidCredentials
+	}
+	user.FailedAttempts = 0
+	user.LockedUntil = time.Time{}
+	return s.setPassword(&user, newPassword)
+}
+
+// Mark a user's email as verified, recording when it happened.
+// The caller is responsible for proving ownership of the email first, e.g. with a gatecode sent to it.
+//
+// Input:
+//   - email string: Verified email.
+// Output:
+//   - error: Any error that occurs, including: ErrUserNotFound if no user has the email, failure to update the store.
+func (s *Service) VerifyEmail(email string) error {
+	entry, err := s.findUserEntryByEmail(email)
+	if err != nil {
+		return err
+	}
+	if entry.Email == "" || entry.status() == StatusDeleted {
+		return errors.Wrap(ErrUserNotFound, email)
+	}
+	if entry.EmailVerified {
+		return nil
+	}
+	entry.EmailVerified = true
+	entry.EmailVerifiedAt = time.Now()
+	return s.store.updateUser(&entry)
 }
 
 // Change user permissions for a given user.
+// These are the user's own permissions; permissions shared by many users are better granted through a role.
 // This action is generally initiated by an admin or the application server, and not a user; as a result,
 // no password is required for the user.
 //
@@ -273,14 +633,17 @@ func ChangeUserPassword(username, password string, newPassword string) error {
 //   - username string: Username to alter.
 //   - newPermissions map[string]bool: Full list of new permissions. Overwrites any permissions with the same name.
 // Output:
-//   - error: Any error that occurs while changing permissions, including: user does not exist, failure to marshal
+//   - error: Any error that occurs while changing permissions, including: ErrUserNotFound, failure to marshal
 //   permissions
-func ChangeUserPermissions(username string, newPermissions map[string]bool) error {
+func (s *Service) ChangeUserPermissions(username string, newPermissions map[string]bool) error {
 	// Get userEntry. We need the entry ID to update the DB
-	entry, err := findUserEntryByUsername(username)
+	entry, err := s.findUserEntryByUsername(username)
 	if err != nil {
 		return err
 	}
+	if entry.Username == "" {
+		return errors.Wrap(ErrUserNotFound, username)
+	}
 	// Get the corresponding User. This unmarshals the permissions string in entry so we can change permissions without a full overwrite.
 	user := entry.toUser()
 	// Write every key-value pair from newPermissions to old permissions.
@@ -297,6 +660,5 @@ func ChangeUserPermissions(username string, newPermissions map[string]bool) erro
 		return err
 	}
 	entry.Permissions = string(bytePerms)
-	updateUser(&entry)
-	return nil
+	return s.store.updateUser(&entry)
 }
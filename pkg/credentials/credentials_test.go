@@ -1,8 +1,19 @@
 package credentials
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
 )
 
 func TestDBAccess(t *testing.T) {
@@ -13,29 +24,246 @@ func TestDBAccess(t *testing.T) {
 		t.FailNow()
 	}
 	// Every single access function should fail if the database is not open.
-	if eAdd, eUpdate := addUser(nil), updateUser(nil); eAdd == nil || eUpdate == nil {
+	closed := &dbStore{}
+	if eAdd, eUpdate := closed.addUser(nil), closed.updateUser(nil); eAdd == nil || eUpdate == nil {
 		t.Error("addUser and updateUser should both return error with a closed database")
 	}
-	if _, eFindEmail := findUserEntryByEmail("foo@bar.com"); eFindEmail == nil {
+	if _, eFindEmail := closed.findUserEntryByEmail("foo@bar.com"); eFindEmail == nil {
 		t.Error("findUserEntryByEmail should return error with a closed database")
 	}
-	if _, eFindUname := findUserEntryByUsername("foobar"); eFindUname == nil {
+	if _, eFindUname := closed.findUserEntryByUsername("foobar"); eFindUname == nil {
 		t.Error("findUserEntryByUsername should return error with a closed database")
 	}
 
 	// Open database
-	if err := OpenDB("test.db"); err != nil {
+	store, err := OpenDB(DBOptions{Driver: "sqlite", DSN: "test.db"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	testService(t, store)
+	// Once the connection is gone, lookups fail instead of reporting a missing user.
+	closeGorm(store.(*dbStore).db)
+	if _, err := store.findUserEntryByEmail("foo@bar.com"); err == nil {
+		t.Error("findUserEntryByEmail should return error when the database can't be read")
+	}
+	if _, err := store.findUserEntryByUsername("foobar"); err == nil {
+		t.Error("findUserEntryByUsername should return error when the database can't be read")
+	}
+	if _, _, err := NewService(store).ValidateUserCred("foobar", "password"); err == nil || errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Login with an unreadable database returned %v", err)
+	}
+}
+
+// TestExternalDB runs against a throwaway postgres or mysql database when one is configured through
+// GATE_TEST_DB_DRIVER and GATE_TEST_DB_DSN. Every table in that database is dropped first.
+func TestExternalDB(t *testing.T) {
+	driver, dsn := os.Getenv("GATE_TEST_DB_DRIVER"), os.Getenv("GATE_TEST_DB_DSN")
+	if driver == "" || dsn == "" {
+		t.Skip("GATE_TEST_DB_DRIVER and GATE_TEST_DB_DSN not set")
+	}
+	store, err := OpenDB(DBOptions{Driver: driver, DSN: dsn, MaxOpenConns: 4})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if err := MigrateDB(DBOptions{Driver: driver, DSN: dsn}, 0); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if store, err = OpenDB(DBOptions{Driver: driver, DSN: dsn, MaxOpenConns: 4}); err != nil {
 		t.Error(err)
+		t.FailNow()
+	}
+	testService(t, store)
+}
+
+// MySQL can only index strings of limited length, so every indexed string column, in the live models and in those
+// frozen for migrations, must be sized; unsized strings are longtext, which MySQL refuses to index.
+func TestMySQLIndexedColumns(t *testing.T) {
+	dialector := mysql.Dialector{Config: &mysql.Config{}}
+	models := []interface{}{
+		&userEntry{}, &roleEntry{}, &applicationEntry{}, &apiKeyEntry{},
+		&userEntryV1{}, &roleEntryV8{}, &applicationEntryV9{}, &apiKeyEntryV9{}, &identifierColumnsV12{},
+		&apiKeyColumnsV13{},
+	}
+	for _, model := range models {
+		parsed, err := schema.Parse(model, &sync.Map{}, schema.NamingStrategy{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, index := range parsed.ParseIndexes() {
+			for _, option := range index.Fields {
+				if option.Field.DataType != schema.String {
+					continue
+				}
+				if dataType := dialector.DataTypeOf(option.Field); !strings.HasPrefix(dataType, "varchar") {
+					t.Errorf("%s.%s is indexed, but is %s in MySQL", parsed.Name, option.Field.Name, dataType)
+				}
+			}
+		}
 	}
+}
 
-	if valid, invalidUser, _ := ValidateUserCred("username", "password"); valid {
+func TestOpenDBFailure(t *testing.T) {
+	if _, err := OpenDB(DBOptions{Driver: "oracle", DSN: "test.db"}); err == nil {
+		t.Error("OpenDB succeeded with an unsupported driver")
+	}
+	if _, err := OpenDB(DBOptions{Driver: "postgres", DSN: "host=127.0.0.1 port=1 connect_timeout=1"}); err == nil {
+		t.Error("OpenDB succeeded with an unreachable postgres database")
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testService(t, NewMemoryStore())
+}
+
+// The models as they are now, which migrations must have created every column of.
+var currentModels = []interface{}{
+	&userEntry{}, &passwordHistoryEntry{}, &roleEntry{}, &roleBinding{}, &roleInclude{},
+	&applicationEntry{}, &membershipEntry{}, &apiKeyEntry{},
+}
+
+func TestMigrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := DBOptions{DSN: dir + "/migrate.db"}
+	if _, err := OpenDB(DBOptions{DSN: opts.DSN, ManualMigrations: true}); !errors.Is(err, ErrSchemaOutdated) {
+		t.Errorf("Opened an unmigrated database with manual migrations: %v", err)
+	}
+	store, err := OpenDB(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := store.(*dbStore).db
+	for _, model := range currentModels {
+		stmt := &gorm.Statement{DB: db}
+		stmt.Parse(model)
+		for _, field := range stmt.Schema.Fields {
+			if !db.Migrator().HasColumn(model, field.DBName) {
+				t.Errorf("Migrations didn't create %s.%s", stmt.Schema.Table, field.DBName)
+			}
+		}
+	}
+	if version, err := SchemaVersion(opts); err != nil || version != LatestSchemaVersion() {
+		t.Errorf("Schema version is %d, expected %d (%v)", version, LatestSchemaVersion(), err)
+	}
+	if _, err := OpenDB(DBOptions{DSN: opts.DSN, ManualMigrations: true}); err != nil {
+		t.Errorf("Couldn't open a migrated database with manual migrations: %v", err)
+	}
+	// Migrating down removes columns and tables, keeping the rest of the data.
+	svc := NewService(store)
+	svc.Hashing = fastHashPolicy("argon2id")
+	svc.RegisterUser("user@email.com", "username", "password", nil)
+	if err := MigrateDB(opts, 8); err != nil {
+		t.Fatal(err)
+	}
+	if db.Migrator().HasTable(&applicationEntry{}) || db.Migrator().HasColumn(&userEntry{}, "display_name") {
+		t.Error("Migrating down left applications and profiles")
+	}
+	if err := MigrateDB(opts, LatestSchemaVersion()); err != nil {
+		t.Fatal(err)
+	}
+	if valid, _, err := svc.ValidateUserCred("username", "password"); !valid {
+		t.Errorf("User didn't survive migrating down and up: %v", err)
+	}
+	// API keys from before prefixes existed are given one, and still found by hash.
+	if err := MigrateDB(opts, 12); err != nil {
+		t.Fatal(err)
+	}
+	db.Create(&apiKeyEntryV9{AppID: 1, KeyHash: hashAPIKey("old-key")})
+	if err := MigrateDB(opts, LatestSchemaVersion()); err != nil {
+		t.Fatal(err)
+	}
+	migrated, err := OpenDB(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err := migrated.findAPIKeyByHash(hashAPIKey("old-key")); !strings.HasPrefix(key.Prefix, "gk_") || err != nil {
+		t.Errorf("Old API key migrated to %+v: %v", key, err)
+	}
+	if err := MigrateDB(opts, 0); err != nil {
+		t.Fatal(err)
+	}
+	if db.Migrator().HasTable(&userEntry{}) {
+		t.Error("Migrating to version 0 left the users table")
+	}
+	if err := MigrateDB(opts, LatestSchemaVersion()+1); err == nil {
+		t.Error("Migrated past the latest version")
+	}
+	db.Create(&schemaMigration{Version: LatestSchemaVersion() + 1, Name: "from the future"})
+	if _, err := OpenDB(opts); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Opened a database from a newer version: %v", err)
+	}
+	// Databases made by AutoMigrate before migrations existed are adopted, whatever columns they have.
+	legacyDSN := dir + "/legacy.db"
+	legacy, err := gorm.Open(sqlite.Open(legacyDSN), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, model := range []interface{}{&userEntryV1{}, &lockoutColumnsV2{}, &passwordHistoryEntryV3{}} {
+		if err := legacy.AutoMigrate(model); err != nil {
+			t.Fatal(err)
+		}
+	}
+	legacy.Create(&userEntryV1{Email: "old@email.com", Username: "old", PasswordHash: "5baa61e4c9b93f3f0682250b6cf8331b7ee68fd8"})
+	store, err = OpenDB(DBOptions{DSN: legacyDSN})
+	if err != nil {
+		t.Fatalf("Couldn't adopt a database from before migrations: %v", err)
+	}
+	svc = NewService(store)
+	svc.Hashing = fastHashPolicy("argon2id")
+	if valid, user, err := svc.ValidateUserCred("old", "password"); !valid || user.Status != StatusActive {
+		t.Errorf("Adopted user is %+v: %v", user, err)
+	}
+	// Users that only differ by the case of their email can't be migrated to canonical identifiers.
+	caseDSN := dir + "/case.db"
+	legacy, err = gorm.Open(sqlite.Open(caseDSN), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := legacy.AutoMigrate(&userEntryV1{}); err != nil {
+		t.Fatal(err)
+	}
+	legacy.Create(&userEntryV1{Email: "same@email.com", Username: "first"})
+	legacy.Create(&userEntryV1{Email: "Same@Email.com", Username: "second"})
+	if _, err := OpenDB(DBOptions{DSN: caseDSN}); err == nil || !strings.Contains(err.Error(), "users 1 and 2") {
+		t.Errorf("Migrated users with the same canonical email: %v", err)
+	}
+	legacy.Model(&userEntryV1{}).Where("id = ?", 2).Update("email", "different@email.com")
+	if _, err := OpenDB(DBOptions{DSN: caseDSN}); err != nil {
+		t.Errorf("Couldn't migrate after fixing a duplicate email: %v", err)
+	}
+}
+
+// Two services on separate stores shouldn't see each other's users.
+func TestSeparateStores(t *testing.T) {
+	first, second := NewService(NewMemoryStore()), NewService(NewMemoryStore())
+	if err := first.RegisterUser("user@email.com", "username", "password", nil); err != nil {
+		t.Error(err)
+	}
+	if err := second.RegisterUser("user@email.com", "username", "password", nil); err != nil {
+		t.Errorf("Registration in a second store failed: %v", err)
+	}
+	if valid, _, _ := second.ValidateUserCred("username", "password"); !valid {
+		t.Error("Couldn't validate user registered in the second store")
+	}
+}
+
+// testService runs the full set of credential operations against a fresh store.
+func testService(t *testing.T, store Store) {
+	svc := NewService(store)
+	if valid, invalidUser, _ := svc.ValidateUserCred("username", "password"); valid {
 		t.Error("Validated user credentials that haven't been registered")
 	} else {
 		if !invalidUser.Empty() {
 			t.Error("ValidateUserCred failed, but the returned User was not the empty User")
 		}
 	}
-	if invalidUser, err := findUserEntryByUsername("username"); err != nil {
+	if invalidUser, err := store.findUserEntryByUsername("username"); err != nil {
 		t.Error("Standalone findUserEntryByUsername returned no error for a nonexistent user")
 	} else {
 		if !invalidUser.Empty() {
@@ -46,72 +274,1389 @@ func TestDBAccess(t *testing.T) {
 	}
 
 	// Register a user
-	if err := RegisterUser("user@email.com", "username", "password", nil); err != nil {
+	if err := svc.RegisterUser("user@email.com", "username", "password", nil); err != nil {
 		t.Error(err)
 	}
 
 	// With that user registered, we should be able to find them by email or username...
-	if foundUser, err := FindUserByEmail("user@email.com"); err != nil {
+	if foundUser, err := svc.FindUserByEmail("user@email.com"); err != nil {
 		t.Error("Got an error when finding user@email.com after registration.")
 	} else if foundUser.Empty() {
 		t.Error("FindUserByEmail returned the empty user for user@email.com after registration.")
 	}
-	if foundUser, err := FindUserByUsername("username"); err != nil {
+	if foundUser, err := svc.FindUserByUsername("username"); err != nil {
 		t.Error("Got an error when finding username after registration.")
 	} else if foundUser.Empty() {
 		t.Error("FindUserByUsername returned the empty user username after registration.")
 	}
 	// There should also be 1 entry.
 	// This doesn't actually hold for the prod db, since there's an admin account, but we're going to ignore that for this test.
-	if Entries() != 1 {
-		t.Errorf("Databse should have 1 entry, but has %d instead", Entries())
+	if entries, _ := svc.Entries(); entries != 1 {
+		t.Errorf("Databse should have 1 entry, but has %d instead", entries)
 	}
 
 	// Validate those user credentials
-	if _, _, err := ValidateUserCred("username", "password"); err != nil {
+	if _, _, err := svc.ValidateUserCred("username", "password"); err != nil {
 		t.Error(err)
 	}
 
 	// Validate again, but using the wrong password
-	if valid, _, _ := ValidateUserCred("username", "wrongpassword"); valid {
+	if valid, _, _ := svc.ValidateUserCred("username", "wrongpassword"); valid {
 		t.Error("Validated user credentials that are incorrect")
 	}
 
 	// Try re-registering (should fail)
-	if err := RegisterUser("user@email.com", "username", "password", nil); err == nil {
+	if err := svc.RegisterUser("user@email.com", "username", "password", nil); err == nil {
 		t.Error("Re-registration under same email/username succeeded when it should fail")
 	}
 	// Make sure the number of entries didn't change with a failed re-registration
-	if Entries() != 1 {
-		t.Errorf("Database should have 1 entry, but has %d instead", Entries())
+	if entries, _ := svc.Entries(); entries != 1 {
+		t.Errorf("Database should have 1 entry, but has %d instead", entries)
 	}
 
 	// Given that fails, let's change passwords. Wrong username?
-	if err := ChangeUserPassword("wrongusername", "password", "newPassword"); err == nil {
+	if err := svc.ChangeUserPassword("wrongusername", "password", "newPassword"); err == nil {
 		t.Error("Password change with incorrect username succeeded when it should fail")
 	}
 
 	// Wrong old password
-	if err := ChangeUserPassword("username", "wrongpassword", "newPassword"); err == nil {
+	if err := svc.ChangeUserPassword("username", "wrongpassword", "newPassword"); err == nil {
 		t.Error("Password change with incorrect old password succeeded when it should fail")
 	}
 
 	// Correct everything
-	if err := ChangeUserPassword("username", "password", "newPassword"); err != nil {
+	if err := svc.ChangeUserPassword("username", "password", "newPassword"); err != nil {
 		t.Error(err)
 	}
 
 	// Re-validate with new password
-	if _, _, err := ValidateUserCred("username", "newPassword"); err != nil {
+	if _, _, err := svc.ValidateUserCred("username", "newPassword"); err != nil {
 		t.Error(err)
 	}
 
 	// Change the permissions for this user
-	if err := ChangeUserPermissions("username", map[string]bool{"testPermission": true}); err != nil {
+	if err := svc.ChangeUserPermissions("username", map[string]bool{"testPermission": true}); err != nil {
 		t.Error(err)
 	}
 	// Check that the permissions changed.
-	if user, err := FindUserByUsername("username"); err != nil || !user.Permissions["testPermission"] {
+	if user, err := svc.FindUserByUsername("username"); err != nil || !user.Permissions["testPermission"] {
 		t.Error("Failed to set testPermission; getting user afterwards did not reflect the permission change.")
 	}
+	// Operations on users that don't exist fail with ErrUserNotFound, and don't create them.
+	if _, err := svc.FindUserByUsername("nobody"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("FindUserByUsername for a missing user returned %v", err)
+	}
+	if _, err := svc.FindUserByEmail("nobody@email.com"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("FindUserByEmail for a missing user returned %v", err)
+	}
+	entries, _ := svc.Entries()
+	if err := svc.ChangeUserPermissions("nobody", map[string]bool{"admin": true}); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("ChangeUserPermissions for a missing user returned %v", err)
+	}
+	if after, _ := svc.Entries(); after != entries {
+		t.Errorf("ChangeUserPermissions for a missing user changed the number of users from %d to %d", entries, after)
+	}
+	for name, change := range map[string]func() error{
+		"DisableUser":   func() error { return svc.DisableUser("nobody") },
+		"UnlockUser":    func() error { return svc.UnlockUser("nobody") },
+		"VerifyEmail":   func() error { return svc.VerifyEmail("nobody@email.com") },
+		"PurgeUser":     func() error { return svc.PurgeUser("nobody") },
+		"GrantRole":     func() error { return svc.GrantRole("nobody", "role") },
+		"ChangeEmail":   func() error { _, err := svc.ChangeUserEmail("nobody", "new@email.com"); return err },
+		"ChangeProfile": func() error { return svc.ChangeUserProfile("nobody", ProfileChange{}) },
+	} {
+		if err := change(); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("%s for a missing user returned %v", name, err)
+		}
+	}
+}
+
+// Unknown users and wrong passwords should fail with the same error.
+func TestGenericCredentialError(t *testing.T) {
+	svc := NewService(NewMemoryStore())
+	svc.Hashing = fastHashPolicy("argon2id")
+	logged := make([]string, 0)
+	svc.Log = func(format string, args ...interface{}) {
+		logged = append(logged, format)
+	}
+	if err := svc.RegisterUser("user@email.com", "username", "password", nil); err != nil {
+		t.Error(err)
+	}
+	_, _, errUnknown := svc.ValidateUserCred("nobody", "password")
+	_, _, errWrong := svc.ValidateUserCred("username", "wrongpassword")
+	if errUnknown != ErrInvalidCredentials || errWrong != ErrInvalidCredentials {
+		t.Errorf("Expected ErrInvalidCredentials for both failures, got %v and %v", errUnknown, errWrong)
+	}
+	if errChange := svc.ChangeUserPassword("nobody", "password", "newPassword"); errChange != ErrInvalidCredentials {
+		t.Errorf("Expected ErrInvalidCredentials for password change of unknown user, got %v", errChange)
+	}
+	if len(logged) != 3 {
+		t.Errorf("Expected 3 logged failure reasons, got %d", len(logged))
+	}
+	// The dummy hash should follow the hash policy.
+	first, _ := svc.getDummyHash()
+	svc.Hashing = fastHashPolicy("scrypt")
+	if second, _ := svc.getDummyHash(); first == second || !strings.HasPrefix(second, "$scrypt$") {
+		t.Errorf("Dummy hash %s wasn't regenerated after a policy change", second)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	svc := NewService(NewMemoryStore())
+	svc.Hashing = fastHashPolicy("argon2id")
+	svc.Lockout = LockoutPolicy{MaxAttempts: 3, Duration: time.Hour, MaxDuration: time.Hour * 4, ResetAfter: time.Hour * 24}
+	if err := svc.RegisterUser("user@email.com", "username", "password", nil); err != nil {
+		t.Error(err)
+	}
+	// A success in between failures resets the count.
+	svc.ValidateUserCred("username", "wrongpassword")
+	svc.ValidateUserCred("username", "wrongpassword")
+	if valid, _, err := svc.ValidateUserCred("username", "password"); !valid {
+		t.Errorf("Couldn't validate user after 2 failures: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := svc.ValidateUserCred("username", "wrongpassword"); err != ErrInvalidCredentials {
+			t.Errorf("Failure %d returned %v instead of ErrInvalidCredentials", i, err)
+		}
+	}
+	_, _, err := svc.ValidateUserCred("username", "password")
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("Correct password for locked account returned %v instead of ErrLocked", err)
+	}
+	var locked *LockedError
+	if !errors.As(err, &locked) || time.Until(locked.Until) < time.Minute*59 {
+		t.Errorf("Lock error %v didn't report an unlock time an hour away", err)
+	}
+	// Password changes go through the same check.
+	if err := svc.ChangeUserPassword("username", "password", "newPassword"); !errors.Is(err, ErrLocked) {
+		t.Errorf("Password change for locked account returned %v instead of ErrLocked", err)
+	}
+	if err := svc.UnlockUser("username"); err != nil {
+		t.Error(err)
+	}
+	if valid, _, err := svc.ValidateUserCred("username", "password"); !valid {
+		t.Errorf("Couldn't validate user after unlocking: %v", err)
+	}
+	if err := svc.UnlockUser("nobody"); err == nil {
+		t.Error("Unlocked a user that doesn't exist")
+	}
+}
+
+// Parallel wrong guesses must all be counted, and counting them mustn't undo other changes to the user.
+func TestConcurrentLockout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbStore, err := OpenDB(DBOptions{DSN: dir + "/lockout.db", MaxOpenConns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, store := range map[string]Store{"memory": NewMemoryStore(), "sqlite": dbStore} {
+		svc := NewService(store)
+		svc.Hashing = fastHashPolicy("argon2id")
+		svc.Lockout = LockoutPolicy{MaxAttempts: 100, Duration: time.Hour, ResetAfter: time.Hour}
+		svc.RegisterUser("user@email.com", "username", "password", nil)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				svc.ValidateUserCred("username", "wrongpassword")
+			}()
+		}
+		wg.Wait()
+		entry, _ := store.findUserEntryByUsername("username")
+		if entry.FailedAttempts != 10 {
+			t.Errorf("%s: counted %d of 10 parallel failures", name, entry.FailedAttempts)
+		}
+		// A failure counted from a stale read keeps changes made since.
+		svc.ChangeUserPermissions("username", map[string]bool{"write": true})
+		svc.recordLoginFailure(&entry)
+		if user, _ := svc.FindUserByUsername("username"); !user.Permissions["write"] {
+			t.Errorf("%s: counting a failure undid a permission change", name)
+		}
+		// Failures older than ResetAfter are forgotten.
+		if failures, err := store.addLoginFailure(entry.ID, time.Now(), time.Now().Add(time.Hour)); failures != 1 {
+			t.Errorf("%s: failure after the reset window counted %d: %v", name, failures, err)
+		}
+	}
+}
+
+func TestLockoutBackoff(t *testing.T) {
+	policy := LockoutPolicy{MaxAttempts: 3, Duration: time.Minute, MaxDuration: time.Minute * 10}
+	expected := map[int]time.Duration{
+		2:  0,
+		3:  time.Minute,
+		4:  time.Minute * 2,
+		5:  time.Minute * 4,
+		6:  time.Minute * 8,
+		7:  time.Minute * 10,
+		50: time.Minute * 10,
+	}
+	for failures, lock := range expected {
+		if got := policy.lockFor(failures); got != lock {
+			t.Errorf("%d failures locked for %v, expected %v", failures, got, lock)
+		}
+	}
+	if lock := (LockoutPolicy{}).lockFor(100); lock != 0 {
+		t.Errorf("Disabled lockout policy locked for %v", lock)
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	ioutil.WriteFile("breached_test.txt", []byte("hunter2\r\n\n5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:3861493\n"), 0644)
+	defer os.Remove("breached_test.txt")
+	breached, err := LoadBreachedPasswords("breached_test.txt")
+	if err != nil {
+		t.Error(err)
+	}
+	if _, err := LoadBreachedPasswords("nonexistent.txt"); err == nil {
+		t.Error("Loaded breached passwords from a file that doesn't exist")
+	}
+	policy := PasswordPolicy{
+		MinLength:        8,
+		MaxLength:        16,
+		RequireUpper:     true,
+		RequireLower:     true,
+		RequireDigit:     true,
+		RequireSymbol:    true,
+		DisallowUserInfo: true,
+		Breached:         breached,
+	}
+
+	expected := map[string]string{
+		"Ab1!":                 "too_short",
+		"Abcdefgh1!Abcdefgh1!": "too_long",
+		"abcdefg1!":            "missing_upper",
+		"ABCDEFG1!":            "missing_lower",
+		"Abcdefgh!":            "missing_digit",
+		"Abcdefgh1":            "missing_symbol",
+		"My-username1":         "contains_username",
+		"Jane.Doe-99":          "contains_email",
+		"hunter2":              "breached",
+		"password":             "breached",
+		"Good-Passw0rd":        "",
+	}
+	for password, code := range expected {
+		err := policy.Check(password, "jane.doe@email.com", "username")
+		found := violationCodes(err)
+		if code == "" {
+			if err != nil {
+				t.Errorf("%s was rejected: %v", password, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrPasswordPolicy) || !strings.Contains(strings.Join(found, ","), code) {
+			t.Errorf("%s should be rejected for %s, got %v", password, code, found)
+		}
+	}
+	if err := (PasswordPolicy{}).Check("", "", ""); err != nil {
+		t.Errorf("Zero policy rejected a password: %v", err)
+	}
+	// Generated passwords meet the policy, or fail when it can't be met.
+	for i := 0; i < 10; i++ {
+		password, err := policy.Generate("jane.doe@email.com", "username")
+		if err != nil || policy.Check(password, "jane.doe@email.com", "username") != nil || len(password) != 16 {
+			t.Errorf("Generated %s, %v", password, err)
+		}
+	}
+	if password, err := (PasswordPolicy{MinLength: 40}).Generate("", ""); err != nil || len(password) != 40 {
+		t.Errorf("Generated %s, %v for a 40 character minimum", password, err)
+	}
+	if _, err := (PasswordPolicy{MaxLength: 2, RequireUpper: true, RequireLower: true, RequireDigit: true}).Generate("", ""); !errors.Is(err, ErrPasswordPolicy) {
+		t.Errorf("Generated a password for a policy that can't be met: %v", err)
+	}
+	// Registration and password changes both enforce the policy.
+	svc := NewService(NewMemoryStore())
+	svc.Hashing = fastHashPolicy("argon2id")
+	svc.Passwords = PasswordPolicy{MinLength: 8}
+	if err := svc.RegisterUser("user@email.com", "username", "short", nil); !errors.Is(err, ErrPasswordPolicy) {
+		t.Errorf("Registration with a short password returned %v", err)
+	}
+	if entries, _ := svc.Entries(); entries != 0 {
+		t.Error("Rejected registration added a user")
+	}
+	if err := svc.RegisterUser("user@email.com", "username", "longpassword", nil); err != nil {
+		t.Error(err)
+	}
+	if err := svc.ChangeUserPassword("username", "longpassword", "short"); !errors.Is(err, ErrPasswordPolicy) {
+		t.Errorf("Password change to a short password returned %v", err)
+	}
+}
+
+// violationCodes lists the codes of the violations in a *PasswordPolicyError.
+func violationCodes(err error) []string {
+	var policyErr *PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		return nil
+	}
+	out := make([]string, len(policyErr.Violations))
+	for i, violation := range policyErr.Violations {
+		out[i] = violation.Code
+	}
+	return out
+}
+
+// Recent passwords, including the current one, can't be reused; older ones can.
+func TestPasswordHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbStore, err := OpenDB(DBOptions{DSN: dir + "/history.db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, store := range map[string]Store{"memory": NewMemoryStore(), "sqlite": dbStore} {
+		svc := NewService(store)
+		svc.Hashing = fastHashPolicy("argon2id")
+		svc.PasswordHistory = 2
+		if err := svc.RegisterUser("user@email.com", "username", "password0", nil); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := svc.ChangeUserPassword("username", "password0", "password0"); !errors.Is(err, ErrPasswordPolicy) {
+			t.Errorf("%s: changing to the current password returned %v", name, err)
+		}
+		for i, password := range []string{"password1", "password2", "password3"} {
+			if err := svc.ChangeUserPassword("username", fmt.Sprintf("password%d", i), password); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+		}
+		// History holds password2 and password1; password0 has been forgotten.
+		for _, password := range []string{"password2", "password1"} {
+			err := svc.ChangeUserPassword("username", "password3", password)
+			if found := violationCodes(err); len(found) != 1 || found[0] != "reused" {
+				t.Errorf("%s: reusing %s returned %v", name, password, err)
+			}
+		}
+		if err := svc.ChangeUserPassword("username", "password3", "password0"); err != nil {
+			t.Errorf("%s: couldn't reuse a forgotten password: %v", name, err)
+		}
+		entry, _ := store.findUserEntryByUsername("username")
+		if history, _ := store.findPasswordHistory(entry.ID, 10); len(history) != 2 {
+			t.Errorf("%s: expected 2 remembered hashes, found %d", name, len(history))
+		}
+	}
+}
+
+func TestUserLifecycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbStore, err := OpenDB(DBOptions{DSN: dir + "/lifecycle.db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, store := range map[string]Store{"memory": NewMemoryStore(), "sqlite": dbStore} {
+		svc := NewService(store)
+		svc.Hashing = fastHashPolicy("argon2id")
+		if err := svc.RegisterUser("user@email.com", "username", "password", nil); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if user, _ := svc.FindUserByUsername("username"); user.Status != StatusActive {
+			t.Errorf("%s: new user has status %q", name, user.Status)
+		}
+		// Disabled users are only told so once their password is checked.
+		if err := svc.DisableUser("username"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if _, _, err := svc.ValidateUserCred("username", "wrongpassword"); err != ErrInvalidCredentials {
+			t.Errorf("%s: wrong password for a disabled user returned %v", name, err)
+		}
+		if valid, _, err := svc.ValidateUserCred("username", "password"); valid || err != ErrUserDisabled {
+			t.Errorf("%s: disabled user validated (%v)", name, err)
+		}
+		if err := svc.CheckUserStatus("user@email.com"); err != ErrUserDisabled {
+			t.Errorf("%s: CheckUserStatus for a disabled user returned %v", name, err)
+		}
+		if err := svc.EnableUser("username"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if valid, _, err := svc.ValidateUserCred("username", "password"); !valid {
+			t.Errorf("%s: re-enabled user didn't validate (%v)", name, err)
+		}
+		// Deleted users look like they don't exist, but keep their names until purged.
+		if err := svc.DeleteUser("username"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if _, _, err := svc.ValidateUserCred("username", "password"); err != ErrInvalidCredentials {
+			t.Errorf("%s: deleted user validation returned %v", name, err)
+		}
+		if err := svc.CheckUserStatus("username"); err != ErrUserDeleted {
+			t.Errorf("%s: CheckUserStatus for a deleted user returned %v", name, err)
+		}
+		if err := svc.EnableUser("username"); err == nil {
+			t.Errorf("%s: enabled a deleted user", name)
+		}
+		if err := svc.RegisterUser("user@email.com", "other", "password", nil); err == nil {
+			t.Errorf("%s: registered over a deleted user's email", name)
+		}
+		if err := svc.RestoreUser("username"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if valid, _, err := svc.ValidateUserCred("username", "password"); !valid {
+			t.Errorf("%s: restored user didn't validate (%v)", name, err)
+		}
+		// Past the restore window, deleted users are purged when next read.
+		svc.DeleteUser("username")
+		svc.RestoreWindow = 0
+		if err := svc.RestoreUser("username"); err != ErrRestoreExpired {
+			t.Errorf("%s: restoring past the window returned %v", name, err)
+		}
+		if err := svc.RegisterUser("user@email.com", "username", "password", nil); err != nil {
+			t.Errorf("%s: couldn't reuse an expired user's names: %v", name, err)
+		}
+		if err := svc.PurgeUser("username"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if entries, _ := svc.Entries(); entries != 0 {
+			t.Errorf("%s: %d entries left after purge", name, entries)
+		}
+		if err := svc.CheckUserStatus("username"); err != nil {
+			t.Errorf("%s: CheckUserStatus for a purged user returned %v", name, err)
+		}
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+	svc := NewService(NewMemoryStore())
+	svc.Hashing = fastHashPolicy("argon2id")
+	if err := svc.RegisterUser("user@email.com", "username", "password", nil); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := svc.FindUserByEmail("user@email.com"); user.EmailVerified {
+		t.Error("New user's email is already verified")
+	}
+	if err := svc.VerifyEmail("other@email.com"); err == nil {
+		t.Error("Verified an email with no user")
+	}
+	before := time.Now()
+	if err := svc.VerifyEmail("user@email.com"); err != nil {
+		t.Error(err)
+	}
+	entry, _ := svc.findUserEntryByEmail("user@email.com")
+	if !entry.EmailVerified || entry.EmailVerifiedAt.Before(before) {
+		t.Errorf("Email verification wasn't recorded: %v at %v", entry.EmailVerified, entry.EmailVerifiedAt)
+	}
+	if valid, user, _ := svc.ValidateUserCred("username", "password"); !valid || !user.EmailVerified {
+		t.Error("Validated user isn't shown as verified")
+	}
+}
+
+func TestResetUserPassword(t *testing.T) {
+	svc := NewService(NewMemoryStore())
+	svc.Hashing = fastHashPolicy("argon2id")
+	svc.Passwords = PasswordPolicy{MinLength: 8}
+	if err := svc.RegisterUser("user@email.com", "username", "password", nil); err != nil {
+		t.Fatal(err)
+	}
+	issued := time.Now().Add(-time.Minute)
+	if err := svc.CheckTokenIssued("username", issued); err != nil {
+		t.Errorf("Token rejected before any password change: %v", err)
+	}
+	if err := svc.ResetUserPassword("other@email.com", "newPassword"); err != ErrInvalidCredentials {
+		t.Errorf("Reset for an unregistered email returned %v", err)
+	}
+	if err := svc.ResetUserPassword("user@email.com", "short"); !errors.Is(err, ErrPasswordPolicy) {
+		t.Errorf("Reset to a short password returned %v", err)
+	}
+	// Resets unlock the account.
+	svc.Lockout = LockoutPolicy{MaxAttempts: 1, Duration: time.Hour}
+	svc.ValidateUserCred("username", "wrongpassword")
+	if err := svc.ResetUserPassword("user@email.com", "newPassword"); err != nil {
+		t.Error(err)
+	}
+	if valid, _, err := svc.ValidateUserCred("username", "newPassword"); !valid {
+		t.Errorf("Couldn't log in with the reset password: %v", err)
+	}
+	// Tokens from before the reset are revoked, by username or email.
+	for _, name := range []string{"username", "user@email.com"} {
+		if err := svc.CheckTokenIssued(name, issued); err != ErrTokenRevoked {
+			t.Errorf("Token for %s from before the reset returned %v", name, err)
+		}
+	}
+	if err := svc.CheckTokenIssued("username", time.Now().Add(time.Second)); err != nil {
+		t.Errorf("Token from after the reset returned %v", err)
+	}
+	if err := svc.CheckTokenIssued("nobody@email.com", issued); err != nil {
+		t.Errorf("Token for an unregistered email returned %v", err)
+	}
+	if err := svc.DisableUser("username"); err != nil {
+		t.Error(err)
+	}
+	if err := svc.ResetUserPassword("user@email.com", "otherPassword"); err != ErrInvalidCredentials {
+		t.Errorf("Reset for a disabled user returned %v", err)
+	}
+}
+
+func TestChangeUserEmail(t *testing.T) {
+	svc := NewService(NewMemoryStore())
+	svc.Hashing = fastHashPolicy("argon2id")
+	svc.RegisterUser("user@email.com", "username", "password", nil)
+	svc.RegisterUser("taken@email.com", "other", "password", nil)
+	if err := svc.CheckEmailAvailable("taken@email.com"); err != ErrDuplicateEmail {
+		t.Errorf("CheckEmailAvailable for a taken email returned %v", err)
+	}
+	if _, err := svc.ChangeUserEmail("username", "taken@email.com"); err != ErrDuplicateEmail {
+		t.Errorf("Changing to a taken email returned %v", err)
+	}
+	code, err := svc.ChangeUserEmail("username", "new@email.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := svc.FindUserByUsername("username"); user.Email != "new@email.com" || !user.EmailVerified {
+		t.Errorf("Email wasn't changed: %+v", user)
+	}
+	if user, _ := svc.FindUserByEmail("user@email.com"); !user.Empty() {
+		t.Error("Old email still finds the user")
+	}
+	// While the change can be reverted, no further change can replace the revert code.
+	if _, err := svc.ChangeUserEmail("username", "third@email.com"); err != ErrEmailChangePending {
+		t.Errorf("Second change in the revert window returned %v", err)
+	}
+	if err := svc.CheckEmailChange("username", "third@email.com"); err != ErrEmailChangePending {
+		t.Errorf("CheckEmailChange in the revert window returned %v", err)
+	}
+	if err := svc.RevertUserEmail("username", "wrongcode"); err != ErrInvalidRevert {
+		t.Errorf("Revert with a wrong code returned %v", err)
+	}
+	issued := time.Now().Add(-time.Minute)
+	if err := svc.RevertUserEmail("username", code); err != nil {
+		t.Error(err)
+	}
+	if user, _ := svc.FindUserByUsername("username"); user.Email != "user@email.com" {
+		t.Errorf("Email wasn't reverted; it's %s", user.Email)
+	}
+	if err := svc.CheckTokenIssued("username", issued); err != ErrTokenRevoked {
+		t.Errorf("Token from before the revert returned %v", err)
+	}
+	if err := svc.RevertUserEmail("username", code); err != ErrInvalidRevert {
+		t.Errorf("Reusing a revert code returned %v", err)
+	}
+	// Revert codes expire.
+	svc.EmailRevertWindow = -time.Second
+	code, _ = svc.ChangeUserEmail("username", "new@email.com")
+	if err := svc.RevertUserEmail("username", code); err != ErrInvalidRevert {
+		t.Errorf("Revert with an expired code returned %v", err)
+	}
+	if _, err := svc.ChangeUserEmail("username", "third@email.com"); err != nil {
+		t.Errorf("Change after the revert window returned %v", err)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbStore, err := OpenDB(DBOptions{DSN: dir + "/roles.db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, store := range map[string]Store{"memory": NewMemoryStore(), "sqlite": dbStore} {
+		svc := NewService(store)
+		svc.Hashing = fastHashPolicy("argon2id")
+		svc.RegisterUser("user@email.com", "username", "password", map[string]bool{"own": true})
+		svc.CreateRole("viewer", map[string]bool{"read": true})
+		svc.CreateRole("editor", map[string]bool{"write": true, "delete": false})
+		svc.CreateRole("admin", map[string]bool{"delete": true})
+		if err := svc.CreateRole("viewer", nil); err == nil {
+			t.Errorf("%s: created a duplicate role", name)
+		}
+		if err := svc.IncludeRole("editor", "viewer"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if err := svc.IncludeRole("viewer", "editor"); err != ErrRoleCycle {
+			t.Errorf("%s: cyclic include returned %v", name, err)
+		}
+		if err := svc.GrantRole("username", "editor"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if err := svc.GrantRole("username", "missing"); !errors.Is(err, ErrRoleNotFound) {
+			t.Errorf("%s: granting a missing role returned %v", name, err)
+		}
+		svc.GrantRole("username", "admin")
+		// Effective permissions merge the user's own with every role's; denies win.
+		_, user, err := svc.ValidateUserCred("username", "password")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		expected := map[string]bool{"own": true, "read": true, "write": true, "delete": false}
+		if len(user.Permissions) != len(expected) {
+			t.Errorf("%s: effective permissions are %v", name, user.Permissions)
+		}
+		for perm, value := range expected {
+			if granted, ok := user.Permissions[perm]; !ok || granted != value {
+				t.Errorf("%s: permission %s is %v, expected %v", name, perm, granted, value)
+			}
+		}
+		if strings.Join(user.Roles, ",") != "admin,editor" {
+			t.Errorf("%s: user roles are %v", name, user.Roles)
+		}
+		// Changing a role changes every user that has it.
+		svc.ChangeRolePermissions("viewer", map[string]bool{"comment": true})
+		if user, _ := svc.FindUserByUsername("username"); !user.Permissions["comment"] {
+			t.Errorf("%s: role change didn't reach the user: %v", name, user.Permissions)
+		}
+		if role, _ := svc.FindRole("editor"); strings.Join(role.Includes, ",") != "viewer" {
+			t.Errorf("%s: editor includes %v", name, role.Includes)
+		}
+		svc.ExcludeRole("editor", "viewer")
+		svc.RevokeRole("username", "admin")
+		if user, _ := svc.FindUserByUsername("username"); user.Permissions["read"] || strings.Join(user.Roles, ",") != "editor" {
+			t.Errorf("%s: exclude and revoke left %v with roles %v", name, user.Permissions, user.Roles)
+		}
+		if err := svc.DeleteRole("editor"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if user, _ := svc.FindUserByUsername("username"); user.Permissions["write"] || len(user.Roles) != 0 {
+			t.Errorf("%s: deleted role still applies: %v", name, user.Permissions)
+		}
+	}
+}
+
+func TestApplications(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbStore, err := OpenDB(DBOptions{DSN: dir + "/apps.db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, store := range map[string]Store{"memory": NewMemoryStore(), "sqlite": dbStore} {
+		svc := NewService(store)
+		svc.Hashing = fastHashPolicy("argon2id")
+		svc.RegisterUser("old@email.com", "old", "password", nil)
+		// Keys from before applications belong to the api pseudo-user, and are refused until they're adopted.
+		svc.RegisterUser("nil", "api", "legacy-key", map[string]bool{"apikey": true})
+		if legacy, err := svc.HasLegacyAPIKey(); err != nil || !legacy {
+			t.Errorf("%s: api pseudo-user not found: %v", name, err)
+		}
+		if _, err := svc.AdoptLegacyAPIKey("legacy-key", "", APIKeyOptions{}); !errors.Is(err, ErrApplicationNotFound) {
+			t.Errorf("%s: legacy key adopted with no applications: %v", name, err)
+		}
+		if err := svc.CreateApplication("shop", "", ApplicationSettings{TokenValidTime: 5}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := svc.CreateApplication("shop", "", ApplicationSettings{}); err == nil {
+			t.Errorf("%s: created a duplicate application", name)
+		}
+		svc.CreateApplication("blog", "https://blog.example.com", ApplicationSettings{})
+		if valid, _, _ := svc.ValidateUserCred("api", "legacy-key"); valid {
+			t.Errorf("%s: logged in as the api pseudo-user", name)
+		}
+		if _, err := svc.ResolveAPIKey("legacy-key"); !errors.Is(err, ErrInvalidAPIKey) {
+			t.Errorf("%s: legacy key resolved before it was adopted: %v", name, err)
+		}
+		if _, err := svc.AdoptLegacyAPIKey("wrong-key", "blog", APIKeyOptions{}); !errors.Is(err, ErrInvalidAPIKey) {
+			t.Errorf("%s: adopted the wrong legacy key: %v", name, err)
+		}
+		adopted, err := svc.AdoptLegacyAPIKey("legacy-key", "blog", APIKeyOptions{Scopes: []string{"login"}})
+		if err != nil || adopted.Application != "blog" || adopted.Name != "legacy" {
+			t.Errorf("%s: legacy key adopted as %+v, %v", name, adopted, err)
+		}
+		// Once adopted, the legacy key is an ordinary API key, and the pseudo-user is gone.
+		if user, _ := svc.FindUserByUsername("api"); !user.Empty() {
+			t.Errorf("%s: api pseudo-user wasn't removed", name)
+		}
+		if legacy, _ := svc.HasLegacyAPIKey(); legacy {
+			t.Errorf("%s: api pseudo-user still reported", name)
+		}
+		if _, err := svc.AdoptLegacyAPIKey("legacy-key", "blog", APIKeyOptions{}); !errors.Is(err, ErrInvalidAPIKey) {
+			t.Errorf("%s: legacy key adopted twice: %v", name, err)
+		}
+		if info, app, err := svc.AuthenticateAPIKey("legacy-key"); err != nil || app.Name != "blog" || info.Allows("register") || !info.Allows("login") {
+			t.Errorf("%s: adopted legacy key resolved to %+v, %v, %v", name, info, app, err)
+		}
+		// The first application adopts existing users; later ones start empty.
+		if member, _ := svc.IsMember("shop", "old"); !member {
+			t.Errorf("%s: existing user isn't a member of the first application", name)
+		}
+		if member, _ := svc.IsMember("blog", "old"); member {
+			t.Errorf("%s: existing user is a member of a later application", name)
+		}
+		key, _, err := svc.CreateAPIKey("blog", APIKeyOptions{})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		app, err := svc.ResolveAPIKey(key)
+		if err != nil || app.Name != "blog" || app.Audience != "https://blog.example.com" {
+			t.Errorf("%s: key resolved to %v, %v", name, app, err)
+		}
+		if _, err := svc.ResolveAPIKey("wrong"); !errors.Is(err, ErrInvalidAPIKey) {
+			t.Errorf("%s: wrong key returned %v", name, err)
+		}
+		if _, _, err := svc.CreateAPIKey("missing", APIKeyOptions{}); !errors.Is(err, ErrApplicationNotFound) {
+			t.Errorf("%s: key for a missing application returned %v", name, err)
+		}
+		// Registering through an application makes the user a member, and leaves nothing behind if it can't.
+		if err := svc.RegisterMember("blog", "joined@email.com", "joined", "password", nil); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if member, _ := svc.IsMember("blog", "joined"); !member {
+			t.Errorf("%s: registered member isn't a member", name)
+		}
+		if err := svc.RegisterMember("missing", "lost@email.com", "lost", "password", nil); !errors.Is(err, ErrApplicationNotFound) {
+			t.Errorf("%s: registration in a missing application returned %v", name, err)
+		}
+		failing := NewService(&membershipFailure{Store: store})
+		failing.Hashing = fastHashPolicy("argon2id")
+		if err := failing.RegisterMember("blog", "lost@email.com", "lost", "password", nil); err == nil {
+			t.Errorf("%s: registration succeeded without a membership", name)
+		}
+		if user, _ := svc.FindUserByUsername("lost"); !user.Empty() {
+			t.Errorf("%s: registration without a membership left the user behind", name)
+		}
+		// Memberships, by username or email.
+		svc.RegisterUser("new@email.com", "new", "password", nil)
+		if err := svc.AddMember("blog", "new@email.com"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		svc.AddMember("blog", "new")
+		if member, _ := svc.IsMember("blog", "new"); !member {
+			t.Errorf("%s: added member isn't a member", name)
+		}
+		if member, err := svc.IsMember("blog", "nobody"); member || err != nil {
+			t.Errorf("%s: missing user membership is %v, %v", name, member, err)
+		}
+		if err := svc.CheckMember("blog", "new@email.com"); err != nil {
+			t.Errorf("%s: member failed membership check: %v", name, err)
+		}
+		svc.RemoveMember("blog", "new")
+		if member, _ := svc.IsMember("blog", "new"); member {
+			t.Errorf("%s: removed member is still a member", name)
+		}
+		// Keys and codes held by removed members stop working; emails that never registered keep working.
+		for _, user := range []string{"new", "new@email.com"} {
+			if err := svc.CheckMember("blog", user); !errors.Is(err, ErrNotMember) {
+				t.Errorf("%s: removed member %s passed membership check: %v", name, user, err)
+			}
+		}
+		if err := svc.CheckMember("blog", "nobody@email.com"); err != nil {
+			t.Errorf("%s: unregistered email failed membership check: %v", name, err)
+		}
+		if err := svc.CheckMember("missing", "new"); !errors.Is(err, ErrApplicationNotFound) {
+			t.Errorf("%s: membership check in a missing application returned %v", name, err)
+		}
+		// Settings.
+		svc.ChangeApplicationSettings("blog", ApplicationSettings{RequireVerifiedEmail: "login"})
+		if app, _ := svc.FindApplication("blog"); app.Settings.RequireVerifiedEmail != "login" {
+			t.Errorf("%s: settings are %v", name, app.Settings)
+		}
+		if apps, _ := svc.ListApplications(); len(apps) != 2 || apps[0].Name != "shop" || apps[0].Settings.TokenValidTime != 5 {
+			t.Errorf("%s: applications are %v", name, apps)
+		}
+	}
+}
+
+// membershipFailure is a Store that can't add memberships.
+type membershipFailure struct {
+	Store
+}
+
+func (membershipFailure) addMembership(in *membershipEntry) error {
+	return fmt.Errorf("addMembership failed; store is read-only")
+}
+
+func TestAPIKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbStore, err := OpenDB(DBOptions{DSN: dir + "/keys.db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, store := range map[string]Store{"memory": NewMemoryStore(), "sqlite": dbStore} {
+		svc := NewService(store)
+		svc.CreateApplication("shop", "", ApplicationSettings{})
+		opts := APIKeyOptions{Name: "frontend", Scopes: []string{"login", " register"}, ExpiresAt: time.Now().Add(time.Hour)}
+		key, info, err := svc.CreateAPIKey("shop", opts)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !strings.HasPrefix(key, info.Prefix+".") || info.Status != APIKeyActive || info.Name != "frontend" {
+			t.Errorf("%s: created key %s with %+v", name, key, info)
+		}
+		if _, _, err := svc.CreateAPIKey("shop", APIKeyOptions{ExpiresAt: time.Now().Add(-time.Hour)}); err == nil {
+			t.Errorf("%s: created an expired key", name)
+		}
+		// Keys carry their scopes, and record their last use.
+		used, app, err := svc.AuthenticateAPIKey(key)
+		if err != nil || app.Name != "shop" {
+			t.Fatalf("%s: key authenticated to %v, %v", name, app, err)
+		}
+		if !used.Allows("login") || !used.Allows("register") || used.Allows("profile") {
+			t.Errorf("%s: key scopes are %v", name, used.Scopes)
+		}
+		if keys, _ := svc.ListAPIKeys("shop"); len(keys) != 1 || keys[0].LastUsed.IsZero() {
+			t.Errorf("%s: listed %+v", name, keys)
+		}
+		if !(APIKey{}).Allows("profile") {
+			t.Errorf("%s: a key without scopes doesn't allow every endpoint", name)
+		}
+		// Rotating with a grace period keeps the old key working until it ends; without one, it's revoked at once.
+		rotated, rotatedInfo, err := svc.RotateAPIKey(info.Prefix, time.Minute)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if rotatedInfo.Name != "frontend" || len(rotatedInfo.Scopes) != 2 || rotatedInfo.Expires.IsZero() {
+			t.Errorf("%s: rotated key is %+v", name, rotatedInfo)
+		}
+		if _, err := svc.ResolveAPIKey(key); err != nil {
+			t.Errorf("%s: old key stopped working during its grace period: %v", name, err)
+		}
+		if _, err := svc.ResolveAPIKey(rotated); err != nil {
+			t.Errorf("%s: rotated key doesn't work: %v", name, err)
+		}
+		again, _, err := svc.RotateAPIKey(rotatedInfo.Prefix, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := svc.ResolveAPIKey(rotated); !errors.Is(err, ErrInvalidAPIKey) {
+			t.Errorf("%s: key rotated without a grace period returned %v", name, err)
+		}
+		if _, _, err := svc.RotateAPIKey(rotatedInfo.Prefix, 0); err == nil {
+			t.Errorf("%s: rotated a revoked key", name)
+		}
+		// Revoked and expired keys are refused, but still listed.
+		if err := svc.RevokeAPIKey(info.Prefix); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if _, err := svc.ResolveAPIKey(key); !errors.Is(err, ErrInvalidAPIKey) {
+			t.Errorf("%s: revoked key returned %v", name, err)
+		}
+		if _, err := svc.ResolveAPIKey(again); err != nil {
+			t.Errorf("%s: revoking one key stopped another: %v", name, err)
+		}
+		entry, _ := store.findAPIKeyByHash(hashAPIKey(again))
+		entry.ExpiresAt = time.Now().Add(-time.Second)
+		store.updateAPIKey(&entry)
+		if _, err := svc.ResolveAPIKey(again); !errors.Is(err, ErrInvalidAPIKey) {
+			t.Errorf("%s: expired key returned %v", name, err)
+		}
+		keys, _ := svc.ListAPIKeys("shop")
+		statuses := make([]string, len(keys))
+		for i, k := range keys {
+			statuses[i] = k.Status
+		}
+		if strings.Join(statuses, ",") != "revoked,revoked,expired" {
+			t.Errorf("%s: key statuses are %v", name, statuses)
+		}
+		if err := svc.RevokeAPIKey("gk_missing"); !errors.Is(err, ErrAPIKeyNotFound) {
+			t.Errorf("%s: revoking a missing key returned %v", name, err)
+		}
+	}
+}
+
+func TestChangeUserProfile(t *testing.T) {
+	svc := NewService(NewMemoryStore())
+	svc.Hashing = fastHashPolicy("argon2id")
+	svc.RegisterUser("user@email.com", "username", "password", nil)
+	name, locale, avatar := "User Name", "en-us", "https://example.com/avatar.png"
+	err := svc.ChangeUserProfile("username", ProfileChange{
+		DisplayName: &name,
+		Locale:      &locale,
+		AvatarURL:   &avatar,
+		Attributes:  map[string]interface{}{"plan": "pro", "seats": 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, _ := svc.FindUserByUsername("username")
+	if user.DisplayName != name || user.Locale != "en-US" || user.AvatarURL != avatar {
+		t.Errorf("Profile is %q, %q, %q", user.DisplayName, user.Locale, user.AvatarURL)
+	}
+	if user.Attributes["plan"] != "pro" || user.Attributes["seats"] != float64(3) {
+		t.Errorf("Attributes are %v", user.Attributes)
+	}
+	// Attributes merge, and null removes one; unset fields are unchanged.
+	svc.ChangeUserProfile("username", ProfileChange{Attributes: map[string]interface{}{"seats": nil, "team": "blue"}})
+	user, _ = svc.FindUserByUsername("username")
+	if _, ok := user.Attributes["seats"]; ok || user.Attributes["plan"] != "pro" || user.Attributes["team"] != "blue" {
+		t.Errorf("Merged attributes are %v", user.Attributes)
+	}
+	if user.DisplayName != name {
+		t.Errorf("Unset display name changed to %q", user.DisplayName)
+	}
+	// Invalid values change nothing.
+	badLocale, badAvatar := "not a locale!", "javascript:alert(1)"
+	for _, change := range []ProfileChange{
+		{Locale: &badLocale},
+		{AvatarURL: &badAvatar},
+		{DisplayName: &badLocale, Attributes: map[string]interface{}{"big": strings.Repeat("a", MaxAttributesSize)}},
+	} {
+		if err := svc.ChangeUserProfile("username", change); !errors.Is(err, ErrInvalidProfile) {
+			t.Errorf("Invalid change %+v returned %v", change, err)
+		}
+	}
+	if user, _ := svc.FindUserByUsername("username"); user.DisplayName != name {
+		t.Errorf("Rejected change set display name to %q", user.DisplayName)
+	}
+	if err := svc.ChangeUserProfile("missing", ProfileChange{DisplayName: &name}); err == nil {
+		t.Error("Changed the profile of a missing user")
+	}
+	// Claims include only the named, set fields and attributes.
+	claims := ProfileClaims(user, []string{ClaimDisplayName, ClaimAvatarURL, "plan", "missing"})
+	if len(claims) != 3 || claims[ClaimDisplayName] != name || claims["plan"] != "pro" {
+		t.Errorf("Claims are %v", claims)
+	}
+	if claims := ProfileClaims(user, nil); claims != nil {
+		t.Errorf("No claims requested, got %v", claims)
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbStore, err := OpenDB(DBOptions{DSN: dir + "/list.db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	for name, store := range map[string]Store{"memory": NewMemoryStore(), "sqlite": dbStore} {
+		svc := NewService(store)
+		svc.Hashing = fastHashPolicy("argon2id")
+		// Usernames in reverse order of creation, so each sort gives a different order.
+		usernames := []string{"gina", "fred", "erin", "dave", "carl", "bob", "alice"}
+		for i, username := range usernames {
+			svc.RegisterUser(map[bool]string{true: "a.", false: "b."}[i%2 == 0]+username+"@email.com", username, "password", nil)
+			entry, _ := svc.findUserEntryByUsername(username)
+			entry.CreatedAt = start.Add(time.Duration(i) * time.Hour)
+			store.updateUser(&entry)
+		}
+		svc.CreateRole("staff", map[string]bool{"billing:*": true})
+		svc.GrantRole("carl", "staff")
+		svc.CreateRole("manager", nil)
+		svc.IncludeRole("manager", "staff")
+		svc.GrantRole("dave", "manager")
+		svc.ChangeUserPermissions("erin", map[string]bool{"billing:read": true})
+		svc.DisableUser("bob")
+		// Paging through everything visits every user once, in order.
+		list := func(query UserQuery) []string {
+			names := []string{}
+			for {
+				page, err := svc.ListUsers(query)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				if len(page.Users) > query.Limit {
+					t.Fatalf("%s: page of %d users with limit %d", name, len(page.Users), query.Limit)
+				}
+				for _, user := range page.Users {
+					names = append(names, user.Username)
+				}
+				if page.NextCursor == "" {
+					return names
+				}
+				query.Cursor = page.NextCursor
+			}
+		}
+		check := func(query UserQuery, expected string) {
+			if got := strings.Join(list(query), ","); got != expected {
+				t.Errorf("%s: %+v listed %s, expected %s", name, query, got, expected)
+			}
+		}
+		check(UserQuery{Limit: 2}, "gina,fred,erin,dave,carl,bob,alice")
+		check(UserQuery{Limit: 3, SortBy: SortByUsername}, "alice,bob,carl,dave,erin,fred,gina")
+		check(UserQuery{Limit: 2, SortBy: SortByCreated, Descending: true}, "alice,bob,carl,dave,erin,fred,gina")
+		check(UserQuery{Limit: 2, SortBy: SortByEmail}, "alice,carl,erin,gina,bob,dave,fred")
+		check(UserQuery{Limit: 2, Filter: UserFilter{EmailPrefix: "b", UsernamePrefix: "d"}}, "dave")
+		check(UserQuery{Limit: 2, Filter: UserFilter{UsernamePrefix: "b", Status: StatusActive}}, "")
+		check(UserQuery{Limit: 2, Filter: UserFilter{Status: StatusDisabled}}, "bob")
+		check(UserQuery{Limit: 1, Filter: UserFilter{Permission: "billing:read"}}, "erin,dave,carl")
+		check(UserQuery{Limit: 2, Filter: UserFilter{
+			CreatedAfter:  start.Add(time.Hour),
+			CreatedBefore: start.Add(4 * time.Hour),
+		}}, "fred,erin,dave")
+		// Cursors only work with the sort they were made for.
+		page, _ := svc.ListUsers(UserQuery{Limit: 1})
+		if _, err := svc.ListUsers(UserQuery{Limit: 1, SortBy: SortByUsername, Cursor: page.NextCursor}); err != ErrInvalidCursor {
+			t.Errorf("%s: cursor for another sort returned %v", name, err)
+		}
+		if _, err := svc.ListUsers(UserQuery{Cursor: "garbage"}); err != ErrInvalidCursor {
+			t.Errorf("%s: garbage cursor returned %v", name, err)
+		}
+		if _, err := svc.ListUsers(UserQuery{SortBy: "password"}); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%s: sorted by an unknown field", name)
+		}
+		if count, _ := svc.Entries(); count != len(usernames) {
+			t.Errorf("%s: Entries is %d", name, count)
+		}
+		// Roles are read once per call, however many users have them.
+		counter := &roleReadCounter{Store: store}
+		page, err := NewService(counter).ListUsers(UserQuery{Limit: 10, SortBy: SortByUsername})
+		if err != nil || len(page.Users) != len(usernames) {
+			t.Fatalf("%s: listed %d users, %v", name, len(page.Users), err)
+		}
+		if dave := page.Users[3]; strings.Join(dave.Roles, ",") != "manager" || !HasPermission(dave, "billing:read") {
+			t.Errorf("%s: dave listed with roles %v and permissions %v", name, dave.Roles, dave.Permissions)
+		}
+		if counter.reads != 3 {
+			t.Errorf("%s: listing users made %d role reads", name, counter.reads)
+		}
+	}
+}
+
+// roleReadCounter is a Store that counts the role reads made through it.
+type roleReadCounter struct {
+	Store
+	reads int
+}
+
+func (c *roleReadCounter) listRoles() ([]roleEntry, error) {
+	c.reads++
+	return c.Store.listRoles()
+}
+
+func (c *roleReadCounter) findRoleByID(id uint) (roleEntry, error) {
+	c.reads++
+	return c.Store.findRoleByID(id)
+}
+
+func (c *roleReadCounter) findRoleBindings(userID uint) ([]roleBinding, error) {
+	c.reads++
+	return c.Store.findRoleBindings(userID)
+}
+
+func (c *roleReadCounter) findRoleBindingsForUsers(userIDs []uint) ([]roleBinding, error) {
+	c.reads++
+	return c.Store.findRoleBindingsForUsers(userIDs)
+}
+
+func (c *roleReadCounter) findRoleIncludes(roleID uint) ([]roleInclude, error) {
+	c.reads++
+	return c.Store.findRoleIncludes(roleID)
+}
+
+func (c *roleReadCounter) listRoleIncludes() ([]roleInclude, error) {
+	c.reads++
+	return c.Store.listRoleIncludes()
+}
+
+func TestDuplicateUsers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sqliteStore, err := OpenDB(DBOptions{DSN: dir + "/duplicates.db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, store := range map[string]Store{"memory": NewMemoryStore(), "sqlite": sqliteStore} {
+		svc := NewService(store)
+		svc.Hashing = fastHashPolicy("argon2id")
+		if err := svc.RegisterUser("Fred@Email.com", "fred", "password", nil); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		// Emails are case-folded and usernames NFKC-normalized.
+		if err := svc.RegisterUser("fred@EMAIL.com", "other", "password", nil); !errors.Is(err, ErrDuplicateEmail) {
+			t.Errorf("%s: Registering a case variant of an email returned %v", name, err)
+		}
+		if err := svc.RegisterUser("other@email.com", "ｆｒｅｄ", "password", nil); !errors.Is(err, ErrDuplicateUsername) {
+			t.Errorf("%s: Registering a fullwidth variant of a username returned %v", name, err)
+		}
+		if err := svc.RegisterUser("other@email.com", "Fred", "password", nil); err != nil {
+			t.Errorf("%s: Usernames differing by case should be distinct: %v", name, err)
+		}
+		if user, err := svc.FindUserByEmail("FRED@email.com"); err != nil || user.Username != "fred" || user.Email != "Fred@Email.com" {
+			t.Errorf("%s: Finding by a case variant of an email returned %+v, %v", name, user, err)
+		}
+		if valid, _, err := svc.ValidateUserCred("ｆｒｅｄ", "password"); !valid {
+			t.Errorf("%s: Couldn't sign in with a fullwidth variant of a username: %v", name, err)
+		}
+		// Stores enforce uniqueness themselves, whatever the caller checked.
+		entry := userEntry{Email: "FRED@EMAIL.COM", Username: "someone"}
+		var duplicate *DuplicateError
+		if err := store.addUser(&entry); !errors.As(err, &duplicate) || duplicate.Field != FieldEmail {
+			t.Errorf("%s: Adding a duplicate email returned %v", name, err)
+		}
+		entry, _ = svc.findUserEntryByUsername("Fred")
+		entry.Username = "fred"
+		if err := store.updateUser(&entry); !errors.As(err, &duplicate) || duplicate.Field != FieldUsername {
+			t.Errorf("%s: Changing to a duplicate username returned %v", name, err)
+		}
+		// Of concurrent registrations for the same user, exactly one succeeds.
+		const racers = 8
+		errs := make(chan error, racers)
+		for i := 0; i < racers; i++ {
+			go func(i int) {
+				errs <- svc.RegisterUser("Racer@Email.com", fmt.Sprintf("racer%d", i), "password", nil)
+			}(i)
+		}
+		succeeded := 0
+		for i := 0; i < racers; i++ {
+			if err := <-errs; err == nil {
+				succeeded++
+			} else if !errors.Is(err, ErrDuplicateEmail) {
+				t.Errorf("%s: Concurrent registration returned %v", name, err)
+			}
+		}
+		if succeeded != 1 {
+			t.Errorf("%s: %d concurrent registrations succeeded", name, succeeded)
+		}
+	}
+	// The unique indexes catch inserts that get past the check.
+	err = sqliteStore.(*dbStore).db.Create(&userEntry{Email: "x@email.com", Username: "x", UsernameKey: "fred"}).Error
+	if !errors.Is(translateDuplicate(err), ErrDuplicateUsername) {
+		t.Errorf("Inserting a duplicate username key returned %v", err)
+	}
+}
+
+func TestFieldEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dsn := dir + "/encrypted.db"
+	// A user from before encryption was turned on.
+	plainStore, err := OpenDB(DBOptions{DSN: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(plainStore)
+	svc.Hashing = fastHashPolicy("argon2id")
+	svc.RegisterUser("old@email.com", "old", "password", nil)
+	closeGorm(plainStore.(*dbStore).db)
+
+	indexKey := []byte(strings.Repeat("i", EncryptionKeySize))
+	key1, key2 := []byte(strings.Repeat("1", EncryptionKeySize)), []byte(strings.Repeat("2", EncryptionKeySize))
+	enc := &FieldEncryption{Keys: map[string][]byte{"1": key1}, PrimaryKey: "1", IndexKey: indexKey}
+	if _, err := OpenDB(DBOptions{DSN: dsn, Encryption: &FieldEncryption{Keys: map[string][]byte{"1": key1[:16]}}}); !errors.Is(err, ErrEncryptionKey) {
+		t.Errorf("Opening with a short key returned %v", err)
+	}
+	if _, err := OpenDB(DBOptions{DSN: dsn, Encryption: &FieldEncryption{Keys: enc.Keys, PrimaryKey: "1"}}); !errors.Is(err, ErrEncryptionKey) {
+		t.Errorf("Opening without an index key returned %v", err)
+	}
+	store, err := OpenDB(DBOptions{DSN: dsn, Encryption: enc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc = NewService(store)
+	svc.Hashing = fastHashPolicy("argon2id")
+	if err := svc.RegisterUser("Fred@Email.com", "fred", "password", nil); err != nil {
+		t.Fatal(err)
+	}
+	name, attributes := "Fred Smith", map[string]interface{}{"plan": "pro"}
+	if err := svc.ChangeUserProfile("fred", ProfileChange{DisplayName: &name, Attributes: attributes}); err != nil {
+		t.Fatal(err)
+	}
+	// Personal data is only stored encrypted, but reads as before.
+	var raw userEntry
+	store.(*dbStore).db.Where("username = ?", "fred").First(&raw)
+	for column, value := range raw.encryptedFields() {
+		if *value != "" && !strings.HasPrefix(*value, encryptedPrefix+"1$") {
+			t.Errorf("%s is stored as %q", column, *value)
+		}
+	}
+	if !strings.HasPrefix(raw.EmailKey, blindIndexPrefix) || strings.Contains(raw.EmailKey, "fred") {
+		t.Errorf("Email key is stored as %q", raw.EmailKey)
+	}
+	if user, err := svc.FindUserByEmail("FRED@email.com"); err != nil || user.Email != "Fred@Email.com" || user.DisplayName != name || user.Attributes["plan"] != "pro" {
+		t.Errorf("Finding an encrypted user by email returned %+v, %v", user, err)
+	}
+	if user, err := svc.FindUserByEmail("old@email.com"); err != nil || user.Username != "old" {
+		t.Errorf("Finding a user stored before encryption returned %+v, %v", user, err)
+	}
+	if err := svc.RegisterUser("fred@EMAIL.com", "other", "password", nil); !errors.Is(err, ErrDuplicateEmail) {
+		t.Errorf("Registering a duplicate encrypted email returned %v", err)
+	}
+	if _, err := svc.ListUsers(UserQuery{Filter: UserFilter{EmailPrefix: "fred"}}); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("Listing by email prefix returned %v", err)
+	}
+	if page, err := svc.ListUsers(UserQuery{}); err != nil || len(page.Users) != 2 || page.Users[1].Email != "Fred@Email.com" {
+		t.Errorf("Listing encrypted users returned %+v, %v", page, err)
+	}
+	if _, err := OpenDB(DBOptions{DSN: dsn}); !errors.Is(err, ErrEncryptionKey) {
+		t.Errorf("Opening an encrypted database without keys returned %v", err)
+	}
+	// Re-encrypting encrypts the old user, then moves everyone to a new key.
+	if count, err := ReencryptUsers(DBOptions{DSN: dsn, Encryption: enc}); err != nil || count != 1 {
+		t.Errorf("Encrypting existing users rewrote %d: %v", count, err)
+	}
+	enc.Keys["2"], enc.PrimaryKey = key2, "2"
+	if count, err := ReencryptUsers(DBOptions{DSN: dsn, Encryption: enc}); err != nil || count != 2 {
+		t.Errorf("Re-encrypting with a new key rewrote %d: %v", count, err)
+	}
+	if count, err := ReencryptUsers(DBOptions{DSN: dsn, Encryption: enc}); err != nil || count != 0 {
+		t.Errorf("Re-encrypting again rewrote %d: %v", count, err)
+	}
+	delete(enc.Keys, "1")
+	rotated, err := OpenDB(DBOptions{DSN: dsn, Encryption: enc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, err := NewService(rotated).FindUserByEmail("old@email.com"); err != nil || user.Username != "old" {
+		t.Errorf("Finding a user after rotation returned %+v, %v", user, err)
+	}
+	// Without a primary key, re-encrypting decrypts.
+	enc.PrimaryKey = ""
+	if count, err := ReencryptUsers(DBOptions{DSN: dsn, Encryption: enc}); err != nil || count != 2 {
+		t.Errorf("Decrypting rewrote %d: %v", count, err)
+	}
+	plainStore, err = OpenDB(DBOptions{DSN: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, err := NewService(plainStore).FindUserByEmail("fred@email.com"); err != nil || user.DisplayName != name {
+		t.Errorf("Finding a decrypted user returned %+v, %v", user, err)
+	}
+}
+
+func TestImportExportUsers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := NewService(NewMemoryStore())
+	source.Hashing = fastHashPolicy("argon2id")
+	source.CreateApplication("shop", "", ApplicationSettings{})
+	source.CreateRole("staff", map[string]bool{"billing:*": true})
+	source.RegisterUser("alice@email.com", "alice", "password", map[string]bool{"admin": true})
+	source.RegisterUser("bob@email.com", "bob", "password", nil)
+	source.GrantRole("alice", "staff")
+	source.AddMember("shop", "alice")
+	source.VerifyEmail("alice@email.com")
+	locale := "en-us"
+	source.ChangeUserProfile("bob", ProfileChange{Locale: &locale, Attributes: map[string]interface{}{"plan": "pro"}})
+	source.DisableUser("bob")
+	bcryptHash, _ := slowHash([]byte("password"), "bcrypt", hashParams{"cost": 4}, Pepper{})
+	for i, format := range []string{FormatJSON, FormatCSV} {
+		dbStore, err := OpenDB(DBOptions{DSN: fmt.Sprintf("%s/import%d.db", dir, i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, store := range map[string]Store{"memory": NewMemoryStore(), "sqlite": dbStore} {
+			name = format + "/" + name
+			var exported strings.Builder
+			if count, err := source.ExportUsers(&exported, format); err != nil || count != 2 {
+				t.Fatalf("%s: exported %d users: %v", name, count, err)
+			}
+			records, err := DecodeUserRecords(strings.NewReader(exported.String()), format)
+			if err != nil || len(records) != 2 {
+				t.Fatalf("%s: decoded %d records: %v", name, len(records), err)
+			}
+			svc := NewService(store)
+			svc.Hashing = fastHashPolicy("argon2id")
+			// Roles and applications must exist before users that reference them are imported.
+			if _, err := svc.ImportUsers(records, ImportOptions{}); !errors.Is(err, ErrImportRejected) {
+				t.Errorf("%s: imported users with missing roles: %v", name, err)
+			}
+			svc.CreateApplication("shop", "", ApplicationSettings{})
+			svc.CreateRole("staff", map[string]bool{"billing:*": true})
+			report, err := svc.ImportUsers(records, ImportOptions{DryRun: true})
+			if err != nil || report.Created != 2 {
+				t.Errorf("%s: dry run reported %+v, %v", name, report, err)
+			}
+			if count, _ := svc.Entries(); count != 0 {
+				t.Errorf("%s: dry run imported %d users", name, count)
+			}
+			if report, err := svc.ImportUsers(records, ImportOptions{}); err != nil || report.Created != 2 {
+				t.Fatalf("%s: import reported %+v, %v", name, report, err)
+			}
+			if valid, user, err := svc.ValidateUserCred("alice", "password"); !valid {
+				t.Errorf("%s: imported user couldn't log in: %v", name, err)
+			} else if !user.EmailVerified || !HasPermission(user, "admin") || !HasPermission(user, "billing:read") {
+				t.Errorf("%s: imported user is %+v", name, user)
+			}
+			if member, _ := svc.IsMember("shop", "alice"); !member {
+				t.Errorf("%s: imported user isn't a member of its application", name)
+			}
+			if bob, _ := svc.FindUserByUsername("bob"); bob.Status != StatusDisabled || bob.Locale != "en-US" || bob.Attributes["plan"] != "pro" {
+				t.Errorf("%s: imported user is %+v", name, bob)
+			}
+			// Conflicts are skipped, fail the whole import, or update the existing user.
+			if report, err := svc.ImportUsers(records, ImportOptions{}); err != nil || report.Skipped != 2 || !report.Problems[0].Conflict {
+				t.Errorf("%s: conflicting import reported %+v, %v", name, report, err)
+			}
+			records[1].PasswordHash = bcryptHash
+			records[1].Status = StatusActive
+			records = append(records, UserRecord{
+				Email:        "carol@email.com",
+				Username:     "carol",
+				PasswordHash: "$pbkdf2-sha256$i=1000$c2FsdHNhbHQ$E196ZhRPzw+wA84EjzHwJO1cv/MFJdO6C/sxmUeTYqY",
+			})
+			if report, err := svc.ImportUsers(records, ImportOptions{OnConflict: ConflictFail}); !errors.Is(err, ErrImportRejected) || report.Created != 0 {
+				t.Errorf("%s: import with conflicts under ConflictFail reported %+v, %v", name, report, err)
+			}
+			if report, err := svc.ImportUsers(records, ImportOptions{OnConflict: ConflictUpdate}); err != nil || report.Updated != 2 || report.Created != 1 {
+				t.Errorf("%s: updating import reported %+v, %v", name, report, err)
+			}
+			for _, username := range []string{"bob", "carol"} {
+				if valid, _, err := svc.ValidateUserCred(username, "password"); !valid {
+					t.Errorf("%s: %s couldn't log in with an imported hash: %v", name, username, err)
+				}
+				if entry, _ := store.findUserEntryByUsername(username); !strings.HasPrefix(entry.PasswordHash, "$argon2id$") {
+					t.Errorf("%s: imported hash wasn't upgraded on login: %s", name, entry.PasswordHash)
+				}
+			}
+			// Invalid records are reported, and nothing is imported.
+			invalid := []UserRecord{
+				{Email: "dave@email.com", Username: "dave", PasswordHash: "plaintext"},
+				{Email: "erin@email.com", Username: "erin", PasswordHash: bcryptHash, Status: "banned"},
+				{Email: "fred@email.com", Username: "fred", PasswordHash: bcryptHash},
+				{Email: "fred@email.com", Username: "fred2", PasswordHash: bcryptHash},
+			}
+			report, err = svc.ImportUsers(invalid, ImportOptions{})
+			if !errors.Is(err, ErrImportRejected) || len(report.Problems) != 3 || report.Problems[2].Record != 4 {
+				t.Errorf("%s: invalid import reported %+v, %v", name, report, err)
+			}
+			if user, _ := svc.FindUserByUsername("fred"); user.Username != "" {
+				t.Errorf("%s: rejected import added a user", name)
+			}
+		}
+	}
+	if _, err := DecodeUserRecords(strings.NewReader("email,password\n"), FormatCSV); err == nil {
+		t.Error("Decoded CSV with an unknown column")
+	}
+	if _, err := DecodeUserRecords(strings.NewReader(`[{"email": "a@email.com", "password": "x"}]`), FormatJSON); err == nil {
+		t.Error("Decoded JSON with an unknown field")
+	}
+}
+
+func TestHasPermission(t *testing.T) {
+	svc := NewService(NewMemoryStore())
+	svc.Hashing = fastHashPolicy("argon2id")
+	svc.RegisterUser("user@email.com", "username", "password", map[string]bool{"billing:invoices:delete": false})
+	svc.CreateRole("accountant", map[string]bool{"billing:*": true})
+	svc.GrantRole("username", "accountant")
+	user, _ := svc.FindUserByUsername("username")
+	for perm, allowed := range map[string]bool{
+		"billing:invoices:read":   true,
+		"billing:invoices:delete": false,
+		"reports:read":            false,
+	} {
+		if HasPermission(user, perm) != allowed {
+			t.Errorf("HasPermission(%s) should be %t", perm, allowed)
+		}
+	}
+	// A wildcard grant, directly or through a role, doesn't make a Gate admin.
+	svc.CreateRole("everything", map[string]bool{"*": true})
+	svc.GrantRole("username", "everything")
+	svc.RegisterUser("star@email.com", "star", "password", map[string]bool{"*": true})
+	for _, name := range []string{"username", "star"} {
+		if user, _ := svc.FindUserByUsername(name); !HasPermission(user, "admin") || IsAdmin(user) {
+			t.Errorf("%s: a * grant made a Gate admin", name)
+		}
+	}
+	svc.CreateRole("gate-admin", map[string]bool{"admin": true})
+	svc.GrantRole("username", "gate-admin")
+	if user, _ := svc.FindUserByUsername("username"); !IsAdmin(user) {
+		t.Error("admin role didn't make a Gate admin")
+	}
 }
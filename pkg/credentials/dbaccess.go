@@ -1,24 +1,192 @@
 package credentials
 
 import (
+	"context"
 	"fmt"
+	"time"
+	"unicode/utf8"
 
+	"github.com/pkg/errors"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 )
 
-var db *gorm.DB
+// dialectors is a map of driver names to gorm dialector creators.
+// See OpenDB for an example of usage.
+var dialectors map[string]func(dsn string) gorm.Dialector = map[string]func(dsn string) gorm.Dialector{
+	"sqlite":   sqlite.Open,
+	"postgres": postgres.Open,
+	"mysql":    mysql.Open,
+}
+
+// connectTimeout is how long OpenDB waits for the database to respond to its startup check.
+const connectTimeout time.Duration = time.Second * 5
+
+// DBOptions describes the database opened by OpenDB.
+type DBOptions struct {
+	// Driver is one of "sqlite", "postgres" or "mysql". Defaults to "sqlite".
+	Driver string
+	// DSN is the data source name passed to the driver. For sqlite, this is the path to the database file.
+	// MySQL DSNs should include parseTime=true.
+	DSN string
+	// MaxOpenConns is the maximum number of open connections. 0 means unlimited.
+	MaxOpenConns int
+	// MaxIdleConns is the maximum number of idle connections. 0 uses the database/sql default.
+	MaxIdleConns int
+	// ConnMaxLifetime is the maximum time a connection may be reused. 0 means forever.
+	ConnMaxLifetime time.Duration
+	// ManualMigrations stops OpenDB migrating the schema; it fails instead if the schema isn't the latest version.
+	// Databases are then migrated with MigrateDB, e.g. by gatemigrate before deploying.
+	ManualMigrations bool
+	// Encryption encrypts personal data in the database; nil stores it in plaintext. See FieldEncryption.
+	Encryption *FieldEncryption
+}
+
+// dbStore is a Store backed by a gorm database.
+type dbStore struct {
+	db *gorm.DB
+	// cipher encrypts entries as they are written, and decrypts them as they are read; see sealEntry and openEntry.
+	cipher *fieldCipher
+}
+
+// Open a gorm database, configure its connection pool, and make sure it can be reached.
+//
+// Input:
+//   - opts DBOptions: Driver, DSN and connection pool settings for the database.
+// Output:
+//   - *gorm.DB: The opened database.
+//   - error: Output if the driver is unsupported, or the open or startup check fails.
+func openGorm(opts DBOptions) (*gorm.DB, error) {
+	if opts.Driver == "" {
+		opts.Driver = "sqlite"
+	}
+	dialector, ok := dialectors[opts.Driver]
+	if !ok {
+		return nil, errors.Errorf("Database driver %s not supported", opts.Driver)
+	}
+	db, err := gorm.Open(dialector(opts.DSN), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		return nil, err
+	}
+	// Configure the connection pool, then make sure the database is reachable.
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	sqlDB.SetMaxOpenConns(opts.MaxOpenConns)
+	if opts.MaxIdleConns != 0 {
+		sqlDB.SetMaxIdleConns(opts.MaxIdleConns)
+	}
+	sqlDB.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+	if err := sqlDB.PingContext(ctx); err != nil {
+		sqlDB.Close()
+		return nil, errors.Wrapf(err, "Couldn't reach %s database", opts.Driver)
+	}
+	return db, nil
+}
+
+// Close a database opened by openGorm.
+//
+// Input:
+//   - db *gorm.DB: Database to close.
+func closeGorm(db *gorm.DB) {
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.Close()
+	}
+}
+
+// Open a database as a Store.
+// The options are configured under Database in config.yml, and should probably not change unless you have a testing
+// database to use. Each call opens a separate store, so several databases can be open at once.
+// Before returning, the database is pinged to make sure it can be reached, and its schema is migrated to
+// LatestSchemaVersion; see MigrateDB.
+//
+// Input:
+//   - opts DBOptions: Driver, DSN and connection pool settings for the database.
+// Output:
+//   - Store: Store backed by the opened database.
+//   - error: Output if the driver is unsupported, the open or startup check fails, or the schema can't be migrated:
+//   ErrSchemaTooNew, ErrSchemaOutdated with ManualMigrations, or the failure of a migration. With sqlite, this most
+//   commonly occurs if the path does not exist; gorm can create a new file, but not directories. ErrEncryptionKey is
+//   returned if the encryption keys can't be used, or the database has encrypted users and opts has no keys.
+func OpenDB(opts DBOptions) (Store, error) {
+	fc, err := newFieldCipher(opts.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openGorm(opts)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.ManualMigrations {
+		err = migrateSchema(db, LatestSchemaVersion())
+	} else if version, versionErr := schemaVersion(db); versionErr != nil {
+		err = versionErr
+	} else if version < LatestSchemaVersion() {
+		err = errors.Wrapf(ErrSchemaOutdated, "version %d of %d", version, LatestSchemaVersion())
+	} else if version > LatestSchemaVersion() {
+		err = errors.Wrapf(ErrSchemaTooNew, "version %d", version)
+	}
+	if err == nil && fc == nil {
+		err = checkUnencrypted(db)
+	}
+	if err != nil {
+		closeGorm(db)
+		return nil, err
+	}
+	return &dbStore{db: db, cipher: fc}, nil
+}
 
 // Add a userEntry to the database.
+// The check for duplicates and the insert share a transaction; the unique indexes on the canonical identifiers catch
+// any concurrent insert the check misses.
 //
 // Input:
 //   - in *userEntry: User entry to add.
 // Output:
-//   - error: Returned if the database is closed.
-func addUser(in *userEntry) error {
-	if db == nil {
+//   - error: Returned if the database is closed, or the entry can't be encrypted or inserted, or a *DuplicateError.
+func (ds *dbStore) addUser(in *userEntry) error {
+	if ds.db == nil {
 		return fmt.Errorf("addUser failed; database not open")
 	}
-	db.Create(in)
+	return ds.writeSealed(in, func(row *userEntry) error {
+		return ds.db.Transaction(func(tx *gorm.DB) error {
+			if err := ds.checkUnique(tx, *in); err != nil {
+				return err
+			}
+			return translateDuplicate(tx.Create(row).Error)
+		})
+	})
+}
+
+// Find an entry in the database that shares a canonical identifier with another.
+//
+// Input:
+//   - tx *gorm.DB: Database or transaction to search.
+//   - in userEntry: Entry to check, with its keys set.
+// Output:
+//   - error: A *DuplicateError if another entry has the same canonical email or username, any error from the database,
+//   or nil.
+func (ds *dbStore) checkUnique(tx *gorm.DB, in userEntry) error {
+	var existing []userEntry
+	err := tx.Where("email_key IN ? OR username_key = ?", ds.cipher.emailKeys(in.Email), in.UsernameKey).
+		Limit(2).Find(&existing).Error
+	if err != nil {
+		return err
+	}
+	for _, entry := range existing {
+		if err := ds.openEntry(&entry); err != nil {
+			return err
+		}
+		if err := in.conflictsWith(entry); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -28,43 +196,705 @@ func addUser(in *userEntry) error {
 //   - in *userEntry: User entry to alter. GORM manages this operation using primary key, which is the
 //   int id of the entry. Highly suggest you don't try changing that.
 // Output:
-//   - error: Returned if the database is closed.
-func updateUser(in *userEntry) error {
-	if db == nil {
+//   - error: Returned if the database is closed, or the entry can't be encrypted or saved, or a *DuplicateError.
+func (ds *dbStore) updateUser(in *userEntry) error {
+	if ds.db == nil {
 		return fmt.Errorf("updateUser failed; database not open")
 	}
-	db.Save(in)
-	return nil
+	return ds.writeSealed(in, func(row *userEntry) error {
+		return translateDuplicate(ds.db.Save(row).Error)
+	})
+}
+
+// Delete a userEntry from the database.
+//
+// Input:
+//   - in *userEntry: User entry to delete, matched by primary key.
+// Output:
+//   - error: Returned if the database is closed, or if the delete fails.
+func (ds *dbStore) deleteUser(in *userEntry) error {
+	if ds.db == nil {
+		return fmt.Errorf("deleteUser failed; database not open")
+	}
+	return ds.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", in.ID).Delete(&passwordHistoryEntry{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", in.ID).Delete(&roleBinding{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", in.ID).Delete(&membershipEntry{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(in).Error
+	})
+}
+
+// Count a failed login against a userEntry in the database. The count is reset and incremented by UPDATE statements
+// rather than read and saved, so concurrent failures are all counted; a reset can't undo an increment, since the
+// increment moves the last failure past resetBefore.
+//
+// Input:
+//   - id uint: ID of the user.
+//   - now time.Time: Time of the failure.
+//   - resetBefore time.Time: Earlier failures are forgotten if the last was before this time.
+// Output:
+//   - int: The user's failure count, including this one and any made concurrently.
+//   - error: Returned if the database is closed, or if an update or query fails.
+func (ds *dbStore) addLoginFailure(id uint, now, resetBefore time.Time) (int, error) {
+	if ds.db == nil {
+		return 0, fmt.Errorf("addLoginFailure failed; database not open")
+	}
+	err := ds.db.Model(&userEntry{}).Where("id = ? AND (last_failure IS NULL OR last_failure < ?)", id, resetBefore).
+		UpdateColumn("failed_attempts", 0).Error
+	if err != nil {
+		return 0, err
+	}
+	err = ds.db.Model(&userEntry{}).Where("id = ?", id).UpdateColumns(map[string]interface{}{
+		"failed_attempts": gorm.Expr("COALESCE(failed_attempts, 0) + 1"),
+		"last_failure":    now,
+	}).Error
+	if err != nil {
+		return 0, err
+	}
+	var failures int
+	err = ds.db.Model(&userEntry{}).Where("id = ?", id).Select("failed_attempts").Scan(&failures).Error
+	return failures, err
+}
+
+// Set when a userEntry in the database unlocks, updating no other column.
+//
+// Input:
+//   - id uint: ID of the user.
+//   - until time.Time: When the account unlocks.
+// Output:
+//   - error: Returned if the database is closed, or if the update fails.
+func (ds *dbStore) lockUser(id uint, until time.Time) error {
+	if ds.db == nil {
+		return fmt.Errorf("lockUser failed; database not open")
+	}
+	return ds.db.Model(&userEntry{}).Where("id = ?", id).UpdateColumn("locked_until", until).Error
+}
+
+// Reset the failed login count, last failure and lock of a userEntry in the database, updating no other column.
+//
+// Input:
+//   - id uint: ID of the user.
+// Output:
+//   - error: Returned if the database is closed, or if the update fails.
+func (ds *dbStore) clearLoginFailures(id uint) error {
+	if ds.db == nil {
+		return fmt.Errorf("clearLoginFailures failed; database not open")
+	}
+	return ds.db.Model(&userEntry{}).Where("id = ?", id).UpdateColumns(map[string]interface{}{
+		"failed_attempts": 0,
+		"last_failure":    time.Time{},
+		"locked_until":    time.Time{},
+	}).Error
 }
 
-// Find a userEntry in the database by its email.
+// Find a userEntry in the database by its canonical email, or its blind index if emails are encrypted.
 //
 // Input:
-//   - find string: Email to find.
+//   - find string: Email to find, in any form.
 // Output:
 //   - out userEntry: The resulting userEntry.
-//   - err error: Returned if the database is closed.
-func findUserEntryByEmail(find string) (out userEntry, err error) {
-	if db == nil {
+//   - err error: Returned if the database is closed or can't be read, or the entry can't be decrypted. A missing entry
+//   isn't an error; out is empty.
+func (ds *dbStore) findUserEntryByEmail(find string) (out userEntry, err error) {
+	if ds.db == nil {
 		err = fmt.Errorf("findUser failed; database not open")
 	} else {
-		db.Where("email = ?", find).First(&out)
+		if err = ds.db.Where("email_key IN ?", ds.cipher.emailKeys(find)).Limit(1).Find(&out).Error; err == nil {
+			err = ds.openEntry(&out)
+		}
 	}
 	return
 }
 
-// Find a userEntry in the database by its username.
+// Find a userEntry in the database by its canonical username.
 //
 // Input:
-//   - find string: Username to find.
+//   - find string: Username to find, in any form.
 // Output:
 //   - out userEntry: The resulting userEntry.
-//   - err error: Returned if the database is closed.
-func findUserEntryByUsername(find string) (out userEntry, err error) {
-	if db == nil {
+//   - err error: Returned if the database is closed or can't be read, or the entry can't be decrypted. A missing entry
+//   isn't an error; out is empty.
+func (ds *dbStore) findUserEntryByUsername(find string) (out userEntry, err error) {
+	if ds.db == nil {
 		err = fmt.Errorf("findUser failed; database not open")
 	} else {
-		db.Where("Username = ?", find).First(&out)
+		if err = ds.db.Where("username_key = ?", usernameKey(find)).Limit(1).Find(&out).Error; err == nil {
+			err = ds.openEntry(&out)
+		}
 	}
 	return
 }
+
+// Get the current number of entries in the database.
+//
+// Output:
+//   - int: Number of entries in the database.
+//   - error: Returned if the database is closed.
+func (ds *dbStore) countUsers() (int, error) {
+	if ds.db == nil {
+		return 0, fmt.Errorf("countUsers failed; database not open")
+	}
+	var count int64
+	if err := ds.db.Model(&userEntry{}).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+// sortColumns maps the SortBy values of a UserQuery to userEntry columns.
+var sortColumns = map[string]string{
+	SortByID:       "id",
+	SortByUsername: "username",
+	SortByEmail:    "email",
+	SortByCreated:  "created_at",
+}
+
+// Get userEntry values in the database that match a query.
+// Prefixes are matched with SUBSTR rather than LIKE, so they need no escaping and compare as = does. Encrypted emails
+// can't be matched by prefix or sorted, so those queries are refused when the database is encrypted.
+//
+// Input:
+//   - q userListQuery: Filter, order, start and limit.
+// Output:
+//   - []userEntry: Matching entries.
+//   - error: Returned if the database is closed, the query fails, or an entry can't be decrypted. ErrInvalidQuery if
+//   the query needs plaintext emails.
+func (ds *dbStore) listUsers(q userListQuery) ([]userEntry, error) {
+	if ds.db == nil {
+		return nil, fmt.Errorf("listUsers failed; database not open")
+	}
+	if ds.cipher != nil && (q.filter.EmailPrefix != "" || q.sortBy == SortByEmail) {
+		return nil, errors.Wrap(ErrInvalidQuery, "encrypted emails can't be matched by prefix or sorted")
+	}
+	tx := ds.db.Model(&userEntry{})
+	if f := emailKey(q.filter.EmailPrefix); f != "" {
+		tx = tx.Where("SUBSTR(email_key, 1, ?) = ?", utf8.RuneCountInString(f), f)
+	}
+	if f := usernameKey(q.filter.UsernamePrefix); f != "" {
+		tx = tx.Where("SUBSTR(username_key, 1, ?) = ?", utf8.RuneCountInString(f), f)
+	}
+	if q.filter.Status == StatusActive {
+		// Entries from before the Status column count as active.
+		tx = tx.Where("status = ? OR status = '' OR status IS NULL", StatusActive)
+	} else if q.filter.Status != "" {
+		tx = tx.Where("status = ?", q.filter.Status)
+	}
+	if !q.filter.CreatedAfter.IsZero() {
+		tx = tx.Where("created_at >= ?", q.filter.CreatedAfter)
+	}
+	if !q.filter.CreatedBefore.IsZero() {
+		tx = tx.Where("created_at < ?", q.filter.CreatedBefore)
+	}
+	column := sortColumns[q.sortBy]
+	direction, compare := "ASC", ">"
+	if q.descending {
+		direction, compare = "DESC", "<"
+	}
+	if q.after != nil {
+		if column == "id" {
+			tx = tx.Where("id "+compare+" ?", q.after.ID)
+		} else {
+			var value interface{} = q.after.Text
+			if q.sortBy == SortByCreated {
+				value = q.after.Time
+			}
+			tx = tx.Where(column+" "+compare+" ? OR ("+column+" = ? AND id "+compare+" ?)", value, value, q.after.ID)
+		}
+	}
+	if column != "id" {
+		tx = tx.Order(column + " " + direction)
+	}
+	out := make([]userEntry, 0)
+	if err := tx.Order("id " + direction).Limit(q.limit).Find(&out).Error; err != nil {
+		return out, err
+	}
+	for i := range out {
+		if err := ds.openEntry(&out[i]); err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
+
+// Record a previous password hash in the database.
+//
+// Input:
+//   - in *passwordHistoryEntry: History entry to add.
+// Output:
+//   - error: Returned if the database is closed, or if the insert fails.
+func (ds *dbStore) addPasswordHistory(in *passwordHistoryEntry) error {
+	if ds.db == nil {
+		return fmt.Errorf("addPasswordHistory failed; database not open")
+	}
+	return ds.db.Create(in).Error
+}
+
+// Get previous password hashes for a user from the database.
+//
+// Input:
+//   - userID uint: ID of the user.
+//   - limit int: Maximum number of hashes to return.
+// Output:
+//   - []passwordHistoryEntry: History entries, newest first.
+//   - error: Returned if the database is closed, or if the query fails.
+func (ds *dbStore) findPasswordHistory(userID uint, limit int) ([]passwordHistoryEntry, error) {
+	if ds.db == nil {
+		return nil, fmt.Errorf("findPasswordHistory failed; database not open")
+	}
+	out := make([]passwordHistoryEntry, 0, limit)
+	err := ds.db.Where("user_id = ?", userID).Order("id desc").Limit(limit).Find(&out).Error
+	return out, err
+}
+
+// Delete all but the newest previous password hashes for a user from the database.
+//
+// Input:
+//   - userID uint: ID of the user.
+//   - keep int: Number of hashes to keep.
+// Output:
+//   - error: Returned if the database is closed, or if the delete fails.
+func (ds *dbStore) prunePasswordHistory(userID uint, keep int) error {
+	if ds.db == nil {
+		return fmt.Errorf("prunePasswordHistory failed; database not open")
+	}
+	kept, err := ds.findPasswordHistory(userID, keep)
+	if err != nil {
+		return err
+	}
+	query := ds.db.Where("user_id = ?", userID)
+	if len(kept) > 0 {
+		query = query.Where("id < ?", kept[len(kept)-1].ID)
+	}
+	return query.Delete(&passwordHistoryEntry{}).Error
+}
+
+// Add a roleEntry to the database.
+//
+// Input:
+//   - in *roleEntry: Role to add.
+// Output:
+//   - error: Returned if the database is closed, or if the insert fails.
+func (ds *dbStore) addRole(in *roleEntry) error {
+	if ds.db == nil {
+		return fmt.Errorf("addRole failed; database not open")
+	}
+	return ds.db.Create(in).Error
+}
+
+// Update a roleEntry in the database.
+//
+// Input:
+//   - in *roleEntry: Role to alter, matched by primary key.
+// Output:
+//   - error: Returned if the database is closed, or if the update fails.
+func (ds *dbStore) updateRole(in *roleEntry) error {
+	if ds.db == nil {
+		return fmt.Errorf("updateRole failed; database not open")
+	}
+	return ds.db.Save(in).Error
+}
+
+// Delete a roleEntry, and its bindings and includes, from the database.
+//
+// Input:
+//   - in *roleEntry: Role to delete, matched by primary key.
+// Output:
+//   - error: Returned if the database is closed, or if the delete fails.
+func (ds *dbStore) deleteRole(in *roleEntry) error {
+	if ds.db == nil {
+		return fmt.Errorf("deleteRole failed; database not open")
+	}
+	return ds.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("role_id = ?", in.ID).Delete(&roleBinding{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("role_id = ? OR included_role_id = ?", in.ID, in.ID).Delete(&roleInclude{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(in).Error
+	})
+}
+
+// Find a roleEntry in the database by its name.
+//
+// Input:
+//   - name string: Name to find.
+// Output:
+//   - roleEntry: The resulting roleEntry, or the empty roleEntry if not found.
+//   - error: Returned if the database is closed, or if the query fails.
+func (ds *dbStore) findRoleByName(name string) (roleEntry, error) {
+	out := roleEntry{}
+	if ds.db == nil {
+		return out, fmt.Errorf("findRoleByName failed; database not open")
+	}
+	err := ds.db.Where("name = ?", name).Limit(1).Find(&out).Error
+	return out, err
+}
+
+// Find a roleEntry in the database by its ID.
+//
+// Input:
+//   - id uint: ID to find.
+// Output:
+//   - roleEntry: The resulting roleEntry, or the empty roleEntry if not found.
+//   - error: Returned if the database is closed, or if the query fails.
+func (ds *dbStore) findRoleByID(id uint) (roleEntry, error) {
+	out := roleEntry{}
+	if ds.db == nil {
+		return out, fmt.Errorf("findRoleByID failed; database not open")
+	}
+	err := ds.db.Where("id = ?", id).Limit(1).Find(&out).Error
+	return out, err
+}
+
+// Get every roleEntry in the database.
+//
+// Output:
+//   - []roleEntry: The roles.
+//   - error: Returned if the database is closed, or if the query fails.
+func (ds *dbStore) listRoles() ([]roleEntry, error) {
+	if ds.db == nil {
+		return nil, fmt.Errorf("listRoles failed; database not open")
+	}
+	out := make([]roleEntry, 0)
+	err := ds.db.Find(&out).Error
+	return out, err
+}
+
+// Grant a role to a user in the database.
+//
+// Input:
+//   - in *roleBinding: Binding to add.
+// Output:
+//   - error: Returned if the database is closed, or if the insert fails.
+func (ds *dbStore) addRoleBinding(in *roleBinding) error {
+	if ds.db == nil {
+		return fmt.Errorf("addRoleBinding failed; database not open")
+	}
+	return ds.db.Create(in).Error
+}
+
+// Revoke a role from a user in the database.
+//
+// Input:
+//   - in *roleBinding: Binding to delete, matched by user and role.
+// Output:
+//   - error: Returned if the database is closed, or if the delete fails.
+func (ds *dbStore) deleteRoleBinding(in *roleBinding) error {
+	if ds.db == nil {
+		return fmt.Errorf("deleteRoleBinding failed; database not open")
+	}
+	return ds.db.Where("user_id = ? AND role_id = ?", in.UserID, in.RoleID).Delete(&roleBinding{}).Error
+}
+
+// Get the roles granted directly to a user from the database.
+//
+// Input:
+//   - userID uint: ID of the user.
+// Output:
+//   - []roleBinding: The user's bindings.
+//   - error: Returned if the database is closed, or if the query fails.
+func (ds *dbStore) findRoleBindings(userID uint) ([]roleBinding, error) {
+	if ds.db == nil {
+		return nil, fmt.Errorf("findRoleBindings failed; database not open")
+	}
+	out := make([]roleBinding, 0)
+	err := ds.db.Where("user_id = ?", userID).Find(&out).Error
+	return out, err
+}
+
+// Get the roles granted directly to any of a set of users from the database, in one query.
+//
+// Input:
+//   - userIDs []uint: IDs of the users.
+// Output:
+//   - []roleBinding: The users' bindings.
+//   - error: Returned if the database is closed, or if the query fails.
+func (ds *dbStore) findRoleBindingsForUsers(userIDs []uint) ([]roleBinding, error) {
+	if ds.db == nil {
+		return nil, fmt.Errorf("findRoleBindingsForUsers failed; database not open")
+	}
+	out := make([]roleBinding, 0)
+	if len(userIDs) == 0 {
+		return out, nil
+	}
+	err := ds.db.Where("user_id IN ?", userIDs).Find(&out).Error
+	return out, err
+}
+
+// Make one role include another in the database.
+//
+// Input:
+//   - in *roleInclude: Include to add.
+// Output:
+//   - error: Returned if the database is closed, or if the insert fails.
+func (ds *dbStore) addRoleInclude(in *roleInclude) error {
+	if ds.db == nil {
+		return fmt.Errorf("addRoleInclude failed; database not open")
+	}
+	return ds.db.Create(in).Error
+}
+
+// Stop one role including another in the database.
+//
+// Input:
+//   - in *roleInclude: Include to delete, matched by both roles.
+// Output:
+//   - error: Returned if the database is closed, or if the delete fails.
+func (ds *dbStore) deleteRoleInclude(in *roleInclude) error {
+	if ds.db == nil {
+		return fmt.Errorf("deleteRoleInclude failed; database not open")
+	}
+	return ds.db.Where("role_id = ? AND included_role_id = ?", in.RoleID, in.IncludedRoleID).Delete(&roleInclude{}).Error
+}
+
+// Get the roles directly included by a role from the database.
+//
+// Input:
+//   - roleID uint: ID of the role.
+// Output:
+//   - []roleInclude: The role's includes.
+//   - error: Returned if the database is closed, or if the query fails.
+func (ds *dbStore) findRoleIncludes(roleID uint) ([]roleInclude, error) {
+	if ds.db == nil {
+		return nil, fmt.Errorf("findRoleIncludes failed; database not open")
+	}
+	out := make([]roleInclude, 0)
+	err := ds.db.Where("role_id = ?", roleID).Find(&out).Error
+	return out, err
+}
+
+// Get every roleInclude in the database.
+//
+// Output:
+//   - []roleInclude: The includes.
+//   - error: Returned if the database is closed, or if the query fails.
+func (ds *dbStore) listRoleIncludes() ([]roleInclude, error) {
+	if ds.db == nil {
+		return nil, fmt.Errorf("listRoleIncludes failed; database not open")
+	}
+	out := make([]roleInclude, 0)
+	err := ds.db.Find(&out).Error
+	return out, err
+}
+
+// Add an applicationEntry to the database.
+//
+// Input:
+//   - in *applicationEntry: Application to add.
+// Output:
+//   - error: Returned if the database is closed, or if the insert fails.
+func (ds *dbStore) addApplication(in *applicationEntry) error {
+	if ds.db == nil {
+		return fmt.Errorf("addApplication failed; database not open")
+	}
+	return ds.db.Create(in).Error
+}
+
+// Update an applicationEntry in the database.
+//
+// Input:
+//   - in *applicationEntry: Application to alter, matched by primary key.
+// Output:
+//   - error: Returned if the database is closed, or if the update fails.
+func (ds *dbStore) updateApplication(in *applicationEntry) error {
+	if ds.db == nil {
+		return fmt.Errorf("updateApplication failed; database not open")
+	}
+	return ds.db.Save(in).Error
+}
+
+// Find an applicationEntry in the database by its name.
+//
+// Input:
+//   - name string: Name to find.
+// Output:
+//   - applicationEntry: The resulting applicationEntry, or the empty applicationEntry if not found.
+//   - error: Returned if the database is closed, or if the query fails.
+func (ds *dbStore) findApplicationByName(name string) (applicationEntry, error) {
+	out := applicationEntry{}
+	if ds.db == nil {
+		return out, fmt.Errorf("findApplicationByName failed; database not open")
+	}
+	err := ds.db.Where("name = ?", name).Limit(1).Find(&out).Error
+	return out, err
+}
+
+// Find an applicationEntry in the database by its ID.
+//
+// Input:
+//   - id uint: ID to find.
+// Output:
+//   - applicationEntry: The resulting applicationEntry, or the empty applicationEntry if not found.
+//   - error: Returned if the database is closed, or if the query fails.
+func (ds *dbStore) findApplicationByID(id uint) (applicationEntry, error) {
+	out := applicationEntry{}
+	if ds.db == nil {
+		return out, fmt.Errorf("findApplicationByID failed; database not open")
+	}
+	err := ds.db.Where("id = ?", id).Limit(1).Find(&out).Error
+	return out, err
+}
+
+// Get every applicationEntry in the database, in order of ID.
+//
+// Output:
+//   - []applicationEntry: The applications.
+//   - error: Returned if the database is closed, or if the query fails.
+func (ds *dbStore) listApplications() ([]applicationEntry, error) {
+	if ds.db == nil {
+		return nil, fmt.Errorf("listApplications failed; database not open")
+	}
+	out := make([]applicationEntry, 0)
+	err := ds.db.Order("id").Find(&out).Error
+	return out, err
+}
+
+// Make a user a member of an application in the database.
+//
+// Input:
+//   - in *membershipEntry: Membership to add.
+// Output:
+//   - error: Returned if the database is closed, or if the insert fails.
+func (ds *dbStore) addMembership(in *membershipEntry) error {
+	if ds.db == nil {
+		return fmt.Errorf("addMembership failed; database not open")
+	}
+	return ds.db.Create(in).Error
+}
+
+// Make every user in the database a member of an application, in a single statement.
+//
+// Input:
+//   - appID uint: ID of the application.
+// Output:
+//   - error: Returned if the database is closed, or if the insert fails.
+func (ds *dbStore) addAllMemberships(appID uint) error {
+	if ds.db == nil {
+		return fmt.Errorf("addAllMemberships failed; database not open")
+	}
+	return ds.db.Exec("INSERT INTO membership_entries (app_id, user_id) SELECT ?, id FROM user_entries", appID).Error
+}
+
+// Remove a user from an application in the database.
+//
+// Input:
+//   - in *membershipEntry: Membership to delete, matched by application and user.
+// Output:
+//   - error: Returned if the database is closed, or if the delete fails.
+func (ds *dbStore) deleteMembership(in *membershipEntry) error {
+	if ds.db == nil {
+		return fmt.Errorf("deleteMembership failed; database not open")
+	}
+	return ds.db.Where("app_id = ? AND user_id = ?", in.AppID, in.UserID).Delete(&membershipEntry{}).Error
+}
+
+// Get the applications a user is a member of from the database.
+//
+// Input:
+//   - userID uint: ID of the user.
+// Output:
+//   - []membershipEntry: The user's memberships.
+//   - error: Returned if the database is closed, or if the query fails.
+func (ds *dbStore) findMemberships(userID uint) ([]membershipEntry, error) {
+	if ds.db == nil {
+		return nil, fmt.Errorf("findMemberships failed; database not open")
+	}
+	out := make([]membershipEntry, 0)
+	err := ds.db.Where("user_id = ?", userID).Find(&out).Error
+	return out, err
+}
+
+// Add an apiKeyEntry to the database.
+//
+// Input:
+//   - in *apiKeyEntry: API key to add.
+// Output:
+//   - error: Returned if the database is closed, or if the insert fails.
+func (ds *dbStore) addAPIKey(in *apiKeyEntry) error {
+	if ds.db == nil {
+		return fmt.Errorf("addAPIKey failed; database not open")
+	}
+	return ds.db.Create(in).Error
+}
+
+// Find an apiKeyEntry in the database by its key hash.
+//
+// Input:
+//   - hash string: Key hash to find.
+// Output:
+//   - apiKeyEntry: The resulting apiKeyEntry, or the empty apiKeyEntry if not found.
+//   - error: Returned if the database is closed, or if the query fails.
+func (ds *dbStore) findAPIKeyByHash(hash string) (apiKeyEntry, error) {
+	out := apiKeyEntry{}
+	if ds.db == nil {
+		return out, fmt.Errorf("findAPIKeyByHash failed; database not open")
+	}
+	err := ds.db.Where("key_hash = ?", hash).Limit(1).Find(&out).Error
+	return out, err
+}
+
+// Find an apiKeyEntry in the database by its prefix.
+//
+// Input:
+//   - prefix string: Prefix to find.
+// Output:
+//   - apiKeyEntry: The resulting apiKeyEntry, or the empty apiKeyEntry if not found.
+//   - error: Returned if the database is closed, or if the query fails.
+func (ds *dbStore) findAPIKeyByPrefix(prefix string) (apiKeyEntry, error) {
+	out := apiKeyEntry{}
+	if ds.db == nil {
+		return out, fmt.Errorf("findAPIKeyByPrefix failed; database not open")
+	}
+	err := ds.db.Where("prefix = ?", prefix).Limit(1).Find(&out).Error
+	return out, err
+}
+
+// Get every apiKeyEntry of an application from the database, in order of ID.
+//
+// Input:
+//   - appID uint: ID of the application.
+// Output:
+//   - []apiKeyEntry: The application's keys.
+//   - error: Returned if the database is closed, or if the query fails.
+func (ds *dbStore) listAPIKeys(appID uint) ([]apiKeyEntry, error) {
+	if ds.db == nil {
+		return nil, fmt.Errorf("listAPIKeys failed; database not open")
+	}
+	out := make([]apiKeyEntry, 0)
+	err := ds.db.Where("app_id = ?", appID).Order("id").Find(&out).Error
+	return out, err
+}
+
+// Overwrite an apiKeyEntry in the database.
+//
+// Input:
+//   - in *apiKeyEntry: API key to save, matched by ID.
+// Output:
+//   - error: Returned if the database is closed, or if the update fails.
+func (ds *dbStore) updateAPIKey(in *apiKeyEntry) error {
+	if ds.db == nil {
+		return fmt.Errorf("updateAPIKey failed; database not open")
+	}
+	return ds.db.Save(in).Error
+}
+
+// Record the last use of an apiKeyEntry in the database, updating no other column.
+//
+// Input:
+//   - id uint: ID of the API key.
+//   - used time.Time: Time of the use.
+// Output:
+//   - error: Returned if the database is closed, or if the update fails.
+func (ds *dbStore) touchAPIKey(id uint, used time.Time) error {
+	if ds.db == nil {
+		return fmt.Errorf("touchAPIKey failed; database not open")
+	}
+	return ds.db.Model(&apiKeyEntry{}).Where("id = ?", id).Update("last_used_at", used).Error
+}
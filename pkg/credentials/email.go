@@ -0,0 +1,171 @@
+package credentials
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrDuplicateEmail is returned when an email already belongs to another user.
+var ErrDuplicateEmail = errors.New("Email is already in use.")
+
+// ErrEmailChangePending is returned by ChangeUserEmail while the previous change can still be reverted, so that a
+// second change can't replace the revert code sent to the original address.
+var ErrEmailChangePending = errors.New("An email change is waiting for its revert window to pass")
+
+// ErrInvalidRevert is returned by RevertUserEmail for wrong, used or expired revert codes.
+var ErrInvalidRevert = errors.New("Invalid or expired revert code")
+
+// DefaultEmailRevertWindow is how long the previous address can revert an email change, unless a Service says otherwise.
+const DefaultEmailRevertWindow time.Duration = time.Hour * 24 * 7
+
+// Hash a revert code for storage. Revert codes are random, so a fast hash is enough.
+//
+// Input:
+//   - code string: Revert code.
+// Output:
+//   - string: Hex SHA-256 digest of code.
+func hashRevertCode(code string) string {
+	digest := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(digest[:])
+}
+
+// Check that no user other than one with a username has an email.
+// Deleted users within their restore window keep their email.
+//
+// Input:
+//   - email string: Email to check.
+//   - username string: User allowed to hold the email; "" if none.
+// Output:
+//   - error: ErrDuplicateEmail if another user has the email, any error from the store, or nil.
+func (s *Service) checkEmailAvailable(email, username string) error {
+	holder, err := s.findUserEntryByEmail(email)
+	if err != nil {
+		return err
+	}
+	if holder.Email != "" && holder.UsernameKey != usernameKey(username) {
+		return ErrDuplicateEmail
+	}
+	return nil
+}
+
+// Check whether an email can be given to a user, for the first step of an email change.
+//
+// Input:
+//   - email string: Email to check.
+// Output:
+//   - error: ErrDuplicateEmail if any user has the email, any error from the store, or nil.
+func (s *Service) CheckEmailAvailable(email string) error {
+	return s.checkEmailAvailable(email, "")
+}
+
+// Check whether a user's email can be changed to an email, for the first step of an email change.
+//
+// Input:
+//   - username string: Username of the user.
+//   - email string: Email to check.
+// Output:
+//   - error: ErrEmailChangePending if the user's last change can still be reverted, ErrDuplicateEmail if any user has
+//   the email, any error from the store, or nil.
+func (s *Service) CheckEmailChange(username, email string) error {
+	user, err := s.findUserEntryByUsername(username)
+	if err != nil {
+		return err
+	}
+	if user.revertPending(time.Now()) {
+		return ErrEmailChangePending
+	}
+	return s.checkEmailAvailable(email, "")
+}
+
+// Check whether the calling userEntry's last email change can still be reverted.
+//
+// Calling:
+//   - u userEntry: Entry to check.
+// Input:
+//   - now time.Time: Current time.
+// Output:
+//   - bool: Is there an unused revert code that hasn't expired?
+func (u userEntry) revertPending(now time.Time) bool {
+	return u.EmailRevertHash != "" && !now.After(u.EmailRevertExpires)
+}
+
+// Change a user's email. The new email counts as verified, so the caller is responsible for proving ownership of it
+// first, e.g. with a gatecode sent to it.
+// The previous email is remembered, along with a revert code that RevertUserEmail accepts until s.EmailRevertWindow
+// passes; the caller should send the code to the previous email, so its owner can undo a change they didn't make.
+// Until then, further changes are refused, so whoever made the change can't make another to replace the revert code.
+//
+// Input:
+//   - username string: Username of the user.
+//   - newEmail string: Email to set. Must not belong to any other user.
+// Output:
+//   - string: Revert code for the previous email.
+//   - error: Any error that occurs, including: ErrUserNotFound if no active user has the username,
+//   ErrEmailChangePending, ErrDuplicateEmail, failure to update the store.
+func (s *Service) ChangeUserEmail(username, newEmail string) (string, error) {
+	user, err := s.findUserEntryByUsername(username)
+	if err != nil {
+		return "", err
+	}
+	if user.Username == "" || user.status() != StatusActive {
+		return "", errors.Wrap(ErrUserNotFound, username)
+	}
+	if user.revertPending(time.Now()) {
+		return "", ErrEmailChangePending
+	}
+	if err := s.checkEmailAvailable(newEmail, username); err != nil {
+		return "", err
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	code := stringEncode(raw)
+	user.PreviousEmail = user.Email
+	user.EmailRevertHash = hashRevertCode(code)
+	user.EmailRevertExpires = time.Now().Add(s.EmailRevertWindow)
+	user.Email = newEmail
+	user.EmailVerified = true
+	user.EmailVerifiedAt = time.Now()
+	if err := s.store.updateUser(&user); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// Undo an email change with the revert code sent to the previous email.
+// Since an unwanted email change suggests the account was taken over, tokens issued to the user are revoked too.
+//
+// Input:
+//   - username string: Username of the user.
+//   - code string: Revert code from ChangeUserEmail.
+// Output:
+//   - error: Any error that occurs, including: ErrInvalidRevert if the code is wrong, used or expired,
+//   ErrDuplicateEmail if another user has taken the previous email since, failure to update the store.
+func (s *Service) RevertUserEmail(username, code string) error {
+	user, err := s.findUserEntryByUsername(username)
+	if err != nil {
+		return err
+	}
+	if user.Username == "" || user.EmailRevertHash == "" || time.Now().After(user.EmailRevertExpires) ||
+		subtle.ConstantTimeCompare([]byte(hashRevertCode(code)), []byte(user.EmailRevertHash)) != 1 {
+		s.Log("Email revert for %s failed: wrong, used or expired code", username)
+		return ErrInvalidRevert
+	}
+	if err := s.checkEmailAvailable(user.PreviousEmail, username); err != nil {
+		return err
+	}
+	user.Email = user.PreviousEmail
+	user.EmailVerified = true
+	user.EmailVerifiedAt = time.Now()
+	user.PreviousEmail = ""
+	user.EmailRevertHash = ""
+	user.EmailRevertExpires = time.Time{}
+	user.TokensValidAfter = time.Now()
+	return s.store.updateUser(&user)
+}
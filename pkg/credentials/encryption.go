@@ -0,0 +1,420 @@
+package credentials
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// ErrEncryptionKey is returned for encryption keys that can't be used, and for values encrypted with a key that isn't
+// configured.
+var ErrEncryptionKey = errors.New("Encryption key unavailable")
+
+// encryptedPrefix starts every encrypted value, which is stored as $aes-gcm$<key ID>$<base64 nonce and ciphertext>.
+const encryptedPrefix = "$aes-gcm$"
+
+// blindIndexPrefix starts the email_key of entries with encrypted emails, to tell it apart from a canonical email.
+const blindIndexPrefix = "$hmac-sha256$"
+
+// EncryptionKeySize is the size of the AES-256 keys in FieldEncryption.Keys, and the minimum size of its IndexKey.
+const EncryptionKeySize = 32
+
+// reencryptBatchSize is how many users ReencryptUsers reads from the database at a time.
+const reencryptBatchSize = 500
+
+// FieldEncryption configures encryption of personal data in a database opened by OpenDB. Emails, previous emails,
+// display names and attributes are encrypted with AES-256-GCM before they are written, so copies of the database don't
+// reveal them. Emails are still found by exact match through a blind index: a keyed HMAC of the canonical email, stored
+// in place of the canonical email itself.
+type FieldEncryption struct {
+	// Keys maps key IDs to keys of EncryptionKeySize bytes. Each value records the ID of the key it was encrypted with,
+	// so a key must be kept here until ReencryptUsers has run with a different PrimaryKey.
+	Keys map[string][]byte
+	// PrimaryKey is the ID of the key values are encrypted with. "" writes values in plaintext; ReencryptUsers then
+	// decrypts every user, e.g. to stop encrypting the database.
+	PrimaryKey string
+	// IndexKey is the HMAC key of the blind index, at least EncryptionKeySize bytes. It is required with PrimaryKey.
+	// Users can't be found by email after IndexKey changes, until ReencryptUsers rebuilds their index.
+	IndexKey []byte
+}
+
+// A fieldCipher encrypts and decrypts the columns of a userEntry, as configured by FieldEncryption.
+// The nil *fieldCipher leaves values as they are stored.
+type fieldCipher struct {
+	aeads    map[string]cipher.AEAD
+	primary  string
+	indexKey []byte
+}
+
+// Make a fieldCipher from FieldEncryption, checking its keys.
+//
+// Input:
+//   - enc *FieldEncryption: Keys to use; nil for none.
+// Output:
+//   - *fieldCipher: The cipher; nil if enc is nil.
+//   - error: ErrEncryptionKey if a key ID or key is invalid, PrimaryKey isn't in Keys, or IndexKey is too short.
+func newFieldCipher(enc *FieldEncryption) (*fieldCipher, error) {
+	if enc == nil {
+		return nil, nil
+	}
+	fc := &fieldCipher{aeads: make(map[string]cipher.AEAD), primary: enc.PrimaryKey, indexKey: enc.IndexKey}
+	for id, key := range enc.Keys {
+		if id == "" || strings.Contains(id, "$") {
+			return nil, errors.Wrapf(ErrEncryptionKey, "key ID %q can't be empty or contain $", id)
+		}
+		if len(key) != EncryptionKeySize {
+			return nil, errors.Wrapf(ErrEncryptionKey, "key %s is %d bytes, not %d", id, len(key), EncryptionKeySize)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if fc.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	if fc.primary == "" {
+		return fc, nil
+	}
+	if _, ok := fc.aeads[fc.primary]; !ok {
+		return nil, errors.Wrapf(ErrEncryptionKey, "primary key %s isn't one of the keys", fc.primary)
+	}
+	if len(fc.indexKey) < EncryptionKeySize {
+		return nil, errors.Wrapf(ErrEncryptionKey, "index key must be at least %d bytes", EncryptionKeySize)
+	}
+	return fc, nil
+}
+
+// Encrypt a value with the primary key.
+// The column is authenticated along with the value, so a value can't be copied into another column.
+//
+// Calling:
+//   - fc *fieldCipher: Cipher to encrypt with.
+// Input:
+//   - column string: Column the value is stored in.
+//   - value string: Value to encrypt.
+// Output:
+//   - string: Encrypted value; value itself if it is empty or there is no primary key.
+//   - error: Returned if a nonce can't be generated.
+func (fc *fieldCipher) encrypt(column, value string) (string, error) {
+	if fc == nil || fc.primary == "" || value == "" {
+		return value, nil
+	}
+	aead := fc.aeads[fc.primary]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(column))
+	return encryptedPrefix + fc.primary + "$" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt a value made by encrypt, with whichever key it names.
+//
+// Calling:
+//   - fc *fieldCipher: Cipher to decrypt with.
+// Input:
+//   - column string: Column the value was read from.
+//   - value string: Stored value.
+// Output:
+//   - string: Decrypted value; value itself if it isn't encrypted, or fc is nil.
+//   - error: ErrEncryptionKey if the key isn't configured or doesn't decrypt the value, or an error if the value is
+//   malformed.
+func (fc *fieldCipher) decrypt(column, value string) (string, error) {
+	if fc == nil || !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, encryptedPrefix), "$", 2)
+	if len(parts) != 2 {
+		return "", errors.Errorf("Malformed encrypted %s", column)
+	}
+	aead, ok := fc.aeads[parts[0]]
+	if !ok {
+		return "", errors.Wrapf(ErrEncryptionKey, "%s was encrypted with key %s, which isn't configured", column, parts[0])
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.Errorf("Malformed encrypted %s", column)
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(column))
+	if err != nil {
+		return "", errors.Wrapf(ErrEncryptionKey, "%s couldn't be decrypted with key %s", column, parts[0])
+	}
+	return string(plain), nil
+}
+
+// Is a stored value in the form encrypt would write it in now?
+//
+// Calling:
+//   - fc *fieldCipher: Cipher to check against.
+// Input:
+//   - value string: Stored value.
+// Output:
+//   - bool: Is value encrypted with the primary key, or not encrypted if there is none?
+func (fc *fieldCipher) current(value string) bool {
+	if fc == nil || fc.primary == "" {
+		return !strings.HasPrefix(value, encryptedPrefix)
+	}
+	return value == "" || strings.HasPrefix(value, encryptedPrefix+fc.primary+"$")
+}
+
+// Get the email_key an email is written with: its blind index if emails are encrypted, otherwise its canonical form.
+//
+// Calling:
+//   - fc *fieldCipher: Cipher to index with.
+// Input:
+//   - email string: Email, in any form.
+// Output:
+//   - string: Key to store.
+func (fc *fieldCipher) emailKey(email string) string {
+	if fc == nil || fc.primary == "" {
+		return emailKey(email)
+	}
+	return fc.blindIndex(email)
+}
+
+// Get every email_key an email may be stored under: its canonical form, for entries written without encryption, and
+// its blind index, for entries written with it.
+//
+// Calling:
+//   - fc *fieldCipher: Cipher to index with.
+// Input:
+//   - email string: Email, in any form.
+// Output:
+//   - []string: Keys to look up.
+func (fc *fieldCipher) emailKeys(email string) []string {
+	keys := []string{emailKey(email)}
+	if fc != nil && len(fc.indexKey) > 0 {
+		keys = append(keys, fc.blindIndex(email))
+	}
+	return keys
+}
+
+// Get the blind index of an email: an HMAC-SHA256 of its canonical form under the index key.
+//
+// Calling:
+//   - fc *fieldCipher: Cipher with the index key.
+// Input:
+//   - email string: Email, in any form.
+// Output:
+//   - string: Blind index.
+func (fc *fieldCipher) blindIndex(email string) string {
+	mac := hmac.New(sha256.New, fc.indexKey)
+	mac.Write([]byte(emailKey(email)))
+	return blindIndexPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Get the columns of the calling userEntry that hold personal data, by column name.
+//
+// Calling:
+//   - u *userEntry: Entry whose fields to get.
+// Output:
+//   - map[string]*string: Pointers to the fields, so they can be changed in place.
+func (u *userEntry) encryptedFields() map[string]*string {
+	return map[string]*string{
+		"email":          &u.Email,
+		"previous_email": &u.PreviousEmail,
+		"display_name":   &u.DisplayName,
+		"attributes":     &u.Attributes,
+	}
+}
+
+// Get an entry in the form it is written to the database in: personal data encrypted, and the email key a blind index.
+//
+// Calling:
+//   - ds *dbStore: Store the entry is written to.
+// Input:
+//   - in userEntry: Entry to encrypt, with its keys set.
+// Output:
+//   - userEntry: Encrypted copy of in.
+//   - error: Returned if a value can't be encrypted.
+func (ds *dbStore) sealEntry(in userEntry) (userEntry, error) {
+	if ds.cipher == nil {
+		return in, nil
+	}
+	in.EmailKey = ds.cipher.emailKey(in.Email)
+	var err error
+	for column, field := range in.encryptedFields() {
+		if *field, err = ds.cipher.encrypt(column, *field); err != nil {
+			return in, err
+		}
+	}
+	return in, nil
+}
+
+// Decrypt an entry read from the database, in place, and set its canonical identifiers from the decrypted values.
+//
+// Calling:
+//   - ds *dbStore: Store the entry was read from.
+// Input:
+//   - entry *userEntry: Entry to decrypt. The empty userEntry is left as it is.
+// Output:
+//   - error: Returned if a value can't be decrypted; see fieldCipher.decrypt.
+func (ds *dbStore) openEntry(entry *userEntry) error {
+	if ds.cipher == nil || entry.ID == 0 {
+		return nil
+	}
+	var err error
+	for column, field := range entry.encryptedFields() {
+		if *field, err = ds.cipher.decrypt(column, *field); err != nil {
+			return errors.Wrapf(err, "user %d", entry.ID)
+		}
+	}
+	entry.setKeys()
+	return nil
+}
+
+// Write an entry in the form sealEntry gives, then copy anything the database set, like the ID, back into it.
+//
+// Calling:
+//   - ds *dbStore: Store to write to.
+// Input:
+//   - in *userEntry: Entry to write; its keys are set, and it is left unencrypted.
+//   - write func(row *userEntry) error: Writes the encrypted entry.
+// Output:
+//   - error: Returned if the entry can't be encrypted, or from write.
+func (ds *dbStore) writeSealed(in *userEntry, write func(row *userEntry) error) error {
+	in.setKeys()
+	row, err := ds.sealEntry(*in)
+	if err != nil {
+		return err
+	}
+	if err := write(&row); err != nil {
+		return err
+	}
+	row.Email, row.PreviousEmail, row.EmailKey = in.Email, in.PreviousEmail, in.EmailKey
+	row.DisplayName, row.Attributes = in.DisplayName, in.Attributes
+	*in = row
+	return nil
+}
+
+// Make sure a database opened without FieldEncryption has no encrypted users, which it could neither read nor find.
+//
+// Input:
+//   - db *gorm.DB: Database to check.
+// Output:
+//   - error: ErrEncryptionKey if any email is encrypted, or an error from the database.
+func checkUnencrypted(db *gorm.DB) error {
+	var ids []uint
+	err := db.Model(&userEntry{}).Where("SUBSTR(email, 1, ?) = ?", len(encryptedPrefix), encryptedPrefix).
+		Limit(1).Pluck("id", &ids).Error
+	if err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		return errors.Wrap(ErrEncryptionKey, "the database has encrypted users, but no encryption keys are configured")
+	}
+	return nil
+}
+
+// Re-encrypt every user in a database with the primary key of opts.Encryption, and rebuild their blind indexes with
+// its index key. Run it after changing either key, after turning on encryption to encrypt existing users, or with no
+// PrimaryKey to decrypt them. Users already in the right form are skipped, so it can be run again after a failure.
+// The server can keep running meanwhile, as long as it has every key that users may be encrypted with.
+//
+// Input:
+//   - opts DBOptions: Database to re-encrypt, with Encryption set. See OpenDB.
+// Output:
+//   - int: Number of users rewritten.
+//   - error: Any error that occurs, including: ErrEncryptionKey if opts.Encryption is nil or a user is encrypted with
+//   a key it doesn't have, a *DuplicateError if two users' blind indexes collide, failure to open or write the
+//   database.
+func ReencryptUsers(opts DBOptions) (int, error) {
+	if opts.Encryption == nil {
+		return 0, errors.Wrap(ErrEncryptionKey, "no encryption keys given")
+	}
+	store, err := OpenDB(opts)
+	if err != nil {
+		return 0, err
+	}
+	ds := store.(*dbStore)
+	defer closeGorm(ds.db)
+	rewritten := 0
+	var lastID uint
+	for {
+		var rows []userEntry
+		if err := ds.db.Where("id > ?", lastID).Order("id").Limit(reencryptBatchSize).Find(&rows).Error; err != nil {
+			return rewritten, err
+		}
+		for _, row := range rows {
+			lastID = row.ID
+			changed, err := ds.reencryptEntry(row)
+			if err != nil {
+				return rewritten, err
+			}
+			if changed {
+				rewritten++
+			}
+		}
+		if len(rows) < reencryptBatchSize {
+			return rewritten, nil
+		}
+	}
+}
+
+// Rewrite a stored entry in the form sealEntry gives, unless it is already in that form.
+// The write only goes ahead if the entry is unchanged since it was read, so concurrent changes aren't undone; if it
+// has changed, it is read and tried again.
+//
+// Calling:
+//   - ds *dbStore: Store to rewrite the entry in.
+// Input:
+//   - stored userEntry: Entry as read from the database.
+// Output:
+//   - bool: Was the entry rewritten?
+//   - error: Returned if the entry can't be decrypted or written, or kept changing.
+func (ds *dbStore) reencryptEntry(stored userEntry) (bool, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		entry := stored
+		if err := ds.openEntry(&entry); err != nil {
+			return false, err
+		}
+		sealed, err := ds.sealEntry(entry)
+		if err != nil {
+			return false, err
+		}
+		current := sealed.EmailKey == stored.EmailKey
+		for _, value := range stored.encryptedFields() {
+			current = current && ds.cipher.current(*value)
+		}
+		if current {
+			return false, nil
+		}
+		tx := ds.db.Model(&userEntry{}).Where("id = ? AND email_key = ?", stored.ID, stored.EmailKey)
+		updates := map[string]interface{}{"email_key": sealed.EmailKey}
+		sealedFields := sealed.encryptedFields()
+		for column, value := range stored.encryptedFields() {
+			updates[column] = *sealedFields[column]
+			if *value == "" {
+				tx = tx.Where(column + " = '' OR " + column + " IS NULL")
+			} else {
+				tx = tx.Where(column+" = ?", *value)
+			}
+		}
+		result := tx.Updates(updates)
+		if result.Error != nil {
+			return false, errors.Wrapf(translateDuplicate(result.Error), "user %d", stored.ID)
+		}
+		if result.RowsAffected > 0 {
+			return true, nil
+		}
+		// The entry changed after it was read.
+		id := stored.ID
+		stored = userEntry{}
+		if err := ds.db.Where("id = ?", id).Limit(1).Find(&stored).Error; err != nil {
+			return false, err
+		}
+		if stored.ID == 0 {
+			return false, nil
+		}
+	}
+	return false, errors.Errorf("User %d kept changing while being re-encrypted", stored.ID)
+}
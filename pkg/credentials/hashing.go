@@ -2,12 +2,23 @@ package credentials
 
 import (
 	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/subtle"
 	"encoding/base64"
+	"fmt"
 	"hash"
+	"math/bits"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
 )
 
 // stringEncode is shorthand for base64.URLEncoding.EncodeToString().
@@ -16,6 +27,10 @@ var stringEncode func([]byte) string = base64.RawURLEncoding.EncodeToString
 // stringDecode is shorthand for base64.URLEncoding.DecodeString().
 var stringDecode func(string) ([]byte, error) = base64.RawURLEncoding.DecodeString
 
+// phcEncode and phcDecode encode salts and digests in PHC strings, which use unpadded standard base64.
+var phcEncode func([]byte) string = base64.RawStdEncoding.EncodeToString
+var phcDecode func(string) ([]byte, error) = base64.RawStdEncoding.DecodeString
+
 // Creates a length 64 random byte string.
 //
 // Output:
@@ -38,48 +53,622 @@ func genSalt() ([]byte, error) {
 	return salt, nil
 }
 
+// hashRounds is the number of sha512 rounds used by DefaultHashPolicy.
 const hashRounds int = 131072 // 2^17
+
+// legacyHashRounds is the number of sha512 rounds used by every hash made before rounds were recorded.
+// It must never change, even if hashRounds does.
+const legacyHashRounds int = 131072 // 2^17
 const minHashMS int = 20
 
-// hfs is a map of string hash function names to a Go Hash object creator.
+// hashKeyLen is the length in bytes of the keys derived by argon2id and scrypt.
+const hashKeyLen int = 64
+
+// hashParams holds the tunable parameters of a hash function, such as argon2id memory or bcrypt cost.
+type hashParams map[string]int
+
+// A hashAlgorithm hashes and verifies passwords for one of the hash functions in hfs.
+// Hashes are self-describing strings that carry the algorithm, its parameters, the salt and the digest together;
+// this is the PHC string format ($id$v=version$key=value,...$salt$digest), or modular crypt format for bcrypt.
+type hashAlgorithm interface {
+	// hash hashes pwd with a new salt under params, returning the encoded hash to store.
+	hash(pwd []byte, params hashParams) (string, error)
+	// verify checks pwd against an encoded hash previously returned by hash.
+	verify(pwd []byte, encoded string) (bool, error)
+	// params gets the parameters an encoded hash was made with.
+	params(encoded string) (hashParams, error)
+}
+
+// hfs is a map of string hash function names to the algorithm that implements them.
 // See slowHash for an example of usage.
-var hfs map[string]func() hash.Hash = map[string]func() hash.Hash{
-	"sha512": sha512.New,
+var hfs map[string]hashAlgorithm = map[string]hashAlgorithm{
+	"sha512": phcAlgorithm{
+		id:         "sha512",
+		paramNames: []string{"i"},
+		derive:     sha512Derive,
+	},
+	"argon2id": phcAlgorithm{
+		id:         "argon2id",
+		version:    argon2.Version,
+		paramNames: []string{"m", "t", "p"},
+		derive:     argon2idDerive,
+	},
+	"scrypt": phcAlgorithm{
+		id:         "scrypt",
+		paramNames: []string{"ln", "r", "p"},
+		derive:     scryptDerive,
+	},
+	"bcrypt": bcryptAlgorithm{},
+	// PBKDF2 hashes come from other systems, through ImportUsers; HashPolicy can't select them for new hashes.
+	"pbkdf2-sha1": pbkdf2Algorithm{phcAlgorithm{
+		id:         "pbkdf2-sha1",
+		paramNames: []string{"i"},
+		derive:     pbkdf2Derive(sha1.New),
+	}},
+	"pbkdf2-sha256": pbkdf2Algorithm{phcAlgorithm{
+		id:         "pbkdf2-sha256",
+		paramNames: []string{"i"},
+		derive:     pbkdf2Derive(sha256.New),
+	}},
+	"pbkdf2-sha512": pbkdf2Algorithm{phcAlgorithm{
+		id:         "pbkdf2-sha512",
+		paramNames: []string{"i"},
+		derive:     pbkdf2Derive(sha512.New),
+	}},
+}
+
+// hashIDs maps the identifier at the start of an encoded hash to its name in hfs.
+// Anything not listed here uses its identifier as its name.
+var hashIDs map[string]string = map[string]string{
+	// passlib's pbkdf2_sha1 hashes start with $pbkdf2$.
+	"pbkdf2": "pbkdf2-sha1",
+	"2a":     "bcrypt",
+	"2b":     "bcrypt",
+	"2y":     "bcrypt",
+}
+
+// A HashPolicy selects the hash function and parameters used for new password hashes.
+// Zero-valued parameters are replaced with the values from DefaultHashPolicy.
+type HashPolicy struct {
+	// Algorithm is one of "argon2id", "scrypt", "bcrypt" or "sha512".
+	Algorithm string
+	// Argon2Time, Argon2Memory (in KiB) and Argon2Threads tune argon2id.
+	Argon2Time    uint32
+	Argon2Memory  uint32
+	Argon2Threads uint8
+	// ScryptN (a power of 2), ScryptR and ScryptP tune scrypt.
+	ScryptN int
+	ScryptR int
+	ScryptP int
+	// BcryptCost tunes bcrypt, from 4 to 31.
+	BcryptCost int
+	// SHA512Rounds tunes sha512.
+	SHA512Rounds int
+}
+
+// Get the default HashPolicy.
+// This uses argon2id, following the second recommended option of RFC 9106.
+//
+// Output:
+//   - HashPolicy: Default hash algorithm and parameters.
+func DefaultHashPolicy() HashPolicy {
+	return HashPolicy{
+		Algorithm:     "argon2id",
+		Argon2Time:    3,
+		Argon2Memory:  64 * 1024,
+		Argon2Threads: 2,
+		ScryptN:       32768,
+		ScryptR:       8,
+		ScryptP:       1,
+		BcryptCost:    12,
+		SHA512Rounds:  hashRounds,
+	}
+}
+
+// Get the hash function name and parameters for new hashes made under the calling policy.
+//
+// Calling:
+//   - p HashPolicy: Policy to read.
+// Output:
+//   - string: Hash function name; a key in hfs.
+//   - hashParams: Parameters for the hash function.
+//   - error: Returned if the policy algorithm is not supported.
+func (p HashPolicy) hashFunc() (string, hashParams, error) {
+	def := DefaultHashPolicy()
+	if p.Algorithm == "" {
+		p.Algorithm = def.Algorithm
+	}
+	if _, ok := hfs[p.Algorithm]; !ok {
+		return "", nil, errors.Errorf("Hash function %s not supported", p.Algorithm)
+	}
+	var params hashParams
+	switch p.Algorithm {
+	case "argon2id":
+		params = hashParams{
+			"t": orDefault(int(p.Argon2Time), int(def.Argon2Time)),
+			"m": orDefault(int(p.Argon2Memory), int(def.Argon2Memory)),
+			"p": orDefault(int(p.Argon2Threads), int(def.Argon2Threads)),
+		}
+	case "scrypt":
+		params = hashParams{
+			"ln": bits.Len(uint(orDefault(p.ScryptN, def.ScryptN))) - 1,
+			"r":  orDefault(p.ScryptR, def.ScryptR),
+			"p":  orDefault(p.ScryptP, def.ScryptP),
+		}
+	case "bcrypt":
+		params = hashParams{
+			"cost": orDefault(p.BcryptCost, def.BcryptCost),
+		}
+	case "sha512":
+		params = hashParams{
+			"i": orDefault(p.SHA512Rounds, def.SHA512Rounds),
+		}
+	default:
+		return "", nil, errors.Errorf("Hash function %s can't be used for new hashes", p.Algorithm)
+	}
+	return p.Algorithm, params, nil
+}
+
+// Check whether an encoded hash was made under a different hash function or parameters than the calling policy.
+// Peppered hashes are checked by the hash of the peppered password; see Pepper.
+//
+// Calling:
+//   - p HashPolicy: Current policy.
+// Input:
+//   - encoded string: Encoded hash to check.
+// Output:
+//   - bool: Should the hash be replaced with one made under p?
+//   - error: Returned if the policy or the encoded hash is invalid.
+func (p HashPolicy) outdated(encoded string) (bool, error) {
+	name, params, err := p.hashFunc()
+	if err != nil {
+		return false, err
+	}
+	if _, encoded, err = splitPepper(encoded); err != nil {
+		return false, err
+	}
+	encodedName, alg, err := findHashAlgorithm(encoded)
+	if err != nil {
+		return false, err
+	}
+	if encodedName != name {
+		return true, nil
+	}
+	encodedParams, err := alg.params(encoded)
+	if err != nil {
+		return false, err
+	}
+	if len(encodedParams) != len(params) {
+		return true, nil
+	}
+	for key, value := range params {
+		if encodedParams[key] != value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Get value, or fallback if value is 0.
+//
+// Input:
+//   - value, fallback int: Value to use, and the value to use instead if it is 0.
+// Output:
+//   - int: value or fallback.
+func orDefault(value, fallback int) int {
+	if value == 0 {
+		return fallback
+	}
+	return value
+}
+
+// Find the algorithm that made an encoded hash.
+// Hashes in none of Gate's formats are checked by the registered HashVerifier that recognizes them, if any.
+//
+// Input:
+//   - encoded string: Encoded hash, starting with $id$, or in a format recognized by a HashVerifier.
+// Output:
+//   - string: Hash function name; a key in hfs, or the name of a HashVerifier.
+//   - hashAlgorithm: The algorithm for that name.
+//   - error: Returned if the hash is malformed or its algorithm is not supported.
+func findHashAlgorithm(encoded string) (string, hashAlgorithm, error) {
+	fields := strings.Split(encoded, "$")
+	if len(fields) >= 3 && fields[0] == "" {
+		name := fields[1]
+		if alias, ok := hashIDs[name]; ok {
+			name = alias
+		}
+		if alg, ok := hfs[name]; ok {
+			return name, alg, nil
+		}
+	}
+	if name, verifier := findHashVerifier(encoded); verifier != nil {
+		return name, verifierAlgorithm{name: name, verifier: verifier}, nil
+	}
+	if len(fields) < 3 || fields[0] != "" {
+		return "", nil, errors.New("Malformed password hash")
+	}
+	return "", nil, errors.Errorf("Hash function %s not supported", fields[1])
 }
 
 // Hashes a byte string VERY SLOWLY with a specific hashfunc supported by hfs.
 // Any private value used in auth MUST be hashed through slowHash.
+// If the pepper has a version, its key is mixed into pwd through an HMAC first, and the version is recorded in the
+// hash.
 //
 // Input:
-//   - pwd, salt byte: Password (or other string) to hash, and the salt to hash it with.
+//   - pwd []byte: Password (or other string) to hash. A new salt is generated for it.
 //   - hashFunc string: Hash function to use. Must be a key in hfs.
+//   - params hashParams: Parameters for the hash function.
+//   - pepper Pepper: Pepper to mix in; the zero Pepper mixes in nothing.
 // Output:
-//   - string: Output hashed value
-//   - error: Any error that occurs, including: unsupported hash function
-func slowHash(pwd, salt []byte, hashFunc string) (string, error) {
-	// Get hash func. Return error if not supported
-	f, ok := hfs[hashFunc]
+//   - string: Output hash, encoded with its pepper version, hash function, parameters and salt.
+//   - error: Any error that occurs, including: unsupported hash function, ErrPepperUnavailable if pepper.Version isn't
+//   in pepper.Keys
+func slowHash(pwd []byte, hashFunc string, params hashParams, pepper Pepper) (string, error) {
+	alg, ok := hfs[hashFunc]
 	if !ok {
 		return "", errors.Errorf("Hash function %s not supported", hashFunc)
 	}
-	hf := f()
-	pwd_full := append(pwd, salt...)
-	pwd_hash := make([]byte, base64.URLEncoding.EncodedLen(hf.Size()))
+	key, err := pepper.key(pepper.Version)
+	if err != nil {
+		return "", err
+	}
+	if key != nil {
+		pwd = pepperPassword(pwd, key)
+	}
+	encoded, err := alg.hash(pwd, params)
+	if err != nil {
+		return "", err
+	}
+	return joinPepper(pepper.Version, encoded), nil
+}
+
+// Checks a byte string against a hash made by slowHash.
+//
+// Input:
+//   - pwd []byte: Password (or other string) to check.
+//   - encoded string: The stored hash.
+//   - pepper Pepper: Pepper with the key of the version the hash records, if any.
+// Output:
+//   - bool: Does pwd match the stored hash?
+//   - error: Any error that occurs, including: unsupported hash function, malformed hash, ErrPepperUnavailable if the
+//   hash's pepper version isn't in pepper.Keys
+func checkHash(pwd []byte, encoded string, pepper Pepper) (bool, error) {
+	version, encoded, err := splitPepper(encoded)
+	if err != nil {
+		return false, err
+	}
+	key, err := pepper.key(version)
+	if err != nil {
+		return false, err
+	}
+	if key != nil {
+		pwd = pepperPassword(pwd, key)
+	}
+	_, alg, err := findHashAlgorithm(encoded)
+	if err != nil {
+		return false, err
+	}
+	return alg.verify(pwd, encoded)
+}
+
+// A phcHash is the decoded form of a PHC string.
+type phcHash struct {
+	id      string
+	version int
+	params  hashParams
+	salt    []byte
+	digest  []byte
+}
+
+// Encode the calling phcHash as a PHC string.
+//
+// Calling:
+//   - ph phcHash: Hash to encode.
+// Input:
+//   - paramNames []string: Parameter names in the order they should be written.
+// Output:
+//   - string: $id[$v=version]$key=value,...$salt$digest
+func (ph phcHash) encode(paramNames []string) string {
+	out := "$" + ph.id
+	if ph.version != 0 {
+		out += fmt.Sprintf("$v=%d", ph.version)
+	}
+	pairs := make([]string, len(paramNames))
+	for i, name := range paramNames {
+		pairs[i] = fmt.Sprintf("%s=%d", name, ph.params[name])
+	}
+	return out + "$" + strings.Join(pairs, ",") + "$" + phcEncode(ph.salt) + "$" + phcEncode(ph.digest)
+}
+
+// Decode a PHC string.
+//
+// Input:
+//   - encoded string: PHC string to decode.
+// Output:
+//   - phcHash: The decoded hash.
+//   - error: Returned if encoded is not a well-formed PHC string with salt and digest.
+func decodePHC(encoded string) (phcHash, error) {
+	fields := strings.Split(encoded, "$")
+	if len(fields) < 5 || fields[0] != "" {
+		return phcHash{}, errors.New("Malformed PHC string")
+	}
+	ph := phcHash{id: fields[1], params: make(hashParams)}
+	fields = fields[2:]
+	// The version field is optional.
+	if strings.HasPrefix(fields[0], "v=") {
+		version, err := strconv.Atoi(strings.TrimPrefix(fields[0], "v="))
+		if err != nil {
+			return phcHash{}, errors.Wrap(err, "Malformed PHC version")
+		}
+		ph.version = version
+		fields = fields[1:]
+	}
+	if len(fields) != 3 {
+		return phcHash{}, errors.New("Malformed PHC string")
+	}
+	if fields[0] != "" {
+		for _, pair := range strings.Split(fields[0], ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return phcHash{}, errors.Errorf("Malformed hash parameter %s", pair)
+			}
+			value, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return phcHash{}, errors.Wrapf(err, "Malformed hash parameter %s", pair)
+			}
+			ph.params[kv[0]] = value
+		}
+	}
+	var err error
+	if ph.salt, err = phcDecode(fields[1]); err != nil {
+		return phcHash{}, errors.Wrap(err, "Malformed PHC salt")
+	}
+	if ph.digest, err = phcDecode(fields[2]); err != nil {
+		return phcHash{}, errors.Wrap(err, "Malformed PHC digest")
+	}
+	return ph, nil
+}
+
+// phcAlgorithm is a hashAlgorithm stored as a PHC string, with a digest derived from the password and salt.
+type phcAlgorithm struct {
+	id         string
+	version    int
+	paramNames []string
+	derive     func(pwd, salt []byte, params hashParams) ([]byte, error)
+}
+
+func (alg phcAlgorithm) hash(pwd []byte, params hashParams) (string, error) {
+	salt, err := genSalt()
+	if err != nil {
+		return "", err
+	}
+	digest, err := alg.derive(pwd, salt, params)
+	if err != nil {
+		return "", err
+	}
+	return phcHash{id: alg.id, version: alg.version, params: params, salt: salt, digest: digest}.encode(alg.paramNames), nil
+}
+
+func (alg phcAlgorithm) verify(pwd []byte, encoded string) (bool, error) {
+	ph, err := decodePHC(encoded)
+	if err != nil {
+		return false, err
+	}
+	if ph.version != alg.version {
+		return false, errors.Errorf("Unsupported %s version %d", alg.id, ph.version)
+	}
+	digest, err := alg.derive(pwd, ph.salt, ph.params)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(digest, ph.digest) == 1, nil
+}
+
+func (alg phcAlgorithm) params(encoded string) (hashParams, error) {
+	ph, err := decodePHC(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return ph.params, nil
+}
+
+// sha512Derive is the original gate hash: sha512 run for i rounds.
+func sha512Derive(pwd, salt []byte, params hashParams) ([]byte, error) {
+	if params["i"] < 1 {
+		return nil, errors.Errorf("Invalid sha512 parameters %v", params)
+	}
+	hf := sha512.New()
+	pwd_full := append(append([]byte{}, pwd...), salt...)
+	var pwd_hash []byte
 	// Initial hash into pwd_hash
 	if _, err := hf.Write(pwd_full); err != nil {
-		return "", err
+		return nil, err
 	} else {
 		pwd_hash = hf.Sum(nil)
 	}
-	// Repeatedly hash for 2^17 rounds.
-	for i := 0; i < 131072; i++ {
+	// Repeatedly hash for the configured number of rounds.
+	for i := 0; i < params["i"]; i++ {
 		if _, err := hf.Write(pwd_hash); err != nil {
-			return "", err
+			return nil, err
 		} else {
 			pwd_hash = hf.Sum(nil)
 		}
 	}
-	// Encode using base64URL
-	encodedHash := stringEncode(pwd_hash)
-	return encodedHash, nil
+	return pwd_hash, nil
+}
+
+// argon2idDerive hashes with argon2id, using parameters t (passes), m (memory in KiB) and p (threads).
+func argon2idDerive(pwd, salt []byte, params hashParams) ([]byte, error) {
+	if params["t"] < 1 || params["m"] < 8 || params["p"] < 1 || params["p"] > 255 {
+		return nil, errors.Errorf("Invalid argon2id parameters %v", params)
+	}
+	return argon2.IDKey(pwd, salt, uint32(params["t"]), uint32(params["m"]), uint8(params["p"]), uint32(hashKeyLen)), nil
+}
+
+// scryptDerive hashes with scrypt, using parameters ln (log2 of N), r and p.
+func scryptDerive(pwd, salt []byte, params hashParams) ([]byte, error) {
+	if params["ln"] < 1 || params["ln"] > 62 {
+		return nil, errors.Errorf("Invalid scrypt parameters %v", params)
+	}
+	return scrypt.Key(pwd, salt, 1<<uint(params["ln"]), params["r"], params["p"], hashKeyLen)
+}
+
+// pbkdf2Derive gets a function hashing with PBKDF2 under hash function h, using parameter i (iterations).
+// The derived key is as long as the output of h, as in the hashes written by passlib and most other libraries.
+func pbkdf2Derive(h func() hash.Hash) func(pwd, salt []byte, params hashParams) ([]byte, error) {
+	return func(pwd, salt []byte, params hashParams) ([]byte, error) {
+		if params["i"] < 1 {
+			return nil, errors.Errorf("Invalid pbkdf2 parameters %v", params)
+		}
+		return pbkdf2.Key(pwd, salt, params["i"], h().Size(), h), nil
+	}
+}
+
+// pbkdf2Algorithm is a phcAlgorithm for PBKDF2 that also verifies hashes in the format written by passlib:
+// $pbkdf2-sha256$rounds$salt$digest, where the rounds have no i= key and the salt and digest are in passlib's ab64
+// encoding, which is unpadded base64 with . in place of +. passlib's pbkdf2_sha1 hashes use the identifier pbkdf2.
+type pbkdf2Algorithm struct {
+	phcAlgorithm
+}
+
+func (alg pbkdf2Algorithm) verify(pwd []byte, encoded string) (bool, error) {
+	ph, err := decodePBKDF2(encoded)
+	if err != nil {
+		return false, err
+	}
+	digest, err := alg.derive(pwd, ph.salt, ph.params)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(digest, ph.digest) == 1, nil
+}
+
+func (alg pbkdf2Algorithm) params(encoded string) (hashParams, error) {
+	ph, err := decodePBKDF2(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return ph.params, nil
+}
+
+// Decode a PBKDF2 hash, either a PHC string or a hash written by passlib.
+//
+// Input:
+//   - encoded string: Hash to decode.
+// Output:
+//   - phcHash: The decoded hash, with the rounds as parameter i.
+//   - error: Returned if encoded is neither a well-formed PHC string nor a well-formed passlib hash.
+func decodePBKDF2(encoded string) (phcHash, error) {
+	fields := strings.Split(encoded, "$")
+	if len(fields) != 5 || fields[0] != "" {
+		return decodePHC(encoded)
+	}
+	// PHC parameters are key=value pairs, so bare rounds mean passlib.
+	rounds, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return decodePHC(encoded)
+	}
+	ph := phcHash{id: fields[1], params: hashParams{"i": rounds}}
+	if ph.salt, err = ab64Decode(fields[3]); err != nil {
+		return phcHash{}, errors.Wrap(err, "Malformed passlib salt")
+	}
+	if ph.digest, err = ab64Decode(fields[4]); err != nil {
+		return phcHash{}, errors.Wrap(err, "Malformed passlib digest")
+	}
+	return ph, nil
+}
+
+// Decode passlib's ab64 encoding, which is unpadded standard base64 with . in place of +.
+//
+// Input:
+//   - encoded string: ab64 string.
+// Output:
+//   - []byte: Decoded bytes.
+//   - error: Returned if encoded isn't ab64.
+func ab64Decode(encoded string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.ReplaceAll(encoded, ".", "+"))
+}
+
+// bcryptAlgorithm hashes with bcrypt, using parameter cost. bcrypt hashes use modular crypt format ($2a$cost$...)
+// rather than PHC strings, and bcrypt generates its own salt.
+type bcryptAlgorithm struct{}
+
+func (bcryptAlgorithm) hash(pwd []byte, params hashParams) (string, error) {
+	out, err := bcrypt.GenerateFromPassword(pwd, params["cost"])
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+func (bcryptAlgorithm) verify(pwd []byte, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), pwd)
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (bcryptAlgorithm) params(encoded string) (hashParams, error) {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	if err != nil {
+		return nil, err
+	}
+	return hashParams{"cost": cost}, nil
+}
+
+// Convert a hash stored in the legacy PasswordHash, Salt and HashFunc columns to an encoded hash.
+// Legacy HashFunc values are either a bare name (sha512, which always used legacyHashRounds rounds) or a name
+// followed by parameters, like argon2id:m=65536,p=2,t=3. Digests and salts were stored in unpadded URL base64.
+//
+// Input:
+//   - passwordHash, salt, hashFunc string: Legacy column values.
+// Output:
+//   - string: Equivalent encoded hash.
+//   - error: Returned if the legacy values are malformed or the hash function is not supported.
+func legacyToEncoded(passwordHash, salt, hashFunc string) (string, error) {
+	name, paramStr := hashFunc, ""
+	if i := strings.Index(hashFunc, ":"); i >= 0 {
+		name, paramStr = hashFunc[:i], hashFunc[i+1:]
+	}
+	params := make(hashParams)
+	if paramStr != "" {
+		for _, pair := range strings.Split(paramStr, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return "", errors.Errorf("Malformed hash parameter %s", pair)
+			}
+			value, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return "", errors.Wrapf(err, "Malformed hash parameter %s", pair)
+			}
+			params[kv[0]] = value
+		}
+	}
+	// bcrypt already stored its own encoded hash.
+	if name == "bcrypt" {
+		return passwordHash, nil
+	}
+	alg, ok := hfs[name].(phcAlgorithm)
+	if !ok {
+		return "", errors.Errorf("Hash function %s not supported", name)
+	}
+	switch name {
+	case "sha512":
+		params["i"] = legacyHashRounds
+	case "scrypt":
+		params["ln"] = bits.Len(uint(params["n"])) - 1
+		delete(params, "n")
+	}
+	saltBytes, err := stringDecode(salt)
+	if err != nil {
+		return "", errors.Wrap(err, "Malformed legacy salt")
+	}
+	digest, err := stringDecode(passwordHash)
+	if err != nil {
+		return "", errors.Wrap(err, "Malformed legacy password hash")
+	}
+	return phcHash{id: alg.id, version: alg.version, params: params, salt: saltBytes, digest: digest}.encode(alg.paramNames), nil
 }
@@ -0,0 +1,306 @@
+package credentials
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// fastHashPolicy returns a policy for algorithm with cheap parameters, to keep tests quick.
+func fastHashPolicy(algorithm string) HashPolicy {
+	return HashPolicy{
+		Algorithm:     algorithm,
+		Argon2Time:    1,
+		Argon2Memory:  1024,
+		Argon2Threads: 1,
+		ScryptN:       1024,
+		ScryptR:       8,
+		ScryptP:       1,
+		BcryptCost:    4,
+	}
+}
+
+func TestHashAlgorithms(t *testing.T) {
+	for _, algorithm := range []string{"sha512", "argon2id", "scrypt", "bcrypt"} {
+		hashFunc, params, err := fastHashPolicy(algorithm).hashFunc()
+		if err != nil {
+			t.Errorf("%s: %v", algorithm, err)
+			continue
+		}
+		pwdHash, err := slowHash([]byte("password"), hashFunc, params, Pepper{})
+		if err != nil {
+			t.Errorf("%s: %v", algorithm, err)
+			continue
+		}
+		if match, err := checkHash([]byte("password"), pwdHash, Pepper{}); err != nil || !match {
+			t.Errorf("%s: correct password didn't match its hash (%v)", algorithm, err)
+		}
+		if match, _ := checkHash([]byte("wrongpassword"), pwdHash, Pepper{}); match {
+			t.Errorf("%s: incorrect password matched the hash", algorithm)
+		}
+		if outdated, err := fastHashPolicy(algorithm).outdated(pwdHash); err != nil || outdated {
+			t.Errorf("%s: hash is outdated under the policy that made it (%v)", algorithm, err)
+		}
+	}
+}
+
+func TestPHCFormat(t *testing.T) {
+	hashFunc, params, _ := fastHashPolicy("argon2id").hashFunc()
+	pwdHash, err := slowHash([]byte("password"), hashFunc, params, Pepper{})
+	if err != nil {
+		t.Error(err)
+	}
+	if !strings.HasPrefix(pwdHash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("Unexpected PHC string %s", pwdHash)
+	}
+	ph, err := decodePHC(pwdHash)
+	if err != nil {
+		t.Error(err)
+	}
+	if ph.id != "argon2id" || ph.version != 19 || ph.params["m"] != 1024 || len(ph.salt) != 64 || len(ph.digest) != hashKeyLen {
+		t.Errorf("PHC string %s decoded incorrectly", pwdHash)
+	}
+	// Hashes keep working when the policy that made them changes; sha512 rounds are read from the hash.
+	rounds, _ := slowHash([]byte("password"), "sha512", hashParams{"i": 1000}, Pepper{})
+	if match, err := checkHash([]byte("password"), rounds, Pepper{}); err != nil || !match {
+		t.Errorf("sha512 hash with 1000 rounds didn't verify (%v)", err)
+	}
+	for _, malformed := range []string{"", "plaintext", "$md4$salt$digest", "$argon2id$v=19$m=lots$c2FsdA$ZGlnZXN0", "$argon2id$v=19$m=8$!!!$ZGlnZXN0"} {
+		if _, err := checkHash([]byte("password"), malformed, Pepper{}); err == nil {
+			t.Errorf("Checked a password against malformed hash %q", malformed)
+		}
+	}
+	if _, _, err := (HashPolicy{Algorithm: "md4"}).hashFunc(); err == nil {
+		t.Error("Policy with an unsupported algorithm produced a hash function")
+	}
+}
+
+// PBKDF2 hashes from other systems should verify, but not be made for new passwords.
+func TestPBKDF2(t *testing.T) {
+	for _, pwdHash := range []string{
+		// Known-answer hashes from passlib's tests, for pbkdf2_sha1 and pbkdf2_sha512.
+		"$pbkdf2$1212$OB.dtnSEXZK8U5cgxU/GYQ$y5LKPOplRmok7CZp/aqVDVg8zGI",
+		"$pbkdf2-sha512$1212$RHY0Fr3IDMSVO/RSZyb5ow$eNLfBK.eVozomMr.1gYa17k9B7KIK25NOEshvhrSX.esqY3s.FvWZViXz4KoLlQI.BzY/YTNJOiKc5gBYFYGww",
+		// pbkdf2_sha256 in passlib's format, with its default 29000 rounds.
+		"$pbkdf2-sha256$29000$QydmzwqLbWCMjPLcpNgGvQ$YfT4jz.vUa6KIZpGo0NvvqSLS50kRIlSgKdtnsI9uu4",
+		// PHC strings, as written by other libraries.
+		"$pbkdf2-sha256$i=1000$c2FsdHNhbHQ$E196ZhRPzw+wA84EjzHwJO1cv/MFJdO6C/sxmUeTYqY",
+	} {
+		if match, err := checkHash([]byte("password"), pwdHash, Pepper{}); err != nil || !match {
+			t.Errorf("Correct password didn't match %s (%v)", pwdHash, err)
+		}
+		if match, _ := checkHash([]byte("wrongpassword"), pwdHash, Pepper{}); match {
+			t.Errorf("Incorrect password matched %s", pwdHash)
+		}
+		if outdated, err := DefaultHashPolicy().outdated(pwdHash); err != nil || !outdated {
+			t.Errorf("%s isn't outdated under the default policy (%v)", pwdHash, err)
+		}
+	}
+	if _, _, err := (HashPolicy{Algorithm: "pbkdf2-sha256"}).hashFunc(); err == nil {
+		t.Error("Policy selected pbkdf2 for new hashes")
+	}
+}
+
+// plainVerifier is a HashVerifier for a made-up format, plain:<password>.
+type plainVerifier struct{}
+
+func (plainVerifier) Recognizes(encoded string) bool { return strings.HasPrefix(encoded, "plain:") }
+func (plainVerifier) Verify(pwd []byte, encoded string) (bool, error) {
+	return "plain:"+string(pwd) == encoded, nil
+}
+
+// Foreign hashes should verify through their HashVerifier, and be replaced on the first login.
+func TestHashVerifiers(t *testing.T) {
+	RegisterHashVerifier("plain", plainVerifier{})
+	defer UnregisterHashVerifier("plain")
+	bcryptHash, _ := slowHash([]byte("password"), "bcrypt", hashParams{"cost": 4}, Pepper{})
+	if !strings.HasPrefix(bcryptHash, "$2a$") {
+		t.Errorf("Unexpected bcrypt hash %s", bcryptHash)
+	}
+	foreign := []string{
+		"pbkdf2_sha256$1000$saltsalt$E196ZhRPzw+wA84EjzHwJO1cv/MFJdO6C/sxmUeTYqY=",
+		"pbkdf2_sha1$1000$saltsalt$6f6/9Uv85mj94wGsyFVjzJ3HHvY=",
+		"$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/",
+		"5baa61e4c9b93f3f0682250b6cf8331b7ee68fd8",
+		"plain:password",
+		bcryptHash,
+	}
+	for _, pwdHash := range foreign {
+		if match, err := checkHash([]byte("password"), pwdHash, Pepper{}); err != nil || !match {
+			t.Errorf("Correct password didn't match %s (%v)", pwdHash, err)
+		}
+		if match, _ := checkHash([]byte("wrongpassword"), pwdHash, Pepper{}); match {
+			t.Errorf("Incorrect password matched %s", pwdHash)
+		}
+	}
+	if md5Crypt([]byte("a much longer password than sixteen bytes"), []byte("ab")) != "$1$ab$ZTj46kRB5W/DcsgaphZJd/" {
+		t.Error("md5crypt of a long password is wrong")
+	}
+	for _, malformed := range []string{"pbkdf2_sha256$many$saltsalt$E196", "pbkdf2_sha256$1000$saltsalt$!!!"} {
+		if _, err := checkHash([]byte("password"), malformed, Pepper{}); err == nil {
+			t.Errorf("Checked a password against malformed hash %q", malformed)
+		}
+	}
+	store := NewMemoryStore()
+	svc := NewService(store)
+	svc.Hashing = fastHashPolicy("argon2id")
+	for i, pwdHash := range foreign {
+		username := fmt.Sprintf("user%d", i)
+		store.addUser(&userEntry{Email: username + "@email.com", Username: username, PasswordHash: pwdHash})
+		if valid, _, _ := svc.ValidateUserCred(username, "wrongpassword"); valid {
+			t.Errorf("Validated a wrong password against %s", pwdHash)
+		}
+		if valid, _, err := svc.ValidateUserCred(username, "password"); !valid {
+			t.Errorf("Couldn't validate against %s: %v", pwdHash, err)
+		}
+		if entry, _ := store.findUserEntryByUsername(username); !strings.HasPrefix(entry.PasswordHash, "$argon2id$") {
+			t.Errorf("%s wasn't replaced on login; hash is %s", pwdHash, entry.PasswordHash)
+		}
+	}
+	UnregisterHashVerifier("plain")
+	if match, _ := checkHash([]byte("password"), "plain:password", Pepper{}); match {
+		t.Error("Unregistered verifier still matched")
+	}
+}
+
+// Entries stored with separate Salt and HashFunc columns should be converted when read, and still validate.
+func TestLegacyHashMigration(t *testing.T) {
+	store := NewMemoryStore()
+	svc := NewService(store)
+	svc.Hashing = fastHashPolicy("sha512")
+	svc.Hashing.SHA512Rounds = legacyHashRounds
+	salt, _ := genSalt()
+	digest, _ := sha512Derive([]byte("password"), salt, hashParams{"i": legacyHashRounds})
+	store.addUser(&userEntry{
+		Email:          "user@email.com",
+		Username:       "username",
+		PasswordHash:   stringEncode(digest),
+		LegacySalt:     stringEncode(salt),
+		LegacyHashFunc: "sha512",
+	})
+	if valid, _, err := svc.ValidateUserCred("username", "password"); !valid {
+		t.Errorf("Couldn't validate legacy entry: %v", err)
+	}
+	entry, _ := store.findUserEntryByUsername("username")
+	if entry.LegacySalt != "" || entry.LegacyHashFunc != "" || !strings.HasPrefix(entry.PasswordHash, "$sha512$i=131072$") {
+		t.Errorf("Legacy entry wasn't converted; hash is %s", entry.PasswordHash)
+	}
+	// Legacy sha512 entries don't depend on the policy's round count.
+	svc.Hashing.SHA512Rounds = 1000
+	store.addUser(&userEntry{
+		Email:          "tuned@email.com",
+		Username:       "tuned",
+		PasswordHash:   stringEncode(digest),
+		LegacySalt:     stringEncode(salt),
+		LegacyHashFunc: "sha512",
+	})
+	if valid, _, err := svc.ValidateUserCred("tuned", "password"); !valid {
+		t.Errorf("Couldn't validate legacy entry under a tuned policy: %v", err)
+	}
+	// Legacy argon2id entries recorded their parameters in HashFunc.
+	key, _ := argon2idDerive([]byte("password"), salt, hashParams{"m": 1024, "t": 1, "p": 1})
+	store.addUser(&userEntry{
+		Email:          "other@email.com",
+		Username:       "other",
+		PasswordHash:   stringEncode(key),
+		LegacySalt:     stringEncode(salt),
+		LegacyHashFunc: "argon2id:m=1024,p=1,t=1",
+	})
+	if valid, _, err := svc.ValidateUserCred("other", "password"); !valid {
+		t.Errorf("Couldn't validate legacy argon2id entry: %v", err)
+	}
+}
+
+// Users hashed under an old policy should be rehashed under the current one when they log in.
+func TestRehashOnLogin(t *testing.T) {
+	store := NewMemoryStore()
+	svc := NewService(store)
+	svc.Hashing = fastHashPolicy("sha512")
+	if err := svc.RegisterUser("user@email.com", "username", "password", nil); err != nil {
+		t.Error(err)
+	}
+	svc.Hashing = fastHashPolicy("argon2id")
+	// A failed login must not rehash anything.
+	svc.ValidateUserCred("username", "wrongpassword")
+	if entry, _ := store.findUserEntryByUsername("username"); !strings.HasPrefix(entry.PasswordHash, "$sha512$") {
+		t.Errorf("Failed login changed password hash to %s", entry.PasswordHash)
+	}
+	if valid, _, err := svc.ValidateUserCred("username", "password"); !valid {
+		t.Errorf("Couldn't validate user after policy change: %v", err)
+	}
+	if entry, _ := store.findUserEntryByUsername("username"); !strings.HasPrefix(entry.PasswordHash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("Password hash is %s after login", entry.PasswordHash)
+	}
+	// Stronger parameters for the same algorithm should also cause an upgrade.
+	svc.Hashing.Argon2Time = 2
+	if valid, _, err := svc.ValidateUserCred("username", "password"); !valid {
+		t.Errorf("Couldn't validate user after rehash: %v", err)
+	}
+	if entry, _ := store.findUserEntryByUsername("username"); !strings.HasPrefix(entry.PasswordHash, "$argon2id$v=19$m=1024,t=2,p=1$") {
+		t.Errorf("Password hash is %s after login", entry.PasswordHash)
+	}
+	if valid, _, err := svc.ValidateUserCred("username", "password"); !valid {
+		t.Errorf("Couldn't validate user after second rehash: %v", err)
+	}
+}
+
+// Peppered hashes need the pepper to check, and are rehashed with the current pepper version on login.
+func TestPepper(t *testing.T) {
+	key1, key2 := []byte("first pepper"), []byte("second pepper")
+	pepper := Pepper{Version: 1, Keys: map[int][]byte{1: key1}}
+	hashFunc, params, _ := fastHashPolicy("argon2id").hashFunc()
+	pwdHash, err := slowHash([]byte("password"), hashFunc, params, pepper)
+	if err != nil || !strings.HasPrefix(pwdHash, "$pepper$v=1$argon2id$v=19$") {
+		t.Errorf("Unexpected peppered hash %s (%v)", pwdHash, err)
+	}
+	if match, err := checkHash([]byte("password"), pwdHash, pepper); err != nil || !match {
+		t.Errorf("Correct password didn't match its peppered hash (%v)", err)
+	}
+	if match, _ := checkHash([]byte("password"), pwdHash, Pepper{Keys: map[int][]byte{1: key2}}); match {
+		t.Error("Password matched its hash under the wrong pepper")
+	}
+	if _, err := checkHash([]byte("password"), pwdHash, Pepper{}); !errors.Is(err, ErrPepperUnavailable) {
+		t.Errorf("Checking without the pepper returned %v", err)
+	}
+	if _, err := slowHash([]byte("password"), hashFunc, params, Pepper{Version: 2}); !errors.Is(err, ErrPepperUnavailable) {
+		t.Errorf("Hashing with a missing pepper version returned %v", err)
+	}
+	for _, malformed := range []string{"$pepper$v=x$argon2id$v=19$m=1,t=1,p=1$c2FsdA$ZGlnZXN0", "$pepper$v=1"} {
+		if _, err := checkHash([]byte("password"), malformed, pepper); err == nil {
+			t.Errorf("Checked a password against malformed hash %q", malformed)
+		}
+	}
+	store := NewMemoryStore()
+	svc := NewService(store)
+	svc.Hashing = fastHashPolicy("argon2id")
+	svc.RegisterUser("user@email.com", "username", "password", nil)
+	for _, step := range []struct {
+		pepper Pepper
+		prefix string
+	}{
+		{pepper, "$pepper$v=1$argon2id$"},
+		{Pepper{Version: 2, Keys: map[int][]byte{1: key1, 2: key2}}, "$pepper$v=2$argon2id$"},
+		{Pepper{Version: 2, Keys: map[int][]byte{2: key2}}, "$pepper$v=2$argon2id$"},
+		{Pepper{Keys: map[int][]byte{2: key2}}, "$argon2id$"},
+	} {
+		svc.Pepper = step.pepper
+		if valid, _, err := svc.ValidateUserCred("username", "password"); !valid {
+			t.Errorf("Couldn't validate user under pepper version %d: %v", step.pepper.Version, err)
+		}
+		if entry, _ := store.findUserEntryByUsername("username"); !strings.HasPrefix(entry.PasswordHash, step.prefix) {
+			t.Errorf("Password hash is %s after login under pepper version %d", entry.PasswordHash, step.pepper.Version)
+		}
+	}
+	// Without the key its hash was made with, nobody can log in.
+	svc.RegisterUser("other@email.com", "other", "password", nil)
+	svc.Pepper = Pepper{Version: 3, Keys: map[int][]byte{3: key1}}
+	svc.ChangeUserPassword("username", "password", "newpassword")
+	svc.Pepper = Pepper{Version: 4, Keys: map[int][]byte{4: key2}}
+	if valid, _, err := svc.ValidateUserCred("username", "newpassword"); valid || !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Validated a user whose pepper was removed: %v", err)
+	}
+	if valid, _, err := svc.ValidateUserCred("other", "password"); !valid {
+		t.Errorf("Couldn't validate an unpeppered user: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package credentials
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A passwordHistoryEntry holds one previous password hash of a user.
+// These are kept in a side table so that ChangeUserPassword can reject recently used passwords; see
+// Service.PasswordHistory.
+type passwordHistoryEntry struct {
+	ID           uint   `gorm:"autoIncrement,primaryKey"`
+	UserID       uint   `gorm:"index"`
+	PasswordHash string `gorm:"password"`
+	Created      time.Time
+}
+
+// Check whether a password matches the current or any remembered previous password of a user.
+//
+// Calling:
+//   - s *Service: Service whose PasswordHistory setting is used.
+// Input:
+//   - user userEntry: User the password is for.
+//   - password string: Candidate new password.
+// Output:
+//   - error: A *PasswordPolicyError with code "reused" if the password was used recently, any error from the store
+//   or from checking hashes, or nil.
+func (s *Service) checkPasswordHistory(user userEntry, password string) error {
+	if s.PasswordHistory <= 0 {
+		return nil
+	}
+	history, err := s.store.findPasswordHistory(user.ID, s.PasswordHistory)
+	if err != nil {
+		return err
+	}
+	hashes := []string{user.PasswordHash}
+	for _, entry := range history {
+		hashes = append(hashes, entry.PasswordHash)
+	}
+	for _, pwdHash := range hashes {
+		match, err := checkHash([]byte(password), pwdHash, s.Pepper)
+		if errors.Is(err, ErrPepperUnavailable) {
+			// Hashes made with a retired pepper can't be checked, but can't be logged in with either.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if match {
+			return &PasswordPolicyError{Violations: []PolicyViolation{
+				{"reused", "Password must not match a recently used password"},
+			}}
+		}
+	}
+	return nil
+}
+
+// Remember a user's outgoing password hash, and forget any beyond the newest PasswordHistory.
+//
+// Calling:
+//   - s *Service: Service whose PasswordHistory setting is used.
+// Input:
+//   - user userEntry: User whose password is about to change. Its PasswordHash is the one remembered.
+// Output:
+//   - error: Any error from the store.
+func (s *Service) recordPasswordHistory(user userEntry) error {
+	if s.PasswordHistory <= 0 {
+		return nil
+	}
+	err := s.store.addPasswordHistory(&passwordHistoryEntry{UserID: user.ID, PasswordHash: user.PasswordHash, Created: time.Now()})
+	if err != nil {
+		return err
+	}
+	return s.store.prunePasswordHistory(user.ID, s.PasswordHistory)
+}
@@ -0,0 +1,149 @@
+package credentials
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// ErrDuplicateUsername is returned when a username already belongs to another user.
+var ErrDuplicateUsername = errors.New("Username is already in use.")
+
+// ErrDuplicateUser is matched by every DuplicateError, whichever identifier is taken.
+var ErrDuplicateUser = errors.New("Email or username is already in use.")
+
+// Identifiers a DuplicateError can be about.
+const (
+	FieldEmail    = "email"
+	FieldUsername = "username"
+)
+
+// A DuplicateError is returned when a user can't be stored because another user already has its email or username,
+// in canonical form. Stores return it even when two registrations race, since the canonical forms are unique in the
+// store itself.
+type DuplicateError struct {
+	// Field is FieldEmail or FieldUsername.
+	Field string
+}
+
+// Describe the calling DuplicateError.
+//
+// Calling:
+//   - e *DuplicateError: Error to describe.
+// Output:
+//   - string: Error message, naming the identifier in use.
+func (e *DuplicateError) Error() string {
+	if e.Field == FieldUsername {
+		return ErrDuplicateUsername.Error()
+	}
+	return ErrDuplicateEmail.Error()
+}
+
+// Is lets errors.Is match a DuplicateError against ErrDuplicateUser, and ErrDuplicateEmail or ErrDuplicateUsername by
+// Field.
+//
+// Calling:
+//   - e *DuplicateError: Error to compare.
+// Input:
+//   - target error: Error to compare against.
+// Output:
+//   - bool: Is target ErrDuplicateUser, or the error for e.Field?
+func (e *DuplicateError) Is(target error) bool {
+	return target == ErrDuplicateUser ||
+		(target == ErrDuplicateEmail && e.Field == FieldEmail) ||
+		(target == ErrDuplicateUsername && e.Field == FieldUsername)
+}
+
+// Get the canonical form of an email, which lookups and uniqueness use. Emails are case-folded, so that
+// User@Email.com and user@email.com are the same user.
+//
+// Input:
+//   - email string: Email as given.
+// Output:
+//   - string: Canonical email.
+func emailKey(email string) string {
+	return cases.Fold().String(email)
+}
+
+// Get the canonical form of a username, which lookups and uniqueness use. Usernames are NFKC-normalized, so that
+// usernames that look the same, like "ｆｒｅｄ" and "fred", are the same user. Case is kept.
+//
+// Input:
+//   - username string: Username as given.
+// Output:
+//   - string: Canonical username.
+func usernameKey(username string) string {
+	return norm.NFKC.String(username)
+}
+
+// Set the canonical identifiers of the calling userEntry from its email and username.
+// Stores call this whenever they write an entry.
+//
+// Calling:
+//   - u *userEntry: Entry to update, in place.
+func (u *userEntry) setKeys() {
+	u.EmailKey = emailKey(u.Email)
+	u.UsernameKey = usernameKey(u.Username)
+}
+
+// Convert a database error from a unique index on a canonical identifier into a DuplicateError.
+// Drivers don't share error types, so this matches the messages of sqlite ("UNIQUE constraint failed"), postgres
+// ("duplicate key value violates unique constraint") and mysql ("Duplicate entry"), which all name the index or column.
+//
+// Input:
+//   - err error: Error from writing a userEntry.
+// Output:
+//   - error: A *DuplicateError if err is a unique violation on email_key or username_key; otherwise err.
+func translateDuplicate(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := strings.ToLower(err.Error())
+	if !strings.Contains(msg, "unique") && !strings.Contains(msg, "duplicate") {
+		return err
+	}
+	switch {
+	case strings.Contains(msg, "email_key"):
+		return &DuplicateError{Field: FieldEmail}
+	case strings.Contains(msg, "username_key"):
+		return &DuplicateError{Field: FieldUsername}
+	}
+	return err
+}
+
+// Find the identifier an entry would share with another entry.
+//
+// Calling:
+//   - u userEntry: Entry to check, with its keys set.
+// Input:
+//   - other userEntry: Entry to compare against.
+// Output:
+//   - error: A *DuplicateError if u and other are different entries sharing a canonical identifier; otherwise nil.
+func (u userEntry) conflictsWith(other userEntry) error {
+	if other.ID == u.ID {
+		return nil
+	}
+	if other.EmailKey == u.EmailKey {
+		return &DuplicateError{Field: FieldEmail}
+	}
+	if other.UsernameKey == u.UsernameKey {
+		return &DuplicateError{Field: FieldUsername}
+	}
+	return nil
+}
+
+// Describe two entries that share a canonical identifier, for migrations that can't make identifiers unique.
+//
+// Input:
+//   - field string: FieldEmail or FieldUsername.
+//   - key string: The shared canonical identifier.
+//   - first, second uint: IDs of the entries.
+// Output:
+//   - error: Error asking for one of the entries to be changed.
+func duplicateKeyError(field, key string, first, second uint) error {
+	return fmt.Errorf("users %d and %d have the same %s %q in canonical form; change one of them and migrate again",
+		first, second, field, key)
+}
@@ -0,0 +1,246 @@
+package credentials
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// User statuses, stored in the Status column of each userEntry.
+// Entries from before the Status column was added have an empty status, which counts as StatusActive.
+const (
+	// StatusActive users can log in normally.
+	StatusActive = "active"
+	// StatusDisabled users keep their data, but can't log in or use their tokens until re-enabled.
+	StatusDisabled = "disabled"
+	// StatusDeleted users are treated as if they don't exist, but can be restored until the restore window passes.
+	StatusDeleted = "deleted"
+)
+
+// ErrUserDisabled is returned by ValidateUserCred and CheckUserStatus for users that have been disabled.
+var ErrUserDisabled = errors.New("Account disabled")
+
+// ErrUserDeleted is returned by CheckUserStatus for users that have been deleted.
+var ErrUserDeleted = errors.New("Account deleted")
+
+// ErrRestoreExpired is returned by RestoreUser once a deleted user's restore window has passed.
+var ErrRestoreExpired = errors.New("Restore window has passed")
+
+// ErrTokenRevoked is returned by CheckTokenIssued for tokens issued before their user's password last changed.
+var ErrTokenRevoked = errors.New("Token revoked")
+
+// DefaultRestoreWindow is how long a deleted user can be restored for, unless a Service says otherwise.
+const DefaultRestoreWindow time.Duration = time.Hour * 24 * 30
+
+// Get the status of the calling userEntry.
+//
+// Calling:
+//   - u userEntry: Entry to check.
+// Output:
+//   - string: One of StatusActive, StatusDisabled or StatusDeleted.
+func (u userEntry) status() string {
+	if u.Status == "" {
+		return StatusActive
+	}
+	return u.Status
+}
+
+// Check whether the calling userEntry was deleted longer ago than a restore window.
+//
+// Calling:
+//   - u userEntry: Entry to check.
+// Input:
+//   - window time.Duration: Restore window.
+//   - now time.Time: Current time.
+// Output:
+//   - bool: Is u deleted, and past its restore window?
+func (u userEntry) deleteExpired(window time.Duration, now time.Time) bool {
+	return u.status() == StatusDeleted && now.Sub(u.DeletedAt) > window
+}
+
+// Permanently remove a userEntry if it was deleted and its restore window has passed.
+// This is called whenever an entry is read, so expired users are purged lazily and their email and username are
+// freed for new registrations.
+//
+// Calling:
+//   - s *Service: Service whose RestoreWindow and store are used.
+// Input:
+//   - entry userEntry: Entry to check.
+// Output:
+//   - userEntry: entry, or the empty userEntry if it was purged.
+//   - error: Any error from the store.
+func (s *Service) purgeIfExpired(entry userEntry) (userEntry, error) {
+	if entry.Empty() || !entry.deleteExpired(s.RestoreWindow, time.Now()) {
+		return entry, nil
+	}
+	if err := s.store.deleteUser(&entry); err != nil {
+		return entry, err
+	}
+	s.Log("User %s purged after its restore window passed", entry.Username)
+	return userEntry{}, nil
+}
+
+// Find a user by username and set their status.
+//
+// Calling:
+//   - s *Service: Service whose store holds the user.
+// Input:
+//   - username string: Username to change.
+//   - from []string: Statuses the user may currently have. If their status isn't one of these, nothing changes.
+//   - to string: New status.
+// Output:
+//   - error: Any error that occurs, including: ErrUserNotFound, user has the wrong status, failure to update
+//   the store.
+func (s *Service) setUserStatus(username string, from []string, to string) error {
+	entry, err := s.findUserEntryByUsername(username)
+	if err != nil {
+		return err
+	}
+	if entry.Username == "" {
+		return errors.Wrap(ErrUserNotFound, username)
+	}
+	allowed := false
+	for _, status := range from {
+		allowed = allowed || entry.status() == status
+	}
+	if !allowed {
+		return errors.Errorf("User %s is %s", username, entry.status())
+	}
+	entry.Status = to
+	if to == StatusDeleted {
+		entry.DeletedAt = time.Now()
+	} else {
+		entry.DeletedAt = time.Time{}
+	}
+	return s.store.updateUser(&entry)
+}
+
+// Disable a user. Disabled users can't log in, and their tokens are rejected by the server, until they are enabled.
+// This action is initiated by an admin; no password is required for the user.
+//
+// Input:
+//   - username string: Username to disable.
+// Output:
+//   - error: Any error that occurs, including: ErrUserNotFound, user is deleted, failure to update the store.
+func (s *Service) DisableUser(username string) error {
+	return s.setUserStatus(username, []string{StatusActive, StatusDisabled}, StatusDisabled)
+}
+
+// Enable a disabled user.
+// This action is initiated by an admin; no password is required for the user.
+//
+// Input:
+//   - username string: Username to enable.
+// Output:
+//   - error: Any error that occurs, including: ErrUserNotFound, user is deleted, failure to update the store.
+func (s *Service) EnableUser(username string) error {
+	return s.setUserStatus(username, []string{StatusActive, StatusDisabled}, StatusActive)
+}
+
+// Soft-delete a user. Deleted users are treated as if they don't exist, but their email and username stay reserved
+// and they can be restored with RestoreUser until s.RestoreWindow passes. After that, they are purged.
+// This action is initiated by an admin; no password is required for the user.
+//
+// Input:
+//   - username string: Username to delete.
+// Output:
+//   - error: Any error that occurs, including: ErrUserNotFound, user is already deleted, failure to update the store.
+func (s *Service) DeleteUser(username string) error {
+	return s.setUserStatus(username, []string{StatusActive, StatusDisabled}, StatusDeleted)
+}
+
+// Restore a deleted user as an active user.
+// This action is initiated by an admin; no password is required for the user.
+//
+// Input:
+//   - username string: Username to restore.
+// Output:
+//   - error: Any error that occurs, including: ErrUserNotFound, user isn't deleted, ErrRestoreExpired if the
+//   restore window has passed, failure to update the store.
+func (s *Service) RestoreUser(username string) error {
+	entry, err := s.store.findUserEntryByUsername(username)
+	if err != nil {
+		return err
+	}
+	if entry.Username != "" && entry.deleteExpired(s.RestoreWindow, time.Now()) {
+		return ErrRestoreExpired
+	}
+	return s.setUserStatus(username, []string{StatusDeleted}, StatusActive)
+}
+
+// Permanently remove a user and their password history, whatever their status.
+// This action is initiated by an admin; no password is required for the user.
+//
+// Input:
+//   - username string: Username to purge.
+// Output:
+//   - error: Any error that occurs, including: ErrUserNotFound, failure to delete from the store.
+func (s *Service) PurgeUser(username string) error {
+	entry, err := s.store.findUserEntryByUsername(username)
+	if err != nil {
+		return err
+	}
+	if entry.Username == "" {
+		return errors.Wrap(ErrUserNotFound, username)
+	}
+	return s.store.deleteUser(&entry)
+}
+
+// Find a userEntry by username, or by email if no user has that username.
+//
+// Calling:
+//   - s *Service: Service whose store is searched.
+// Input:
+//   - name string: Username or email to find.
+// Output:
+//   - userEntry: The resulting userEntry, or the empty userEntry if not found.
+//   - error: Any error from the store.
+func (s *Service) findUserEntryByName(name string) (userEntry, error) {
+	entry, err := s.findUserEntryByUsername(name)
+	if err == nil && entry.Username == "" {
+		entry, err = s.findUserEntryByEmail(name)
+	}
+	return entry, err
+}
+
+// Check whether a token issued to a user at some time is still valid, for callers that hold a token.
+// Tokens are revoked whenever their user's password changes. Users that don't exist pass, since tokens may be issued
+// to email addresses that never registered.
+//
+// Input:
+//   - name string: Username or email the token was issued to.
+//   - issued time.Time: When the token was issued. Tokens record this in whole seconds, so tokens issued in the same
+//   second as a password change are revoked too.
+// Output:
+//   - error: ErrTokenRevoked if the token was revoked, any error from the store, or nil.
+func (s *Service) CheckTokenIssued(name string, issued time.Time) error {
+	entry, err := s.findUserEntryByName(name)
+	if err != nil {
+		return err
+	}
+	if !entry.TokensValidAfter.IsZero() && !issued.After(entry.TokensValidAfter.Truncate(time.Second)) {
+		return ErrTokenRevoked
+	}
+	return nil
+}
+
+// Check that a user may currently authenticate, for callers that hold a token rather than a password.
+// Users that don't exist pass, since tokens may be issued to email addresses that never registered.
+//
+// Input:
+//   - name string: Username or email of the user.
+// Output:
+//   - error: ErrUserDisabled or ErrUserDeleted if the user may not authenticate, any error from the store, or nil.
+func (s *Service) CheckUserStatus(name string) error {
+	entry, err := s.findUserEntryByName(name)
+	if err != nil {
+		return err
+	}
+	switch entry.status() {
+	case StatusDisabled:
+		return ErrUserDisabled
+	case StatusDeleted:
+		return ErrUserDeleted
+	}
+	return nil
+}
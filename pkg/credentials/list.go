@@ -0,0 +1,220 @@
+package credentials
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidQuery is returned by ListUsers for unknown sorts and statuses.
+var ErrInvalidQuery = errors.New("Invalid user query")
+
+// ErrInvalidCursor is returned by ListUsers for cursors it didn't make, or made for a different sort.
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// Ways ListUsers can sort users. Ties are broken by the order users were added.
+const (
+	SortByID       = "id"
+	SortByUsername = "username"
+	SortByEmail    = "email"
+	SortByCreated  = "created"
+)
+
+// DefaultListLimit is how many users ListUsers returns when the query doesn't say; MaxListLimit is the most it returns.
+const (
+	DefaultListLimit = 50
+	MaxListLimit     = 500
+)
+
+// A UserFilter selects users for ListUsers. Zero fields match every user.
+type UserFilter struct {
+	EmailPrefix    string
+	UsernamePrefix string
+	// Permission matches users whose effective permissions grant it, as HasPermission.
+	Permission string
+	// Status is one of StatusActive, StatusDisabled or StatusDeleted.
+	Status string
+	// CreatedAfter and CreatedBefore bound when the user registered; CreatedAfter is inclusive. Users registered before
+	// registration times were recorded count as created at the zero time.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+// A UserQuery describes a page of users to list.
+type UserQuery struct {
+	Filter UserFilter
+	// SortBy is one of the SortBy values; "" sorts by SortByID.
+	SortBy     string
+	Descending bool
+	// Limit is the most users to return; 0 uses DefaultListLimit, and it is capped at MaxListLimit.
+	Limit int
+	// Cursor is the NextCursor of the previous page, or "" for the first page. It must be used with the same SortBy
+	// and Descending.
+	Cursor string
+}
+
+// A UserPage is one page of users from ListUsers.
+type UserPage struct {
+	Users []User `json:"users"`
+	// NextCursor gets the next page when passed as UserQuery.Cursor; "" if this is the last page.
+	NextCursor string `json:"nextCursor"`
+}
+
+// A userCursor is the position of a user in a sorted list: its sort value, and its ID to break ties.
+type userCursor struct {
+	SortBy     string    `json:"s"`
+	Descending bool      `json:"d"`
+	ID         uint      `json:"i"`
+	Text       string    `json:"t,omitempty"`
+	Time       time.Time `json:"c,omitempty"`
+}
+
+// A userListQuery is a UserQuery as understood by a Store. Permission filtering is left to the Service, since it
+// depends on roles.
+type userListQuery struct {
+	filter     UserFilter
+	sortBy     string
+	descending bool
+	// after is the position to list from, exclusive; nil to list from the start.
+	after *userCursor
+	limit int
+}
+
+// Get the position of the calling userEntry in a sorted list.
+//
+// Calling:
+//   - u userEntry: Entry to locate.
+// Input:
+//   - sortBy string: One of the SortBy values.
+//   - descending bool: Is the list in descending order?
+// Output:
+//   - userCursor: Position of u.
+func (u userEntry) cursor(sortBy string, descending bool) userCursor {
+	c := userCursor{SortBy: sortBy, Descending: descending, ID: u.ID}
+	switch sortBy {
+	case SortByUsername:
+		c.Text = u.Username
+	case SortByEmail:
+		c.Text = u.Email
+	case SortByCreated:
+		c.Time = u.CreatedAt
+	}
+	return c
+}
+
+// Encode a userCursor for UserPage.NextCursor.
+//
+// Input:
+//   - c userCursor: Cursor to encode.
+// Output:
+//   - string: Opaque cursor.
+func encodeCursor(c userCursor) string {
+	encoded, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// Decode a cursor made by encodeCursor, checking that it was made for a sort.
+//
+// Input:
+//   - cursor string: Opaque cursor.
+//   - sortBy string: Sort the cursor must be for.
+//   - descending bool: Sort order the cursor must be for.
+// Output:
+//   - *userCursor: Decoded cursor.
+//   - error: ErrInvalidCursor if the cursor can't be decoded or was made for a different sort.
+func decodeCursor(cursor, sortBy string, descending bool) (*userCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := &userCursor{}
+	if err := json.Unmarshal(raw, c); err != nil || c.SortBy != sortBy || c.Descending != descending {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// List users matching a filter, one page at a time.
+//
+// Input:
+//   - query UserQuery: Filter, sort and page to list.
+// Output:
+//   - UserPage: Matching users, with their effective permissions, and the cursor for the next page.
+//   - error: Any error that occurs, including: ErrInvalidQuery for an unknown sort or status, ErrInvalidCursor, failure
+//   to read the store.
+func (s *Service) ListUsers(query UserQuery) (UserPage, error) {
+	page := UserPage{Users: []User{}}
+	if query.SortBy == "" {
+		query.SortBy = SortByID
+	}
+	switch query.SortBy {
+	case SortByID, SortByUsername, SortByEmail, SortByCreated:
+	default:
+		return page, errors.Wrapf(ErrInvalidQuery, "can't sort users by %s", query.SortBy)
+	}
+	switch query.Filter.Status {
+	case "", StatusActive, StatusDisabled, StatusDeleted:
+	default:
+		return page, errors.Wrapf(ErrInvalidQuery, "unknown user status %s", query.Filter.Status)
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	} else if limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+	storeQuery := userListQuery{
+		filter:     query.Filter,
+		sortBy:     query.SortBy,
+		descending: query.Descending,
+		limit:      limit + 1,
+	}
+	if query.Cursor != "" {
+		after, err := decodeCursor(query.Cursor, query.SortBy, query.Descending)
+		if err != nil {
+			return page, err
+		}
+		storeQuery.after = after
+	}
+	// The store can't filter by permission, so keep reading until the page is full or the store runs out.
+	// The page holds one user more than asked for, to tell whether there is a next page.
+	// Roles are read once for the whole call, and each batch's role bindings in one query.
+	var last userEntry
+	graph := &roleGraph{store: s.store}
+	for {
+		entries, err := s.store.listUsers(storeQuery)
+		if err != nil {
+			return page, err
+		}
+		kept := make([]userEntry, 0, len(entries))
+		for _, entry := range entries {
+			position := entry.cursor(query.SortBy, query.Descending)
+			storeQuery.after = &position
+			if entry, err = s.purgeIfExpired(entry); err != nil {
+				return page, err
+			} else if entry.ID != 0 {
+				kept = append(kept, entry)
+			}
+		}
+		users, err := s.publicUsers(kept, graph)
+		if err != nil {
+			return page, err
+		}
+		for i, user := range users {
+			if query.Filter.Permission != "" && !HasPermission(user, query.Filter.Permission) {
+				continue
+			}
+			if len(page.Users) == limit {
+				page.NextCursor = encodeCursor(last.cursor(query.SortBy, query.Descending))
+				return page, nil
+			}
+			page.Users = append(page.Users, user)
+			last = kept[i]
+		}
+		if len(entries) < storeQuery.limit {
+			return page, nil
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package credentials
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrLocked is matched (with errors.Is) by every LockedError.
+var ErrLocked = errors.New("Account temporarily locked")
+
+// A LockedError is returned by ValidateUserCred when a user has failed to log in too many times.
+type LockedError struct {
+	// Until is when the account unlocks.
+	Until time.Time
+}
+
+// Error describes the calling LockedError.
+//
+// Calling:
+//   - e *LockedError: Error to describe.
+// Output:
+//   - string: Error message, including the unlock time.
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%v until %s", ErrLocked, e.Until.UTC().Format(time.RFC3339))
+}
+
+// Is lets errors.Is match a LockedError against ErrLocked.
+//
+// Calling:
+//   - e *LockedError: Error to compare.
+// Input:
+//   - target error: Error to compare against.
+// Output:
+//   - bool: Is target ErrLocked?
+func (e *LockedError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// A LockoutPolicy controls how failed logins lock an account.
+// Once a user reaches MaxAttempts consecutive failures, their account is locked for Duration. Each further failure
+// after the lock expires doubles the lock, up to MaxDuration.
+type LockoutPolicy struct {
+	// MaxAttempts is the number of consecutive failures allowed before locking. 0 disables lockout.
+	MaxAttempts int
+	// Duration is how long the first lock lasts.
+	Duration time.Duration
+	// MaxDuration caps the length of a lock.
+	MaxDuration time.Duration
+	// ResetAfter is how long after the last failure the failure count is forgotten.
+	ResetAfter time.Duration
+}
+
+// Get the default LockoutPolicy.
+// This allows 5 attempts, then locks for 1 minute, doubling up to 1 hour. Failures are forgotten after 24 hours.
+//
+// Output:
+//   - LockoutPolicy: Default lockout settings.
+func DefaultLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		MaxAttempts: 5,
+		Duration:    time.Minute,
+		MaxDuration: time.Hour,
+		ResetAfter:  time.Hour * 24,
+	}
+}
+
+// Get how long an account with a number of failures should be locked under the calling policy.
+//
+// Calling:
+//   - p LockoutPolicy: Policy to apply.
+// Input:
+//   - failures int: Consecutive failed attempts.
+// Output:
+//   - time.Duration: Lock length. 0 if the account shouldn't be locked.
+func (p LockoutPolicy) lockFor(failures int) time.Duration {
+	if p.MaxAttempts <= 0 || failures < p.MaxAttempts {
+		return 0
+	}
+	lock := p.Duration
+	for i := p.MaxAttempts; i < failures && (p.MaxDuration <= 0 || lock < p.MaxDuration); i++ {
+		lock *= 2
+	}
+	if p.MaxDuration > 0 && lock > p.MaxDuration {
+		lock = p.MaxDuration
+	}
+	return lock
+}
+
+// Check whether a userEntry is locked.
+//
+// Calling:
+//   - u userEntry: Entry to check.
+// Input:
+//   - now time.Time: Current time.
+// Output:
+//   - error: A *LockedError if the entry is locked, otherwise nil.
+func (u userEntry) lockedError(now time.Time) error {
+	if u.LockedUntil.After(now) {
+		return &LockedError{Until: u.LockedUntil}
+	}
+	return nil
+}
+
+// Record a failed login for a userEntry, locking it if the lockout policy says so.
+// The failure is counted by the store in one atomic change, so parallel guesses can't all see the same count and
+// slip past the lock, and only the lockout columns are written, so a concurrent change to the user isn't undone.
+//
+// Calling:
+//   - s *Service: Service whose Lockout policy is used.
+// Input:
+//   - user *userEntry: Entry that failed to log in. Its lockout fields are updated in place.
+// Output:
+//   - error: Any error from updating the store.
+func (s *Service) recordLoginFailure(user *userEntry) error {
+	if s.Lockout.MaxAttempts <= 0 {
+		return nil
+	}
+	now := time.Now()
+	var resetBefore time.Time
+	if s.Lockout.ResetAfter > 0 {
+		resetBefore = now.Add(-s.Lockout.ResetAfter)
+	}
+	failures, err := s.store.addLoginFailure(user.ID, now, resetBefore)
+	if err != nil {
+		return err
+	}
+	user.FailedAttempts = failures
+	user.LastFailure = now
+	if lock := s.Lockout.lockFor(failures); lock > 0 {
+		user.LockedUntil = now.Add(lock)
+		s.Log("User %s locked until %s after %d failed attempts", user.Username, user.LockedUntil.UTC().Format(time.RFC3339), failures)
+		return s.store.lockUser(user.ID, user.LockedUntil)
+	}
+	return nil
+}
+
+// Clear the failed login count for a userEntry after a successful login.
+//
+// Calling:
+//   - s *Service: Service whose store holds the entry.
+// Input:
+//   - user *userEntry: Entry that logged in. Its lockout fields are cleared in place and in the store, if it had any
+//   failures.
+// Output:
+//   - error: Any error from updating the store.
+func (s *Service) recordLoginSuccess(user *userEntry) error {
+	if user.FailedAttempts == 0 && user.LockedUntil.IsZero() {
+		return nil
+	}
+	user.FailedAttempts = 0
+	user.LastFailure = time.Time{}
+	user.LockedUntil = time.Time{}
+	return s.store.clearLoginFailures(user.ID)
+}
+
+// Unlock a user's account and clear their failed login count.
+// This action is initiated by an admin; no password is required for the user.
+//
+// Input:
+//   - username string: Username to unlock.
+// Output:
+//   - error: Any error that occurs while unlocking, including: ErrUserNotFound, failure to update the store.
+func (s *Service) UnlockUser(username string) error {
+	entry, err := s.findUserEntryByUsername(username)
+	if err != nil {
+		return err
+	}
+	if entry.Username == "" {
+		return errors.Wrap(ErrUserNotFound, username)
+	}
+	return s.store.clearLoginFailures(entry.ID)
+}
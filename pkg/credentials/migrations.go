@@ -0,0 +1,568 @@
+package credentials
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// ErrSchemaOutdated is returned by OpenDB with ManualMigrations when the database hasn't been migrated to
+// LatestSchemaVersion.
+var ErrSchemaOutdated = errors.New("Database schema is outdated")
+
+// ErrSchemaTooNew is returned when a database has been migrated by a newer version of Gate than this one.
+var ErrSchemaTooNew = errors.New("Database schema is newer than this version of Gate")
+
+// A schemaMigration records a migration applied to a database, in the schema_migrations table.
+type schemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (schemaMigration) TableName() string { return "schema_migrations" }
+
+// A migration changes the database schema from the previous version to its own, or back.
+// Migrations work on frozen copies of the models as they were at that version, rather than the current models, so
+// that they always do the same thing. Every change is checked first, so migrations can adopt databases created by
+// AutoMigrate before migrations existed, whatever columns they already had.
+type migration struct {
+	name string
+	up   func(tx *gorm.DB) error
+	down func(tx *gorm.DB) error
+}
+
+// migrations are every schema change, in order; a migration's version is its position, from 1.
+// Released migrations must never change. Changing a model needs a new migration at the end.
+var migrations = []migration{
+	{
+		name: "create users",
+		up:   func(tx *gorm.DB) error { return createTables(tx, &userEntryV1{}) },
+		down: func(tx *gorm.DB) error { return tx.Migrator().DropTable(&userEntryV1{}) },
+	},
+	{
+		name: "add failed login tracking",
+		up:   func(tx *gorm.DB) error { return addColumns(tx, &lockoutColumnsV2{}) },
+		down: func(tx *gorm.DB) error { return dropColumns(tx, &lockoutColumnsV2{}) },
+	},
+	{
+		name: "create password history",
+		up:   func(tx *gorm.DB) error { return createTables(tx, &passwordHistoryEntryV3{}) },
+		down: func(tx *gorm.DB) error { return tx.Migrator().DropTable(&passwordHistoryEntryV3{}) },
+	},
+	{
+		name: "add account status",
+		up:   func(tx *gorm.DB) error { return addColumns(tx, &statusColumnsV4{}) },
+		down: func(tx *gorm.DB) error { return dropColumns(tx, &statusColumnsV4{}) },
+	},
+	{
+		name: "add email verification",
+		up:   func(tx *gorm.DB) error { return addColumns(tx, &verificationColumnsV5{}) },
+		down: func(tx *gorm.DB) error { return dropColumns(tx, &verificationColumnsV5{}) },
+	},
+	{
+		name: "add token revocation",
+		up:   func(tx *gorm.DB) error { return addColumns(tx, &revocationColumnsV6{}) },
+		down: func(tx *gorm.DB) error { return dropColumns(tx, &revocationColumnsV6{}) },
+	},
+	{
+		name: "add email change",
+		up:   func(tx *gorm.DB) error { return addColumns(tx, &emailChangeColumnsV7{}) },
+		down: func(tx *gorm.DB) error { return dropColumns(tx, &emailChangeColumnsV7{}) },
+	},
+	{
+		name: "create roles",
+		up: func(tx *gorm.DB) error {
+			return createTables(tx, &roleEntryV8{}, &roleBindingV8{}, &roleIncludeV8{})
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&roleEntryV8{}, &roleBindingV8{}, &roleIncludeV8{})
+		},
+	},
+	{
+		name: "create applications",
+		up: func(tx *gorm.DB) error {
+			return createTables(tx, &applicationEntryV9{}, &membershipEntryV9{}, &apiKeyEntryV9{})
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&applicationEntryV9{}, &membershipEntryV9{}, &apiKeyEntryV9{})
+		},
+	},
+	{
+		name: "add profiles",
+		up:   func(tx *gorm.DB) error { return addColumns(tx, &profileColumnsV10{}) },
+		down: func(tx *gorm.DB) error { return dropColumns(tx, &profileColumnsV10{}) },
+	},
+	{
+		name: "add registration times",
+		up: func(tx *gorm.DB) error {
+			if err := addColumns(tx, &createdColumnsV11{}); err != nil {
+				return err
+			}
+			if !tx.Migrator().HasIndex(&createdColumnsV11{}, "CreatedAt") {
+				if err := tx.Migrator().CreateIndex(&createdColumnsV11{}, "CreatedAt"); err != nil {
+					return err
+				}
+			}
+			// Users from before registration times were recorded count as created at the zero time, as in memory, so
+			// that they sort and page like any other value.
+			return tx.Model(&createdColumnsV11{}).Where("created_at IS NULL").Update("created_at", time.Time{}).Error
+		},
+		down: func(tx *gorm.DB) error { return dropColumns(tx, &createdColumnsV11{}) },
+	},
+	{
+		name: "add canonical identifiers",
+		up: func(tx *gorm.DB) error {
+			if err := addColumns(tx, &identifierColumnsV12{}); err != nil {
+				return err
+			}
+			if err := backfillIdentifiers(tx); err != nil {
+				return err
+			}
+			for _, field := range []string{"EmailKey", "UsernameKey"} {
+				if tx.Migrator().HasIndex(&identifierColumnsV12{}, field) {
+					continue
+				}
+				if err := tx.Migrator().CreateIndex(&identifierColumnsV12{}, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		down: func(tx *gorm.DB) error {
+			for _, field := range []string{"EmailKey", "UsernameKey"} {
+				if !tx.Migrator().HasIndex(&identifierColumnsV12{}, field) {
+					continue
+				}
+				if err := tx.Migrator().DropIndex(&identifierColumnsV12{}, field); err != nil {
+					return err
+				}
+			}
+			return dropColumns(tx, &identifierColumnsV12{})
+		},
+	},
+	{
+		name: "add api key details",
+		up: func(tx *gorm.DB) error {
+			if err := addColumns(tx, &apiKeyColumnsV13{}); err != nil {
+				return err
+			}
+			if err := backfillAPIKeyPrefixes(tx); err != nil {
+				return err
+			}
+			if tx.Migrator().HasIndex(&apiKeyColumnsV13{}, "Prefix") {
+				return nil
+			}
+			return tx.Migrator().CreateIndex(&apiKeyColumnsV13{}, "Prefix")
+		},
+		down: func(tx *gorm.DB) error {
+			if tx.Migrator().HasIndex(&apiKeyColumnsV13{}, "Prefix") {
+				if err := tx.Migrator().DropIndex(&apiKeyColumnsV13{}, "Prefix"); err != nil {
+					return err
+				}
+			}
+			return dropColumns(tx, &apiKeyColumnsV13{})
+		},
+	},
+}
+
+// Frozen models used by migrations. Models adding columns to an existing table name only the new columns.
+
+type userEntryV1 struct {
+	ID           uint
+	Email        string
+	Username     string
+	PasswordHash string
+	Salt         string
+	HashFunc     string
+	Permissions  string
+}
+
+func (userEntryV1) TableName() string { return "user_entries" }
+
+type lockoutColumnsV2 struct {
+	FailedAttempts int
+	LastFailure    time.Time
+	LockedUntil    time.Time
+}
+
+func (lockoutColumnsV2) TableName() string { return "user_entries" }
+
+type passwordHistoryEntryV3 struct {
+	ID           uint
+	UserID       uint `gorm:"index"`
+	PasswordHash string
+	Created      time.Time
+}
+
+func (passwordHistoryEntryV3) TableName() string { return "password_history_entries" }
+
+type statusColumnsV4 struct {
+	Status    string `gorm:"default:active"`
+	DeletedAt time.Time
+}
+
+func (statusColumnsV4) TableName() string { return "user_entries" }
+
+type verificationColumnsV5 struct {
+	EmailVerified   bool
+	EmailVerifiedAt time.Time
+}
+
+func (verificationColumnsV5) TableName() string { return "user_entries" }
+
+type revocationColumnsV6 struct {
+	TokensValidAfter time.Time
+}
+
+func (revocationColumnsV6) TableName() string { return "user_entries" }
+
+type emailChangeColumnsV7 struct {
+	PreviousEmail      string
+	EmailRevertHash    string
+	EmailRevertExpires time.Time
+}
+
+func (emailChangeColumnsV7) TableName() string { return "user_entries" }
+
+type roleEntryV8 struct {
+	ID          uint
+	Name        string `gorm:"size:191;uniqueIndex"`
+	Permissions string
+}
+
+func (roleEntryV8) TableName() string { return "role_entries" }
+
+type roleBindingV8 struct {
+	ID     uint
+	UserID uint `gorm:"index"`
+	RoleID uint `gorm:"index"`
+}
+
+func (roleBindingV8) TableName() string { return "role_bindings" }
+
+type roleIncludeV8 struct {
+	ID             uint
+	RoleID         uint `gorm:"index"`
+	IncludedRoleID uint `gorm:"index"`
+}
+
+func (roleIncludeV8) TableName() string { return "role_includes" }
+
+type applicationEntryV9 struct {
+	ID       uint
+	Name     string `gorm:"size:191;uniqueIndex"`
+	Audience string
+	Settings string
+}
+
+func (applicationEntryV9) TableName() string { return "application_entries" }
+
+type membershipEntryV9 struct {
+	ID     uint
+	AppID  uint `gorm:"index"`
+	UserID uint `gorm:"index"`
+}
+
+func (membershipEntryV9) TableName() string { return "membership_entries" }
+
+type apiKeyEntryV9 struct {
+	ID      uint
+	AppID   uint   `gorm:"index"`
+	KeyHash string `gorm:"size:191;uniqueIndex"`
+}
+
+func (apiKeyEntryV9) TableName() string { return "api_key_entries" }
+
+type profileColumnsV10 struct {
+	DisplayName string
+	Locale      string
+	AvatarURL   string
+	Attributes  string
+}
+
+func (profileColumnsV10) TableName() string { return "user_entries" }
+
+type createdColumnsV11 struct {
+	CreatedAt time.Time `gorm:"index"`
+}
+
+func (createdColumnsV11) TableName() string { return "user_entries" }
+
+type identifierColumnsV12 struct {
+	EmailKey    string `gorm:"size:191;uniqueIndex"`
+	UsernameKey string `gorm:"size:191;uniqueIndex"`
+}
+
+func (identifierColumnsV12) TableName() string { return "user_entries" }
+
+type identifierRowV12 struct {
+	ID       uint
+	Email    string
+	Username string
+}
+
+func (identifierRowV12) TableName() string { return "user_entries" }
+
+// Set the canonical identifiers of every user, in batches by ID.
+// Users that only differed by case or Unicode form can't be told apart once identifiers are canonical, so they stop
+// the migration until one of them is changed.
+//
+// Input:
+//   - tx *gorm.DB: Database to change.
+// Output:
+//   - error: Any error from the database, or an error naming two users with the same canonical email or username.
+func backfillIdentifiers(tx *gorm.DB) error {
+	const batchSize = 500
+	emails := map[string]uint{}
+	usernames := map[string]uint{}
+	var after uint
+	for {
+		var rows []identifierRowV12
+		if err := tx.Where("id > ?", after).Order("id").Limit(batchSize).Find(&rows).Error; err != nil {
+			return err
+		}
+		for _, row := range rows {
+			keys := identifierColumnsV12{EmailKey: emailKey(row.Email), UsernameKey: usernameKey(row.Username)}
+			if first, ok := emails[keys.EmailKey]; ok {
+				return duplicateKeyError(FieldEmail, keys.EmailKey, first, row.ID)
+			}
+			if first, ok := usernames[keys.UsernameKey]; ok {
+				return duplicateKeyError(FieldUsername, keys.UsernameKey, first, row.ID)
+			}
+			emails[keys.EmailKey] = row.ID
+			usernames[keys.UsernameKey] = row.ID
+			err := tx.Model(&identifierColumnsV12{}).Where("id = ?", row.ID).
+				Updates(map[string]interface{}{"email_key": keys.EmailKey, "username_key": keys.UsernameKey}).Error
+			if err != nil {
+				return err
+			}
+		}
+		if len(rows) < batchSize {
+			return nil
+		}
+		after = rows[len(rows)-1].ID
+	}
+}
+
+type apiKeyColumnsV13 struct {
+	Prefix     string `gorm:"size:191;uniqueIndex"`
+	Name       string
+	Scopes     string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastUsedAt time.Time
+	RevokedAt  time.Time
+}
+
+func (apiKeyColumnsV13) TableName() string { return "api_key_entries" }
+
+type apiKeyRowV13 struct {
+	ID uint
+}
+
+func (apiKeyRowV13) TableName() string { return "api_key_entries" }
+
+// Give every API key from before prefixes existed a random prefix, so admins can name it to rotate or revoke it, and
+// set its other new columns to their empty values. These keys are looked up by hash as before; the prefix isn't part
+// of them.
+//
+// Input:
+//   - tx *gorm.DB: Database to change.
+// Output:
+//   - error: Any error from the database.
+func backfillAPIKeyPrefixes(tx *gorm.DB) error {
+	var rows []apiKeyRowV13
+	if err := tx.Where("prefix IS NULL OR prefix = ''").Order("id").Find(&rows).Error; err != nil {
+		return err
+	}
+	for _, row := range rows {
+		prefix, err := newAPIKeyPrefix()
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&apiKeyColumnsV13{}).Where("id = ?", row.ID).Updates(map[string]interface{}{
+			"prefix": prefix, "name": "", "scopes": "[]", "created_at": time.Time{}, "expires_at": time.Time{},
+			"last_used_at": time.Time{}, "revoked_at": time.Time{},
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Create tables that don't exist yet.
+//
+// Input:
+//   - tx *gorm.DB: Database to change.
+//   - models ...interface{}: Models of the tables to create.
+// Output:
+//   - error: Any error from the database.
+func createTables(tx *gorm.DB, models ...interface{}) error {
+	for _, model := range models {
+		if tx.Migrator().HasTable(model) {
+			continue
+		}
+		if err := tx.Migrator().CreateTable(model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add every column of a model that its table doesn't have yet.
+//
+// Input:
+//   - tx *gorm.DB: Database to change.
+//   - model interface{}: Model naming the table and the columns to add.
+// Output:
+//   - error: Any error from the database.
+func addColumns(tx *gorm.DB, model interface{}) error {
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(model); err != nil {
+		return err
+	}
+	for _, field := range stmt.Schema.Fields {
+		if tx.Migrator().HasColumn(model, field.DBName) {
+			continue
+		}
+		if err := tx.Migrator().AddColumn(model, field.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Drop every column of a model that its table has.
+//
+// Input:
+//   - tx *gorm.DB: Database to change.
+//   - model interface{}: Model naming the table and the columns to drop.
+// Output:
+//   - error: Any error from the database.
+func dropColumns(tx *gorm.DB, model interface{}) error {
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(model); err != nil {
+		return err
+	}
+	for _, field := range stmt.Schema.Fields {
+		if !tx.Migrator().HasColumn(model, field.DBName) {
+			continue
+		}
+		if err := tx.Migrator().DropColumn(model, field.DBName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the latest schema version, which OpenDB migrates databases to.
+//
+// Output:
+//   - int: Version of the last migration.
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
+
+// Get the schema version of an open database.
+//
+// Input:
+//   - db *gorm.DB: Database to check.
+// Output:
+//   - int: Version of the last migration applied; 0 if none have been.
+//   - error: Any error from the database.
+func schemaVersion(db *gorm.DB) (int, error) {
+	if !db.Migrator().HasTable(&schemaMigration{}) {
+		return 0, nil
+	}
+	var version int
+	err := db.Model(&schemaMigration{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error
+	return version, err
+}
+
+// Migrate an open database up or down to a schema version. Each migration runs in its own transaction, and is
+// recorded in the schema_migrations table. Note that MySQL can't roll back schema changes, so a failed migration
+// there may need cleaning up by hand.
+//
+// Input:
+//   - db *gorm.DB: Database to migrate.
+//   - target int: Version to migrate to, from 0 (no tables) to LatestSchemaVersion.
+// Output:
+//   - error: Any error that occurs, including: ErrSchemaTooNew, invalid target, failure of a migration.
+func migrateSchema(db *gorm.DB, target int) error {
+	if target < 0 || target > len(migrations) {
+		return errors.Errorf("No schema version %d; the latest is %d", target, len(migrations))
+	}
+	if err := createTables(db, &schemaMigration{}); err != nil {
+		return err
+	}
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return errors.Wrapf(ErrSchemaTooNew, "version %d", version)
+	}
+	for ; version < target; version++ {
+		m := migrations[version]
+		applied := schemaMigration{Version: version + 1, Name: m.name, AppliedAt: time.Now()}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&applied).Error
+		})
+		if err != nil {
+			return errors.Wrapf(err, "Couldn't migrate to schema version %d (%s)", applied.Version, m.name)
+		}
+	}
+	for ; version > target; version-- {
+		m := migrations[version-1]
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&schemaMigration{}, version).Error
+		})
+		if err != nil {
+			return errors.Wrapf(err, "Couldn't revert schema version %d (%s)", version, m.name)
+		}
+	}
+	return nil
+}
+
+// Get the schema version of a database.
+//
+// Input:
+//   - opts DBOptions: Database to check. See OpenDB.
+// Output:
+//   - int: Version of the last migration applied; 0 for a new database. Compare with LatestSchemaVersion.
+//   - error: Any error that occurs, including: unsupported driver, failure to reach the database.
+func SchemaVersion(opts DBOptions) (int, error) {
+	db, err := openGorm(opts)
+	if err != nil {
+		return 0, err
+	}
+	defer closeGorm(db)
+	return schemaVersion(db)
+}
+
+// Migrate a database up or down to a schema version, on demand. OpenDB migrates to the latest version by itself,
+// unless DBOptions.ManualMigrations is set. Migrating down loses the data in the columns and tables it removes.
+//
+// Input:
+//   - opts DBOptions: Database to migrate. See OpenDB.
+//   - version int: Version to migrate to, from 0 (no tables) to LatestSchemaVersion.
+// Output:
+//   - error: Any error that occurs, including: unsupported driver, failure to reach the database, ErrSchemaTooNew,
+//   failure of a migration. Migrations before the one that failed stay applied.
+func MigrateDB(opts DBOptions, version int) error {
+	db, err := openGorm(opts)
+	if err != nil {
+		return err
+	}
+	defer closeGorm(db)
+	return migrateSchema(db, version)
+}
@@ -0,0 +1,100 @@
+package credentials
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrPepperUnavailable is returned for hashes made with a pepper version that isn't in Pepper.Keys.
+var ErrPepperUnavailable = errors.New("Password pepper unavailable")
+
+// pepperPrefix starts every peppered hash, which is stored as $pepper$v=<version> followed by the hash of the
+// peppered password, e.g. $pepper$v=1$argon2id$v=19$m=65536,t=3,p=2$salt$digest.
+const pepperPrefix = "$pepper$v="
+
+// A Pepper is a set of secret keys mixed into password hashes. Unlike salts, peppers aren't stored with the hashes, so
+// a copy of the store isn't enough to crack them. Passwords are run through HMAC-SHA256 under the key before they are
+// hashed, and each hash records the version of the key it was made with, so keys can be rotated: set Version to a new
+// key, keep the old one in Keys, and hashes are rehashed with the new key as their users log in.
+type Pepper struct {
+	// Version is the key new hashes are made with; 0 makes them without a pepper.
+	Version int
+	// Keys maps versions, from 1, to keys. A version must be kept until no hash uses it, or its users can't log in.
+	Keys map[int][]byte
+}
+
+// Mix a pepper key into a password.
+//
+// Input:
+//   - pwd []byte: Password to pepper.
+//   - key []byte: Pepper key.
+// Output:
+//   - []byte: The HMAC-SHA256 of pwd under key, in base64, so every hash function can take it.
+func pepperPassword(pwd, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(pwd)
+	return []byte(phcEncode(mac.Sum(nil)))
+}
+
+// Get the key for a pepper version.
+//
+// Calling:
+//   - p Pepper: Pepper to read.
+// Input:
+//   - version int: Version of the key; 0 for none.
+// Output:
+//   - []byte: The key; nil for version 0.
+//   - error: ErrPepperUnavailable if version isn't in p.Keys.
+func (p Pepper) key(version int) ([]byte, error) {
+	if version == 0 {
+		return nil, nil
+	}
+	key, ok := p.Keys[version]
+	if !ok {
+		return nil, errors.Wrapf(ErrPepperUnavailable, "version %d", version)
+	}
+	return key, nil
+}
+
+// Split a stored hash into the version of the pepper it was made with and the hash itself.
+//
+// Input:
+//   - encoded string: Stored hash, peppered or not.
+// Output:
+//   - int: Pepper version; 0 if encoded isn't peppered.
+//   - string: The hash of the peppered password, as made by the hash function.
+//   - error: Returned if encoded is peppered but malformed.
+func splitPepper(encoded string) (int, string, error) {
+	if !strings.HasPrefix(encoded, pepperPrefix) {
+		return 0, encoded, nil
+	}
+	rest := strings.TrimPrefix(encoded, pepperPrefix)
+	end := strings.Index(rest, "$")
+	if end < 0 {
+		return 0, "", errors.New("Malformed peppered hash")
+	}
+	version, err := strconv.Atoi(rest[:end])
+	if err != nil || version < 1 {
+		return 0, "", errors.Errorf("Malformed pepper version %s", rest[:end])
+	}
+	return version, rest[end:], nil
+}
+
+// Record the pepper version a hash was made with.
+//
+// Input:
+//   - version int: Pepper version; 0 for none.
+//   - encoded string: Hash made by the hash function.
+// Output:
+//   - string: The hash to store.
+func joinPepper(version int, encoded string) string {
+	if version == 0 {
+		return encoded
+	}
+	return fmt.Sprintf("%s%d%s", pepperPrefix, version, encoded)
+}
@@ -0,0 +1,251 @@
+package credentials
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// ErrPasswordPolicy is matched (with errors.Is) by every PasswordPolicyError.
+var ErrPasswordPolicy = errors.New("Password does not meet policy")
+
+// A PolicyViolation is one reason a password was rejected by a PasswordPolicy.
+type PolicyViolation struct {
+	// Code is a stable, machine-readable identifier, such as "too_short" or "breached".
+	Code string `json:"code"`
+	// Message is a human-readable description of the violation.
+	Message string `json:"message"`
+}
+
+// A PasswordPolicyError is returned when a password is rejected by a PasswordPolicy.
+type PasswordPolicyError struct {
+	Violations []PolicyViolation
+}
+
+// Error describes the calling PasswordPolicyError.
+//
+// Calling:
+//   - e *PasswordPolicyError: Error to describe.
+// Output:
+//   - string: Error message listing every violation.
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, violation := range e.Violations {
+		messages[i] = violation.Message
+	}
+	return fmt.Sprintf("%v: %s", ErrPasswordPolicy, strings.Join(messages, "; "))
+}
+
+// Is lets errors.Is match a PasswordPolicyError against ErrPasswordPolicy.
+//
+// Calling:
+//   - e *PasswordPolicyError: Error to compare.
+// Input:
+//   - target error: Error to compare against.
+// Output:
+//   - bool: Is target ErrPasswordPolicy?
+func (e *PasswordPolicyError) Is(target error) bool {
+	return target == ErrPasswordPolicy
+}
+
+// A PasswordPolicy restricts the passwords accepted by RegisterUser and ChangeUserPassword.
+// The zero PasswordPolicy accepts every password.
+type PasswordPolicy struct {
+	// MinLength and MaxLength bound the number of characters in a password. 0 means no bound.
+	MinLength int
+	MaxLength int
+	// RequireUpper, RequireLower, RequireDigit and RequireSymbol require at least one character of each class.
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// DisallowUserInfo rejects passwords that contain the username, the email, or the part of the email before the @.
+	DisallowUserInfo bool
+	// Breached is a set of known-breached passwords, loaded with LoadBreachedPasswords.
+	Breached BreachedPasswords
+}
+
+// generatedPasswordLength is the length of passwords made by PasswordPolicy.Generate, unless the policy bounds it.
+const generatedPasswordLength = 32
+
+// generatedPasswordChars are the characters passwords made by PasswordPolicy.Generate are drawn from. They include
+// every class a policy can require.
+const generatedPasswordChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_.!@#%+="
+
+// generateAttempts bounds how many random passwords PasswordPolicy.Generate tries before giving up.
+const generateAttempts = 100
+
+// BreachedPasswords is a set of known-breached passwords. Entries are either plaintext passwords or
+// uppercase hex SHA-1 digests of passwords.
+type BreachedPasswords map[string]struct{}
+
+// Load a list of breached passwords from a local file.
+// Each line holds one plaintext password, or one SHA-1 digest in hex, optionally followed by :count as in the
+// Have I Been Pwned downloads. Blank lines are skipped.
+//
+// Input:
+//   - path string: Path to the list.
+// Output:
+//   - BreachedPasswords: The loaded set.
+//   - error: Any error that occurs while reading the file.
+func LoadBreachedPasswords(path string) (BreachedPasswords, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	breached := make(BreachedPasswords)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if digest := strings.SplitN(line, ":", 2)[0]; isSHA1Hex(digest) {
+			line = strings.ToUpper(digest)
+		}
+		breached[line] = struct{}{}
+	}
+	return breached, scanner.Err()
+}
+
+// Check whether a string is a hex SHA-1 digest.
+//
+// Input:
+//   - s string: String to check.
+// Output:
+//   - bool: Is s 40 hex characters?
+func isSHA1Hex(s string) bool {
+	if len(s) != sha1.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// Check whether the calling set contains a password, in plaintext or as a SHA-1 digest.
+//
+// Calling:
+//   - bp BreachedPasswords: Set to check.
+// Input:
+//   - password string: Password to look for.
+// Output:
+//   - bool: Is password in the set?
+func (bp BreachedPasswords) contains(password string) bool {
+	if len(bp) == 0 {
+		return false
+	}
+	if _, ok := bp[password]; ok {
+		return true
+	}
+	digest := sha1.Sum([]byte(password))
+	_, ok := bp[strings.ToUpper(hex.EncodeToString(digest[:]))]
+	return ok
+}
+
+// Check a password against the calling policy.
+//
+// Calling:
+//   - p PasswordPolicy: Policy to check against.
+// Input:
+//   - password string: Password to check.
+//   - email, username string: The user the password is for; used by DisallowUserInfo.
+// Output:
+//   - error: A *PasswordPolicyError listing every violation, or nil if the password is accepted.
+func (p PasswordPolicy) Check(password, email, username string) error {
+	violations := make([]PolicyViolation, 0)
+	length := utf8.RuneCountInString(password)
+	if p.MinLength > 0 && length < p.MinLength {
+		violations = append(violations, PolicyViolation{"too_short", fmt.Sprintf("Password must be at least %d characters", p.MinLength)})
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		violations = append(violations, PolicyViolation{"too_long", fmt.Sprintf("Password must be at most %d characters", p.MaxLength)})
+	}
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, char := range password {
+		switch {
+		case unicode.IsUpper(char):
+			hasUpper = true
+		case unicode.IsLower(char):
+			hasLower = true
+		case unicode.IsDigit(char):
+			hasDigit = true
+		case !unicode.IsLetter(char):
+			hasSymbol = true
+		}
+	}
+	if p.RequireUpper && !hasUpper {
+		violations = append(violations, PolicyViolation{"missing_upper", "Password must contain an uppercase letter"})
+	}
+	if p.RequireLower && !hasLower {
+		violations = append(violations, PolicyViolation{"missing_lower", "Password must contain a lowercase letter"})
+	}
+	if p.RequireDigit && !hasDigit {
+		violations = append(violations, PolicyViolation{"missing_digit", "Password must contain a digit"})
+	}
+	if p.RequireSymbol && !hasSymbol {
+		violations = append(violations, PolicyViolation{"missing_symbol", "Password must contain a symbol"})
+	}
+	if p.DisallowUserInfo {
+		lowerPassword := strings.ToLower(password)
+		localPart := strings.SplitN(email, "@", 2)[0]
+		if username != "" && strings.Contains(lowerPassword, strings.ToLower(username)) {
+			violations = append(violations, PolicyViolation{"contains_username", "Password must not contain the username"})
+		}
+		if email != "" && (strings.Contains(lowerPassword, strings.ToLower(email)) ||
+			(len(localPart) >= 3 && strings.Contains(lowerPassword, strings.ToLower(localPart)))) {
+			violations = append(violations, PolicyViolation{"contains_email", "Password must not contain the email address"})
+		}
+	}
+	if p.Breached.contains(password) {
+		violations = append(violations, PolicyViolation{"breached", "Password appears in a list of breached passwords"})
+	}
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// Generate a random password accepted by the calling policy.
+//
+// Calling:
+//   - p PasswordPolicy: Policy the password must meet.
+// Input:
+//   - email, username string: The user the password is for; used by DisallowUserInfo.
+// Output:
+//   - string: The password.
+//   - error: Returned if no random bytes could be read, or no accepted password was found, e.g. because MaxLength is
+//   too short for the required character classes.
+func (p PasswordPolicy) Generate(email, username string) (string, error) {
+	length := generatedPasswordLength
+	if p.MinLength > length {
+		length = p.MinLength
+	}
+	if p.MaxLength > 0 && p.MaxLength < length {
+		length = p.MaxLength
+	}
+	max := big.NewInt(int64(len(generatedPasswordChars)))
+	for attempt := 0; attempt < generateAttempts; attempt++ {
+		password := make([]byte, length)
+		for i := range password {
+			n, err := rand.Int(rand.Reader, max)
+			if err != nil {
+				return "", err
+			}
+			password[i] = generatedPasswordChars[n.Int64()]
+		}
+		if p.Check(string(password), email, username) == nil {
+			return string(password), nil
+		}
+	}
+	return "", errors.Wrap(ErrPasswordPolicy, "Couldn't generate a password meeting the policy")
+}
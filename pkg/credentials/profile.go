@@ -0,0 +1,155 @@
+package credentials
+
+import (
+	"encoding/json"
+	"net/url"
+
+	"github.com/pkg/errors"
+	"golang.org/x/text/language"
+)
+
+// ErrInvalidProfile is returned by ChangeUserProfile for profile values that can't be stored.
+var ErrInvalidProfile = errors.New("Invalid profile")
+
+// MaxAttributesSize is the largest a user's attributes may be, in bytes of JSON.
+const MaxAttributesSize = 16 * 1024
+
+// Names of the profile fields, as used in JSON and by ProfileClaims.
+const (
+	ClaimDisplayName = "displayName"
+	ClaimLocale      = "locale"
+	ClaimAvatarURL   = "avatarUrl"
+)
+
+// A ProfileChange describes changes to a user's profile. Fields left nil are unchanged.
+type ProfileChange struct {
+	DisplayName *string `json:"displayName"`
+	// Locale is a BCP 47 language tag, like en-US. It is stored in canonical form.
+	Locale *string `json:"locale"`
+	// AvatarURL must be an absolute http or https URL.
+	AvatarURL *string `json:"avatarUrl"`
+	// Attributes are merged into the user's attributes; an attribute set to null is removed.
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// Decode a JSON attribute string, as stored in userEntry.
+//
+// Input:
+//   - encoded string: JSON attributes. "" and "null" decode to an empty set.
+// Output:
+//   - map[string]interface{}: Decoded attributes; never nil.
+func decodeAttributes(encoded string) map[string]interface{} {
+	attributes := make(map[string]interface{})
+	json.Unmarshal([]byte(encoded), &attributes)
+	if attributes == nil {
+		attributes = make(map[string]interface{})
+	}
+	return attributes
+}
+
+// Apply a ProfileChange to the calling userEntry, checking every value first.
+//
+// Calling:
+//   - u *userEntry: Entry to change, in place. Unchanged if an error is returned.
+// Input:
+//   - change ProfileChange: Changes to apply.
+// Output:
+//   - error: ErrInvalidProfile, wrapped with the reason, if any value is invalid.
+func (u *userEntry) applyProfileChange(change ProfileChange) error {
+	locale := u.Locale
+	if change.Locale != nil {
+		locale = ""
+		if *change.Locale != "" {
+			tag, err := language.Parse(*change.Locale)
+			if err != nil {
+				return errors.Wrapf(ErrInvalidProfile, "locale %s", *change.Locale)
+			}
+			locale = tag.String()
+		}
+	}
+	if change.AvatarURL != nil && *change.AvatarURL != "" {
+		avatar, err := url.Parse(*change.AvatarURL)
+		if err != nil || (avatar.Scheme != "http" && avatar.Scheme != "https") || avatar.Host == "" {
+			return errors.Wrapf(ErrInvalidProfile, "avatar URL %s", *change.AvatarURL)
+		}
+	}
+	attributes := decodeAttributes(u.Attributes)
+	for name, value := range change.Attributes {
+		if value == nil {
+			delete(attributes, name)
+		} else {
+			attributes[name] = value
+		}
+	}
+	encoded, err := json.Marshal(attributes)
+	if err != nil {
+		return errors.Wrap(ErrInvalidProfile, err.Error())
+	}
+	if len(encoded) > MaxAttributesSize {
+		return errors.Wrapf(ErrInvalidProfile, "attributes are larger than %d bytes", MaxAttributesSize)
+	}
+	if change.DisplayName != nil {
+		u.DisplayName = *change.DisplayName
+	}
+	if change.AvatarURL != nil {
+		u.AvatarURL = *change.AvatarURL
+	}
+	u.Locale = locale
+	u.Attributes = string(encoded)
+	return nil
+}
+
+// Change a user's profile: display name, locale, avatar URL and attributes.
+// Like ChangeUserPermissions, no password is required; callers must authenticate the change themselves.
+//
+// Input:
+//   - username string: Username to alter.
+//   - change ProfileChange: Changes to make. Nothing is changed if any value is invalid.
+// Output:
+//   - error: Any error that occurs, including: ErrUserNotFound, ErrInvalidProfile, failure to update the store.
+func (s *Service) ChangeUserProfile(username string, change ProfileChange) error {
+	entry, err := s.findUserEntryByUsername(username)
+	if err != nil {
+		return err
+	}
+	if entry.Username == "" || entry.status() == StatusDeleted {
+		return errors.Wrap(ErrUserNotFound, username)
+	}
+	if err := entry.applyProfileChange(change); err != nil {
+		return err
+	}
+	return s.store.updateUser(&entry)
+}
+
+// Get the claims a gate key should carry for a user's profile.
+//
+// Input:
+//   - user User: User the key is issued to.
+//   - names []string: Claims to include. ClaimDisplayName, ClaimLocale and ClaimAvatarURL name profile fields; any
+//   other name is looked up in the user's attributes.
+// Output:
+//   - map[string]interface{}: Claims, leaving out any that are unset; nil if there are none.
+func ProfileClaims(user User, names []string) map[string]interface{} {
+	var claims map[string]interface{}
+	for _, name := range names {
+		var value interface{}
+		switch name {
+		case ClaimDisplayName:
+			value = user.DisplayName
+		case ClaimLocale:
+			value = user.Locale
+		case ClaimAvatarURL:
+			value = user.AvatarURL
+		default:
+			value = user.Attributes[name]
+		}
+		if value == nil || value == "" {
+			continue
+		}
+		if claims == nil {
+			claims = make(map[string]interface{})
+		}
+		claims[name] = value
+	}
+	return claims
+}
@@ -0,0 +1,494 @@
+package credentials
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/jakenichols2719/gate/pkg/gatekey"
+	"github.com/pkg/errors"
+)
+
+// ErrRoleNotFound is returned when a named role doesn't exist.
+var ErrRoleNotFound = errors.New("Role not found")
+
+// ErrRoleCycle is returned by IncludeRole when the inclusion would make a role include itself.
+var ErrRoleCycle = errors.New("Role would include itself")
+
+// A roleEntry is a named set of permissions, stored in its own table.
+// Permissions are stored as JSON, in the same format as userEntry.Permissions.
+type roleEntry struct {
+	ID          uint   `gorm:"autoIncrement,primaryKey"`
+	Name        string `gorm:"size:191;uniqueIndex"`
+	Permissions string
+}
+
+// A roleBinding grants a role to a user.
+type roleBinding struct {
+	ID     uint `gorm:"autoIncrement,primaryKey"`
+	UserID uint `gorm:"index"`
+	RoleID uint `gorm:"index"`
+}
+
+// A roleInclude makes one role include every permission of another.
+type roleInclude struct {
+	ID             uint `gorm:"autoIncrement,primaryKey"`
+	RoleID         uint `gorm:"index"`
+	IncludedRoleID uint `gorm:"index"`
+}
+
+// A Role contains *public* information about a role.
+type Role struct {
+	Name        string          `json:"name"`
+	Permissions map[string]bool `json:"permissions"`
+	// Includes lists the roles whose permissions this role also grants.
+	Includes []string `json:"includes"`
+}
+
+// Merge a set of permissions into another. A permission set to false is an explicit deny, and always wins over
+// a grant of the same permission.
+//
+// Input:
+//   - into map[string]bool: Permissions to merge into. Changed in place.
+//   - from map[string]bool: Permissions to merge.
+func mergePermissions(into, from map[string]bool) {
+	for name, value := range from {
+		if granted, ok := into[name]; !ok || granted {
+			into[name] = value
+		}
+	}
+}
+
+// Check whether a user has a permission, such as billing:invoices:read.
+// Granted permissions may use wildcards, like billing:*, and denied permissions override every grant; see
+// gatekey.PermissionsAllow, which app servers holding a gate key can use to get the same answer.
+//
+// Input:
+//   - user User: User to check, with its effective permissions as returned by a Service.
+//   - perm string: Permission to check.
+// Output:
+//   - bool: Does user have perm?
+func HasPermission(user User, perm string) bool {
+	return gatekey.PermissionsAllow(user.Permissions, perm)
+}
+
+// Check whether a user is a Gate admin, with control of the dashboard. Unlike HasPermission, this needs
+// gatekey.AdminPermission granted by name, by the user or one of their roles: wildcards such as * don't match it.
+//
+// Input:
+//   - user User: User to check, with its effective permissions as returned by a Service.
+// Output:
+//   - bool: Is user a Gate admin?
+func IsAdmin(user User) bool {
+	return user.Permissions[gatekey.AdminPermission]
+}
+
+// Decode a JSON permission string, as stored in userEntry and roleEntry.
+//
+// Input:
+//   - encoded string: JSON permissions. "" and "null" decode to an empty set.
+// Output:
+//   - map[string]bool: Decoded permissions; never nil.
+func decodePermissions(encoded string) map[string]bool {
+	permissions := make(map[string]bool)
+	json.Unmarshal([]byte(encoded), &permissions)
+	if permissions == nil {
+		permissions = make(map[string]bool)
+	}
+	return permissions
+}
+
+// Find a role by name, failing if it doesn't exist.
+//
+// Calling:
+//   - s *Service: Service whose store is searched.
+// Input:
+//   - name string: Role name.
+// Output:
+//   - roleEntry: The role.
+//   - error: ErrRoleNotFound, or any error from the store.
+func (s *Service) findRole(name string) (roleEntry, error) {
+	role, err := s.store.findRoleByName(name)
+	if err != nil {
+		return role, err
+	}
+	if role.ID == 0 {
+		return role, errors.Wrap(ErrRoleNotFound, name)
+	}
+	return role, nil
+}
+
+// Get the IDs of a set of roles and every role they include, directly or indirectly.
+//
+// Calling:
+//   - s *Service: Service whose store is searched.
+// Input:
+//   - roleIDs []uint: Roles to start from.
+// Output:
+//   - []uint: IDs of roleIDs and every role they include, each once, in the order they were found.
+//   - error: Any error from the store.
+func (s *Service) resolveRoles(roleIDs []uint) ([]uint, error) {
+	seen := make(map[uint]bool)
+	resolved := make([]uint, 0, len(roleIDs))
+	queue := append([]uint{}, roleIDs...)
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		resolved = append(resolved, id)
+		includes, err := s.store.findRoleIncludes(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, include := range includes {
+			queue = append(queue, include.IncludedRoleID)
+		}
+	}
+	return resolved, nil
+}
+
+// A roleGraph is every role and the roles each directly includes, read from the store once so that the roles of many
+// users can be resolved without reading the store for each. It is read the first time it's needed.
+type roleGraph struct {
+	store    Store
+	roles    map[uint]roleEntry
+	includes map[uint][]uint
+}
+
+// Read the calling roleGraph from its store, unless it has been already.
+//
+// Calling:
+//   - g *roleGraph: Graph to read.
+// Output:
+//   - error: Any error from the store.
+func (g *roleGraph) load() error {
+	if g.roles != nil {
+		return nil
+	}
+	roles, err := g.store.listRoles()
+	if err != nil {
+		return err
+	}
+	includes, err := g.store.listRoleIncludes()
+	if err != nil {
+		return err
+	}
+	g.roles = make(map[uint]roleEntry, len(roles))
+	for _, role := range roles {
+		g.roles[role.ID] = role
+	}
+	g.includes = make(map[uint][]uint)
+	for _, include := range includes {
+		g.includes[include.RoleID] = append(g.includes[include.RoleID], include.IncludedRoleID)
+	}
+	return nil
+}
+
+// Get the IDs of a set of roles and every role they include, directly or indirectly. The graph must be loaded.
+//
+// Calling:
+//   - g *roleGraph: Loaded graph.
+// Input:
+//   - roleIDs []uint: Roles to start from.
+// Output:
+//   - []uint: IDs of roleIDs and every role they include, each once, in the order they were found.
+func (g *roleGraph) resolve(roleIDs []uint) []uint {
+	seen := make(map[uint]bool)
+	resolved := make([]uint, 0, len(roleIDs))
+	queue := append([]uint{}, roleIDs...)
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		resolved = append(resolved, id)
+		queue = append(queue, g.includes[id]...)
+	}
+	return resolved
+}
+
+// Get the public User for a userEntry, with its permissions resolved from its own permissions and its roles.
+//
+// Calling:
+//   - s *Service: Service whose store holds the user's roles.
+// Input:
+//   - entry userEntry: Entry to convert. The empty userEntry converts to the empty User.
+// Output:
+//   - User: Public user, whose Permissions are the effective permissions and whose Roles are the directly granted roles.
+//   - error: Any error from the store.
+func (s *Service) publicUser(entry userEntry) (User, error) {
+	users, err := s.publicUsers([]userEntry{entry}, &roleGraph{store: s.store})
+	if err != nil {
+		return User{}, err
+	}
+	return users[0], nil
+}
+
+// Get the public Users for a set of userEntry values, as publicUser does, reading the bindings of every user in one
+// query and the roles from a shared graph.
+//
+// Calling:
+//   - s *Service: Service whose store holds the users' roles.
+// Input:
+//   - entries []userEntry: Entries to convert.
+//   - graph *roleGraph: Role graph of s's store, read if any user has roles. Pass the same graph to convert several
+//   sets of entries while reading the roles once.
+// Output:
+//   - []User: Public users, in the order of entries.
+//   - error: Any error from the store.
+func (s *Service) publicUsers(entries []userEntry, graph *roleGraph) ([]User, error) {
+	ids := make([]uint, 0, len(entries))
+	for _, entry := range entries {
+		if entry.ID != 0 {
+			ids = append(ids, entry.ID)
+		}
+	}
+	direct := make(map[uint][]uint)
+	if len(ids) > 0 {
+		bindings, err := s.store.findRoleBindingsForUsers(ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, binding := range bindings {
+			direct[binding.UserID] = append(direct[binding.UserID], binding.RoleID)
+		}
+	}
+	if len(direct) > 0 {
+		if err := graph.load(); err != nil {
+			return nil, err
+		}
+	}
+	users := make([]User, len(entries))
+	for i, entry := range entries {
+		users[i] = entry.toUser()
+		if entry.ID == 0 {
+			continue
+		}
+		users[i].Roles = []string{}
+		roleIDs := direct[entry.ID]
+		for j, id := range graph.resolve(roleIDs) {
+			role := graph.roles[id]
+			if j < len(roleIDs) {
+				users[i].Roles = append(users[i].Roles, role.Name)
+			}
+			mergePermissions(users[i].Permissions, decodePermissions(role.Permissions))
+		}
+		sort.Strings(users[i].Roles)
+	}
+	return users, nil
+}
+
+// Create a role.
+//
+// Input:
+//   - name string: Role name. Must be unique.
+//   - permissions map[string]bool: Permissions the role grants, or denies if false.
+// Output:
+//   - error: Any error that occurs, including: name already in use, failure to add to the store.
+func (s *Service) CreateRole(name string, permissions map[string]bool) error {
+	if name == "" {
+		return errors.New("Role name is empty")
+	}
+	existing, err := s.store.findRoleByName(name)
+	if err != nil {
+		return err
+	}
+	if existing.ID != 0 {
+		return errors.Errorf("Role %s already exists", name)
+	}
+	perm, _ := json.Marshal(permissions)
+	return s.store.addRole(&roleEntry{Name: name, Permissions: string(perm)})
+}
+
+// Delete a role, revoking it from every user and removing it from every role that includes it.
+//
+// Input:
+//   - name string: Role to delete.
+// Output:
+//   - error: Any error that occurs, including: ErrRoleNotFound, failure to delete from the store.
+func (s *Service) DeleteRole(name string) error {
+	role, err := s.findRole(name)
+	if err != nil {
+		return err
+	}
+	return s.store.deleteRole(&role)
+}
+
+// Change the permissions of a role. This changes the effective permissions of every user granted the role, or a role
+// that includes it.
+//
+// Input:
+//   - name string: Role to alter.
+//   - newPermissions map[string]bool: New permissions. Overwrites any permissions with the same name.
+// Output:
+//   - error: Any error that occurs, including: ErrRoleNotFound, failure to update the store.
+func (s *Service) ChangeRolePermissions(name string, newPermissions map[string]bool) error {
+	role, err := s.findRole(name)
+	if err != nil {
+		return err
+	}
+	permissions := decodePermissions(role.Permissions)
+	for perm, value := range newPermissions {
+		permissions[perm] = value
+	}
+	encoded, err := json.Marshal(permissions)
+	if err != nil {
+		return err
+	}
+	role.Permissions = string(encoded)
+	return s.store.updateRole(&role)
+}
+
+// Get a role by name.
+//
+// Input:
+//   - name string: Role to find.
+// Output:
+//   - Role: The role, with its own permissions and the roles it directly includes.
+//   - error: Any error that occurs, including: ErrRoleNotFound, failure to read the store.
+func (s *Service) FindRole(name string) (Role, error) {
+	entry, err := s.findRole(name)
+	if err != nil {
+		return Role{}, err
+	}
+	role := Role{Name: entry.Name, Permissions: decodePermissions(entry.Permissions), Includes: []string{}}
+	includes, err := s.store.findRoleIncludes(entry.ID)
+	if err != nil {
+		return Role{}, err
+	}
+	for _, include := range includes {
+		included, err := s.store.findRoleByID(include.IncludedRoleID)
+		if err != nil {
+			return Role{}, err
+		}
+		role.Includes = append(role.Includes, included.Name)
+	}
+	sort.Strings(role.Includes)
+	return role, nil
+}
+
+// Make one role include every permission of another.
+//
+// Input:
+//   - name string: Role that includes.
+//   - include string: Role that is included.
+// Output:
+//   - error: Any error that occurs, including: ErrRoleNotFound, ErrRoleCycle if include already includes name,
+//   failure to update the store.
+func (s *Service) IncludeRole(name, include string) error {
+	role, err := s.findRole(name)
+	if err != nil {
+		return err
+	}
+	included, err := s.findRole(include)
+	if err != nil {
+		return err
+	}
+	closure, err := s.resolveRoles([]uint{included.ID})
+	if err != nil {
+		return err
+	}
+	for _, id := range closure {
+		if id == role.ID {
+			return ErrRoleCycle
+		}
+	}
+	existing, err := s.store.findRoleIncludes(role.ID)
+	if err != nil {
+		return err
+	}
+	for _, e := range existing {
+		if e.IncludedRoleID == included.ID {
+			return nil
+		}
+	}
+	return s.store.addRoleInclude(&roleInclude{RoleID: role.ID, IncludedRoleID: included.ID})
+}
+
+// Stop one role including another.
+//
+// Input:
+//   - name string: Role that includes.
+//   - include string: Role that is included.
+// Output:
+//   - error: Any error that occurs, including: ErrRoleNotFound, failure to update the store.
+func (s *Service) ExcludeRole(name, include string) error {
+	role, err := s.findRole(name)
+	if err != nil {
+		return err
+	}
+	included, err := s.findRole(include)
+	if err != nil {
+		return err
+	}
+	return s.store.deleteRoleInclude(&roleInclude{RoleID: role.ID, IncludedRoleID: included.ID})
+}
+
+// Find a user and a role by name, for granting or revoking.
+//
+// Calling:
+//   - s *Service: Service whose store is searched.
+// Input:
+//   - username, name string: Username and role name.
+// Output:
+//   - roleBinding: Binding between the two; it may not be stored.
+//   - bool: Is the role already granted to the user?
+//   - error: Any error that occurs, including: ErrUserNotFound, ErrRoleNotFound, failure to read the store.
+func (s *Service) findRoleBinding(username, name string) (roleBinding, bool, error) {
+	user, err := s.findUserEntryByUsername(username)
+	if err != nil {
+		return roleBinding{}, false, err
+	}
+	if user.Username == "" {
+		return roleBinding{}, false, errors.Wrap(ErrUserNotFound, username)
+	}
+	role, err := s.findRole(name)
+	if err != nil {
+		return roleBinding{}, false, err
+	}
+	binding := roleBinding{UserID: user.ID, RoleID: role.ID}
+	bindings, err := s.store.findRoleBindings(user.ID)
+	if err != nil {
+		return binding, false, err
+	}
+	for _, b := range bindings {
+		if b.RoleID == role.ID {
+			return b, true, nil
+		}
+	}
+	return binding, false, nil
+}
+
+// Grant a role to a user. Granting a role the user already has does nothing.
+//
+// Input:
+//   - username string: User to grant the role to.
+//   - name string: Role to grant.
+// Output:
+//   - error: Any error that occurs, including: ErrUserNotFound, ErrRoleNotFound, failure to update the store.
+func (s *Service) GrantRole(username, name string) error {
+	binding, granted, err := s.findRoleBinding(username, name)
+	if err != nil || granted {
+		return err
+	}
+	return s.store.addRoleBinding(&binding)
+}
+
+// Revoke a role from a user. Revoking a role the user doesn't have does nothing.
+//
+// Input:
+//   - username string: User to revoke the role from.
+//   - name string: Role to revoke.
+// Output:
+//   - error: Any error that occurs, including: ErrUserNotFound, ErrRoleNotFound, failure to update the store.
+func (s *Service) RevokeRole(username, name string) error {
+	binding, granted, err := s.findRoleBinding(username, name)
+	if err != nil || !granted {
+		return err
+	}
+	return s.store.deleteRoleBinding(&binding)
+}
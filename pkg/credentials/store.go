@@ -0,0 +1,991 @@
+package credentials
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Store is where a Service keeps its users, roles, applications and API keys: a database opened with OpenDB, or
+// memory, from NewMemoryStore. Those are the only implementations. The methods of Store are not exported, since they
+// deal in entry types holding private data such as password hashes, so it can't be implemented outside this package;
+// other databases are supported through OpenDB's drivers instead. Any number of stores may be open at once, each used
+// through its own Service.
+type Store interface {
+	// addUser adds a new userEntry to the store. The entry ID and canonical identifiers are set by the store.
+	// A *DuplicateError is returned if another entry has the same canonical email or username.
+	addUser(in *userEntry) error
+	// updateUser overwrites the stored userEntry with the same ID as in, setting its canonical identifiers.
+	// A *DuplicateError is returned if another entry has the same canonical email or username.
+	updateUser(in *userEntry) error
+	// deleteUser removes the stored userEntry with the same ID as in.
+	deleteUser(in *userEntry) error
+	// addLoginFailure counts a failed login against a user in a single atomic change, forgetting earlier failures
+	// if the last was before resetBefore, and returns the new count. Only the failure columns are written.
+	addLoginFailure(id uint, now, resetBefore time.Time) (int, error)
+	// lockUser sets only when a user's account unlocks.
+	lockUser(id uint, until time.Time) error
+	// clearLoginFailures resets only a user's failure count, last failure and lock.
+	clearLoginFailures(id uint) error
+	// findUserEntryByEmail finds a userEntry by canonical email. The empty userEntry is returned if none exists.
+	findUserEntryByEmail(find string) (userEntry, error)
+	// findUserEntryByUsername finds a userEntry by canonical username. The empty userEntry is returned if none exists.
+	findUserEntryByUsername(find string) (userEntry, error)
+	// countUsers gets the number of userEntry values in the store.
+	countUsers() (int, error)
+	// listUsers gets userEntry values matching a query's filter, other than its permission, in the query's order.
+	listUsers(q userListQuery) ([]userEntry, error)
+	// addPasswordHistory records a previous password hash for a user.
+	addPasswordHistory(in *passwordHistoryEntry) error
+	// findPasswordHistory gets up to limit previous password hashes for a user, newest first.
+	findPasswordHistory(userID uint, limit int) ([]passwordHistoryEntry, error)
+	// prunePasswordHistory deletes all but the newest keep previous password hashes for a user.
+	prunePasswordHistory(userID uint, keep int) error
+	// addRole adds a new roleEntry to the store. The entry ID is set by the store.
+	addRole(in *roleEntry) error
+	// updateRole overwrites the stored roleEntry with the same ID as in.
+	updateRole(in *roleEntry) error
+	// deleteRole removes the stored roleEntry with the same ID as in, along with its bindings and includes.
+	deleteRole(in *roleEntry) error
+	// findRoleByName finds a roleEntry by name. The empty roleEntry is returned if none exists.
+	findRoleByName(name string) (roleEntry, error)
+	// findRoleByID finds a roleEntry by ID. The empty roleEntry is returned if none exists.
+	findRoleByID(id uint) (roleEntry, error)
+	// listRoles gets every roleEntry.
+	listRoles() ([]roleEntry, error)
+	// addRoleBinding grants a role to a user.
+	addRoleBinding(in *roleBinding) error
+	// deleteRoleBinding removes the stored roleBinding with the same user and role as in.
+	deleteRoleBinding(in *roleBinding) error
+	// findRoleBindings gets the roles granted directly to a user.
+	findRoleBindings(userID uint) ([]roleBinding, error)
+	// findRoleBindingsForUsers gets the roles granted directly to any of a set of users.
+	findRoleBindingsForUsers(userIDs []uint) ([]roleBinding, error)
+	// addRoleInclude makes one role include another.
+	addRoleInclude(in *roleInclude) error
+	// deleteRoleInclude removes the stored roleInclude with the same roles as in.
+	deleteRoleInclude(in *roleInclude) error
+	// findRoleIncludes gets the roles directly included by a role.
+	findRoleIncludes(roleID uint) ([]roleInclude, error)
+	// listRoleIncludes gets every roleInclude.
+	listRoleIncludes() ([]roleInclude, error)
+	// addApplication adds a new applicationEntry to the store. The entry ID is set by the store.
+	addApplication(in *applicationEntry) error
+	// updateApplication overwrites the stored applicationEntry with the same ID as in.
+	updateApplication(in *applicationEntry) error
+	// findApplicationByName finds an applicationEntry by name. The empty applicationEntry is returned if none exists.
+	findApplicationByName(name string) (applicationEntry, error)
+	// findApplicationByID finds an applicationEntry by ID. The empty applicationEntry is returned if none exists.
+	findApplicationByID(id uint) (applicationEntry, error)
+	// listApplications gets every applicationEntry, in order of ID.
+	listApplications() ([]applicationEntry, error)
+	// addMembership makes a user a member of an application.
+	addMembership(in *membershipEntry) error
+	// addAllMemberships makes every stored user a member of an application.
+	addAllMemberships(appID uint) error
+	// deleteMembership removes the stored membershipEntry with the same application and user as in.
+	deleteMembership(in *membershipEntry) error
+	// findMemberships gets the applications a user is a member of.
+	findMemberships(userID uint) ([]membershipEntry, error)
+	// addAPIKey adds a new apiKeyEntry to the store.
+	addAPIKey(in *apiKeyEntry) error
+	// findAPIKeyByHash finds an apiKeyEntry by key hash. The empty apiKeyEntry is returned if none exists.
+	findAPIKeyByHash(hash string) (apiKeyEntry, error)
+	// findAPIKeyByPrefix finds an apiKeyEntry by prefix. The empty apiKeyEntry is returned if none exists.
+	findAPIKeyByPrefix(prefix string) (apiKeyEntry, error)
+	// listAPIKeys gets every apiKeyEntry of an application, in order of ID.
+	listAPIKeys(appID uint) ([]apiKeyEntry, error)
+	// updateAPIKey overwrites the stored apiKeyEntry with the same ID as in.
+	updateAPIKey(in *apiKeyEntry) error
+	// touchAPIKey sets only the last use of the stored apiKeyEntry with an ID, so it can't undo a concurrent revoke.
+	touchAPIKey(id uint, used time.Time) error
+}
+
+// memoryStore is a Store that holds all entries in memory.
+// Entries are lost when the process exits, so this is mostly useful for testing.
+type memoryStore struct {
+	mu      sync.RWMutex
+	entries map[uint]userEntry
+	nextID  uint
+	// history maps user IDs to their previous password hashes, oldest first.
+	history map[uint][]passwordHistoryEntry
+	// Roles, and the bindings and includes between them and users.
+	roles      map[uint]roleEntry
+	nextRoleID uint
+	bindings   []roleBinding
+	includes   []roleInclude
+	// Applications, and their memberships and API keys.
+	apps        map[uint]applicationEntry
+	nextAppID   uint
+	memberships []membershipEntry
+	apiKeys     []apiKeyEntry
+}
+
+// Create a new, empty in-memory Store.
+//
+// Output:
+//   - Store: Store that keeps all users in memory.
+func NewMemoryStore() Store {
+	return &memoryStore{
+		entries:    make(map[uint]userEntry),
+		nextID:     1,
+		history:    make(map[uint][]passwordHistoryEntry),
+		roles:      make(map[uint]roleEntry),
+		nextRoleID: 1,
+		apps:       make(map[uint]applicationEntry),
+		nextAppID:  1,
+	}
+}
+
+// Find a stored entry that shares a canonical identifier with another. ms.mu must be held.
+//
+// Input:
+//   - in userEntry: Entry to check, with its keys set.
+// Output:
+//   - error: A *DuplicateError if another stored entry has the same canonical email or username; otherwise nil.
+func (ms *memoryStore) checkUnique(in userEntry) error {
+	for _, entry := range ms.entries {
+		if err := in.conflictsWith(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add a userEntry to memory. The ID of in is set to the next free ID.
+// Checking for duplicates and adding happen under one lock, so concurrent adds can't both succeed.
+//
+// Input:
+//   - in *userEntry: User entry to add.
+// Output:
+//   - error: Returned if in is nil, or a *DuplicateError.
+func (ms *memoryStore) addUser(in *userEntry) error {
+	if in == nil {
+		return fmt.Errorf("addUser failed; nil userEntry")
+	}
+	in.setKeys()
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if err := ms.checkUnique(*in); err != nil {
+		return err
+	}
+	in.ID = ms.nextID
+	ms.nextID++
+	ms.entries[in.ID] = *in
+	return nil
+}
+
+// Update a userEntry in memory.
+//
+// Input:
+//   - in *userEntry: User entry to alter, matched by ID.
+// Output:
+//   - error: Returned if in is nil or has no stored counterpart, or a *DuplicateError.
+func (ms *memoryStore) updateUser(in *userEntry) error {
+	if in == nil {
+		return fmt.Errorf("updateUser failed; nil userEntry")
+	}
+	in.setKeys()
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.entries[in.ID]; !ok {
+		return fmt.Errorf("updateUser failed; no entry with ID %d", in.ID)
+	}
+	if err := ms.checkUnique(*in); err != nil {
+		return err
+	}
+	ms.entries[in.ID] = *in
+	return nil
+}
+
+// Delete a userEntry from memory.
+//
+// Input:
+//   - in *userEntry: User entry to delete, matched by ID.
+// Output:
+//   - error: Returned if in is nil.
+func (ms *memoryStore) deleteUser(in *userEntry) error {
+	if in == nil {
+		return fmt.Errorf("deleteUser failed; nil userEntry")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.entries, in.ID)
+	delete(ms.history, in.ID)
+	ms.bindings = filterBindings(ms.bindings, func(b roleBinding) bool { return b.UserID != in.ID })
+	ms.memberships = filterMemberships(ms.memberships, func(m membershipEntry) bool { return m.UserID != in.ID })
+	return nil
+}
+
+// Count a failed login against a userEntry in memory.
+//
+// Input:
+//   - id uint: ID of the user.
+//   - now time.Time: Time of the failure.
+//   - resetBefore time.Time: Earlier failures are forgotten if the last was before this time.
+// Output:
+//   - int: The user's failure count, including this one.
+//   - error: Returned if no entry has the ID.
+func (ms *memoryStore) addLoginFailure(id uint, now, resetBefore time.Time) (int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entry, ok := ms.entries[id]
+	if !ok {
+		return 0, fmt.Errorf("addLoginFailure failed; no entry with ID %d", id)
+	}
+	if entry.LastFailure.Before(resetBefore) {
+		entry.FailedAttempts = 0
+	}
+	entry.FailedAttempts++
+	entry.LastFailure = now
+	ms.entries[id] = entry
+	return entry.FailedAttempts, nil
+}
+
+// Set when a userEntry in memory unlocks.
+//
+// Input:
+//   - id uint: ID of the user.
+//   - until time.Time: When the account unlocks.
+// Output:
+//   - error: Returned if no entry has the ID.
+func (ms *memoryStore) lockUser(id uint, until time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entry, ok := ms.entries[id]
+	if !ok {
+		return fmt.Errorf("lockUser failed; no entry with ID %d", id)
+	}
+	entry.LockedUntil = until
+	ms.entries[id] = entry
+	return nil
+}
+
+// Reset the failed login count, last failure and lock of a userEntry in memory.
+//
+// Input:
+//   - id uint: ID of the user.
+// Output:
+//   - error: Returned if no entry has the ID.
+func (ms *memoryStore) clearLoginFailures(id uint) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entry, ok := ms.entries[id]
+	if !ok {
+		return fmt.Errorf("clearLoginFailures failed; no entry with ID %d", id)
+	}
+	entry.FailedAttempts = 0
+	entry.LastFailure = time.Time{}
+	entry.LockedUntil = time.Time{}
+	ms.entries[id] = entry
+	return nil
+}
+
+// Find a userEntry in memory that matches a condition.
+//
+// Input:
+//   - match func(userEntry) bool: Condition to check each entry against.
+// Output:
+//   - userEntry: The first matching entry, or the empty userEntry if none match.
+func (ms *memoryStore) findWhere(match func(userEntry) bool) userEntry {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	for _, entry := range ms.entries {
+		if match(entry) {
+			return entry
+		}
+	}
+	return userEntry{}
+}
+
+// Find a userEntry in memory by its canonical email.
+//
+// Input:
+//   - find string: Email to find, in any form.
+// Output:
+//   - userEntry: The resulting userEntry.
+//   - error: Always nil.
+func (ms *memoryStore) findUserEntryByEmail(find string) (userEntry, error) {
+	key := emailKey(find)
+	return ms.findWhere(func(entry userEntry) bool { return entry.EmailKey == key }), nil
+}
+
+// Find a userEntry in memory by its canonical username.
+//
+// Input:
+//   - find string: Username to find, in any form.
+// Output:
+//   - userEntry: The resulting userEntry.
+//   - error: Always nil.
+func (ms *memoryStore) findUserEntryByUsername(find string) (userEntry, error) {
+	key := usernameKey(find)
+	return ms.findWhere(func(entry userEntry) bool { return entry.UsernameKey == key }), nil
+}
+
+// Get the number of userEntry values in memory.
+//
+// Output:
+//   - int: Number of entries.
+//   - error: Always nil.
+func (ms *memoryStore) countUsers() (int, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return len(ms.entries), nil
+}
+
+// Check whether the calling userEntry matches a filter, other than its permission.
+//
+// Calling:
+//   - u userEntry: Entry to check.
+// Input:
+//   - f UserFilter: Filter to check against.
+// Output:
+//   - bool: Does u match f?
+func (u userEntry) matches(f UserFilter) bool {
+	return strings.HasPrefix(u.EmailKey, emailKey(f.EmailPrefix)) &&
+		strings.HasPrefix(u.UsernameKey, usernameKey(f.UsernamePrefix)) &&
+		(f.Status == "" || u.status() == f.Status) &&
+		!u.CreatedAt.Before(f.CreatedAfter) &&
+		(f.CreatedBefore.IsZero() || u.CreatedAt.Before(f.CreatedBefore))
+}
+
+// Compare the positions of two users in a sorted list.
+//
+// Input:
+//   - a, b userCursor: Positions to compare, both for the same sort.
+// Output:
+//   - int: Negative if a comes first in ascending order, positive if b does, 0 if they are the same user.
+func compareCursors(a, b userCursor) int {
+	if a.Text != b.Text {
+		return strings.Compare(a.Text, b.Text)
+	}
+	if !a.Time.Equal(b.Time) {
+		if a.Time.Before(b.Time) {
+			return -1
+		}
+		return 1
+	}
+	return int(a.ID) - int(b.ID)
+}
+
+// Get userEntry values in memory that match a query.
+//
+// Input:
+//   - q userListQuery: Filter, order, start and limit.
+// Output:
+//   - []userEntry: Matching entries.
+//   - error: Always nil.
+func (ms *memoryStore) listUsers(q userListQuery) ([]userEntry, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	out := make([]userEntry, 0)
+	for _, entry := range ms.entries {
+		if !entry.matches(q.filter) {
+			continue
+		}
+		if q.after != nil {
+			order := compareCursors(entry.cursor(q.sortBy, q.descending), *q.after)
+			if (q.descending && order >= 0) || (!q.descending && order <= 0) {
+				continue
+			}
+		}
+		out = append(out, entry)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		order := compareCursors(out[i].cursor(q.sortBy, q.descending), out[j].cursor(q.sortBy, q.descending))
+		return (order < 0) != q.descending
+	})
+	if len(out) > q.limit {
+		out = out[:q.limit]
+	}
+	return out, nil
+}
+
+// Record a previous password hash in memory.
+//
+// Input:
+//   - in *passwordHistoryEntry: History entry to add.
+// Output:
+//   - error: Returned if in is nil.
+func (ms *memoryStore) addPasswordHistory(in *passwordHistoryEntry) error {
+	if in == nil {
+		return fmt.Errorf("addPasswordHistory failed; nil passwordHistoryEntry")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.history[in.UserID] = append(ms.history[in.UserID], *in)
+	return nil
+}
+
+// Get previous password hashes for a user from memory.
+//
+// Input:
+//   - userID uint: ID of the user.
+//   - limit int: Maximum number of hashes to return.
+// Output:
+//   - []passwordHistoryEntry: History entries, newest first.
+//   - error: Always nil.
+func (ms *memoryStore) findPasswordHistory(userID uint, limit int) ([]passwordHistoryEntry, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	history := ms.history[userID]
+	out := make([]passwordHistoryEntry, 0, limit)
+	for i := len(history) - 1; i >= 0 && len(out) < limit; i-- {
+		out = append(out, history[i])
+	}
+	return out, nil
+}
+
+// Delete all but the newest previous password hashes for a user from memory.
+//
+// Input:
+//   - userID uint: ID of the user.
+//   - keep int: Number of hashes to keep.
+// Output:
+//   - error: Always nil.
+func (ms *memoryStore) prunePasswordHistory(userID uint, keep int) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if history := ms.history[userID]; len(history) > keep {
+		ms.history[userID] = append([]passwordHistoryEntry{}, history[len(history)-keep:]...)
+	}
+	return nil
+}
+
+// Keep the role bindings that match a condition.
+//
+// Input:
+//   - bindings []roleBinding: Bindings to filter. Not modified.
+//   - keep func(roleBinding) bool: Condition for keeping a binding.
+// Output:
+//   - []roleBinding: Kept bindings.
+func filterBindings(bindings []roleBinding, keep func(roleBinding) bool) []roleBinding {
+	out := make([]roleBinding, 0, len(bindings))
+	for _, binding := range bindings {
+		if keep(binding) {
+			out = append(out, binding)
+		}
+	}
+	return out
+}
+
+// Keep the role includes that match a condition.
+//
+// Input:
+//   - includes []roleInclude: Includes to filter. Not modified.
+//   - keep func(roleInclude) bool: Condition for keeping an include.
+// Output:
+//   - []roleInclude: Kept includes.
+func filterIncludes(includes []roleInclude, keep func(roleInclude) bool) []roleInclude {
+	out := make([]roleInclude, 0, len(includes))
+	for _, include := range includes {
+		if keep(include) {
+			out = append(out, include)
+		}
+	}
+	return out
+}
+
+// Add a roleEntry to memory. The ID of in is set to the next free role ID.
+//
+// Input:
+//   - in *roleEntry: Role to add.
+// Output:
+//   - error: Returned if in is nil.
+func (ms *memoryStore) addRole(in *roleEntry) error {
+	if in == nil {
+		return fmt.Errorf("addRole failed; nil roleEntry")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	in.ID = ms.nextRoleID
+	ms.nextRoleID++
+	ms.roles[in.ID] = *in
+	return nil
+}
+
+// Update a roleEntry in memory.
+//
+// Input:
+//   - in *roleEntry: Role to alter, matched by ID.
+// Output:
+//   - error: Returned if in is nil or has no stored counterpart.
+func (ms *memoryStore) updateRole(in *roleEntry) error {
+	if in == nil {
+		return fmt.Errorf("updateRole failed; nil roleEntry")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.roles[in.ID]; !ok {
+		return fmt.Errorf("updateRole failed; no role with ID %d", in.ID)
+	}
+	ms.roles[in.ID] = *in
+	return nil
+}
+
+// Delete a roleEntry, and its bindings and includes, from memory.
+//
+// Input:
+//   - in *roleEntry: Role to delete, matched by ID.
+// Output:
+//   - error: Returned if in is nil.
+func (ms *memoryStore) deleteRole(in *roleEntry) error {
+	if in == nil {
+		return fmt.Errorf("deleteRole failed; nil roleEntry")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.roles, in.ID)
+	ms.bindings = filterBindings(ms.bindings, func(b roleBinding) bool { return b.RoleID != in.ID })
+	ms.includes = filterIncludes(ms.includes, func(i roleInclude) bool {
+		return i.RoleID != in.ID && i.IncludedRoleID != in.ID
+	})
+	return nil
+}
+
+// Find a roleEntry in memory by its name.
+//
+// Input:
+//   - name string: Name to find.
+// Output:
+//   - roleEntry: The resulting roleEntry.
+//   - error: Always nil.
+func (ms *memoryStore) findRoleByName(name string) (roleEntry, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	for _, role := range ms.roles {
+		if role.Name == name {
+			return role, nil
+		}
+	}
+	return roleEntry{}, nil
+}
+
+// Find a roleEntry in memory by its ID.
+//
+// Input:
+//   - id uint: ID to find.
+// Output:
+//   - roleEntry: The resulting roleEntry.
+//   - error: Always nil.
+func (ms *memoryStore) findRoleByID(id uint) (roleEntry, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.roles[id], nil
+}
+
+// Get every roleEntry in memory.
+//
+// Output:
+//   - []roleEntry: The roles, in no particular order.
+//   - error: Always nil.
+func (ms *memoryStore) listRoles() ([]roleEntry, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	out := make([]roleEntry, 0, len(ms.roles))
+	for _, role := range ms.roles {
+		out = append(out, role)
+	}
+	return out, nil
+}
+
+// Grant a role to a user in memory.
+//
+// Input:
+//   - in *roleBinding: Binding to add.
+// Output:
+//   - error: Returned if in is nil.
+func (ms *memoryStore) addRoleBinding(in *roleBinding) error {
+	if in == nil {
+		return fmt.Errorf("addRoleBinding failed; nil roleBinding")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.bindings = append(ms.bindings, *in)
+	return nil
+}
+
+// Revoke a role from a user in memory.
+//
+// Input:
+//   - in *roleBinding: Binding to delete, matched by user and role.
+// Output:
+//   - error: Returned if in is nil.
+func (ms *memoryStore) deleteRoleBinding(in *roleBinding) error {
+	if in == nil {
+		return fmt.Errorf("deleteRoleBinding failed; nil roleBinding")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.bindings = filterBindings(ms.bindings, func(b roleBinding) bool {
+		return b.UserID != in.UserID || b.RoleID != in.RoleID
+	})
+	return nil
+}
+
+// Get the roles granted directly to a user from memory.
+//
+// Input:
+//   - userID uint: ID of the user.
+// Output:
+//   - []roleBinding: The user's bindings.
+//   - error: Always nil.
+func (ms *memoryStore) findRoleBindings(userID uint) ([]roleBinding, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return filterBindings(ms.bindings, func(b roleBinding) bool { return b.UserID == userID }), nil
+}
+
+// Get the roles granted directly to any of a set of users from memory.
+//
+// Input:
+//   - userIDs []uint: IDs of the users.
+// Output:
+//   - []roleBinding: The users' bindings.
+//   - error: Always nil.
+func (ms *memoryStore) findRoleBindingsForUsers(userIDs []uint) ([]roleBinding, error) {
+	wanted := make(map[uint]bool, len(userIDs))
+	for _, id := range userIDs {
+		wanted[id] = true
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return filterBindings(ms.bindings, func(b roleBinding) bool { return wanted[b.UserID] }), nil
+}
+
+// Make one role include another in memory.
+//
+// Input:
+//   - in *roleInclude: Include to add.
+// Output:
+//   - error: Returned if in is nil.
+func (ms *memoryStore) addRoleInclude(in *roleInclude) error {
+	if in == nil {
+		return fmt.Errorf("addRoleInclude failed; nil roleInclude")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.includes = append(ms.includes, *in)
+	return nil
+}
+
+// Stop one role including another in memory.
+//
+// Input:
+//   - in *roleInclude: Include to delete, matched by both roles.
+// Output:
+//   - error: Returned if in is nil.
+func (ms *memoryStore) deleteRoleInclude(in *roleInclude) error {
+	if in == nil {
+		return fmt.Errorf("deleteRoleInclude failed; nil roleInclude")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.includes = filterIncludes(ms.includes, func(i roleInclude) bool {
+		return i.RoleID != in.RoleID || i.IncludedRoleID != in.IncludedRoleID
+	})
+	return nil
+}
+
+// Get the roles directly included by a role from memory.
+//
+// Input:
+//   - roleID uint: ID of the role.
+// Output:
+//   - []roleInclude: The role's includes.
+//   - error: Always nil.
+func (ms *memoryStore) findRoleIncludes(roleID uint) ([]roleInclude, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return filterIncludes(ms.includes, func(i roleInclude) bool { return i.RoleID == roleID }), nil
+}
+
+// Get every roleInclude in memory.
+//
+// Output:
+//   - []roleInclude: The includes.
+//   - error: Always nil.
+func (ms *memoryStore) listRoleIncludes() ([]roleInclude, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return append([]roleInclude{}, ms.includes...), nil
+}
+
+// Keep the memberships that match a condition.
+//
+// Input:
+//   - memberships []membershipEntry: Memberships to filter. Not modified.
+//   - keep func(membershipEntry) bool: Condition for keeping a membership.
+// Output:
+//   - []membershipEntry: Kept memberships.
+func filterMemberships(memberships []membershipEntry, keep func(membershipEntry) bool) []membershipEntry {
+	out := make([]membershipEntry, 0, len(memberships))
+	for _, membership := range memberships {
+		if keep(membership) {
+			out = append(out, membership)
+		}
+	}
+	return out
+}
+
+// Add an applicationEntry to memory. The ID of in is set to the next free application ID.
+//
+// Input:
+//   - in *applicationEntry: Application to add.
+// Output:
+//   - error: Returned if in is nil.
+func (ms *memoryStore) addApplication(in *applicationEntry) error {
+	if in == nil {
+		return fmt.Errorf("addApplication failed; nil applicationEntry")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	in.ID = ms.nextAppID
+	ms.nextAppID++
+	ms.apps[in.ID] = *in
+	return nil
+}
+
+// Update an applicationEntry in memory.
+//
+// Input:
+//   - in *applicationEntry: Application to alter, matched by ID.
+// Output:
+//   - error: Returned if in is nil or has no stored counterpart.
+func (ms *memoryStore) updateApplication(in *applicationEntry) error {
+	if in == nil {
+		return fmt.Errorf("updateApplication failed; nil applicationEntry")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.apps[in.ID]; !ok {
+		return fmt.Errorf("updateApplication failed; no application with ID %d", in.ID)
+	}
+	ms.apps[in.ID] = *in
+	return nil
+}
+
+// Find an applicationEntry in memory by its name.
+//
+// Input:
+//   - name string: Name to find.
+// Output:
+//   - applicationEntry: The resulting applicationEntry.
+//   - error: Always nil.
+func (ms *memoryStore) findApplicationByName(name string) (applicationEntry, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	for _, app := range ms.apps {
+		if app.Name == name {
+			return app, nil
+		}
+	}
+	return applicationEntry{}, nil
+}
+
+// Find an applicationEntry in memory by its ID.
+//
+// Input:
+//   - id uint: ID to find.
+// Output:
+//   - applicationEntry: The resulting applicationEntry.
+//   - error: Always nil.
+func (ms *memoryStore) findApplicationByID(id uint) (applicationEntry, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.apps[id], nil
+}
+
+// Get every applicationEntry in memory, in order of ID.
+//
+// Output:
+//   - []applicationEntry: The applications.
+//   - error: Always nil.
+func (ms *memoryStore) listApplications() ([]applicationEntry, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	out := make([]applicationEntry, 0, len(ms.apps))
+	for id := uint(1); id < ms.nextAppID; id++ {
+		if app, ok := ms.apps[id]; ok {
+			out = append(out, app)
+		}
+	}
+	return out, nil
+}
+
+// Make a user a member of an application in memory.
+//
+// Input:
+//   - in *membershipEntry: Membership to add.
+// Output:
+//   - error: Returned if in is nil.
+func (ms *memoryStore) addMembership(in *membershipEntry) error {
+	if in == nil {
+		return fmt.Errorf("addMembership failed; nil membershipEntry")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.memberships = append(ms.memberships, *in)
+	return nil
+}
+
+// Make every user in memory a member of an application.
+//
+// Input:
+//   - appID uint: ID of the application.
+// Output:
+//   - error: Always nil.
+func (ms *memoryStore) addAllMemberships(appID uint) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for id := range ms.entries {
+		ms.memberships = append(ms.memberships, membershipEntry{AppID: appID, UserID: id})
+	}
+	return nil
+}
+
+// Remove a user from an application in memory.
+//
+// Input:
+//   - in *membershipEntry: Membership to delete, matched by application and user.
+// Output:
+//   - error: Returned if in is nil.
+func (ms *memoryStore) deleteMembership(in *membershipEntry) error {
+	if in == nil {
+		return fmt.Errorf("deleteMembership failed; nil membershipEntry")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.memberships = filterMemberships(ms.memberships, func(m membershipEntry) bool {
+		return m.AppID != in.AppID || m.UserID != in.UserID
+	})
+	return nil
+}
+
+// Get the applications a user is a member of from memory.
+//
+// Input:
+//   - userID uint: ID of the user.
+// Output:
+//   - []membershipEntry: The user's memberships.
+//   - error: Always nil.
+func (ms *memoryStore) findMemberships(userID uint) ([]membershipEntry, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return filterMemberships(ms.memberships, func(m membershipEntry) bool { return m.UserID == userID }), nil
+}
+
+// Add an apiKeyEntry to memory.
+//
+// Input:
+//   - in *apiKeyEntry: API key to add.
+// Output:
+//   - error: Returned if in is nil, or if its hash or prefix is already stored.
+func (ms *memoryStore) addAPIKey(in *apiKeyEntry) error {
+	if in == nil {
+		return fmt.Errorf("addAPIKey failed; nil apiKeyEntry")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, key := range ms.apiKeys {
+		if key.KeyHash == in.KeyHash || key.Prefix == in.Prefix {
+			return fmt.Errorf("addAPIKey failed; API key already exists")
+		}
+	}
+	in.ID = uint(len(ms.apiKeys) + 1)
+	ms.apiKeys = append(ms.apiKeys, *in)
+	return nil
+}
+
+// Find an apiKeyEntry in memory by its key hash.
+//
+// Input:
+//   - hash string: Key hash to find.
+// Output:
+//   - apiKeyEntry: The resulting apiKeyEntry.
+//   - error: Always nil.
+func (ms *memoryStore) findAPIKeyByHash(hash string) (apiKeyEntry, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	for _, key := range ms.apiKeys {
+		if key.KeyHash == hash {
+			return key, nil
+		}
+	}
+	return apiKeyEntry{}, nil
+}
+
+// Find an apiKeyEntry in memory by its prefix.
+//
+// Input:
+//   - prefix string: Prefix to find.
+// Output:
+//   - apiKeyEntry: The resulting apiKeyEntry.
+//   - error: Always nil.
+func (ms *memoryStore) findAPIKeyByPrefix(prefix string) (apiKeyEntry, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	for _, key := range ms.apiKeys {
+		if key.Prefix == prefix {
+			return key, nil
+		}
+	}
+	return apiKeyEntry{}, nil
+}
+
+// Get every apiKeyEntry of an application in memory, in order of ID.
+//
+// Input:
+//   - appID uint: ID of the application.
+// Output:
+//   - []apiKeyEntry: The application's keys.
+//   - error: Always nil.
+func (ms *memoryStore) listAPIKeys(appID uint) ([]apiKeyEntry, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	out := make([]apiKeyEntry, 0)
+	for _, key := range ms.apiKeys {
+		if key.AppID == appID {
+			out = append(out, key)
+		}
+	}
+	return out, nil
+}
+
+// Overwrite an apiKeyEntry in memory.
+//
+// Input:
+//   - in *apiKeyEntry: API key to store, matched by ID.
+// Output:
+//   - error: Returned if in is nil or isn't stored.
+func (ms *memoryStore) updateAPIKey(in *apiKeyEntry) error {
+	if in == nil {
+		return fmt.Errorf("updateAPIKey failed; nil apiKeyEntry")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if in.ID == 0 || int(in.ID) > len(ms.apiKeys) {
+		return fmt.Errorf("updateAPIKey failed; no API key with ID %d", in.ID)
+	}
+	ms.apiKeys[in.ID-1] = *in
+	return nil
+}
+
+// Record the last use of an apiKeyEntry in memory.
+//
+// Input:
+//   - id uint: ID of the API key.
+//   - used time.Time: Time of the use.
+// Output:
+//   - error: Returned if the key isn't stored.
+func (ms *memoryStore) touchAPIKey(id uint, used time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if id == 0 || int(id) > len(ms.apiKeys) {
+		return fmt.Errorf("touchAPIKey failed; no API key with ID %d", id)
+	}
+	ms.apiKeys[id-1].LastUsedAt = used
+	return nil
+}
@@ -0,0 +1,667 @@
+package credentials
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrImportRejected is returned by ImportUsers when nothing was imported, because a record is invalid or conflicts
+// with an existing user under ConflictFail. The ImportReport says which records.
+var ErrImportRejected = errors.New("Import rejected")
+
+// Formats of user records for ImportUsers and ExportUsers.
+const (
+	// FormatJSON is a JSON array of UserRecord objects.
+	FormatJSON = "json"
+	// FormatCSV is a CSV file with a header row naming the columns, which are the JSON fields of UserRecord.
+	// Permissions, roles, applications and attributes are JSON; empty cells are zero values.
+	FormatCSV = "csv"
+)
+
+// How ImportUsers treats records whose email or username is already in use.
+const (
+	// ConflictSkip reports the record and imports the others.
+	ConflictSkip = "skip"
+	// ConflictUpdate overwrites the existing user with the record, when the email and username belong to the same user.
+	ConflictUpdate = "update"
+	// ConflictFail reports the record and imports nothing.
+	ConflictFail = "fail"
+)
+
+// exportBatchSize is how many users ExportUsers reads from the store at a time.
+const exportBatchSize = 500
+
+// csvColumns are the columns written by ExportUsers in FormatCSV, in order.
+var csvColumns = []string{
+	"email", "username", "passwordHash", "permissions", "roles", "applications", "status", "emailVerified",
+	"displayName", "locale", "avatarUrl", "attributes", "created",
+}
+
+// A UserRecord is a user in the portable format used by ImportUsers and ExportUsers.
+// Unlike User, it carries the password hash, and only the user's own permissions.
+type UserRecord struct {
+	Email    string `json:"email"`
+	Username string `json:"username"`
+	// PasswordHash is a self-describing hash: a PHC string for argon2id, scrypt, sha512 or pbkdf2-sha1/sha256/sha512
+	// (e.g. $pbkdf2-sha256$i=29000$salt$digest, or passlib's $pbkdf2-sha256$29000$salt$digest), a bcrypt hash ($2a$,
+	// $2b$ or $2y$), or any format recognized by a HashVerifier. Peppered hashes can only be checked with the same Pepper keys they were made with.
+	PasswordHash string          `json:"passwordHash"`
+	Permissions  map[string]bool `json:"permissions"`
+	// Roles and Applications name roles granted to the user and applications it is a member of. They must exist.
+	Roles        []string `json:"roles"`
+	Applications []string `json:"applications"`
+	// Status is one of StatusActive, StatusDisabled or StatusDeleted; "" is StatusActive.
+	Status        string                 `json:"status"`
+	EmailVerified bool                   `json:"emailVerified"`
+	DisplayName   string                 `json:"displayName"`
+	Locale        string                 `json:"locale"`
+	AvatarURL     string                 `json:"avatarUrl"`
+	Attributes    map[string]interface{} `json:"attributes"`
+	// Created is when the user registered; zero imports as the time of import.
+	Created time.Time `json:"created"`
+}
+
+// ImportOptions control ImportUsers.
+type ImportOptions struct {
+	// DryRun checks every record and reports what would happen, without changing the store.
+	DryRun bool
+	// OnConflict is one of ConflictSkip, ConflictUpdate or ConflictFail; "" is ConflictSkip.
+	OnConflict string
+}
+
+// An ImportProblem is a record that ImportUsers couldn't import.
+type ImportProblem struct {
+	// Record is the position of the record in the import, from 1.
+	Record   int    `json:"record"`
+	Email    string `json:"email"`
+	Username string `json:"username"`
+	Reason   string `json:"reason"`
+	// Conflict is set if the email or username is already in use; otherwise the record is invalid.
+	Conflict bool `json:"conflict"`
+}
+
+// An ImportReport describes the outcome of ImportUsers. On a dry run, it describes what would have happened.
+type ImportReport struct {
+	Created  int             `json:"created"`
+	Updated  int             `json:"updated"`
+	Skipped  int             `json:"skipped"`
+	Problems []ImportProblem `json:"problems"`
+}
+
+// An importPlan is a checked record, and what ImportUsers will do with it.
+type importPlan struct {
+	// entry is the userEntry to store; it has the ID of the existing user if updating one.
+	entry userEntry
+	roles []uint
+	apps  []uint
+	// previous is the existing user, if updating one.
+	previous userEntry
+	updated  bool
+}
+
+// Decode user records, as written by ExportUsers.
+//
+// Input:
+//   - r io.Reader: Records to read.
+//   - format string: FormatJSON or FormatCSV.
+// Output:
+//   - []UserRecord: Decoded records, in order.
+//   - error: Any error that occurs, including: unsupported format, malformed records, unknown fields or columns.
+func DecodeUserRecords(r io.Reader, format string) ([]UserRecord, error) {
+	switch format {
+	case FormatJSON:
+		records := []UserRecord{}
+		decoder := json.NewDecoder(r)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&records); err != nil {
+			return nil, errors.Wrap(err, "Malformed JSON user records")
+		}
+		return records, nil
+	case FormatCSV:
+		return decodeCSVRecords(r)
+	}
+	return nil, errors.Errorf("Unsupported user record format %s", format)
+}
+
+// Decode user records from CSV with a header row.
+//
+// Input:
+//   - r io.Reader: CSV to read.
+// Output:
+//   - []UserRecord: Decoded records, in order.
+//   - error: Any error that occurs, including: unknown columns, malformed cells. Missing columns are left empty.
+func decodeCSVRecords(r io.Reader) ([]UserRecord, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err == io.EOF {
+		return []UserRecord{}, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "Malformed CSV user records")
+	}
+	known := make(map[string]bool)
+	for _, column := range csvColumns {
+		known[column] = true
+	}
+	for _, column := range header {
+		if !known[column] {
+			return nil, errors.Errorf("Unknown CSV column %s", column)
+		}
+	}
+	records := []UserRecord{}
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, errors.Wrap(err, "Malformed CSV user records")
+		}
+		cells := make(map[string]string)
+		for i, column := range header {
+			cells[column] = row[i]
+		}
+		record, err := decodeCSVRecord(cells)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", line)
+		}
+		records = append(records, record)
+	}
+}
+
+// Decode one CSV row into a UserRecord.
+//
+// Input:
+//   - cells map[string]string: Cells of the row, by column name. Missing columns are empty.
+// Output:
+//   - UserRecord: Decoded record.
+//   - error: Returned if a JSON, boolean or time cell is malformed.
+func decodeCSVRecord(cells map[string]string) (UserRecord, error) {
+	record := UserRecord{
+		Email:        cells["email"],
+		Username:     cells["username"],
+		PasswordHash: cells["passwordHash"],
+		Status:       cells["status"],
+		DisplayName:  cells["displayName"],
+		Locale:       cells["locale"],
+		AvatarURL:    cells["avatarUrl"],
+	}
+	jsonCells := map[string]interface{}{
+		"permissions":  &record.Permissions,
+		"roles":        &record.Roles,
+		"applications": &record.Applications,
+		"attributes":   &record.Attributes,
+	}
+	for column, into := range jsonCells {
+		if cells[column] == "" {
+			continue
+		}
+		if err := json.Unmarshal([]byte(cells[column]), into); err != nil {
+			return record, errors.Wrapf(err, "Malformed %s", column)
+		}
+	}
+	if cells["emailVerified"] != "" {
+		verified, err := strconv.ParseBool(cells["emailVerified"])
+		if err != nil {
+			return record, errors.Wrap(err, "Malformed emailVerified")
+		}
+		record.EmailVerified = verified
+	}
+	if cells["created"] != "" {
+		created, err := time.Parse(time.RFC3339Nano, cells["created"])
+		if err != nil {
+			return record, errors.Wrap(err, "Malformed created")
+		}
+		record.Created = created
+	}
+	return record, nil
+}
+
+// A recordWriter writes user records in one of the formats.
+type recordWriter interface {
+	write(record UserRecord) error
+	// close finishes the output; it doesn't close the underlying writer.
+	close() error
+}
+
+// jsonRecordWriter writes a JSON array, one record per line.
+type jsonRecordWriter struct {
+	w       io.Writer
+	written int
+}
+
+func (jw *jsonRecordWriter) write(record UserRecord) error {
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	sep := ",\n"
+	if jw.written == 0 {
+		sep = "[\n"
+	}
+	jw.written++
+	_, err = jw.w.Write(append([]byte(sep), encoded...))
+	return err
+}
+
+func (jw *jsonRecordWriter) close() error {
+	end := "\n]\n"
+	if jw.written == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(jw.w, end)
+	return err
+}
+
+// csvRecordWriter writes CSV with the header row csvColumns.
+type csvRecordWriter struct {
+	w *csv.Writer
+}
+
+func (cw *csvRecordWriter) write(record UserRecord) error {
+	cells := []string{record.Email, record.Username, record.PasswordHash}
+	for _, value := range []interface{}{record.Permissions, record.Roles, record.Applications} {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		cells = append(cells, string(encoded))
+	}
+	attributes, err := json.Marshal(record.Attributes)
+	if err != nil {
+		return err
+	}
+	created := ""
+	if !record.Created.IsZero() {
+		created = record.Created.Format(time.RFC3339Nano)
+	}
+	cells = append(cells, record.Status, strconv.FormatBool(record.EmailVerified), record.DisplayName, record.Locale,
+		record.AvatarURL, string(attributes), created)
+	return cw.w.Write(cells)
+}
+
+func (cw *csvRecordWriter) close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// Get a recordWriter for a format, writing any header it needs.
+//
+// Input:
+//   - w io.Writer: Where records are written.
+//   - format string: FormatJSON or FormatCSV.
+// Output:
+//   - recordWriter: Writer for the format.
+//   - error: Returned if the format is unsupported, or the header can't be written.
+func newRecordWriter(w io.Writer, format string) (recordWriter, error) {
+	switch format {
+	case FormatJSON:
+		return &jsonRecordWriter{w: w}, nil
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		return &csvRecordWriter{w: cw}, cw.Write(csvColumns)
+	}
+	return nil, errors.Errorf("Unsupported user record format %s", format)
+}
+
+// Convert a userEntry to a UserRecord, looking up its roles and applications.
+//
+// Calling:
+//   - s *Service: Service whose store holds the entry.
+// Input:
+//   - entry userEntry: Entry to convert. Legacy hash columns are converted in the record, but not in the store.
+// Output:
+//   - UserRecord: The user's record.
+//   - error: Any error from converting the hash or reading the store.
+func (s *Service) userRecord(entry userEntry) (UserRecord, error) {
+	if _, err := entry.upgradeLegacyHash(); err != nil {
+		return UserRecord{}, err
+	}
+	record := UserRecord{
+		Email:         entry.Email,
+		Username:      entry.Username,
+		PasswordHash:  entry.PasswordHash,
+		Permissions:   decodePermissions(entry.Permissions),
+		Roles:         []string{},
+		Applications:  []string{},
+		Status:        entry.status(),
+		EmailVerified: entry.EmailVerified,
+		DisplayName:   entry.DisplayName,
+		Locale:        entry.Locale,
+		AvatarURL:     entry.AvatarURL,
+		Attributes:    decodeAttributes(entry.Attributes),
+		Created:       entry.CreatedAt,
+	}
+	bindings, err := s.store.findRoleBindings(entry.ID)
+	if err != nil {
+		return UserRecord{}, err
+	}
+	for _, binding := range bindings {
+		role, err := s.store.findRoleByID(binding.RoleID)
+		if err != nil {
+			return UserRecord{}, err
+		}
+		record.Roles = append(record.Roles, role.Name)
+	}
+	memberships, err := s.store.findMemberships(entry.ID)
+	if err != nil {
+		return UserRecord{}, err
+	}
+	for _, membership := range memberships {
+		app, err := s.store.findApplicationByID(membership.AppID)
+		if err != nil {
+			return UserRecord{}, err
+		}
+		record.Applications = append(record.Applications, app.Name)
+	}
+	sort.Strings(record.Roles)
+	sort.Strings(record.Applications)
+	return record, nil
+}
+
+// Export every user in the store, including disabled and deleted users, in order of registration.
+// Password hashes are exported as they are stored, so the records can be imported into another store with
+// ImportUsers without anyone resetting their password.
+//
+// Input:
+//   - w io.Writer: Where records are written. Records contain password hashes, so keep the output private.
+//   - format string: FormatJSON or FormatCSV.
+// Output:
+//   - int: Number of users exported.
+//   - error: Any error that occurs, including: unsupported format, failure to read the store, failure to write.
+func (s *Service) ExportUsers(w io.Writer, format string) (int, error) {
+	out, err := newRecordWriter(w, format)
+	if err != nil {
+		return 0, err
+	}
+	exported := 0
+	query := userListQuery{sortBy: SortByID, limit: exportBatchSize}
+	for {
+		entries, err := s.store.listUsers(query)
+		if err != nil {
+			return exported, err
+		}
+		for _, entry := range entries {
+			record, err := s.userRecord(entry)
+			if err != nil {
+				return exported, errors.Wrapf(err, "user %s", entry.Username)
+			}
+			if err := out.write(record); err != nil {
+				return exported, err
+			}
+			exported++
+			position := entry.cursor(SortByID, false)
+			query.after = &position
+		}
+		if len(entries) < query.limit {
+			return exported, out.close()
+		}
+	}
+}
+
+// Apply the calling UserRecord to a userEntry, replacing everything the record describes.
+//
+// Calling:
+//   - r UserRecord: Record to apply.
+// Input:
+//   - entry *userEntry: Entry to change, in place. Unchanged if an error is returned.
+// Output:
+//   - error: Returned if the record is invalid.
+func (r UserRecord) apply(entry *userEntry) error {
+	if r.Email == "" || r.Username == "" {
+		return errors.New("Email and username are required")
+	}
+	_, pwdHash, err := splitPepper(r.PasswordHash)
+	if err != nil {
+		return err
+	}
+	_, alg, err := findHashAlgorithm(pwdHash)
+	if err != nil {
+		return err
+	}
+	if _, err := alg.params(pwdHash); err != nil {
+		return err
+	}
+	status := r.Status
+	switch status {
+	case "":
+		status = StatusActive
+	case StatusActive, StatusDisabled, StatusDeleted:
+	default:
+		return errors.Errorf("Unknown user status %s", r.Status)
+	}
+	changed := *entry
+	changed.Attributes = ""
+	profile := ProfileChange{DisplayName: &r.DisplayName, Locale: &r.Locale, AvatarURL: &r.AvatarURL, Attributes: r.Attributes}
+	if err := changed.applyProfileChange(profile); err != nil {
+		return err
+	}
+	permissions, err := json.Marshal(r.Permissions)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	changed.Email = r.Email
+	changed.Username = r.Username
+	changed.Permissions = string(permissions)
+	if changed.PasswordHash != r.PasswordHash {
+		changed.PasswordHash = r.PasswordHash
+		changed.TokensValidAfter = now
+	}
+	if status == StatusDeleted && changed.status() != StatusDeleted {
+		changed.DeletedAt = now
+	}
+	changed.Status = status
+	if r.EmailVerified && !changed.EmailVerified {
+		changed.EmailVerifiedAt = now
+	}
+	changed.EmailVerified = r.EmailVerified
+	if !r.Created.IsZero() {
+		changed.CreatedAt = r.Created
+	} else if changed.CreatedAt.IsZero() {
+		changed.CreatedAt = now
+	}
+	*entry = changed
+	return nil
+}
+
+// Check a record for ImportUsers and decide what to do with it.
+//
+// Calling:
+//   - s *Service: Service whose store is imported into.
+// Input:
+//   - record UserRecord: Record to check.
+//   - onConflict string: One of the Conflict values.
+// Output:
+//   - importPlan: What to do with the record.
+//   - *ImportProblem: Why the record can't be imported, or nil. Record isn't set.
+//   - error: Any error from the store.
+func (s *Service) planImport(record UserRecord, onConflict string) (importPlan, *ImportProblem, error) {
+	plan := importPlan{}
+	problem := func(conflict bool, reason string) (importPlan, *ImportProblem, error) {
+		return plan, &ImportProblem{Email: record.Email, Username: record.Username, Reason: reason, Conflict: conflict}, nil
+	}
+	for _, name := range record.Roles {
+		role, err := s.store.findRoleByName(name)
+		if err != nil {
+			return plan, nil, err
+		} else if role.ID == 0 {
+			return problem(false, "Role "+name+" not found")
+		}
+		plan.roles = append(plan.roles, role.ID)
+	}
+	for _, name := range record.Applications {
+		app, err := s.store.findApplicationByName(name)
+		if err != nil {
+			return plan, nil, err
+		} else if app.ID == 0 {
+			return problem(false, "Application "+name+" not found")
+		}
+		plan.apps = append(plan.apps, app.ID)
+	}
+	byEmail, err := s.findUserEntryByEmail(record.Email)
+	if err != nil {
+		return plan, nil, err
+	}
+	byUsername, err := s.findUserEntryByUsername(record.Username)
+	if err != nil {
+		return plan, nil, err
+	}
+	switch {
+	case byEmail.ID == 0 && byUsername.ID == 0:
+	case onConflict != ConflictUpdate:
+		return problem(true, "Email or username is already in use")
+	case byEmail.ID != 0 && byUsername.ID != 0 && byEmail.ID != byUsername.ID:
+		return problem(true, "Email and username belong to different users")
+	case byEmail.ID != 0:
+		plan.previous, plan.updated = byEmail, true
+	default:
+		plan.previous, plan.updated = byUsername, true
+	}
+	plan.entry = plan.previous
+	if err := record.apply(&plan.entry); err != nil {
+		return problem(false, err.Error())
+	}
+	return plan, nil, nil
+}
+
+// Import users from another store or another system, keeping their password hashes.
+// Every record is checked before anything is written: if any record is invalid, or conflicts with an existing user
+// under ConflictFail, nothing is imported and ErrImportRejected is returned. Records are also invalid if they repeat
+// the email or username of an earlier record. Imported hashes made under a different hash policy are upgraded when
+// their user logs in, as usual.
+// Updated users get exactly the roles and applications of their record; their password history is kept, and tokens
+// issued before their password hash changed are revoked. Deleted users start a new restore window when imported.
+//
+// Input:
+//   - records []UserRecord: Users to import. See DecodeUserRecords.
+//   - opts ImportOptions: Whether to change the store, and how to treat conflicts.
+// Output:
+//   - ImportReport: What was imported, skipped, or wrong.
+//   - error: Any error that occurs, including: ErrImportRejected, unknown OnConflict, failure to read or update the
+//   store. A store failure can leave earlier records imported.
+func (s *Service) ImportUsers(records []UserRecord, opts ImportOptions) (ImportReport, error) {
+	report := ImportReport{Problems: []ImportProblem{}}
+	onConflict := opts.OnConflict
+	switch onConflict {
+	case "":
+		onConflict = ConflictSkip
+	case ConflictSkip, ConflictUpdate, ConflictFail:
+	default:
+		return report, errors.Errorf("Unknown conflict handling %s", opts.OnConflict)
+	}
+	plans := []importPlan{}
+	seenEmails, seenUsernames := make(map[string]bool), make(map[string]bool)
+	rejected := false
+	for i, record := range records {
+		plan, problem, err := s.planImport(record, onConflict)
+		if err != nil {
+			return report, err
+		}
+		if problem == nil && (seenEmails[emailKey(record.Email)] || seenUsernames[usernameKey(record.Username)]) {
+			problem = &ImportProblem{Email: record.Email, Username: record.Username, Reason: "Repeats an earlier record"}
+		}
+		seenEmails[emailKey(record.Email)], seenUsernames[usernameKey(record.Username)] = true, true
+		if problem != nil {
+			problem.Record = i + 1
+			report.Problems = append(report.Problems, *problem)
+			if !problem.Conflict || onConflict == ConflictFail {
+				rejected = true
+			}
+			report.Skipped++
+			continue
+		}
+		if plan.updated {
+			report.Updated++
+		} else {
+			report.Created++
+		}
+		plans = append(plans, plan)
+	}
+	if rejected {
+		report.Created, report.Updated, report.Skipped = 0, 0, len(records)
+		return report, ErrImportRejected
+	}
+	if opts.DryRun {
+		return report, nil
+	}
+	for _, plan := range plans {
+		if err := s.writeImport(plan); err != nil {
+			return report, errors.Wrapf(err, "user %s", plan.entry.Username)
+		}
+	}
+	return report, nil
+}
+
+// Write one planned import to the store.
+//
+// Calling:
+//   - s *Service: Service whose store is imported into.
+// Input:
+//   - plan importPlan: Checked record to write.
+// Output:
+//   - error: Any error from the store.
+func (s *Service) writeImport(plan importPlan) error {
+	entry := plan.entry
+	if !plan.updated {
+		if err := s.store.addUser(&entry); err != nil {
+			return err
+		}
+	} else {
+		if plan.previous.PasswordHash != entry.PasswordHash {
+			if err := s.recordPasswordHistory(plan.previous); err != nil {
+				return err
+			}
+		}
+		if err := s.store.updateUser(&entry); err != nil {
+			return err
+		}
+	}
+	bindings, err := s.store.findRoleBindings(entry.ID)
+	if err != nil {
+		return err
+	}
+	roles := make(map[uint]bool)
+	for _, id := range plan.roles {
+		roles[id] = true
+	}
+	for _, binding := range bindings {
+		if !roles[binding.RoleID] {
+			if err := s.store.deleteRoleBinding(&binding); err != nil {
+				return err
+			}
+		}
+		delete(roles, binding.RoleID)
+	}
+	for id := range roles {
+		if err := s.store.addRoleBinding(&roleBinding{UserID: entry.ID, RoleID: id}); err != nil {
+			return err
+		}
+	}
+	memberships, err := s.store.findMemberships(entry.ID)
+	if err != nil {
+		return err
+	}
+	apps := make(map[uint]bool)
+	for _, id := range plan.apps {
+		apps[id] = true
+	}
+	for _, membership := range memberships {
+		if !apps[membership.AppID] {
+			if err := s.store.deleteMembership(&membership); err != nil {
+				return err
+			}
+		}
+		delete(apps, membership.AppID)
+	}
+	for id := range apps {
+		if err := s.store.addMembership(&membershipEntry{AppID: id, UserID: entry.ID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package credentials
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// A HashVerifier checks passwords against hashes in a foreign format, such as those of users moved from another system.
+// Verifiers can't make new hashes: once a user's password matches a foreign hash, the hash is replaced with one made
+// under the Service's HashPolicy. Hashes in Gate's own formats (see hfs) never reach a verifier.
+type HashVerifier interface {
+	// Recognizes reports whether encoded is in the verifier's format.
+	Recognizes(encoded string) bool
+	// Verify checks pwd against encoded, which the verifier recognizes. It should compare in constant time.
+	Verify(pwd []byte, encoded string) (bool, error)
+}
+
+// A namedVerifier is a HashVerifier and the name it was registered under.
+type namedVerifier struct {
+	name     string
+	verifier HashVerifier
+}
+
+// hashVerifiers are the registered HashVerifiers, asked in order of registration.
+var hashVerifiersMu sync.RWMutex
+var hashVerifiers []namedVerifier = []namedVerifier{
+	{name: "django-pbkdf2", verifier: djangoPBKDF2Verifier{}},
+	{name: "md5crypt", verifier: md5CryptVerifier{}},
+	{name: "sha1", verifier: sha1Verifier{}},
+}
+
+// Register a HashVerifier for a foreign hash format, after the built-in verifiers for Django PBKDF2
+// (pbkdf2_sha256$iterations$salt$digest), md5crypt ($1$salt$digest) and unsalted hex SHA-1.
+// bcrypt hashes ($2a$, $2b$, $2y$) are one of Gate's own formats, and need no verifier.
+//
+// Input:
+//   - name string: Name of the format, used in errors and logs. Registering a name again replaces its verifier.
+//   - verifier HashVerifier: Verifier for the format.
+func RegisterHashVerifier(name string, verifier HashVerifier) {
+	hashVerifiersMu.Lock()
+	defer hashVerifiersMu.Unlock()
+	for i, registered := range hashVerifiers {
+		if registered.name == name {
+			hashVerifiers[i].verifier = verifier
+			return
+		}
+	}
+	hashVerifiers = append(hashVerifiers, namedVerifier{name: name, verifier: verifier})
+}
+
+// Unregister the HashVerifier registered under a name, if there is one. Hashes in its format will no longer
+// validate until it's registered again.
+//
+// Input:
+//   - name string: Name the verifier was registered under.
+func UnregisterHashVerifier(name string) {
+	hashVerifiersMu.Lock()
+	defer hashVerifiersMu.Unlock()
+	for i, registered := range hashVerifiers {
+		if registered.name == name {
+			hashVerifiers = append(hashVerifiers[:i:i], hashVerifiers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Find the registered HashVerifier that recognizes an encoded hash.
+//
+// Input:
+//   - encoded string: Hash to find a verifier for.
+// Output:
+//   - string: Name of the verifier.
+//   - HashVerifier: The verifier, or nil if none recognizes encoded.
+func findHashVerifier(encoded string) (string, HashVerifier) {
+	hashVerifiersMu.RLock()
+	defer hashVerifiersMu.RUnlock()
+	for _, registered := range hashVerifiers {
+		if registered.verifier.Recognizes(encoded) {
+			return registered.name, registered.verifier
+		}
+	}
+	return "", nil
+}
+
+// verifierAlgorithm adapts a HashVerifier to a hashAlgorithm that can only verify.
+type verifierAlgorithm struct {
+	name     string
+	verifier HashVerifier
+}
+
+func (alg verifierAlgorithm) hash(pwd []byte, params hashParams) (string, error) {
+	return "", errors.Errorf("Hash function %s can't be used for new hashes", alg.name)
+}
+
+func (alg verifierAlgorithm) verify(pwd []byte, encoded string) (bool, error) {
+	return alg.verifier.Verify(pwd, encoded)
+}
+
+// Foreign hashes have no parameters Gate can tune; any policy finds them outdated, since their name isn't in hfs.
+func (alg verifierAlgorithm) params(encoded string) (hashParams, error) {
+	return hashParams{}, nil
+}
+
+// djangoPBKDF2Verifier verifies Django's PBKDF2 hashes: pbkdf2_sha256$iterations$salt$digest, or pbkdf2_sha1.
+// The salt is used as is, and the digest is padded standard base64.
+type djangoPBKDF2Verifier struct{}
+
+// djangoHashes maps Django PBKDF2 algorithm names to their hash functions.
+var djangoHashes map[string]func() hash.Hash = map[string]func() hash.Hash{
+	"pbkdf2_sha256": sha256.New,
+	"pbkdf2_sha1":   sha1.New,
+}
+
+func (djangoPBKDF2Verifier) Recognizes(encoded string) bool {
+	fields := strings.Split(encoded, "$")
+	_, ok := djangoHashes[fields[0]]
+	return ok && len(fields) == 4
+}
+
+func (djangoPBKDF2Verifier) Verify(pwd []byte, encoded string) (bool, error) {
+	fields := strings.Split(encoded, "$")
+	iterations, err := strconv.Atoi(fields[1])
+	if err != nil || iterations < 1 {
+		return false, errors.Errorf("Malformed Django iterations %s", fields[1])
+	}
+	digest, err := base64.StdEncoding.DecodeString(fields[3])
+	if err != nil || len(digest) == 0 {
+		return false, errors.New("Malformed Django digest")
+	}
+	key := pbkdf2.Key(pwd, []byte(fields[2]), iterations, len(digest), djangoHashes[fields[0]])
+	return subtle.ConstantTimeCompare(key, digest) == 1, nil
+}
+
+// md5CryptVerifier verifies md5crypt hashes, as made by crypt(3) and openssl passwd -1: $1$salt$digest.
+type md5CryptVerifier struct{}
+
+// cryptAlphabet is the base64 alphabet of crypt(3).
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+func (md5CryptVerifier) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$1$") && strings.Count(encoded, "$") == 3
+}
+
+func (md5CryptVerifier) Verify(pwd []byte, encoded string) (bool, error) {
+	salt := strings.Split(encoded, "$")[2]
+	return subtle.ConstantTimeCompare([]byte(md5Crypt(pwd, []byte(salt))), []byte(encoded)) == 1, nil
+}
+
+// Hash a password with md5crypt.
+//
+// Input:
+//   - pwd []byte: Password to hash.
+//   - salt []byte: Salt; only the first 8 bytes are used.
+// Output:
+//   - string: $1$salt$digest
+func md5Crypt(pwd, salt []byte) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	alternate := md5.New()
+	alternate.Write(pwd)
+	alternate.Write(salt)
+	alternate.Write(pwd)
+	alternateSum := alternate.Sum(nil)
+	h := md5.New()
+	h.Write(pwd)
+	h.Write([]byte("$1$"))
+	h.Write(salt)
+	for left := len(pwd); left > 0; left -= 16 {
+		if left > 16 {
+			h.Write(alternateSum)
+		} else {
+			h.Write(alternateSum[:left])
+		}
+	}
+	for i := len(pwd); i != 0; i >>= 1 {
+		if i&1 == 1 {
+			h.Write([]byte{0})
+		} else if len(pwd) > 0 {
+			h.Write(pwd[:1])
+		}
+	}
+	sum := h.Sum(nil)
+	// 1000 rounds, mixing in the password and salt in an order set by the round number.
+	for i := 0; i < 1000; i++ {
+		h = md5.New()
+		if i&1 == 1 {
+			h.Write(pwd)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write(salt)
+		}
+		if i%7 != 0 {
+			h.Write(pwd)
+		}
+		if i&1 == 1 {
+			h.Write(sum)
+		} else {
+			h.Write(pwd)
+		}
+		sum = h.Sum(nil)
+	}
+	out := []byte("$1$" + string(salt) + "$")
+	encode := func(value uint, chars int) {
+		for ; chars > 0; chars-- {
+			out = append(out, cryptAlphabet[value&0x3f])
+			value >>= 6
+		}
+	}
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(sum[group[0]])<<16|uint(sum[group[1]])<<8|uint(sum[group[2]]), 4)
+	}
+	encode(uint(sum[11]), 2)
+	return string(out)
+}
+
+// sha1Verifier verifies unsalted SHA-1 digests in hex, as stored by some legacy applications.
+type sha1Verifier struct{}
+
+func (sha1Verifier) Recognizes(encoded string) bool {
+	if len(encoded) != 2*sha1.Size {
+		return false
+	}
+	_, err := hex.DecodeString(encoded)
+	return err == nil
+}
+
+func (sha1Verifier) Verify(pwd []byte, encoded string) (bool, error) {
+	digest, _ := hex.DecodeString(encoded)
+	sum := sha1.Sum(pwd)
+	return subtle.ConstantTimeCompare(sum[:], digest) == 1, nil
+}
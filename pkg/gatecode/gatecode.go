@@ -8,11 +8,15 @@
 //   ...
 //   recEmail, recCode := receiveInputFromUserSomehow()
 //   valid := gatecode.ValidateGateCode(recEmail, recCode)
+// Codes for other purposes, such as email verification, use NewGateCodeFor and ValidateGateCodeFor, and are kept
+// separately from login codes.
 // gatecode does not currently protect against abandoned codes, so there's a risk of filling up memory.
 package gatecode
 
 import (
-	"math/rand"
+	"crypto/rand"
+	"math/big"
+	"sync"
 	"time"
 )
 
@@ -24,13 +28,21 @@ type gateCode struct {
 	Expires time.Time
 }
 
-// activeCodes maps emails to their respective codes.
+// codeLifetime is how long codes from NewGateCode last.
+const codeLifetime time.Duration = time.Minute * 5
+
+// activeCodes maps purposes and emails to their respective codes; see codeKey.
 var activeCodes map[string]*gateCode = make(map[string]*gateCode)
 
+// codesMu guards activeCodes, which is used from concurrent request handlers.
+var codesMu sync.Mutex
+
 // letters contains a list of valid runes used in authorization codes.
 var letters = []rune("ABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
 // Generates a ct-length authorization code using all-caps letters.
+// Codes authorize logins, password resets and email changes, so they come from crypto/rand; a failure to read it
+// panics rather than produce a guessable code.
 //
 // Input:
 //   - ct int: Number of characters to generate
@@ -38,27 +50,59 @@ var letters = []rune("ABCDEFGHIJKLMNOPQRSTUVWXYZ")
 //   - string: string authorization code
 func genCode(ct int) string {
 	seq := make([]rune, ct)
+	max := big.NewInt(int64(len(letters)))
 	for i := range seq {
-		seq[i] = letters[rand.Intn(len(letters))]
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic("gatecode: couldn't read random bytes: " + err.Error())
+		}
+		seq[i] = letters[n.Int64()]
 	}
 	return string(seq)
 }
 
+// Get the activeCodes key for a purpose and email.
+// Codes for different purposes are kept apart, so that e.g. sending a login code doesn't replace a verification code.
+//
+// Input:
+//   - purpose, email string: Purpose and email the code is for.
+// Output:
+//   - string: Key into activeCodes.
+func codeKey(purpose, email string) string {
+	return purpose + "\x00" + email
+}
+
 // Generates a new authorization code, and stores it in memory for checking later.
+// Codes expire after 5 minutes.
 //
 // Input:
 //   - email string: Output code will be attached to this email. See authmail for how mail is sent.
 // Output:
 //   - string: string authorization code.
 func NewGateCode(email string) string {
+	return NewGateCodeFor("", email, codeLifetime)
+}
+
+// Generates a new authorization code for a specific purpose, such as email verification, and stores it in memory
+// for checking later. It replaces any earlier code for the same purpose and email, but not codes for other purposes.
+//
+// Input:
+//   - purpose string: What the code is for. Must match the purpose given to ValidateGateCodeFor.
+//   - email string: Output code will be attached to this email.
+//   - valid time.Duration: How long the code lasts.
+// Output:
+//   - string: string authorization code.
+func NewGateCodeFor(purpose, email string, valid time.Duration) string {
 	now := time.Now()
 	newCode := &gateCode{
 		Email:   email,
 		Code:    genCode(6),
 		Created: now,
-		Expires: now.Add(time.Minute * 5),
+		Expires: now.Add(valid),
 	}
-	activeCodes[email] = newCode
+	codesMu.Lock()
+	defer codesMu.Unlock()
+	activeCodes[codeKey(purpose, email)] = newCode
 	return newCode.Code
 }
 
@@ -69,15 +113,26 @@ func NewGateCode(email string) string {
 // Output:
 //   - bool: Represents code validity. true if code correct and unexpired, false if email incorrect, code incorrect, or expired.
 func ValidateGateCode(email, code string) bool {
-	storedCode, ok := activeCodes[email]
+	return ValidateGateCodeFor("", email, code)
+}
+
+// Validates a given authorization code against a purpose and email.
+// The stored code is used up whether or not validation succeeds.
+//
+// Input:
+//   - purpose string: What the code is for. Must match the purpose given to NewGateCodeFor.
+//   - email, code string: Both the email and code must match records.
+// Output:
+//   - bool: Represents code validity. true if code correct and unexpired, false if purpose or email incorrect, code
+//   incorrect, or expired.
+func ValidateGateCodeFor(purpose, email, code string) bool {
+	codesMu.Lock()
+	defer codesMu.Unlock()
+	key := codeKey(purpose, email)
+	storedCode, ok := activeCodes[key]
 	if !ok {
 		return false
 	}
-	if storedCode.Code == code && storedCode.Expires.After(time.Now()) {
-		delete(activeCodes, email)
-		return true
-	} else {
-		delete(activeCodes, email)
-		return false
-	}
+	delete(activeCodes, key)
+	return storedCode.Code == code && storedCode.Expires.After(time.Now())
 }
@@ -1,6 +1,9 @@
 package gatecode
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestValidateAuthCode(t *testing.T) {
 	// Test correct authcode
@@ -22,3 +25,24 @@ func TestValidateAuthCode(t *testing.T) {
 		t.Errorf("Validation 2 passed when it should have failed")
 	}
 }
+
+func TestGateCodePurposes(t *testing.T) {
+	verify := NewGateCodeFor("verify", "testuser@gmail.com", time.Hour)
+	login := NewGateCode("testuser@gmail.com")
+	// A login code must not replace or validate as a verification code.
+	if ValidateGateCodeFor("verify", "testuser@gmail.com", login) && login != verify {
+		t.Errorf("Login code validated as a verification code")
+	}
+	verify = NewGateCodeFor("verify", "testuser@gmail.com", time.Hour)
+	if !ValidateGateCode("testuser@gmail.com", login) {
+		t.Errorf("Login code was replaced by a verification code")
+	}
+	if !ValidateGateCodeFor("verify", "testuser@gmail.com", verify) {
+		t.Errorf("Verification code failed when it should have passed")
+	}
+	// Expired codes fail.
+	expired := NewGateCodeFor("verify", "testuser@gmail.com", -time.Second)
+	if ValidateGateCodeFor("verify", "testuser@gmail.com", expired) {
+		t.Errorf("Expired code passed")
+	}
+}
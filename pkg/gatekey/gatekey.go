@@ -7,8 +7,19 @@ import (
 	"encoding/json"
 	"strings"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
+// ErrMalformedToken is returned by Verify when a token isn't an exported GateKey at all.
+var ErrMalformedToken = errors.New("Malformed token")
+
+// ErrInvalidSignature is returned by Verify when a token wasn't signed with the secret, or was altered after signing.
+var ErrInvalidSignature = errors.New("Invalid token signature")
+
+// ErrExpiredToken is returned by Verify when a correctly signed token has expired.
+var ErrExpiredToken = errors.New("Token expired")
+
 // jwtHeader: `auth` treats these as constants.
 type GateKeyHeader struct {
 	Algorithm string `json:"alg"`
@@ -22,6 +33,10 @@ type GateKeyBody struct {
 	Permissions map[string]bool `json:"permissions"`
 	Created     int64           `json:"iat"`
 	Expires     int64           `json:"exp"`
+	// Audience names the application the key was issued for. Keys from before applications existed have none.
+	Audience string `json:"aud,omitempty"`
+	// Claims holds profile fields and attributes of the user, for applications that ask for them.
+	Claims map[string]interface{} `json:"claims,omitempty"`
 }
 
 // Gate key structure.
@@ -82,10 +97,8 @@ func Export(key *GateKey, secret []byte) string {
 
 // Verify an exported GateKey.
 // This and Export are inverse operations; the same secret MUST be used in both for correct results.
-// Notably, this returns a bool representing validity AND an error. The error does not represent the state
-// of the token, but any error that occured during validation. It is recommended that when checking if the
-// result of Verify, if the bool output is false, that the error also be checked for a reason; if the error
-// is nil, then the token has a valid format but is either not signed correctly or expired.
+// The bool result is true only if the error is nil; the error says why a token isn't valid, and can be matched with
+// errors.Is.
 //
 // Input:
 //   - token string: Exported GateKey.
@@ -93,30 +106,38 @@ func Export(key *GateKey, secret []byte) string {
 // Output:
 //   - *GateKey: Resulting GateKey. nil if verification failed.
 //   - bool: Is token valid?
-//   - error: Any error that occurs during verification.
+//   - error: ErrMalformedToken if token can't be decoded, ErrInvalidSignature if it isn't signed with secret,
+//   ErrExpiredToken if it has expired, or nil.
 func Verify(token string, secret []byte) (*GateKey, bool, error) {
 	items := strings.Split(token, ".")
+	if len(items) != 3 {
+		return nil, false, errors.Wrapf(ErrMalformedToken, "%d parts instead of 3", len(items))
+	}
 	// Unmarshal and decode the JWT
 	key := &GateKey{}
 	head, err := base64.RawURLEncoding.DecodeString(items[0])
 	if err != nil {
-		return nil, false, err
+		return nil, false, errors.Wrapf(ErrMalformedToken, "header: %v", err)
 	}
 	err = json.Unmarshal([]byte(head), &(key.Header))
 	if err != nil {
-		return nil, false, err
+		return nil, false, errors.Wrapf(ErrMalformedToken, "header: %v", err)
 	}
 	body, err := base64.RawURLEncoding.DecodeString(items[1])
 	if err != nil {
-		return nil, false, err
+		return nil, false, errors.Wrapf(ErrMalformedToken, "body: %v", err)
 	}
 	err = json.Unmarshal([]byte(body), &(key.Body))
 	if err != nil {
-		return nil, false, err
+		return nil, false, errors.Wrapf(ErrMalformedToken, "body: %v", err)
 	}
 	// Re-export the resulting key; should result in the exact same output
 	expected := Export(key, secret)
-	// Return verification eval result and new token
-	expired := key.Body.Expires < time.Now().Unix()
-	return key, token == expected && !expired, nil
+	if !hmac.Equal([]byte(token), []byte(expected)) {
+		return nil, false, ErrInvalidSignature
+	}
+	if key.Body.Expires < time.Now().Unix() {
+		return nil, false, ErrExpiredToken
+	}
+	return key, true, nil
 }
@@ -1,6 +1,7 @@
 package gatekey
 
 import (
+	"errors"
 	"strings"
 	"testing"
 	"time"
@@ -94,3 +95,86 @@ func TestExportVerifyInvalid(t *testing.T) {
 		t.Error("Placing erroneous rune in body didn't return an error from Verify")
 	}
 }
+
+// Test that Verify reports why a token is invalid, without panicking on tokens that aren't GateKeys at all.
+func TestVerifyErrors(t *testing.T) {
+	token := Export(NewGateKey("testUser", nil, time.Hour), []byte("test"))
+	expired := Export(NewGateKey("testUser", nil, -time.Hour), []byte("test"))
+	for name, test := range map[string]struct {
+		token  string
+		secret string
+		err    error
+	}{
+		"no dots":      {"notatoken", "test", ErrMalformedToken},
+		"empty":        {"", "test", ErrMalformedToken},
+		"extra part":   {token + ".more", "test", ErrMalformedToken},
+		"wrong secret": {token, "other", ErrInvalidSignature},
+		"expired":      {expired, "test", ErrExpiredToken},
+	} {
+		key, valid, err := Verify(test.token, []byte(test.secret))
+		if valid || key != nil || !errors.Is(err, test.err) {
+			t.Errorf("%s: Verify returned %v, %t, %v instead of %v", name, key, valid, err, test.err)
+		}
+	}
+}
+
+func TestHasPermission(t *testing.T) {
+	key := NewGateKey("testUser@gmail.com", map[string]bool{
+		"admin":                   true,
+		"billing:*":               true,
+		"billing:invoices:delete": false,
+		"reports:*:read":          true,
+		"audit:*":                 false,
+		"*":                       true,
+	}, time.Hour)
+	expected := map[string]bool{
+		"admin":                   true,
+		"billing:invoices:read":   true,
+		"billing:refunds":         true,
+		"billing:invoices:delete": false,
+		"reports:sales:read":      true,
+		"reports:sales:write":     true, // Allowed by *
+		"audit:log:read":          false,
+		"audit":                   true, // audit:* needs at least one more segment
+	}
+	for perm, allowed := range expected {
+		if HasPermission(key, perm) != allowed {
+			t.Errorf("HasPermission(%s) should be %t", perm, allowed)
+		}
+	}
+	key.Body.Permissions = map[string]bool{"reports:*:read": true, "billing": true}
+	for perm, allowed := range map[string]bool{
+		"reports:sales:read":       true,
+		"reports:sales:write":      false,
+		"reports:sales:daily:read": false,
+		"reports:read":             false,
+		"billing":                  true,
+		"billing:invoices":         false,
+	} {
+		if HasPermission(key, perm) != allowed {
+			t.Errorf("HasPermission(%s) should be %t", perm, allowed)
+		}
+	}
+	if HasPermission(nil, "admin") {
+		t.Error("nil key granted a permission")
+	}
+}
+
+func TestIsAdmin(t *testing.T) {
+	for _, test := range []struct {
+		perms map[string]bool
+		admin bool
+	}{
+		{map[string]bool{"admin": true}, true},
+		{map[string]bool{"*": true}, false},
+		{map[string]bool{"*": true, "admin": false}, false},
+		{map[string]bool{"admin:*": true, "*:*": true}, false},
+	} {
+		if IsAdmin(NewGateKey("testUser@gmail.com", test.perms, time.Hour)) != test.admin {
+			t.Errorf("IsAdmin with %v should be %t", test.perms, test.admin)
+		}
+	}
+	if IsAdmin(nil) {
+		t.Error("nil key is an admin's")
+	}
+}
@@ -0,0 +1,96 @@
+package gatekey
+
+import (
+	"strings"
+)
+
+// permissionSep separates the segments of a permission.
+const permissionSep = ":"
+
+// permissionWildcard matches any segment of a permission.
+const permissionWildcard = "*"
+
+// AdminPermission makes its holder a Gate admin, with control of the dashboard. It is only granted by name, never by
+// wildcards, so that an application's * grant doesn't control Gate itself; see IsAdmin.
+const AdminPermission = "admin"
+
+// Check whether a permission pattern covers a permission.
+//
+// Input:
+//   - pattern string: Granted or denied permission, possibly with wildcards.
+//   - perm string: Permission being checked. Wildcards in perm are matched literally.
+// Output:
+//   - bool: Does pattern cover perm?
+func permissionMatches(pattern, perm string) bool {
+	if pattern == perm {
+		return true
+	}
+	patternSegs := strings.Split(pattern, permissionSep)
+	permSegs := strings.Split(perm, permissionSep)
+	for i, seg := range patternSegs {
+		last := i == len(patternSegs)-1
+		if i >= len(permSegs) {
+			return false
+		}
+		if seg == permissionWildcard {
+			if last {
+				return true
+			}
+			continue
+		}
+		if seg != permSegs[i] {
+			return false
+		}
+	}
+	return len(patternSegs) == len(permSegs)
+}
+
+// Check whether a set of permissions allows a permission.
+// Permissions are strings of segments separated by colons, from general to specific, such as billing:invoices:read.
+// A pattern may use * as a segment to match any one segment; a trailing * matches one or more segments, so billing:*
+// covers every billing permission, and * alone covers everything. A pattern set to false is an explicit deny.
+// The permission is allowed if any granted pattern covers it and no denied pattern does.
+//
+// Input:
+//   - permissions map[string]bool: Granted (true) and denied (false) permission patterns.
+//   - perm string: Permission to check, such as billing:invoices:read.
+// Output:
+//   - bool: Is perm allowed?
+func PermissionsAllow(permissions map[string]bool, perm string) bool {
+	allowed := false
+	for pattern, granted := range permissions {
+		if !permissionMatches(pattern, perm) {
+			continue
+		}
+		if !granted {
+			return false
+		}
+		allowed = true
+	}
+	return allowed
+}
+
+// Check whether a GateKey grants a permission. See PermissionsAllow.
+//
+// Input:
+//   - key *GateKey: Key to check. A nil key grants nothing.
+//   - perm string: Permission to check.
+// Output:
+//   - bool: Does key grant perm?
+func HasPermission(key *GateKey, perm string) bool {
+	if key == nil {
+		return false
+	}
+	return PermissionsAllow(key.Body.Permissions, perm)
+}
+
+// Check whether a GateKey belongs to a Gate admin. Unlike HasPermission, this needs AdminPermission granted by name:
+// wildcards such as * don't match it.
+//
+// Input:
+//   - key *GateKey: Key to check. A nil key isn't an admin's.
+// Output:
+//   - bool: Does key grant AdminPermission exactly?
+func IsAdmin(key *GateKey) bool {
+	return key != nil && key.Body.Permissions[AdminPermission]
+}
@@ -3,6 +3,7 @@ package mail
 import (
 	"fmt"
 	"net/smtp"
+	"time"
 )
 
 // struct Host holds host data for sending SMTP through SES.
@@ -53,6 +54,105 @@ func NewAuthMessage(sendTo string, code string) []byte {
 	return []byte(msg)
 }
 
+// Generate a new email verification message given a target email and a gate code.
+//
+// Input:
+//   - sendTo string: Email to verify; the code is sent here
+//   - code string: Verification code
+//   - valid time.Duration: How long the code lasts, for the message text
+// Output:
+//   - []byte: Properly formatted message for sending through smtp.
+func NewVerificationMessage(sendTo string, code string, valid time.Duration) []byte {
+	msg := fmt.Sprintf(
+		"To: %s\r\n"+
+			"Subject: Verify your email address\r\n"+
+			"\r\n"+
+			"Your email verification code is %s.\n"+
+			"This code will expire in %s.\r\n",
+		sendTo, code, describeDuration(valid),
+	)
+	return []byte(msg)
+}
+
+// Generate a new password reset message given a target email and a gate code.
+//
+// Input:
+//   - sendTo string: Email of the user resetting their password
+//   - code string: Reset code
+//   - valid time.Duration: How long the code lasts, for the message text
+// Output:
+//   - []byte: Properly formatted message for sending through smtp.
+func NewPasswordResetMessage(sendTo string, code string, valid time.Duration) []byte {
+	msg := fmt.Sprintf(
+		"To: %s\r\n"+
+			"Subject: Password Reset Code\r\n"+
+			"\r\n"+
+			"Your password reset code is %s.\n"+
+			"This code will expire in %s. If you didn't ask to reset your password, you can ignore this email.\r\n",
+		sendTo, code, describeDuration(valid),
+	)
+	return []byte(msg)
+}
+
+// Generate a new email change confirmation message, sent to the new address, given a gate code.
+//
+// Input:
+//   - sendTo string: The new email
+//   - code string: Confirmation code
+//   - valid time.Duration: How long the code lasts, for the message text
+// Output:
+//   - []byte: Properly formatted message for sending through smtp.
+func NewEmailChangeMessage(sendTo string, code string, valid time.Duration) []byte {
+	msg := fmt.Sprintf(
+		"To: %s\r\n"+
+			"Subject: Confirm your new email address\r\n"+
+			"\r\n"+
+			"Your email change confirmation code is %s.\n"+
+			"This code will expire in %s.\r\n",
+		sendTo, code, describeDuration(valid),
+	)
+	return []byte(msg)
+}
+
+// Generate a notice of an email change, sent to the previous address, with a link that reverts the change.
+//
+// Input:
+//   - sendTo string: The previous email
+//   - newEmail string: The email the account changed to
+//   - revertLink string: Link that reverts the change
+//   - valid time.Duration: How long the link lasts, for the message text
+// Output:
+//   - []byte: Properly formatted message for sending through smtp.
+func NewEmailChangedNotice(sendTo string, newEmail string, revertLink string, valid time.Duration) []byte {
+	msg := fmt.Sprintf(
+		"To: %s\r\n"+
+			"Subject: Your email address was changed\r\n"+
+			"\r\n"+
+			"The email address for your account was changed to %s.\n"+
+			"If you didn't make this change, open the link below within %s to change it back:\n"+
+			"%s\r\n",
+		sendTo, newEmail, describeDuration(valid), revertLink,
+	)
+	return []byte(msg)
+}
+
+// Describe a duration in words for a message, in whole hours if possible and whole minutes otherwise.
+//
+// Input:
+//   - d time.Duration: Duration to describe
+// Output:
+//   - string: Description, such as "24 hours" or "1 minute"
+func describeDuration(d time.Duration) string {
+	count, unit := int64(d/time.Minute), "minute"
+	if d >= time.Hour && d%time.Hour == 0 {
+		count, unit = int64(d/time.Hour), "hour"
+	}
+	if count != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("%d %s", count, unit)
+}
+
 // Send a message from a Host to an email address.
 //
 // Input:
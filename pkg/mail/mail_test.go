@@ -2,7 +2,9 @@ package mail
 
 import (
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 // Testing for this one is a little more difficult, since SendMessage has to send out an email.
@@ -24,3 +26,15 @@ func TestSendMessage(t *testing.T) {
 	msg := NewAuthMessage(testRecipient, "AAAAAA")
 	SendMessage(testHost, testRecipient, msg)
 }
+
+func TestVerificationMessage(t *testing.T) {
+	msg := string(NewVerificationMessage(testRecipient, "AAAAAA", 24*time.Hour))
+	if !strings.Contains(msg, "AAAAAA") || !strings.Contains(msg, "24 hours") {
+		t.Errorf("Unexpected verification message:\n%s", msg)
+	}
+	for d, expected := range map[time.Duration]string{time.Minute: "1 minute", 90 * time.Minute: "90 minutes", time.Hour: "1 hour"} {
+		if described := describeDuration(d); described != expected {
+			t.Errorf("%v described as %q, expected %q", d, described, expected)
+		}
+	}
+}
@@ -1,9 +1,14 @@
 package server
 
 import (
+	"encoding/base64"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/jakenichols2719/gate/pkg/credentials"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
 )
@@ -20,7 +25,129 @@ type SMTPHostConfig struct {
 }
 
 type DBConfig struct {
-	Path string `yaml:"Path"`
+	Driver          string `yaml:"Driver"`
+	Path            string `yaml:"Path"`
+	DSN_ENV         string `yaml:"ENV_DSN"`
+	DSN             string `yaml:"-"`
+	MaxOpenConns    int    `yaml:"MaxOpenConns"`
+	MaxIdleConns    int    `yaml:"MaxIdleConns"`
+	ConnMaxLifetime int    `yaml:"ConnMaxLifetime"`
+	// ManualMigrations leaves schema migrations to gatemigrate; the server refuses to start on an outdated schema.
+	ManualMigrations bool `yaml:"ManualMigrations"`
+	// Encryption is optional; leaving it out stores personal data in plaintext.
+	Encryption EncryptionConfig `yaml:"Encryption"`
+	// encryption is Encryption with its keys read and decoded; see readEncryption.
+	encryption *credentials.FieldEncryption
+}
+
+// EncryptionConfig gives the keys personal data in the database is encrypted with. Keys are base64, and may be given
+// in the config file, or in the environment variables named by the _ENV fields, as with other secrets.
+type EncryptionConfig struct {
+	// Keys maps key IDs to keys. Keys_ENV names a variable holding more, as comma-separated id:key pairs.
+	Keys     map[string]string `yaml:"Keys"`
+	Keys_ENV string            `yaml:"ENV_Keys"`
+	// PrimaryKey is the ID of the key new values are encrypted with; "" stops encrypting them.
+	PrimaryKey   string `yaml:"PrimaryKey"`
+	IndexKey     string `yaml:"IndexKey"`
+	IndexKey_ENV string `yaml:"ENV_IndexKey"`
+}
+
+// Read the keys of the calling EncryptionConfig from the environment, and decode them.
+//
+// Calling:
+//   - cfg EncryptionConfig: Encryption configuration.
+// Output:
+//   - *credentials.FieldEncryption: Encryption for credentials.DBOptions; nil if no keys are configured.
+//   - error: Returned if an environment variable can't be read, or a key isn't base64.
+func (cfg EncryptionConfig) fieldEncryption() (*credentials.FieldEncryption, error) {
+	enc := &credentials.FieldEncryption{Keys: make(map[string][]byte), PrimaryKey: cfg.PrimaryKey}
+	for id, key := range cfg.Keys {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Encryption key %s isn't base64", id)
+		}
+		enc.Keys[id] = decoded
+	}
+	if cfg.Keys_ENV != "" {
+		keys, err := readKeyList(cfg.Keys_ENV)
+		if err != nil {
+			return nil, err
+		}
+		for id, key := range keys {
+			enc.Keys[id] = key
+		}
+	}
+	indexKey := cfg.IndexKey
+	if cfg.IndexKey_ENV != "" {
+		var ok bool
+		if indexKey, ok = os.LookupEnv(cfg.IndexKey_ENV); !ok {
+			return nil, errors.Errorf("Couldn't read %s", cfg.IndexKey_ENV)
+		}
+	}
+	if indexKey != "" {
+		decoded, err := base64.StdEncoding.DecodeString(indexKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "Encryption index key isn't base64")
+		}
+		enc.IndexKey = decoded
+	}
+	if len(enc.Keys) == 0 && enc.IndexKey == nil && enc.PrimaryKey == "" {
+		return nil, nil
+	}
+	return enc, nil
+}
+
+// Read a list of keys from an environment variable, as comma-separated id:key pairs with base64 keys.
+//
+// Input:
+//   - env string: Name of the environment variable.
+// Output:
+//   - map[string][]byte: Decoded keys, by ID.
+//   - error: Returned if the variable isn't set, isn't a list of pairs, or a key isn't base64.
+func readKeyList(env string) (map[string][]byte, error) {
+	value, ok := os.LookupEnv(env)
+	if !ok {
+		return nil, errors.Errorf("Couldn't read %s", env)
+	}
+	keys := make(map[string][]byte)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("%s must be a comma-separated list of id:key pairs", env)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Key %s in %s isn't base64", parts[0], env)
+		}
+		keys[parts[0]] = decoded
+	}
+	return keys, nil
+}
+
+// Get the credentials.DBOptions described by the calling DBConfig.
+// sqlite databases are opened from Path; any other driver uses the DSN read from DSN_ENV.
+//
+// Calling:
+//   - cfg DBConfig: Database configuration.
+// Output:
+//   - credentials.DBOptions: Options for credentials.OpenDB.
+func (cfg DBConfig) Options() credentials.DBOptions {
+	opts := credentials.DBOptions{
+		Driver:           cfg.Driver,
+		DSN:              cfg.DSN,
+		MaxOpenConns:     cfg.MaxOpenConns,
+		MaxIdleConns:     cfg.MaxIdleConns,
+		ConnMaxLifetime:  time.Duration(cfg.ConnMaxLifetime) * time.Minute,
+		ManualMigrations: cfg.ManualMigrations,
+		Encryption:       cfg.encryption,
+	}
+	if opts.Driver == "" || opts.Driver == "sqlite" {
+		opts.DSN = cfg.Path
+	}
+	return opts
 }
 
 type JWTConfig struct {
@@ -28,6 +155,291 @@ type JWTConfig struct {
 	TokenSecret     string `yaml:"-"`
 	UserValidTime   int    `yaml:"UserValidTime"`
 	AdminValidTime  int    `yaml:"AdminValidTime"`
+	// ProfileClaims names the profile fields and attributes gate keys carry, unless an application sets its own.
+	ProfileClaims []string `yaml:"ProfileClaims"`
+}
+
+type HashConfig struct {
+	Algorithm string `yaml:"Algorithm"`
+	Argon2id  struct {
+		Time    uint32 `yaml:"Time"`
+		Memory  uint32 `yaml:"Memory"`
+		Threads uint8  `yaml:"Threads"`
+	} `yaml:"Argon2id"`
+	Scrypt struct {
+		N int `yaml:"N"`
+		R int `yaml:"R"`
+		P int `yaml:"P"`
+	} `yaml:"Scrypt"`
+	Bcrypt struct {
+		Cost int `yaml:"Cost"`
+	} `yaml:"Bcrypt"`
+	SHA512 struct {
+		Rounds int `yaml:"Rounds"`
+	} `yaml:"SHA512"`
+	// Pepper is optional; leaving it out hashes passwords without a pepper.
+	Pepper PepperConfig `yaml:"Pepper"`
+	// pepper is Pepper with its keys read and decoded; see readEnvs.
+	pepper credentials.Pepper
+}
+
+// PepperConfig gives the secret keys mixed into password hashes, by version. The keys are read from the environment
+// variable named by Keys_ENV, as comma-separated version:key pairs with base64 keys, like 1:<key>,2:<key>.
+type PepperConfig struct {
+	// Version is the key new hashes are made with; 0 for none. Hashes made with other versions are rehashed on login.
+	Version  int    `yaml:"Version"`
+	Keys_ENV string `yaml:"ENV_Keys"`
+}
+
+// Read the keys of the calling PepperConfig from the environment.
+//
+// Calling:
+//   - cfg PepperConfig: Pepper configuration.
+// Output:
+//   - credentials.Pepper: Pepper for credentials.Service.Pepper.
+//   - error: Returned if the environment variable can't be read, a version isn't a positive number, or Version has no
+//   key.
+func (cfg PepperConfig) read() (credentials.Pepper, error) {
+	pepper := credentials.Pepper{Version: cfg.Version, Keys: make(map[int][]byte)}
+	if cfg.Keys_ENV != "" {
+		keys, err := readKeyList(cfg.Keys_ENV)
+		if err != nil {
+			return pepper, err
+		}
+		for id, key := range keys {
+			version, err := strconv.Atoi(id)
+			if err != nil || version < 1 {
+				return pepper, errors.Errorf("Pepper version %s in %s must be a positive number", id, cfg.Keys_ENV)
+			}
+			pepper.Keys[version] = key
+		}
+	}
+	if _, ok := pepper.Keys[cfg.Version]; cfg.Version != 0 && !ok {
+		return pepper, errors.Errorf("Pepper version %d has no key", cfg.Version)
+	}
+	return pepper, nil
+}
+
+// Get the credentials.HashPolicy described by the calling HashConfig.
+// Unset values fall back to credentials.DefaultHashPolicy.
+//
+// Calling:
+//   - cfg HashConfig: Password hashing configuration.
+// Output:
+//   - credentials.HashPolicy: Policy for credentials.Service.Hashing.
+func (cfg HashConfig) Policy() credentials.HashPolicy {
+	return credentials.HashPolicy{
+		Algorithm:     cfg.Algorithm,
+		Argon2Time:    cfg.Argon2id.Time,
+		Argon2Memory:  cfg.Argon2id.Memory,
+		Argon2Threads: cfg.Argon2id.Threads,
+		ScryptN:       cfg.Scrypt.N,
+		ScryptR:       cfg.Scrypt.R,
+		ScryptP:       cfg.Scrypt.P,
+		BcryptCost:    cfg.Bcrypt.Cost,
+		SHA512Rounds:  cfg.SHA512.Rounds,
+	}
+}
+
+type LockoutConfig struct {
+	MaxAttempts int `yaml:"MaxAttempts"`
+	Duration    int `yaml:"Duration"`
+	MaxDuration int `yaml:"MaxDuration"`
+	ResetAfter  int `yaml:"ResetAfter"`
+}
+
+// Get the credentials.LockoutPolicy described by the calling LockoutConfig. All durations are in minutes.
+//
+// Calling:
+//   - cfg LockoutConfig: Failed login lockout configuration. MaxAttempts 0 disables lockout.
+// Output:
+//   - credentials.LockoutPolicy: Policy for credentials.Service.Lockout.
+func (cfg LockoutConfig) Policy() credentials.LockoutPolicy {
+	return credentials.LockoutPolicy{
+		MaxAttempts: cfg.MaxAttempts,
+		Duration:    time.Duration(cfg.Duration) * time.Minute,
+		MaxDuration: time.Duration(cfg.MaxDuration) * time.Minute,
+		ResetAfter:  time.Duration(cfg.ResetAfter) * time.Minute,
+	}
+}
+
+type PasswordPolicyConfig struct {
+	MinLength        int    `yaml:"MinLength"`
+	MaxLength        int    `yaml:"MaxLength"`
+	RequireUpper     bool   `yaml:"RequireUpper"`
+	RequireLower     bool   `yaml:"RequireLower"`
+	RequireDigit     bool   `yaml:"RequireDigit"`
+	RequireSymbol    bool   `yaml:"RequireSymbol"`
+	DisallowUserInfo bool   `yaml:"DisallowUserInfo"`
+	BreachedList     string `yaml:"BreachedList"`
+	// History is how many previous passwords a user may not reuse. 0 disables the check.
+	History int `yaml:"History"`
+}
+
+// Get the credentials.PasswordPolicy described by the calling PasswordPolicyConfig.
+// If BreachedList is set, the list is loaded from that file.
+//
+// Calling:
+//   - cfg PasswordPolicyConfig: Password policy configuration. The zero config accepts every password.
+// Output:
+//   - credentials.PasswordPolicy: Policy for credentials.Service.Passwords.
+//   - error: Returned if the breached password list can't be read.
+func (cfg PasswordPolicyConfig) Policy() (credentials.PasswordPolicy, error) {
+	policy := credentials.PasswordPolicy{
+		MinLength:        cfg.MinLength,
+		MaxLength:        cfg.MaxLength,
+		RequireUpper:     cfg.RequireUpper,
+		RequireLower:     cfg.RequireLower,
+		RequireDigit:     cfg.RequireDigit,
+		RequireSymbol:    cfg.RequireSymbol,
+		DisallowUserInfo: cfg.DisallowUserInfo,
+	}
+	if cfg.BreachedList != "" {
+		breached, err := credentials.LoadBreachedPasswords(cfg.BreachedList)
+		if err != nil {
+			return policy, errors.Wrapf(err, "Couldn't load breached password list %s", cfg.BreachedList)
+		}
+		policy.Breached = breached
+	}
+	return policy, nil
+}
+
+// Values of EmailVerificationConfig.Require.
+const (
+	// RequireVerifiedNone lets unverified users log in and get gate keys.
+	RequireVerifiedNone = "none"
+	// RequireVerifiedLogin refuses logins from unverified users.
+	RequireVerifiedLogin = "login"
+	// RequireVerifiedToken lets unverified users log in, but refuses them gate keys.
+	RequireVerifiedToken = "token"
+)
+
+type EmailVerificationConfig struct {
+	Require       string `yaml:"Require"`
+	CodeValidTime int    `yaml:"CodeValidTime"`
+}
+
+// Check that the calling EmailVerificationConfig is usable.
+//
+// Calling:
+//   - cfg EmailVerificationConfig: Email verification configuration. The zero config is RequireVerifiedNone.
+// Output:
+//   - error: Returned if Require isn't one of the RequireVerified values.
+func (cfg EmailVerificationConfig) check() error {
+	switch cfg.Require {
+	case "", RequireVerifiedNone, RequireVerifiedLogin, RequireVerifiedToken:
+		return nil
+	}
+	return errors.Errorf("EmailVerification Require must be one of %s, %s or %s, not %s",
+		RequireVerifiedNone, RequireVerifiedLogin, RequireVerifiedToken, cfg.Require)
+}
+
+// Get how long verification codes last.
+//
+// Calling:
+//   - cfg EmailVerificationConfig: Email verification configuration. CodeValidTime is in minutes.
+// Output:
+//   - time.Duration: Code lifetime; 24 hours if CodeValidTime isn't set.
+func (cfg EmailVerificationConfig) codeLifetime() time.Duration {
+	if cfg.CodeValidTime <= 0 {
+		return time.Hour * 24
+	}
+	return time.Duration(cfg.CodeValidTime) * time.Minute
+}
+
+type PasswordResetConfig struct {
+	CodeValidTime int `yaml:"CodeValidTime"`
+}
+
+// Get how long password reset codes last.
+//
+// Calling:
+//   - cfg PasswordResetConfig: Password reset configuration. CodeValidTime is in minutes.
+// Output:
+//   - time.Duration: Code lifetime; 15 minutes if CodeValidTime isn't set.
+func (cfg PasswordResetConfig) codeLifetime() time.Duration {
+	if cfg.CodeValidTime <= 0 {
+		return time.Minute * 15
+	}
+	return time.Duration(cfg.CodeValidTime) * time.Minute
+}
+
+type EmailChangeConfig struct {
+	CodeValidTime int `yaml:"CodeValidTime"`
+	FreshKeyAge   int `yaml:"FreshKeyAge"`
+	RevertWindow  int `yaml:"RevertWindow"`
+}
+
+// Get how long email change confirmation codes last.
+//
+// Calling:
+//   - cfg EmailChangeConfig: Email change configuration. CodeValidTime is in minutes.
+// Output:
+//   - time.Duration: Code lifetime; 1 hour if CodeValidTime isn't set.
+func (cfg EmailChangeConfig) codeLifetime() time.Duration {
+	if cfg.CodeValidTime <= 0 {
+		return time.Hour
+	}
+	return time.Duration(cfg.CodeValidTime) * time.Minute
+}
+
+// Get how recently a gate key must have been issued to start an email change without a password.
+//
+// Calling:
+//   - cfg EmailChangeConfig: Email change configuration. FreshKeyAge is in minutes.
+// Output:
+//   - time.Duration: Maximum key age; 10 minutes if FreshKeyAge isn't set.
+func (cfg EmailChangeConfig) freshKeyAge() time.Duration {
+	if cfg.FreshKeyAge <= 0 {
+		return time.Minute * 10
+	}
+	return time.Duration(cfg.FreshKeyAge) * time.Minute
+}
+
+// Get how long the previous address can revert an email change.
+//
+// Calling:
+//   - cfg EmailChangeConfig: Email change configuration. RevertWindow is in hours.
+// Output:
+//   - time.Duration: Revert window; credentials.DefaultEmailRevertWindow if RevertWindow isn't set.
+func (cfg EmailChangeConfig) revertWindow() time.Duration {
+	if cfg.RevertWindow <= 0 {
+		return credentials.DefaultEmailRevertWindow
+	}
+	return time.Duration(cfg.RevertWindow) * time.Hour
+}
+
+type ApplicationConfig struct {
+	Name     string `yaml:"Name"`
+	Audience string `yaml:"Audience"`
+	// LegacyKey is optional; it's only needed once, to adopt the API key of a database from before applications existed.
+	LegacyKey LegacyKeyConfig `yaml:"LegacyKey"`
+}
+
+// LegacyKeyConfig adopts the API key of a database from before applications existed, which is refused until then.
+// The key is read from the environment variable named by Key_ENV, and adopted on startup; the variable can be removed
+// once the server has started with it.
+type LegacyKeyConfig struct {
+	Key_ENV string `yaml:"ENV_Key"`
+	// Application the key is adopted into; empty uses the first application.
+	Application string `yaml:"Application"`
+	// Scopes the key is limited to, as for keys made from the dashboard; empty allows every endpoint.
+	Scopes []string `yaml:"Scopes"`
+	// key is the legacy API key, read from Key_ENV; see readEnvs.
+	key string
+}
+
+// Get the name of the application created on first run, or when upgrading a database from before applications existed.
+//
+// Calling:
+//   - cfg ApplicationConfig: Application configuration.
+// Output:
+//   - string: Application name; "Gate" if Name isn't set.
+func (cfg ApplicationConfig) name() string {
+	if cfg.Name == "" {
+		return "Gate"
+	}
+	return cfg.Name
 }
 
 // ServerConfig defines configuration settings for the authentication server.
@@ -38,6 +450,18 @@ type AuthServerConfig struct {
 	SMTPHost SMTPHostConfig `yaml:"SMTPHost"`
 	DB       DBConfig       `yaml:"Database"`
 	JWT      JWTConfig      `yaml:"JWT"`
+	Hashing  HashConfig     `yaml:"Hashing"`
+	Lockout  LockoutConfig  `yaml:"Lockout"`
+	// Passwords is optional; leaving it out accepts every password.
+	Passwords PasswordPolicyConfig `yaml:"PasswordPolicy"`
+	// EmailVerification is optional; leaving it out never requires a verified email.
+	EmailVerification EmailVerificationConfig `yaml:"EmailVerification"`
+	// PasswordReset is optional; leaving it out uses 15 minute reset codes.
+	PasswordReset PasswordResetConfig `yaml:"PasswordReset"`
+	// EmailChange is optional; leaving it out uses the defaults described in config.yml.
+	EmailChange EmailChangeConfig `yaml:"EmailChange"`
+	// Application is optional; it only names the first application, and later ones are created from the dashboard.
+	Application ApplicationConfig `yaml:"Application"`
 }
 
 func NewConfig() *AuthServerConfig {
@@ -66,7 +490,36 @@ func (cfg *AuthServerConfig) readEnvs() error {
 	if !ok {
 		return errors.Errorf("Couldn't read %s", cfg.JWT.TokenSecret_ENV)
 	}
-	return nil
+	var err error
+	if cfg.Hashing.pepper, err = cfg.Hashing.Pepper.read(); err != nil {
+		return err
+	}
+	if legacy := &cfg.Application.LegacyKey; legacy.Key_ENV != "" {
+		if legacy.key, ok = os.LookupEnv(legacy.Key_ENV); !ok {
+			return errors.Errorf("Couldn't read %s", legacy.Key_ENV)
+		}
+	}
+	return cfg.readDBEnvs()
+}
+
+// Read the environment variables of the database settings in the calling AuthServerConfig.
+//
+// Calling:
+//   - cfg *AuthServerConfig: Config to read environment values into.
+// Output:
+//   - error: Returned if any database ENV value couldn't be read, or an encryption key couldn't be decoded.
+func (cfg *AuthServerConfig) readDBEnvs() error {
+	// The database DSN is only needed for networked databases, so it's optional.
+	if cfg.DB.DSN_ENV != "" {
+		var ok bool
+		cfg.DB.DSN, ok = os.LookupEnv(cfg.DB.DSN_ENV)
+		if !ok {
+			return errors.Errorf("Couldn't read %s", cfg.DB.DSN_ENV)
+		}
+	}
+	var err error
+	cfg.DB.encryption, err = cfg.DB.Encryption.fieldEncryption()
+	return err
 }
 
 // Read a configuration file into the calling *AuthServerConfig.
@@ -74,7 +527,8 @@ func (cfg *AuthServerConfig) readEnvs() error {
 // Calling:
 //   - cfg *AuthServerConfig: Config to read file into. If no error results, cfg should be fully populated.
 // Output:
-//   - error: Any error that occurs when reading, including: file doesn't exist, invalid yaml format, envs not present
+//   - error: Any error that occurs when reading, including: file doesn't exist, invalid yaml format, invalid settings,
+//   envs not present
 func (cfg *AuthServerConfig) ReadConfig(fn string) error {
 	input, err := ioutil.ReadFile(fn)
 	if err != nil {
@@ -84,6 +538,9 @@ func (cfg *AuthServerConfig) ReadConfig(fn string) error {
 	if err != nil {
 		return err
 	}
+	if err = cfg.EmailVerification.check(); err != nil {
+		return err
+	}
 	err = cfg.readEnvs()
 	if err != nil {
 		return err
@@ -91,3 +548,22 @@ func (cfg *AuthServerConfig) ReadConfig(fn string) error {
 
 	return nil
 }
+
+// Read only the database settings from a configuration file, for tools that open the database without running a
+// server. Unlike ReadConfig, only the database environment variables need to be set.
+//
+// Calling:
+//   - cfg *AuthServerConfig: Config to read file into. If no error results, cfg.DB is fully populated.
+// Output:
+//   - error: Any error that occurs when reading, including: file doesn't exist, invalid yaml format, database envs not
+//   present, encryption keys not base64
+func (cfg *AuthServerConfig) ReadDBConfig(fn string) error {
+	input, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(input, cfg); err != nil {
+		return err
+	}
+	return cfg.readDBEnvs()
+}
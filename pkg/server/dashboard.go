@@ -5,16 +5,20 @@ import (
 	"fmt"
 	"net/http"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"text/template"
 	"time"
 
 	"github.com/jakenichols2719/gate/pkg/credentials"
 	"github.com/jakenichols2719/gate/pkg/gatekey"
 	gatemail "github.com/jakenichols2719/gate/pkg/mail"
+	"github.com/pkg/errors"
 )
 
 // Persistent data for Dashboard.
 type DashboardData struct {
+	// AppName names the applications served; it is refreshed whenever the dashboard is loaded.
 	AppName string
 	EmailOk bool
 	TLSOk   bool
@@ -34,7 +38,7 @@ type Dashboard struct {
 func createDashboard(fromServer *AuthServer) *Dashboard {
 	return &Dashboard{
 		Data: DashboardData{
-			AppName: "Test App",
+			AppName: fromServer.Config.Application.name(),
 			EmailOk: true,
 			TLSOk:   false,
 		},
@@ -50,6 +54,23 @@ func setIcon(in map[string]interface{}, at string, to string) {
 	in[at] = fmt.Sprintf("/dashboard/resource/img/%s", to)
 }
 
+// Check whether a request carries a valid admin gate key cookie.
+//
+// Calling:
+//   - d *Dashboard: Dashboard whose server config holds the token secret.
+// Input:
+//   - r *http.Request: Request to check.
+// Output:
+//   - bool: Was the request made by a logged-in admin?
+func (d *Dashboard) isAdmin(r *http.Request) bool {
+	authCookie, err := r.Cookie("admin-gate-key")
+	if err != nil {
+		return false
+	}
+	key, valid, err := gatekey.Verify(authCookie.Value, []byte(d.srv.Config.JWT.TokenSecret))
+	return err == nil && valid && gatekey.IsAdmin(key)
+}
+
 // Serve requests to dashboard.
 // This implements the http.Handler interface on Dashboard.
 func (d *Dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -58,18 +79,27 @@ func (d *Dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	reqfile := filepath.Join(d.serveDirectory, requrl)
 	// Update dashboard data depending on the requested endpoint.
 	tmplData := make(map[string]interface{})
+	if apps, err := d.srv.users.ListApplications(); err == nil && len(apps) > 0 {
+		names := make([]string, len(apps))
+		for i, app := range apps {
+			names[i] = app.Name
+		}
+		d.Data.AppName = strings.Join(names, ", ")
+		tmplData["Applications"] = apps
+		keys := make([]credentials.APIKey, 0)
+		for _, app := range apps {
+			if appKeys, err := d.srv.users.ListAPIKeys(app.Name); err == nil {
+				keys = append(keys, appKeys...)
+			}
+		}
+		tmplData["APIKeys"] = keys
+	}
 	tmplData["Info"] = d.Data
 	switch requrl {
 	case "/dashboard":
 		{
 			// Check authentication token
-			if authCookie, err := r.Cookie("admin-gate-key"); err == nil {
-				key, valid, err := gatekey.Verify(authCookie.Value, []byte(d.srv.Config.JWT.TokenSecret))
-				if err != nil || !valid || !key.Body.Permissions["admin"] {
-					http.Redirect(w, r, "/dashboard/login", http.StatusFound)
-					break
-				}
-			} else {
+			if !d.isAdmin(r) {
 				http.Redirect(w, r, "/dashboard/login", http.StatusFound)
 				break
 			}
@@ -88,7 +118,11 @@ func (d *Dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 			// Database
 			setIcon(tmplData, "DBOkIcon", "yes.svg")
-			tmplData["DBInfo"] = "auth currently uses a local database. More support will be added in future updates here."
+			driver := d.srv.Config.DB.Driver
+			if driver == "" {
+				driver = "sqlite"
+			}
+			tmplData["DBInfo"] = fmt.Sprintf("auth is using a %s database.", driver)
 			// TLS
 			if !d.Data.TLSOk {
 				// Dial the server host using TLS.
@@ -157,6 +191,280 @@ func (d *Dashboard) handleControls(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/dashboard", http.StatusFound)
 }
 
+// Standalone handler for unlocking user accounts
+func (d *Dashboard) handleUnlockUser(w http.ResponseWriter, r *http.Request) {
+	if !d.isAdmin(r) {
+		http.Redirect(w, r, "/dashboard/login", http.StatusFound)
+		return
+	}
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		username := r.Form.Get("username")
+		if err := d.srv.users.UnlockUser(username); err != nil {
+			Log("Couldn't unlock user %s: %v", username, err)
+		} else {
+			Log("User %s unlocked from dashboard", username)
+		}
+	}
+	http.Redirect(w, r, "/dashboard", http.StatusFound)
+}
+
+// Standalone handler for account lifecycle actions: disable, enable, delete, restore and purge.
+func (d *Dashboard) handleUserStatus(w http.ResponseWriter, r *http.Request) {
+	if !d.isAdmin(r) {
+		http.Redirect(w, r, "/dashboard/login", http.StatusFound)
+		return
+	}
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		username := r.Form.Get("username")
+		action := r.Form.Get("action")
+		actions := map[string]func(string) error{
+			"disable": d.srv.users.DisableUser,
+			"enable":  d.srv.users.EnableUser,
+			"delete":  d.srv.users.DeleteUser,
+			"restore": d.srv.users.RestoreUser,
+			"purge":   d.srv.users.PurgeUser,
+		}
+		if apply, ok := actions[action]; !ok {
+			Log("Unknown user action %s", action)
+		} else if err := apply(username); err != nil {
+			Log("Couldn't %s user %s: %v", action, username, err)
+		} else {
+			Log("User %s: %s from dashboard", username, action)
+		}
+	}
+	http.Redirect(w, r, "/dashboard", http.StatusFound)
+}
+
+// Parse a comma-separated list of permissions from a dashboard form. Permissions prefixed with ! are denied.
+//
+// Input:
+//   - list string: Permissions, e.g. "edit, publish, !delete".
+// Output:
+//   - map[string]bool: Parsed permissions.
+func parsePermissionList(list string) map[string]bool {
+	permissions := make(map[string]bool)
+	for _, perm := range strings.Split(list, ",") {
+		perm = strings.TrimSpace(perm)
+		if strings.HasPrefix(perm, "!") {
+			permissions[strings.TrimPrefix(perm, "!")] = false
+		} else if perm != "" {
+			permissions[perm] = true
+		}
+	}
+	return permissions
+}
+
+// Standalone handler for role management: create, delete, set permissions, include, exclude, grant and revoke.
+func (d *Dashboard) handleRoles(w http.ResponseWriter, r *http.Request) {
+	if !d.isAdmin(r) {
+		http.Redirect(w, r, "/dashboard/login", http.StatusFound)
+		return
+	}
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		role := r.Form.Get("role")
+		target := r.Form.Get("target")
+		users := d.srv.users
+		var err error
+		switch action := r.Form.Get("action"); action {
+		case "create":
+			err = users.CreateRole(role, parsePermissionList(r.Form.Get("permissions")))
+		case "delete":
+			err = users.DeleteRole(role)
+		case "permissions":
+			err = users.ChangeRolePermissions(role, parsePermissionList(r.Form.Get("permissions")))
+		case "include":
+			err = users.IncludeRole(role, target)
+		case "exclude":
+			err = users.ExcludeRole(role, target)
+		case "grant":
+			err = users.GrantRole(target, role)
+		case "revoke":
+			err = users.RevokeRole(target, role)
+		default:
+			err = fmt.Errorf("unknown role action %s", action)
+		}
+		if err != nil {
+			Log("Role %s update failed: %v", role, err)
+		} else {
+			Log("Role %s updated from dashboard", role)
+		}
+	}
+	http.Redirect(w, r, "/dashboard", http.StatusFound)
+}
+
+// Standalone handler for application management: create, new API key, settings, and members.
+// New API keys take a name, comma-separated scopes (empty allows every endpoint) and a lifetime in days (0 never
+// expires).
+// Creating an application or a key shows the new key once, instead of returning to the dashboard.
+func (d *Dashboard) handleApplications(w http.ResponseWriter, r *http.Request) {
+	if !d.isAdmin(r) {
+		http.Redirect(w, r, "/dashboard/login", http.StatusFound)
+		return
+	}
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		name := r.Form.Get("application")
+		member := r.Form.Get("member")
+		users := d.srv.users
+		var err error
+		switch action := r.Form.Get("action"); action {
+		case "create":
+			if err = users.CreateApplication(name, r.Form.Get("audience"), credentials.ApplicationSettings{}); err == nil {
+				d.writeNewAPIKey(w, name, credentials.APIKeyOptions{Name: "default"})
+				return
+			}
+		case "key":
+			opts := credentials.APIKeyOptions{Name: r.Form.Get("keyName"), Scopes: strings.Split(r.Form.Get("scopes"), ",")}
+			if days, _ := strconv.Atoi(r.Form.Get("expiresDays")); days > 0 {
+				opts.ExpiresAt = time.Now().AddDate(0, 0, days)
+			}
+			d.writeNewAPIKey(w, name, opts)
+			return
+		case "settings":
+			settings := credentials.ApplicationSettings{RequireVerifiedEmail: r.Form.Get("requireVerifiedEmail")}
+			settings.TokenValidTime, _ = strconv.Atoi(r.Form.Get("tokenValidTime"))
+			for _, claim := range strings.Split(r.Form.Get("profileClaims"), ",") {
+				if claim = strings.TrimSpace(claim); claim != "" {
+					settings.ProfileClaims = append(settings.ProfileClaims, claim)
+				}
+			}
+			if err = (EmailVerificationConfig{Require: settings.RequireVerifiedEmail}).check(); err == nil {
+				err = users.ChangeApplicationSettings(name, settings)
+			}
+		case "add-member":
+			err = users.AddMember(name, member)
+		case "remove-member":
+			err = users.RemoveMember(name, member)
+		default:
+			err = fmt.Errorf("unknown application action %s", action)
+		}
+		if err != nil {
+			Log("Application %s update failed: %v", name, err)
+		} else {
+			Log("Application %s updated from dashboard", name)
+		}
+	}
+	http.Redirect(w, r, "/dashboard", http.StatusFound)
+}
+
+// Create an API key for an application, and write it out as the response.
+//
+// Calling:
+//   - d *Dashboard: Dashboard whose server holds the applications.
+// Input:
+//   - w http.ResponseWriter: Response writer from the handler.
+//   - name string: Application to create the key for.
+//   - opts credentials.APIKeyOptions: Name, scopes and expiry of the key.
+func (d *Dashboard) writeNewAPIKey(w http.ResponseWriter, name string, opts credentials.APIKeyOptions) {
+	key, info, err := d.srv.users.CreateAPIKey(name, opts)
+	if err != nil {
+		Log("Couldn't create API key for %s: %v", name, err)
+		WriteResponse(w, http.StatusBadRequest, fmt.Sprintf("Couldn't create API key for %s\n", name))
+		return
+	}
+	Log("API key %s created for %s from dashboard", info.Prefix, name)
+	writeAPIKey(w, info, key)
+}
+
+// Write out a new API key as the response, which is the only time it is shown.
+//
+// Input:
+//   - w http.ResponseWriter: Response writer from the handler.
+//   - info credentials.APIKey: Public information about the key.
+//   - key string: The key.
+func writeAPIKey(w http.ResponseWriter, info credentials.APIKey, key string) {
+	WriteResponse(w, http.StatusOK, fmt.Sprintf("API key %s for %s:\n\n%s\n\nIt will never be shown again--save it somewhere secure.\n", info.Prefix, info.Application, key))
+}
+
+// Standalone handler for API key management: rotate and revoke, by key prefix.
+// Rotating shows the new key once, instead of returning to the dashboard; the old key keeps working for the grace
+// period given in minutes.
+func (d *Dashboard) handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if !d.isAdmin(r) {
+		http.Redirect(w, r, "/dashboard/login", http.StatusFound)
+		return
+	}
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		prefix := r.Form.Get("prefix")
+		var err error
+		switch action := r.Form.Get("action"); action {
+		case "rotate":
+			minutes, _ := strconv.Atoi(r.Form.Get("graceMinutes"))
+			var key string
+			var info credentials.APIKey
+			if key, info, err = d.srv.users.RotateAPIKey(prefix, time.Duration(minutes)*time.Minute); err == nil {
+				Log("API key %s rotated to %s from dashboard", prefix, info.Prefix)
+				writeAPIKey(w, info, key)
+				return
+			}
+		case "revoke":
+			err = d.srv.users.RevokeAPIKey(prefix)
+		default:
+			err = fmt.Errorf("unknown API key action %s", action)
+		}
+		if err != nil {
+			Log("API key %s update failed: %v", prefix, err)
+		} else {
+			Log("API key %s updated from dashboard", prefix)
+		}
+	}
+	http.Redirect(w, r, "/dashboard", http.StatusFound)
+}
+
+// Standalone handler for listing users as JSON. Query parameters: emailPrefix, usernamePrefix, permission, status,
+// createdAfter and createdBefore (RFC 3339), sort (id, username, email or created), order (asc or desc), limit and
+// cursor.
+func (d *Dashboard) handleListUsers(w http.ResponseWriter, r *http.Request) {
+	if !d.isAdmin(r) {
+		WriteErrorResponse(w, ErrAdminRequired)
+		return
+	}
+	if r.Method != http.MethodGet {
+		WriteErrorResponse(w, errors.Wrap(ErrMethodNotAllowed, "/dashboard/users only accepts GET requests"))
+		return
+	}
+	params := r.URL.Query()
+	query := credentials.UserQuery{
+		Filter: credentials.UserFilter{
+			EmailPrefix:    params.Get("emailPrefix"),
+			UsernamePrefix: params.Get("usernamePrefix"),
+			Permission:     params.Get("permission"),
+			Status:         params.Get("status"),
+		},
+		SortBy:     params.Get("sort"),
+		Descending: params.Get("order") == "desc",
+		Cursor:     params.Get("cursor"),
+	}
+	var err error
+	if limit := params.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			WriteErrorResponse(w, invalidRequest("limit must be a number"))
+			return
+		}
+	}
+	for param, into := range map[string]*time.Time{
+		"createdAfter":  &query.Filter.CreatedAfter,
+		"createdBefore": &query.Filter.CreatedBefore,
+	} {
+		if value := params.Get(param); value != "" {
+			if *into, err = time.Parse(time.RFC3339, value); err != nil {
+				WriteErrorResponse(w, invalidRequest("%s must be an RFC 3339 time", param))
+				return
+			}
+		}
+	}
+	page, err := d.srv.users.ListUsers(query)
+	if err != nil {
+		WriteErrorResponse(w, errors.Wrap(err, "Couldn't list users"))
+		return
+	}
+	WriteJSONResponse(w, http.StatusOK, page)
+}
+
 // Standalone handler for admin login
 func (d *Dashboard) handleAdminLogin(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodPost {
@@ -165,10 +473,9 @@ func (d *Dashboard) handleAdminLogin(w http.ResponseWriter, r *http.Request) {
 		username := r.Form["username"][0]
 		password := r.Form["password"][0]
 		fmt.Println("Validating admin user")
-		valid, user, err := credentials.ValidateUserCred(username, password)
+		valid, user, err := d.srv.users.ValidateUserCred(username, password)
 		if err == nil && valid {
-			admin, ok := user.Permissions["admin"]
-			if ok && admin {
+			if credentials.IsAdmin(user) {
 				fmt.Printf("Admin user %s logged in\n", user.Username)
 				// Set cookie to admin token
 				jwt := gatekey.NewGateKey(user.Username, user.Permissions, time.Duration(d.srv.Config.JWT.AdminValidTime)*time.Minute)
@@ -188,5 +495,11 @@ func (d *Dashboard) addEndpoints() {
 	http.Handle(d.serveAddr+"resource/", http.StripPrefix("/dashboard/resource/", resourceFS))
 	http.HandleFunc(d.serveAddr+"update-config-smtp", d.handleSMTP)
 	http.HandleFunc(d.serveAddr+"update-config-controls", d.handleControls)
+	http.HandleFunc(d.serveAddr+"unlock-user", d.handleUnlockUser)
+	http.HandleFunc(d.serveAddr+"user-status", d.handleUserStatus)
+	http.HandleFunc(d.serveAddr+"roles", d.handleRoles)
+	http.HandleFunc(d.serveAddr+"applications", d.handleApplications)
+	http.HandleFunc(d.serveAddr+"api-keys", d.handleAPIKeys)
+	http.HandleFunc(d.serveAddr+"users", d.handleListUsers)
 	http.HandleFunc(d.serveAddr+"login/admin-login", d.handleAdminLogin)
 }
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jakenichols2719/gate/pkg/credentials"
+	"github.com/jakenichols2719/gate/pkg/gatekey"
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidRequest is matched by errors about the request itself, such as a missing field or a body that isn't JSON.
+var ErrInvalidRequest = errors.New("Invalid request")
+
+// ErrMethodNotAllowed is returned for requests made with the wrong HTTP method.
+var ErrMethodNotAllowed = errors.New("Method not allowed")
+
+// ErrAPIKeyScope is returned for API keys whose scopes don't include the endpoint called.
+var ErrAPIKeyScope = errors.New("API key isn't allowed to call this endpoint")
+
+// ErrServerDisabled is returned for API calls while the server is closed from the dashboard.
+var ErrServerDisabled = errors.New("Server is currently disabled")
+
+// ErrInvalidCode is returned when an emailed code is wrong, used or expired.
+var ErrInvalidCode = errors.New("Invalid code")
+
+// ErrWrongAudience is returned for gate keys issued for another application.
+var ErrWrongAudience = errors.New("Gate key was issued for another application")
+
+// ErrKeyTooOld is returned for gate keys too old to authorize a sensitive change, such as an email change.
+var ErrKeyTooOld = errors.New("Gate key is too old for this request; re-authentication is required")
+
+// ErrEmailNotVerified is returned when an application requires a verified email and the user hasn't verified theirs.
+var ErrEmailNotVerified = errors.New("Email not verified")
+
+// ErrAdminRequired is returned for dashboard API calls without an admin login.
+var ErrAdminRequired = errors.New("Admin login required")
+
+// A requestError describes what is wrong with a request. Its message is written back to the client as is.
+type requestError struct {
+	msg string
+}
+
+// Make an error describing what is wrong with a request.
+//
+// Input:
+//   - format string, args ...interface{}: Description of the problem, as with fmt.Sprintf.
+// Output:
+//   - error: Error matching ErrInvalidRequest.
+func invalidRequest(format string, args ...interface{}) error {
+	return &requestError{msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *requestError) Error() string { return e.msg }
+
+func (e *requestError) Is(target error) bool { return target == ErrInvalidRequest }
+
+// Get the error to respond with for credentials that couldn't be validated.
+//
+// Input:
+//   - err error: Error from credentials.Service.ValidateUserCred.
+// Output:
+//   - error: err, or credentials.ErrInvalidCredentials if err is nil.
+func credentialError(err error) error {
+	if err == nil {
+		return credentials.ErrInvalidCredentials
+	}
+	return err
+}
+
+// An errorMapping gives the response for errors matching err.
+type errorMapping struct {
+	err    error
+	status int
+	// code is a stable, machine-readable name for the error.
+	code string
+	// detail is set for errors whose full message is meant for clients. Other errors are described by err alone, so
+	// that internal details they were wrapped with aren't echoed.
+	detail bool
+}
+
+// errorMappings are checked in order, so more specific errors come before the errors they also match.
+var errorMappings = []errorMapping{
+	{err: ErrInvalidRequest, status: http.StatusBadRequest, code: "invalid_request", detail: true},
+	{err: ErrMethodNotAllowed, status: http.StatusMethodNotAllowed, code: "method_not_allowed"},
+	{err: ErrServerDisabled, status: http.StatusServiceUnavailable, code: "server_disabled"},
+	{err: credentials.ErrInvalidAPIKey, status: http.StatusUnauthorized, code: "invalid_api_key"},
+	{err: ErrAPIKeyScope, status: http.StatusForbidden, code: "api_key_scope"},
+	{err: credentials.ErrInvalidCredentials, status: http.StatusUnauthorized, code: "invalid_credentials"},
+	{err: credentials.ErrLocked, status: http.StatusTooManyRequests, code: "account_locked"},
+	{err: credentials.ErrUserDisabled, status: http.StatusForbidden, code: "account_disabled"},
+	{err: credentials.ErrUserDeleted, status: http.StatusForbidden, code: "account_deleted"},
+	{err: credentials.ErrNotMember, status: http.StatusForbidden, code: "not_member"},
+	{err: ErrEmailNotVerified, status: http.StatusForbidden, code: "email_not_verified"},
+	{err: ErrAdminRequired, status: http.StatusUnauthorized, code: "admin_required"},
+	{err: gatekey.ErrMalformedToken, status: http.StatusUnauthorized, code: "malformed_token"},
+	{err: gatekey.ErrInvalidSignature, status: http.StatusUnauthorized, code: "invalid_token"},
+	{err: gatekey.ErrExpiredToken, status: http.StatusUnauthorized, code: "expired_token"},
+	{err: credentials.ErrTokenRevoked, status: http.StatusUnauthorized, code: "token_revoked"},
+	{err: ErrWrongAudience, status: http.StatusUnauthorized, code: "wrong_audience"},
+	{err: ErrKeyTooOld, status: http.StatusUnauthorized, code: "key_too_old"},
+	{err: ErrInvalidCode, status: http.StatusUnauthorized, code: "invalid_code"},
+	{err: credentials.ErrInvalidRevert, status: http.StatusUnauthorized, code: "invalid_revert_code"},
+	{err: credentials.ErrUserNotFound, status: http.StatusNotFound, code: "user_not_found"},
+	{err: credentials.ErrDuplicateEmail, status: http.StatusConflict, code: "duplicate_email"},
+	{err: credentials.ErrDuplicateUsername, status: http.StatusConflict, code: "duplicate_username"},
+	{err: credentials.ErrEmailChangePending, status: http.StatusConflict, code: "email_change_pending"},
+	{err: credentials.ErrDuplicateUser, status: http.StatusConflict, code: "duplicate_user"},
+	{err: credentials.ErrPasswordPolicy, status: http.StatusBadRequest, code: "password_policy"},
+	{err: credentials.ErrInvalidProfile, status: http.StatusBadRequest, code: "invalid_profile", detail: true},
+	{err: credentials.ErrInvalidQuery, status: http.StatusBadRequest, code: "invalid_query", detail: true},
+	{err: credentials.ErrInvalidCursor, status: http.StatusBadRequest, code: "invalid_cursor"},
+	{err: credentials.ErrApplicationNotFound, status: http.StatusNotFound, code: "application_not_found"},
+	{err: credentials.ErrAPIKeyNotFound, status: http.StatusNotFound, code: "api_key_not_found"},
+	{err: credentials.ErrRoleNotFound, status: http.StatusNotFound, code: "role_not_found"},
+}
+
+// Response body for every error. Error is a stable code for programs to check; Message is for people.
+type ErrorResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+	// Reasons lists why a password was rejected, for password_policy errors.
+	Reasons []credentials.PolicyViolation `json:"reasons,omitempty"`
+}
+
+// Get the status and body of the response for an error.
+//
+// Input:
+//   - err error: Error to describe.
+// Output:
+//   - int: HTTP status code; 500 for errors with no mapping.
+//   - ErrorResponse: Response body.
+func errorResponse(err error) (int, ErrorResponse) {
+	for _, mapping := range errorMappings {
+		if !errors.Is(err, mapping.err) {
+			continue
+		}
+		resp := ErrorResponse{Error: mapping.code, Message: mapping.err.Error()}
+		if mapping.detail {
+			resp.Message = err.Error()
+		}
+		var policyErr *credentials.PasswordPolicyError
+		if errors.As(err, &policyErr) {
+			resp.Reasons = policyErr.Violations
+		}
+		return mapping.status, resp
+	}
+	return http.StatusInternalServerError, ErrorResponse{Error: "internal_error", Message: "Internal server error"}
+}
+
+// Write out the JSON error response for an error, with the status and code given by errorMappings.
+// Errors without a mapping are logged, and written as a 500 without their message. Locked accounts get a Retry-After
+// header if the unlock time is known.
+//
+// Input:
+//   - w http.ResponseWriter: Response writer from the handler.
+//   - err error: Error to write. Wrapping it with context for the log doesn't change the response.
+func WriteErrorResponse(w http.ResponseWriter, err error) {
+	status, resp := errorResponse(err)
+	if status == http.StatusInternalServerError {
+		Log("%v", err)
+	}
+	var locked *credentials.LockedError
+	if errors.As(err, &locked) {
+		retry := int(time.Until(locked.Until).Seconds()) + 1
+		w.Header().Set("Retry-After", fmt.Sprint(retry))
+	}
+	WriteJSONResponse(w, status, resp)
+}
@@ -2,15 +2,15 @@ package server
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"html/template"
 	"io/ioutil"
 	"net/http"
 	"net/mail"
+	"net/url"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,6 +18,7 @@ import (
 	"github.com/jakenichols2719/gate/pkg/gatecode"
 	"github.com/jakenichols2719/gate/pkg/gatekey"
 	gatemail "github.com/jakenichols2719/gate/pkg/mail"
+	"github.com/pkg/errors"
 )
 
 /* Quick reminder of the contents of AuthServerConfig:
@@ -41,6 +42,8 @@ Config {
 type AuthServer struct {
 	Config *AuthServerConfig // Configuration settings
 	Open   bool              // Is server open to API calls?
+	// Credentials service; not exported, opened from the configured database in Start
+	users *credentials.Service
 	// Server; not exported, used internally for controlling HTTPS server
 	srv *http.Server
 	// Waitgroup; needed to maintain concurrency with server
@@ -87,108 +90,348 @@ func WriteResponse(w http.ResponseWriter, code int, msg string) {
 	w.Write([]byte(msg))
 }
 
+// Write out a JSON response.
+//
+// Input:
+//   - w http.ResponseWriter: Response writer from the handler.
+//   - code int: HTTP response code.
+//   - body interface{}: Value to marshal as the response body.
+func WriteJSONResponse(w http.ResponseWriter, code int, body interface{}) {
+	out, err := json.Marshal(body)
+	if err != nil {
+		WriteResponse(w, http.StatusInternalServerError, "Couldn't encode response\n")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	WriteResponse(w, code, string(out))
+}
+
 // Request body format for all authentication requests.
 type AuthRequestBody struct {
 	Email       string `json:"email"`
 	Username    string `json:"username"`
 	Password    string `json:"password"`
 	NewPassword string `json:"newPassword"`
+	NewEmail    string `json:"newEmail"`
 	Code        string `json:"authCode"`
 	GetKey      bool   `json:"getKey"`
 	Key         string `json:"gateKey"`
+	// Profile holds changes for /updateProfile.
+	Profile credentials.ProfileChange `json:"profile"`
 }
 
-// Read the body of an http request with AuthRequestBody params.
+// Read the body of an http request with AuthRequestBody params, and find the application it is for.
 //
+// Calling:
+//   - s *AuthServer: Server whose credentials are used to check the x-api-key header.
 // Input:
 //   - out *AuthRequestBody: Pointer to an AuthRequestBody object to read data into
 //   - req *http.Request: Request to read from. This uses ioutil.ReadAll, which means it depletes the buffer; trying to call
 //   any other read on the request after ReadRequestBody will make the body appear to be empty.
 // Output:
-//   - Error, if one occurs. Non-POST requests and invalid JSON will cause this.
-func ReadRequestBody(out *AuthRequestBody, req *http.Request) error {
+//   - credentials.Application: Application that the x-api-key header belongs to.
+//   - Error, if one occurs, for WriteErrorResponse: ErrMethodNotAllowed for non-POST requests,
+//   credentials.ErrInvalidAPIKey for a missing, invalid, revoked or expired API key, ErrAPIKeyScope for a key whose
+//   scopes don't include the endpoint, ErrInvalidRequest for a body that isn't JSON.
+func (s *AuthServer) ReadRequestBody(out *AuthRequestBody, req *http.Request) (credentials.Application, error) {
 	if req.Method != http.MethodPost {
-		return errors.New("gate requests MUST be POST requests.")
+		return credentials.Application{}, errors.Wrap(ErrMethodNotAllowed, "gate requests MUST be POST requests")
 	}
-	if apikey := req.Header.Get("x-api-key"); apikey != "" {
-		// Check API key "user"
-		if validKey, _, err := credentials.ValidateUserCred("api", apikey); err != nil || !validKey {
-			return errors.New("couldn't validate the x-api-key header field")
-		}
-	} else {
-		return errors.New("gate requests require the x-api-key header with a valid API key")
+	apikey := req.Header.Get("x-api-key")
+	if apikey == "" {
+		return credentials.Application{}, errors.Wrap(credentials.ErrInvalidAPIKey, "no x-api-key header")
+	}
+	key, app, err := s.users.AuthenticateAPIKey(apikey)
+	if err != nil {
+		return credentials.Application{}, errors.Wrap(err, "Couldn't resolve API key")
+	}
+	// Endpoints are named by their path, e.g. login for /login.
+	if endpoint := strings.TrimPrefix(req.URL.Path, "/"); !key.Allows(endpoint) {
+		return credentials.Application{}, errors.Wrapf(ErrAPIKeyScope, "key %s can't call %s", key.Prefix, endpoint)
 	}
 	bodyReader := req.Body
 	body, err := ioutil.ReadAll(bodyReader)
 	if err != nil {
-		return err
+		return app, invalidRequest("Couldn't read request body: %v", err)
 	}
 	if err := json.Unmarshal(body, out); err != nil {
-		return err
+		return app, invalidRequest("Couldn't read request body: %v", err)
+	}
+	return app, nil
+}
+
+// Get how long gate keys issued for an application last.
+//
+// Calling:
+//   - s *AuthServer: Server whose JWT config holds the default.
+// Input:
+//   - app credentials.Application: Application the key is for.
+// Output:
+//   - time.Duration: The application's TokenValidTime if set, or the configured UserValidTime.
+func (s *AuthServer) userValidTime(app credentials.Application) time.Duration {
+	if app.Settings.TokenValidTime > 0 {
+		return time.Duration(app.Settings.TokenValidTime) * time.Minute
+	}
+	return time.Duration(s.Config.JWT.UserValidTime) * time.Minute
+}
+
+// Get when an application requires users to have verified their email.
+//
+// Calling:
+//   - s *AuthServer: Server whose EmailVerification config holds the default.
+// Input:
+//   - app credentials.Application: Application being logged in to.
+// Output:
+//   - string: One of the RequireVerified values.
+func (s *AuthServer) requireVerified(app credentials.Application) string {
+	if app.Settings.RequireVerifiedEmail != "" {
+		return app.Settings.RequireVerifiedEmail
+	}
+	return s.Config.EmailVerification.Require
+}
+
+// Get the profile claims gate keys for an application carry.
+//
+// Calling:
+//   - s *AuthServer: Server whose JWT config holds the default.
+// Input:
+//   - app credentials.Application: Application the key is for.
+// Output:
+//   - []string: The application's ProfileClaims if set, or the configured ProfileClaims.
+func (s *AuthServer) profileClaims(app credentials.Application) []string {
+	if len(app.Settings.ProfileClaims) > 0 {
+		return app.Settings.ProfileClaims
 	}
-	return nil
+	return s.Config.JWT.ProfileClaims
+}
+
+// Issue a signed gate key for an application.
+//
+// Calling:
+//   - s *AuthServer: Server whose token secret signs the key.
+// Input:
+//   - app credentials.Application: Application the key is for; its audience becomes the aud claim.
+//   - subject string: Username or email the key is issued to.
+//   - permissions map[string]bool: Permissions the key grants.
+//   - user credentials.User: User the key is issued to, for profile claims. The empty User adds none.
+// Output:
+//   - string: Exported gate key.
+func (s *AuthServer) issueGateKey(app credentials.Application, subject string, permissions map[string]bool, user credentials.User) string {
+	jwt := gatekey.NewGateKey(subject, permissions, s.userValidTime(app))
+	jwt.Body.Audience = app.Audience
+	jwt.Body.Claims = credentials.ProfileClaims(user, s.profileClaims(app))
+	return gatekey.Export(jwt, []byte(s.Config.JWT.TokenSecret))
+}
+
+// Verify a gate key sent to an application, writing an error response if it can't be used.
+//
+// Calling:
+//   - s *AuthServer: Server whose credentials and token secret are used.
+// Input:
+//   - w http.ResponseWriter: Response writer from the handler. On failure, an error response is written here.
+//   - app credentials.Application: Application the request is for. The key must have been issued for it.
+//   - key string: Exported gate key.
+// Output:
+//   - *gatekey.GateKey: The verified key, or nil if it can't be used.
+func (s *AuthServer) verifyGateKey(w http.ResponseWriter, app credentials.Application, key string) *gatekey.GateKey {
+	token, valid, err := gatekey.Verify(key, []byte(s.Config.JWT.TokenSecret))
+	if !valid {
+		WriteErrorResponse(w, err)
+		return nil
+	}
+	// Keys only work for the application they were issued for.
+	if token.Body.Audience != app.Audience {
+		WriteErrorResponse(w, ErrWrongAudience)
+		return nil
+	}
+	// Tokens stop working as soon as their user is disabled or deleted. Both look the same to the client.
+	if err := s.users.CheckUserStatus(token.Body.ForUser); errors.Is(err, credentials.ErrUserDisabled) ||
+		errors.Is(err, credentials.ErrUserDeleted) {
+		Log("Token for %s refused: %v", token.Body.ForUser, err)
+		WriteErrorResponse(w, credentials.ErrUserDisabled)
+		return nil
+	} else if err != nil {
+		WriteErrorResponse(w, errors.Wrapf(err, "Couldn't check status of %s", token.Body.ForUser))
+		return nil
+	}
+	// Tokens are revoked when their user's password changes.
+	if err := s.users.CheckTokenIssued(token.Body.ForUser, time.Unix(token.Body.Created, 0)); err != nil {
+		Log("Token for %s refused: %v", token.Body.ForUser, err)
+		WriteErrorResponse(w, err)
+		return nil
+	}
+	// Tokens stop working as soon as their user is removed from the application.
+	if err := s.users.CheckMember(app.Name, token.Body.ForUser); err != nil {
+		Log("Token for %s refused: %v", token.Body.ForUser, err)
+		WriteErrorResponse(w, err)
+		return nil
+	}
+	return token
+}
+
+// Find the registered user a gate key was issued to, writing an error response if there isn't one.
+// Keys from email code logins are issued to an email rather than a username.
+//
+// Calling:
+//   - s *AuthServer: Server whose credentials are searched.
+// Input:
+//   - w http.ResponseWriter: Response writer from the handler. On failure, an error response is written here.
+//   - token *gatekey.GateKey: Verified gate key.
+// Output:
+//   - credentials.User: The user, or the empty User if the key doesn't belong to a registered user.
+func (s *AuthServer) keyUser(w http.ResponseWriter, token *gatekey.GateKey) credentials.User {
+	user, err := s.users.FindUserByUsername(token.Body.ForUser)
+	if errors.Is(err, credentials.ErrUserNotFound) {
+		user, err = s.users.FindUserByEmail(token.Body.ForUser)
+	}
+	if err != nil {
+		WriteErrorResponse(w, err)
+		return credentials.User{}
+	}
+	return user
 }
 
 // Credential registration
 func (s *AuthServer) handleCredRegiRequest(w http.ResponseWriter, req *http.Request) {
 	if !s.Open {
-		WriteResponse(w, http.StatusInternalServerError, "Server is currently disabled")
+		WriteErrorResponse(w, ErrServerDisabled)
 		return
 	}
 	authReq := AuthRequestBody{}
-	err := ReadRequestBody(&authReq, req)
+	app, err := s.ReadRequestBody(&authReq, req)
 	if err != nil {
-		errMsg := fmt.Sprintf("Couldn't read request body: %v\n", err)
-		WriteResponse(w, http.StatusBadRequest, errMsg)
+		WriteErrorResponse(w, err)
 		return
 	}
 	if authReq.Email == "" || authReq.Username == "" || authReq.Password == "" {
-		errMsg := fmt.Sprintf("email, username, and password are needed for endpoint /register\n")
-		WriteResponse(w, http.StatusBadRequest, errMsg)
+		WriteErrorResponse(w, invalidRequest("email, username, and password are needed for endpoint /register"))
 		return
 	}
 	// Make sure email is valid
 	if _, err := mail.ParseAddress(authReq.Email); err != nil {
-		errMsg := fmt.Sprintf("invalid email\n")
-		WriteResponse(w, http.StatusBadRequest, errMsg)
+		WriteErrorResponse(w, invalidRequest("invalid email"))
 		return
 	}
-	// Register user.
-	if err := credentials.RegisterUser(authReq.Email, authReq.Username, authReq.Password, nil); err != nil {
-		errMsg := fmt.Sprintf("Registration failed: %v\n", err)
-		WriteResponse(w, http.StatusBadRequest, errMsg)
+	// Register user, as a member of the application. Registration is undone if the membership can't be added.
+	if err := s.users.RegisterMember(app.Name, authReq.Email, authReq.Username, authReq.Password, nil); err != nil {
+		WriteErrorResponse(w, errors.Wrapf(err, "Registration of %s failed", authReq.Username))
 	} else {
-		succMsg := fmt.Sprintf("User %s registered successfully under email %s\n", authReq.Username, authReq.Email)
+		s.sendVerificationEmail(authReq.Email)
+		succMsg := fmt.Sprintf("User %s registered successfully under email %s. A verification code has been sent to that address.\n", authReq.Username, authReq.Email)
 		WriteResponse(w, http.StatusOK, succMsg)
 	}
 }
 
+// verifyCodePurpose is the gatecode purpose for email verification codes.
+const verifyCodePurpose = "verify"
+
+// Send an email verification code to a user.
+// Failures are logged rather than returned, since they shouldn't fail the request that triggered them.
+//
+// Calling:
+//   - s *AuthServer: Server whose SMTP host and verification settings are used.
+// Input:
+//   - email string: Address to verify.
+func (s *AuthServer) sendVerificationEmail(email string) {
+	lifetime := s.Config.EmailVerification.codeLifetime()
+	code := gatecode.NewGateCodeFor(verifyCodePurpose, email, lifetime)
+	msg := gatemail.NewVerificationMessage(email, code, lifetime)
+	if err := gatemail.SendMessage(s.SMTPHost(), email, msg); err != nil {
+		Log("Couldn't send verification email to %s: %v", email, err)
+	}
+}
+
+// Email verification
+func (s *AuthServer) handleVerifyEmailRequest(w http.ResponseWriter, req *http.Request) {
+	if !s.Open {
+		WriteErrorResponse(w, ErrServerDisabled)
+		return
+	}
+	authReq := AuthRequestBody{}
+	_, err := s.ReadRequestBody(&authReq, req)
+	if err != nil {
+		WriteErrorResponse(w, err)
+		return
+	}
+	if authReq.Email == "" || authReq.Code == "" {
+		WriteErrorResponse(w, invalidRequest("email and authCode are needed for endpoint /verifyEmail"))
+		return
+	}
+	if !gatecode.ValidateGateCodeFor(verifyCodePurpose, authReq.Email, authReq.Code) {
+		WriteErrorResponse(w, ErrInvalidCode)
+		return
+	}
+	if err := s.users.VerifyEmail(authReq.Email); err != nil {
+		WriteErrorResponse(w, errors.Wrapf(err, "Email verification for %s failed", authReq.Email))
+		return
+	}
+	WriteResponse(w, http.StatusOK, fmt.Sprintf("Email %s verified\n", authReq.Email))
+}
+
+// Resend an email verification code
+func (s *AuthServer) handleResendVerificationRequest(w http.ResponseWriter, req *http.Request) {
+	if !s.Open {
+		WriteErrorResponse(w, ErrServerDisabled)
+		return
+	}
+	authReq := AuthRequestBody{}
+	_, err := s.ReadRequestBody(&authReq, req)
+	if err != nil {
+		WriteErrorResponse(w, err)
+		return
+	}
+	if authReq.Email == "" {
+		WriteErrorResponse(w, invalidRequest("email is needed for endpoint /resendVerification"))
+		return
+	}
+	// Only send to registered, active, unverified users, but respond the same way either way so that
+	// registered emails aren't revealed.
+	user, err := s.users.FindUserByEmail(authReq.Email)
+	if err != nil && !errors.Is(err, credentials.ErrUserNotFound) {
+		Log("Couldn't look up %s for verification: %v", authReq.Email, err)
+	} else if user.Status == credentials.StatusActive && !user.EmailVerified {
+		s.sendVerificationEmail(authReq.Email)
+	}
+	WriteResponse(w, http.StatusOK, fmt.Sprintf("If %s needs verification, a code has been sent to it\n", authReq.Email))
+}
+
 // Credential authorization
 func (s *AuthServer) handleCredAuthRequest(w http.ResponseWriter, req *http.Request) {
 	if !s.Open {
-		WriteResponse(w, http.StatusInternalServerError, "Server is currently disabled")
+		WriteErrorResponse(w, ErrServerDisabled)
 		return
 	}
 	authReq := AuthRequestBody{}
-	err := ReadRequestBody(&authReq, req)
+	app, err := s.ReadRequestBody(&authReq, req)
 	if err != nil {
-		errMsg := fmt.Sprintf("Couldn't read request body: %v\n", err)
-		WriteResponse(w, http.StatusBadRequest, errMsg)
+		WriteErrorResponse(w, err)
 		return
 	}
 	if authReq.Username == "" || authReq.Password == "" {
-		errMsg := fmt.Sprintf("username and password are needed for endpoint /register\n")
-		WriteResponse(w, http.StatusBadRequest, errMsg)
+		WriteErrorResponse(w, invalidRequest("username and password are needed for endpoint /login"))
 		return
 	}
-	valid, entry, err := credentials.ValidateUserCred(authReq.Username, authReq.Password)
+	valid, entry, err := s.users.ValidateUserCred(authReq.Username, authReq.Password)
 	if !valid {
-		errMsg := fmt.Sprintf("Invalid credentials\n")
-		WriteResponse(w, http.StatusUnauthorized, errMsg)
+		WriteErrorResponse(w, credentialError(err))
+		return
+	}
+	// Users that aren't members of the application fail like a wrong password, so they aren't revealed.
+	if member, err := s.users.IsMember(app.Name, authReq.Username); err != nil {
+		WriteErrorResponse(w, errors.Wrapf(err, "Couldn't check membership of %s in %s", authReq.Username, app.Name))
+		return
+	} else if !member {
+		WriteErrorResponse(w, credentials.ErrInvalidCredentials)
 		return
 	}
-	jwt := gatekey.NewGateKey(authReq.Username, entry.Permissions, time.Duration(s.Config.JWT.UserValidTime)*time.Minute)
-	token := gatekey.Export(jwt, []byte(s.Config.JWT.TokenSecret))
+	if !entry.EmailVerified {
+		require := s.requireVerified(app)
+		if require == RequireVerifiedLogin || (require == RequireVerifiedToken && authReq.GetKey) {
+			WriteErrorResponse(w, ErrEmailNotVerified)
+			return
+		}
+	}
+	token := s.issueGateKey(app, authReq.Username, entry.Permissions, entry)
 	if authReq.GetKey {
 		WriteResponse(w, http.StatusOK, token)
 	} else {
@@ -199,53 +442,304 @@ func (s *AuthServer) handleCredAuthRequest(w http.ResponseWriter, req *http.Requ
 // Credential change
 func (s *AuthServer) handlePwdChangeRequest(w http.ResponseWriter, req *http.Request) {
 	if !s.Open {
-		WriteResponse(w, http.StatusInternalServerError, "Server is currently disabled")
+		WriteErrorResponse(w, ErrServerDisabled)
 		return
 	}
 	authReq := AuthRequestBody{}
-	err := ReadRequestBody(&authReq, req)
+	_, err := s.ReadRequestBody(&authReq, req)
 	if err != nil {
-		errMsg := fmt.Sprintf("Couldn't read request body: %v\n", err)
-		WriteResponse(w, http.StatusBadRequest, errMsg)
+		WriteErrorResponse(w, err)
 		return
 	}
 	if authReq.Username == "" || authReq.Password == "" || authReq.NewPassword == "" {
-		errMsg := fmt.Sprintf("username, password, and new password are needed for endpoint /changePassword\n")
-		WriteResponse(w, http.StatusBadRequest, errMsg)
+		WriteErrorResponse(w, invalidRequest("username, password, and new password are needed for endpoint /changePassword"))
 		return
 	}
-	err = credentials.ChangeUserPassword(authReq.Username, authReq.Password, authReq.NewPassword)
+	err = s.users.ChangeUserPassword(authReq.Username, authReq.Password, authReq.NewPassword)
 	if err != nil {
-		errMsg := fmt.Sprintf("Failed to reset password: %v\n", err)
-		WriteResponse(w, http.StatusUnauthorized, errMsg)
+		WriteErrorResponse(w, errors.Wrapf(err, "Password change for %s failed", authReq.Username))
 	} else {
 		succMsg := fmt.Sprintf("Password changed successfully. Please log back in.\n")
 		WriteResponse(w, http.StatusOK, succMsg)
 	}
 }
 
+// resetCodePurpose is the gatecode purpose for password reset codes.
+const resetCodePurpose = "reset"
+
+// Forgotten password, step 1: send a reset code
+func (s *AuthServer) handleForgotPasswordRequest(w http.ResponseWriter, req *http.Request) {
+	if !s.Open {
+		WriteErrorResponse(w, ErrServerDisabled)
+		return
+	}
+	authReq := AuthRequestBody{}
+	app, err := s.ReadRequestBody(&authReq, req)
+	if err != nil {
+		WriteErrorResponse(w, err)
+		return
+	}
+	if authReq.Email == "" {
+		WriteErrorResponse(w, invalidRequest("email is needed for endpoint /forgotPassword"))
+		return
+	}
+	// Only send to active members of the application, but respond the same way either way so that registered emails
+	// aren't revealed.
+	user, err := s.users.FindUserByEmail(authReq.Email)
+	if err != nil && !errors.Is(err, credentials.ErrUserNotFound) {
+		Log("Couldn't look up %s for password reset: %v", authReq.Email, err)
+	} else if member, _ := s.users.IsMember(app.Name, authReq.Email); member && user.Status == credentials.StatusActive {
+		lifetime := s.Config.PasswordReset.codeLifetime()
+		code := gatecode.NewGateCodeFor(resetCodePurpose, authReq.Email, lifetime)
+		msg := gatemail.NewPasswordResetMessage(authReq.Email, code, lifetime)
+		if err := gatemail.SendMessage(s.SMTPHost(), authReq.Email, msg); err != nil {
+			Log("Couldn't send password reset email to %s: %v", authReq.Email, err)
+		}
+	}
+	WriteResponse(w, http.StatusOK, fmt.Sprintf("If %s is registered, a password reset code has been sent to it\n", authReq.Email))
+}
+
+// Forgotten password, step 2: set a new password with a reset code
+func (s *AuthServer) handleConfirmPasswordResetRequest(w http.ResponseWriter, req *http.Request) {
+	if !s.Open {
+		WriteErrorResponse(w, ErrServerDisabled)
+		return
+	}
+	authReq := AuthRequestBody{}
+	_, err := s.ReadRequestBody(&authReq, req)
+	if err != nil {
+		WriteErrorResponse(w, err)
+		return
+	}
+	if authReq.Email == "" || authReq.Code == "" || authReq.NewPassword == "" {
+		WriteErrorResponse(w, invalidRequest("email, authCode, and newPassword are needed for endpoint /confirmPasswordReset"))
+		return
+	}
+	// Codes are only sent to registered emails, so an unregistered email fails here like a wrong code.
+	if !gatecode.ValidateGateCodeFor(resetCodePurpose, authReq.Email, authReq.Code) {
+		WriteErrorResponse(w, ErrInvalidCode)
+		return
+	}
+	// The code is used up either way, so after a password policy error the user has to request a new one to try
+	// another password.
+	err = s.users.ResetUserPassword(authReq.Email, authReq.NewPassword)
+	if errors.Is(err, credentials.ErrInvalidCredentials) {
+		WriteErrorResponse(w, ErrInvalidCode)
+	} else if err != nil {
+		WriteErrorResponse(w, errors.Wrapf(err, "Password reset for %s failed", authReq.Email))
+	} else {
+		WriteResponse(w, http.StatusOK, "Password changed successfully. Please log back in.\n")
+	}
+}
+
+// Get the gatecode purpose for confirming a user's email change.
+// Codes are keyed by the new email, and the purpose ties them to the user that asked for the change.
+//
+// Input:
+//   - username string: User changing their email.
+// Output:
+//   - string: gatecode purpose.
+func emailChangePurpose(username string) string {
+	return "email-change:" + username
+}
+
+// Authenticate a request to change an email, using either a username and password or a recently issued gate key.
+//
+// Calling:
+//   - s *AuthServer: Server whose credentials and token secret are used.
+// Input:
+//   - w http.ResponseWriter: Response writer from the handler. On failure, an error response is written here.
+//   - app credentials.Application: Application the request is for. Gate keys must have been issued for it.
+//   - authReq AuthRequestBody: Request body, holding username and password, or gateKey.
+// Output:
+//   - string: Username of the authenticated user, or "" if authentication failed.
+func (s *AuthServer) authenticateEmailChange(w http.ResponseWriter, app credentials.Application, authReq AuthRequestBody) string {
+	if authReq.Key == "" {
+		if valid, _, err := s.users.ValidateUserCred(authReq.Username, authReq.Password); !valid {
+			WriteErrorResponse(w, credentialError(err))
+			return ""
+		}
+		// As for /login, users that aren't members of the application fail like a wrong password.
+		if member, err := s.users.IsMember(app.Name, authReq.Username); err != nil {
+			WriteErrorResponse(w, errors.Wrapf(err, "Couldn't check membership of %s in %s", authReq.Username, app.Name))
+			return ""
+		} else if !member {
+			WriteErrorResponse(w, credentials.ErrInvalidCredentials)
+			return ""
+		}
+		return authReq.Username
+	}
+	token := s.verifyGateKey(w, app, authReq.Key)
+	if token == nil {
+		return ""
+	}
+	if time.Since(time.Unix(token.Body.Created, 0)) > s.Config.EmailChange.freshKeyAge() {
+		WriteErrorResponse(w, ErrKeyTooOld)
+		return ""
+	}
+	return s.keyUser(w, token).Username
+}
+
+// Email change, step 1: authenticate and send a confirmation code to the new address
+func (s *AuthServer) handleChangeEmailRequest(w http.ResponseWriter, req *http.Request) {
+	if !s.Open {
+		WriteErrorResponse(w, ErrServerDisabled)
+		return
+	}
+	authReq := AuthRequestBody{}
+	app, err := s.ReadRequestBody(&authReq, req)
+	if err != nil {
+		WriteErrorResponse(w, err)
+		return
+	}
+	if authReq.NewEmail == "" || (authReq.Key == "" && (authReq.Username == "" || authReq.Password == "")) {
+		WriteErrorResponse(w, invalidRequest("newEmail, and either username and password or gateKey, are needed for endpoint /changeEmail"))
+		return
+	}
+	if _, err := mail.ParseAddress(authReq.NewEmail); err != nil {
+		WriteErrorResponse(w, invalidRequest("invalid email"))
+		return
+	}
+	username := s.authenticateEmailChange(w, app, authReq)
+	if username == "" {
+		return
+	}
+	if err := s.users.CheckEmailChange(username, authReq.NewEmail); err != nil {
+		WriteErrorResponse(w, errors.Wrapf(err, "Email change for %s failed", username))
+		return
+	}
+	lifetime := s.Config.EmailChange.codeLifetime()
+	code := gatecode.NewGateCodeFor(emailChangePurpose(username), authReq.NewEmail, lifetime)
+	msg := gatemail.NewEmailChangeMessage(authReq.NewEmail, code, lifetime)
+	if err := gatemail.SendMessage(s.SMTPHost(), authReq.NewEmail, msg); err != nil {
+		Log("Couldn't send email change code to %s: %v", authReq.NewEmail, err)
+	}
+	WriteResponse(w, http.StatusOK, fmt.Sprintf("A confirmation code has been sent to %s\n", authReq.NewEmail))
+}
+
+// Email change, step 2: confirm the new address, and send a revert link to the old one
+func (s *AuthServer) handleConfirmEmailChangeRequest(w http.ResponseWriter, req *http.Request) {
+	if !s.Open {
+		WriteErrorResponse(w, ErrServerDisabled)
+		return
+	}
+	authReq := AuthRequestBody{}
+	_, err := s.ReadRequestBody(&authReq, req)
+	if err != nil {
+		WriteErrorResponse(w, err)
+		return
+	}
+	if authReq.Username == "" || authReq.NewEmail == "" || authReq.Code == "" {
+		WriteErrorResponse(w, invalidRequest("username, newEmail, and authCode are needed for endpoint /confirmEmailChange"))
+		return
+	}
+	if !gatecode.ValidateGateCodeFor(emailChangePurpose(authReq.Username), authReq.NewEmail, authReq.Code) {
+		WriteErrorResponse(w, ErrInvalidCode)
+		return
+	}
+	oldUser, err := s.users.FindUserByUsername(authReq.Username)
+	if err != nil {
+		WriteErrorResponse(w, errors.Wrapf(err, "Email change for %s failed", authReq.Username))
+		return
+	}
+	revertCode, err := s.users.ChangeUserEmail(authReq.Username, authReq.NewEmail)
+	if err != nil {
+		WriteErrorResponse(w, errors.Wrapf(err, "Email change for %s failed", authReq.Username))
+		return
+	}
+	// Tell the old address, with a link to undo the change.
+	revertLink := fmt.Sprintf("https://gate.%s/revertEmail?%s", s.Config.Domain, url.Values{
+		"username": {authReq.Username},
+		"code":     {revertCode},
+	}.Encode())
+	msg := gatemail.NewEmailChangedNotice(oldUser.Email, authReq.NewEmail, revertLink, s.users.EmailRevertWindow)
+	if err := gatemail.SendMessage(s.SMTPHost(), oldUser.Email, msg); err != nil {
+		Log("Couldn't send email change notice to %s: %v", oldUser.Email, err)
+	}
+	WriteResponse(w, http.StatusOK, fmt.Sprintf("Email changed to %s\n", authReq.NewEmail))
+}
+
+// Page shown for a revert link. Opening the link only shows this form, since mail scanners and prefetchers open
+// links too; submitting it makes the revert.
+var revertEmailPage = template.Must(template.New("revertEmail").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Revert email change</title></head>
+<body>
+	<p>Someone changed the email of your account. If it wasn't you, revert the change; you will be signed out
+	everywhere, and should reset your password.</p>
+	<form action="/revertEmail" method="post">
+		<input type="hidden" name="username" value="{{.Username}}">
+		<input type="hidden" name="code" value="{{.Code}}">
+		<input type="submit" value="Revert email change">
+	</form>
+</body>
+</html>
+`))
+
+// Email change revert. This is opened from a link in an email, so it takes no API key; the revert code
+// authenticates it. GET shows a form confirming the revert, which is POSTed back to make it.
+func (s *AuthServer) handleRevertEmailRequest(w http.ResponseWriter, req *http.Request) {
+	if !s.Open {
+		WriteErrorResponse(w, ErrServerDisabled)
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		WriteErrorResponse(w, errors.Wrap(ErrMethodNotAllowed, "/revertEmail only accepts GET and POST requests"))
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		WriteErrorResponse(w, invalidRequest("Couldn't read request: %v", err))
+		return
+	}
+	username, code := req.Form.Get("username"), req.Form.Get("code")
+	if username == "" || code == "" {
+		WriteErrorResponse(w, invalidRequest("username and code are needed for endpoint /revertEmail"))
+		return
+	}
+	if req.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := revertEmailPage.Execute(w, map[string]string{"Username": username, "Code": code}); err != nil {
+			Log("Couldn't write email revert page: %v", err)
+		}
+		return
+	}
+	// A duplicate email means another account has taken the previous email since the change.
+	if err := s.users.RevertUserEmail(username, code); err != nil {
+		WriteErrorResponse(w, errors.Wrapf(err, "Email revert for %s failed", username))
+	} else {
+		Log("Email change for %s reverted", username)
+		WriteResponse(w, http.StatusOK, "Your email change has been reverted, and you have been signed out everywhere. Please reset your password.\n")
+	}
+}
+
 // Handle email authentication requests
 func (s *AuthServer) HandleEmailAuthRequest(w http.ResponseWriter, req *http.Request) {
 	if !s.Open {
-		WriteResponse(w, http.StatusInternalServerError, "Server is currently disabled")
+		WriteErrorResponse(w, ErrServerDisabled)
 		return
 	}
 	authReq := AuthRequestBody{}
-	err := ReadRequestBody(&authReq, req)
+	app, err := s.ReadRequestBody(&authReq, req)
 	if err != nil {
-		errMsg := fmt.Sprintf("Couldn't read request body: %v\n", err)
-		WriteResponse(w, http.StatusBadRequest, errMsg)
+		WriteErrorResponse(w, err)
 		return
 	}
 	// Also throw a 400 if there's no included email
 	if authReq.Email == "" {
-		errMsg := fmt.Sprintf("email is needed for endpoint /mail\n")
-		WriteResponse(w, http.StatusBadRequest, errMsg)
+		WriteErrorResponse(w, invalidRequest("email is needed for endpoint /mail"))
+		return
+	}
+	// Send an authentication email and write out 200. Disabled and deleted users, and users that aren't members of
+	// the application, get no email, but the response is the same so that accounts aren't revealed.
+	if err := s.users.CheckUserStatus(authReq.Email); err != nil {
+		Log("Authentication email to %s not sent: %v", authReq.Email, err)
+	} else if err := s.users.CheckMember(app.Name, authReq.Email); err != nil {
+		Log("Authentication email to %s not sent: %v", authReq.Email, err)
+	} else {
+		code := gatecode.NewGateCode(authReq.Email)
+		msg := gatemail.NewAuthMessage(authReq.Email, code)
+		gatemail.SendMessage(s.SMTPHost(), authReq.Email, msg)
 	}
-	// Send an authentication email and write out 200=
-	code := gatecode.NewGateCode(authReq.Email)
-	msg := gatemail.NewAuthMessage(authReq.Email, code)
-	gatemail.SendMessage(s.SMTPHost(), authReq.Email, msg)
 	succMsg := fmt.Sprintf("Authentication email sent to %s\n", authReq.Email)
 	WriteResponse(w, http.StatusOK, succMsg)
 }
@@ -253,70 +747,137 @@ func (s *AuthServer) HandleEmailAuthRequest(w http.ResponseWriter, req *http.Req
 // Handle authentication code requests
 func (s *AuthServer) HandleCodeAuthRequest(w http.ResponseWriter, req *http.Request) {
 	if !s.Open {
-		WriteResponse(w, http.StatusInternalServerError, "Server is currently disabled")
+		WriteErrorResponse(w, ErrServerDisabled)
 		return
 	}
 	// Read in body. Send a 400 on failure
 	authReq := AuthRequestBody{}
-	err := ReadRequestBody(&authReq, req)
+	app, err := s.ReadRequestBody(&authReq, req)
 	if err != nil {
-		errMsg := fmt.Sprintf("Couldn't read request body: %v\n", err)
-		WriteResponse(w, http.StatusBadRequest, errMsg)
+		WriteErrorResponse(w, err)
 		return
 	}
 	if authReq.Email == "" || authReq.Code == "" {
-		errMsg := fmt.Sprintf("email and authCode are needed for endpoint /code\n")
-		WriteResponse(w, http.StatusBadRequest, errMsg)
+		WriteErrorResponse(w, invalidRequest("email and authCode are needed for endpoint /code"))
 		return
 	}
-	valid := gatecode.ValidateGateCode(authReq.Email, authReq.Code)
-	if secret, okToSign := os.LookupEnv(s.Config.JWT.TokenSecret); !valid || !okToSign {
-		jwt := gatekey.NewGateKey(authReq.Email, map[string]bool{"authorized": true}, time.Duration(s.Config.JWT.UserValidTime)*time.Minute)
-		token := gatekey.Export(jwt, []byte(secret))
-		if authReq.GetKey {
-			WriteResponse(w, http.StatusOK, token)
-		} else {
-			WriteResponse(w, http.StatusOK, "no token requested; set getToken=true in request body for an auth token\n")
-		}
+	if !gatecode.ValidateGateCode(authReq.Email, authReq.Code) {
+		WriteErrorResponse(w, ErrInvalidCode)
+		return
+	}
+	if err := s.users.CheckUserStatus(authReq.Email); errors.Is(err, credentials.ErrUserDisabled) ||
+		errors.Is(err, credentials.ErrUserDeleted) {
+		Log("Code login for %s refused: %v", authReq.Email, err)
+		WriteErrorResponse(w, credentials.ErrUserDisabled)
+		return
+	} else if err != nil {
+		WriteErrorResponse(w, errors.Wrapf(err, "Code login for %s failed", authReq.Email))
+		return
+	}
+	if err := s.users.CheckMember(app.Name, authReq.Email); err != nil {
+		Log("Code login for %s refused: %v", authReq.Email, err)
+		WriteErrorResponse(w, err)
+		return
+	}
+	// Emails that never registered can log in with a code too; their keys carry no profile claims.
+	user, err := s.users.FindUserByEmail(authReq.Email)
+	if err != nil && !errors.Is(err, credentials.ErrUserNotFound) {
+		WriteErrorResponse(w, errors.Wrapf(err, "Code login for %s failed", authReq.Email))
+		return
+	}
+	token := s.issueGateKey(app, authReq.Email, map[string]bool{"authorized": true}, user)
+	if authReq.GetKey {
+		WriteResponse(w, http.StatusOK, token)
 	} else {
-		errMsg := fmt.Sprintf("Invalid code")
-		WriteResponse(w, http.StatusUnauthorized, errMsg)
+		WriteResponse(w, http.StatusOK, "no token requested; set getToken=true in request body for an auth token\n")
 	}
 }
 
 func (s *AuthServer) HandleKeyAuthRequest(w http.ResponseWriter, req *http.Request) {
 	if !s.Open {
-		WriteResponse(w, http.StatusInternalServerError, "Server is currently disabled")
+		WriteErrorResponse(w, ErrServerDisabled)
 		return
 	}
 	// Read in body. Send a 400 on failure
 	authReq := AuthRequestBody{}
-	err := ReadRequestBody(&authReq, req)
+	app, err := s.ReadRequestBody(&authReq, req)
 	if err != nil {
-		errMsg := fmt.Sprintf("Couldn't read request body: %v\n", err)
-		WriteResponse(w, http.StatusBadRequest, errMsg)
+		WriteErrorResponse(w, err)
 		return
 	}
 	if authReq.Key == "" {
-		errMsg := fmt.Sprintf("authToken is needed for endpoint /token\n")
-		WriteResponse(w, http.StatusBadRequest, errMsg)
+		WriteErrorResponse(w, invalidRequest("authToken is needed for endpoint /token"))
 		return
 	}
 	// Verify the authToken included with the request
-	token, valid, err := gatekey.Verify(authReq.Key, []byte(s.Config.JWT.TokenSecret))
+	token := s.verifyGateKey(w, app, authReq.Key)
+	if token == nil {
+		return
+	}
+
+	outToken, _ := json.Marshal(token)
+	WriteResponse(w, http.StatusOK, string(outToken))
+}
+
+// Profile lookup, for the user a gate key was issued to
+func (s *AuthServer) handleProfileRequest(w http.ResponseWriter, req *http.Request) {
+	if !s.Open {
+		WriteErrorResponse(w, ErrServerDisabled)
+		return
+	}
+	authReq := AuthRequestBody{}
+	app, err := s.ReadRequestBody(&authReq, req)
 	if err != nil {
-		errMsg := fmt.Sprintf("Couldn't process bearer token: %v\n", err)
-		WriteResponse(w, http.StatusUnauthorized, errMsg)
+		WriteErrorResponse(w, err)
 		return
 	}
-	if !valid {
-		errMsg := fmt.Sprintf("Bearer token has is altered or expired. Re-authentication is required.\n")
-		WriteResponse(w, http.StatusUnauthorized, errMsg)
+	if authReq.Key == "" {
+		WriteErrorResponse(w, invalidRequest("gateKey is needed for endpoint /profile"))
 		return
 	}
+	token := s.verifyGateKey(w, app, authReq.Key)
+	if token == nil {
+		return
+	}
+	if user := s.keyUser(w, token); user.Username != "" {
+		WriteJSONResponse(w, http.StatusOK, user)
+	}
+}
 
-	outToken, _ := json.Marshal(token)
-	WriteResponse(w, http.StatusOK, string(outToken))
+// Profile change, for the user a gate key was issued to
+func (s *AuthServer) handleUpdateProfileRequest(w http.ResponseWriter, req *http.Request) {
+	if !s.Open {
+		WriteErrorResponse(w, ErrServerDisabled)
+		return
+	}
+	authReq := AuthRequestBody{}
+	app, err := s.ReadRequestBody(&authReq, req)
+	if err != nil {
+		WriteErrorResponse(w, err)
+		return
+	}
+	if authReq.Key == "" {
+		WriteErrorResponse(w, invalidRequest("gateKey and profile are needed for endpoint /updateProfile"))
+		return
+	}
+	token := s.verifyGateKey(w, app, authReq.Key)
+	if token == nil {
+		return
+	}
+	user := s.keyUser(w, token)
+	if user.Username == "" {
+		return
+	}
+	if err := s.users.ChangeUserProfile(user.Username, authReq.Profile); err != nil {
+		WriteErrorResponse(w, errors.Wrapf(err, "Profile change for %s failed", user.Username))
+		return
+	}
+	changed, err := s.users.FindUserByUsername(user.Username)
+	if err != nil {
+		WriteErrorResponse(w, errors.Wrapf(err, "Couldn't read profile of %s", user.Username))
+		return
+	}
+	WriteJSONResponse(w, http.StatusOK, changed)
 }
 
 // Start an authentication server.
@@ -331,9 +892,26 @@ func (s *AuthServer) Start() {
 	OpenLog()
 	fmt.Printf("Starting server. Log file located at %s\n", LogFile)
 	// Open database
-	credentials.OpenDB(s.Config.DB.Path)
+	store, err := credentials.OpenDB(s.Config.DB.Options())
+	if err != nil {
+		Log("Couldn't open database: %v", err)
+		fmt.Printf("Couldn't open database: %v\n", err)
+		os.Exit(1)
+	}
+	s.users = credentials.NewService(store)
+	s.users.Hashing = s.Config.Hashing.Policy()
+	s.users.Pepper = s.Config.Hashing.pepper
+	s.users.Lockout = s.Config.Lockout.Policy()
+	if s.users.Passwords, err = s.Config.Passwords.Policy(); err != nil {
+		Log("%v", err)
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	s.users.PasswordHistory = s.Config.Passwords.History
+	s.users.EmailRevertWindow = s.Config.EmailChange.revertWindow()
+	s.users.Log = func(format string, args ...interface{}) { Log(format, args...) }
 	// Check entries. Count as first run if empty.
-	if credentials.Entries() == 0 {
+	if entries, err := s.users.Entries(); err == nil && entries == 0 {
 		fmt.Println("Welcome to Gate")
 		fmt.Println("Your database is empty--you'll need to register admin credentials so you can use the dashboard.")
 		var email, username, password string
@@ -341,33 +919,74 @@ func (s *AuthServer) Start() {
 		fmt.Scanln(&email)
 		fmt.Print("Username: ")
 		fmt.Scanln(&username)
+		password, err = s.users.Passwords.Generate(email, username)
+		if err != nil {
+			fmt.Printf("Couldn't generate a password: %v\n", err)
+			os.Exit(1)
+		}
+		if err := s.users.RegisterUser(email, username, password, map[string]bool{"admin": true}); err != nil {
+			fmt.Printf("Couldn't register %s: %v\n", username, err)
+			os.Exit(1)
+		}
 		fmt.Println("Your password is below. It will never be output again--save it somewhere secure.")
-		pwd := make([]byte, 32)
-		rand.Read(pwd[:])
-		password = base64.RawURLEncoding.EncodeToString(pwd)
 		fmt.Println(password)
 		fmt.Println("Press enter when you have saved your password.")
 		fmt.Scanln()
-		credentials.RegisterUser(email, username, password, map[string]bool{"admin": true})
 		fmt.Println("Registered.")
+		if err := s.users.CreateApplication(s.Config.Application.name(), s.Config.Application.Audience, credentials.ApplicationSettings{}); err != nil {
+			fmt.Printf("Couldn't create application: %v\n", err)
+			os.Exit(1)
+		}
+		apikey, _, err := s.users.CreateAPIKey(s.Config.Application.name(), credentials.APIKeyOptions{Name: "default"})
+		if err != nil {
+			fmt.Printf("Couldn't create API key: %v\n", err)
+			os.Exit(1)
+		}
 		fmt.Println("All Gate API calls require an API key. Your API key is below. It will never be output again--save it somewhere secure.")
-		ak := make([]byte, 32)
-		rand.Read(ak[:])
-		apikey := base64.RawURLEncoding.EncodeToString(ak)
 		fmt.Println(apikey)
 		fmt.Println("Press enter when you have saved your API key.")
 		fmt.Scanln()
-		credentials.RegisterUser("nil", "api", apikey, map[string]bool{"apikey": true})
 		fmt.Printf("Please clear this output and start the server again. You can access your dashboard at https://gate.%s/dashboard\n", s.Config.Domain)
 		os.Exit(0)
 	}
+	// Databases from before applications existed get one, which adopts every user.
+	if apps, err := s.users.ListApplications(); err == nil && len(apps) == 0 {
+		if err := s.users.CreateApplication(s.Config.Application.name(), s.Config.Application.Audience, credentials.ApplicationSettings{}); err != nil {
+			Log("Couldn't create application: %v", err)
+			fmt.Printf("Couldn't create application: %v\n", err)
+			os.Exit(1)
+		}
+		Log("Created application %s for existing users", s.Config.Application.name())
+	}
+	// The API key of a database from before applications existed is refused until it's adopted as an ordinary key.
+	if legacy, err := s.users.HasLegacyAPIKey(); err == nil && legacy {
+		cfg := s.Config.Application.LegacyKey
+		if cfg.key == "" {
+			Log("The API key from before applications existed is refused until it's adopted; see Application.LegacyKey in config.yml")
+		} else if key, err := s.users.AdoptLegacyAPIKey(cfg.key, cfg.Application, credentials.APIKeyOptions{Scopes: cfg.Scopes}); err != nil {
+			Log("Couldn't adopt the legacy API key: %v", err)
+			fmt.Printf("Couldn't adopt the legacy API key: %v\n", err)
+			os.Exit(1)
+		} else {
+			Log("Adopted the legacy API key into %s as %s", key.Application, key.Prefix)
+		}
+	}
 	// Add handlers
 	http.HandleFunc(fmt.Sprintf("gate.%s/register", s.Config.Domain), s.handleCredRegiRequest)
 	http.HandleFunc(fmt.Sprintf("gate.%s/login", s.Config.Domain), s.handleCredAuthRequest)
 	http.HandleFunc(fmt.Sprintf("gate.%s/resetPassword", s.Config.Domain), s.handlePwdChangeRequest)
+	http.HandleFunc(fmt.Sprintf("gate.%s/forgotPassword", s.Config.Domain), s.handleForgotPasswordRequest)
+	http.HandleFunc(fmt.Sprintf("gate.%s/confirmPasswordReset", s.Config.Domain), s.handleConfirmPasswordResetRequest)
+	http.HandleFunc(fmt.Sprintf("gate.%s/changeEmail", s.Config.Domain), s.handleChangeEmailRequest)
+	http.HandleFunc(fmt.Sprintf("gate.%s/confirmEmailChange", s.Config.Domain), s.handleConfirmEmailChangeRequest)
+	http.HandleFunc(fmt.Sprintf("gate.%s/revertEmail", s.Config.Domain), s.handleRevertEmailRequest)
 	http.HandleFunc(fmt.Sprintf("gate.%s/mail", s.Config.Domain), s.HandleEmailAuthRequest)
 	http.HandleFunc(fmt.Sprintf("gate.%s/code", s.Config.Domain), s.HandleCodeAuthRequest)
 	http.HandleFunc(fmt.Sprintf("gate.%s/key", s.Config.Domain), s.HandleKeyAuthRequest)
+	http.HandleFunc(fmt.Sprintf("gate.%s/verifyEmail", s.Config.Domain), s.handleVerifyEmailRequest)
+	http.HandleFunc(fmt.Sprintf("gate.%s/resendVerification", s.Config.Domain), s.handleResendVerificationRequest)
+	http.HandleFunc(fmt.Sprintf("gate.%s/profile", s.Config.Domain), s.handleProfileRequest)
+	http.HandleFunc(fmt.Sprintf("gate.%s/updateProfile", s.Config.Domain), s.handleUpdateProfileRequest)
 	// Create dashboard from this AuthServer, and add its endpoint
 	createDashboard(s).addEndpoints()
 	// Generate address
@@ -380,12 +999,12 @@ func (s *AuthServer) Start() {
 		Handler: nil,
 	}
 	s.wg = sync.WaitGroup{}
-	err := Log("Starting auth server at https://%s.%s", "gate", fulladdr)
+	err = Log("Starting auth server at https://%s.%s", "gate", fulladdr)
 	if err != nil {
 		fmt.Println(err)
 	}
+	s.wg.Add(1)
 	go func() {
-		s.wg.Add(1)
 		err := s.srv.ListenAndServeTLS(crt, key)
 		switch err {
 		case http.ErrServerClosed: